@@ -4,9 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/karelbilek/amqp-test-server/server"
+	"github.com/karelbilek/amqp-test-server/stats"
 	"github.com/rcrowley/go-metrics"
 	"net/http"
 	"os"
+	"regexp"
+	"sort"
 )
 
 func homeJSON(w http.ResponseWriter, r *http.Request, server *server.Server) {
@@ -26,6 +29,118 @@ func statsJSON(w http.ResponseWriter, r *http.Request, server *server.Server) {
 	w.Write(b)
 }
 
+// Drop the samples of the histogram named by ?name=, or of every histogram,
+// then report the stats
+func resetStats(w http.ResponseWriter, r *http.Request, server *server.Server) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Use POST to reset the stats", http.StatusMethodNotAllowed)
+		return
+	}
+	if name := r.URL.Query().Get("name"); len(name) != 0 {
+		stats.Reset(name)
+	} else {
+		stats.ResetAll()
+	}
+	statsJSON(w, r, server)
+}
+
+// List bindings, optionally only those from ?exchange= or to ?queue=
+func bindingsJSON(w http.ResponseWriter, r *http.Request, server *server.Server) {
+	var bindings = server.Bindings()
+	if name := r.URL.Query().Get("exchange"); len(name) != 0 {
+		var found bool
+		bindings, found = server.BindingsForExchange(name)
+		if !found {
+			http.Error(w, "Exchange not found", http.StatusNotFound)
+			return
+		}
+	} else if name := r.URL.Query().Get("queue"); len(name) != 0 {
+		bindings = server.BindingsForQueue(name)
+	}
+	var b, err = json.MarshalIndent(bindings, "", "    ")
+	if err != nil {
+		w.Write([]byte(err.Error()))
+	}
+	w.Write(b)
+}
+
+// List the exchanges of the default virtual host ordered by name
+func exchangesJSON(w http.ResponseWriter, r *http.Request, server *server.Server) {
+	var exchanges = make([]map[string]interface{}, 0)
+	for _, ex := range server.Exchanges() {
+		exchanges = append(exchanges, map[string]interface{}{
+			"name":       ex.Name,
+			"type":       ex.TypeName(),
+			"durable":    ex.Durable,
+			"autoDelete": ex.AutoDelete,
+			"internal":   ex.Internal,
+			"system":     ex.System,
+		})
+	}
+	var b, err = json.MarshalIndent(exchanges, "", "    ")
+	if err != nil {
+		w.Write([]byte(err.Error()))
+	}
+	w.Write(b)
+}
+
+func storeJSON(w http.ResponseWriter, r *http.Request, server *server.Server) {
+	var b, err = json.MarshalIndent(server.StoreStats(), "", "    ")
+	if err != nil {
+		w.Write([]byte(err.Error()))
+	}
+	w.Write(b)
+}
+
+// Reclaim dead message store entries, then report what the stores hold
+func compactStore(w http.ResponseWriter, r *http.Request, server *server.Server) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Use POST to compact the message stores", http.StatusMethodNotAllowed)
+		return
+	}
+	server.CompactStores()
+	storeJSON(w, r, server)
+}
+
+var prometheusInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+func prometheusName(name string) string {
+	return "dispatchd_" + prometheusInvalidChars.ReplaceAllString(name, "_")
+}
+
+// Write the metrics registry in the Prometheus text exposition format
+func prometheusText(w http.ResponseWriter, r *http.Request) {
+	var lines = make([]string, 0)
+	metrics.DefaultRegistry.Each(func(name string, i interface{}) {
+		var n = prometheusName(name)
+		switch m := i.(type) {
+		case metrics.Gauge:
+			lines = append(lines, fmt.Sprintf("%s %d", n, m.Value()))
+		case metrics.Meter:
+			var snap = m.Snapshot()
+			lines = append(lines,
+				fmt.Sprintf("%s_total %d", n, snap.Count()),
+				fmt.Sprintf("%s_rate1 %f", n, snap.Rate1()),
+				fmt.Sprintf("%s_rate %f", n, stats.WindowRate(m)),
+			)
+		case metrics.Histogram:
+			var snap = m.Snapshot()
+			lines = append(lines,
+				fmt.Sprintf("%s_count %d", n, snap.Count()),
+				fmt.Sprintf("%s_mean %f", n, snap.Mean()),
+				fmt.Sprintf("%s_max %d", n, snap.Max()),
+			)
+		}
+	})
+	sort.Strings(lines)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
+
 func StartAdminServer(server *server.Server, port int) {
 	// Static files
 	var path = os.Getenv("STATIC_PATH")
@@ -47,10 +162,40 @@ func StartAdminServer(server *server.Server, port int) {
 		homeJSON(w, r, server)
 	})
 
+	http.HandleFunc("/api/bindings", func(w http.ResponseWriter, r *http.Request) {
+		bindingsJSON(w, r, server)
+	})
+
+	http.HandleFunc("/api/exchanges", func(w http.ResponseWriter, r *http.Request) {
+		exchangesJSON(w, r, server)
+	})
+
 	http.HandleFunc("/api/stats", func(w http.ResponseWriter, r *http.Request) {
 		statsJSON(w, r, server)
 	})
 
+	http.HandleFunc("/api/stats/reset", func(w http.ResponseWriter, r *http.Request) {
+		resetStats(w, r, server)
+	})
+
+	http.HandleFunc("/api/store", func(w http.ResponseWriter, r *http.Request) {
+		storeJSON(w, r, server)
+	})
+
+	http.HandleFunc("/api/store/compact", func(w http.ResponseWriter, r *http.Request) {
+		compactStore(w, r, server)
+	})
+
+	http.Handle("/api/connections/", server.ConnectionHandler())
+
+	http.Handle("/api/queues/", server.QueueHandler())
+
+	http.Handle("/api/events", server.EventsHandler())
+
+	http.HandleFunc("/metrics", prometheusText)
+
+	http.Handle("/healthz", server.HealthHandler())
+
 	// Boot admin server
 	fmt.Printf("Admin server on port %d, static files from: %s\n", port, path)
 	http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
@@ -0,0 +1,179 @@
+package amqp
+
+import (
+	"errors"
+	"io"
+)
+
+// The access class was removed in 0-9-1, so it isn't part of the generated
+// protocol. Older clients still send access.request before using a channel,
+// so the two methods they rely on are implemented by hand here.
+
+var ClassIdAccess uint16 = 30
+
+// ************************
+// AccessRequest
+// ************************
+var MethodIdAccessRequest uint16 = 10
+
+type AccessRequest struct {
+	Realm     string
+	Exclusive bool
+	Passive   bool
+	Active    bool
+	// Named so they don't clash with the MethodFrame Read/Write methods
+	WriteAccess bool
+	ReadAccess  bool
+}
+
+func (f *AccessRequest) MethodIdentifier() (uint16, uint16) {
+	return 30, 10
+}
+
+func (f *AccessRequest) MethodName() string {
+	return "AccessRequest"
+}
+
+func (f *AccessRequest) FrameType() byte {
+	return 1
+}
+
+// Reader
+func (f *AccessRequest) Read(reader io.Reader, strictMode bool) (err error) {
+
+	f.Realm, err = ReadShortstr(reader)
+	if err != nil {
+		return errors.New("Error reading field Realm: " + err.Error())
+	}
+
+	bits, err := ReadOctet(reader)
+	if err != nil {
+		return errors.New("Error reading bit fields" + err.Error())
+	}
+
+	f.Exclusive = (bits&(1<<0) > 0)
+	f.Passive = (bits&(1<<1) > 0)
+	f.Active = (bits&(1<<2) > 0)
+	f.WriteAccess = (bits&(1<<3) > 0)
+	f.ReadAccess = (bits&(1<<4) > 0)
+
+	return
+}
+
+// Writer
+func (f *AccessRequest) Write(writer io.Writer) (err error) {
+	if err = WriteShort(writer, 30); err != nil {
+		return err
+	}
+	if err = WriteShort(writer, 10); err != nil {
+		return err
+	}
+
+	err = WriteShortstr(writer, f.Realm)
+	if err != nil {
+		return errors.New("Error writing field Realm")
+	}
+
+	var bits byte
+
+	if f.Exclusive {
+		bits |= 1 << 0
+	}
+	if f.Passive {
+		bits |= 1 << 1
+	}
+	if f.Active {
+		bits |= 1 << 2
+	}
+	if f.WriteAccess {
+		bits |= 1 << 3
+	}
+	if f.ReadAccess {
+		bits |= 1 << 4
+	}
+
+	err = WriteOctet(writer, bits)
+	if err != nil {
+		return errors.New("Error writing bit fields")
+	}
+
+	return
+}
+
+// ************************
+// AccessRequestOk
+// ************************
+var MethodIdAccessRequestOk uint16 = 11
+
+type AccessRequestOk struct {
+	Ticket uint16
+}
+
+func (f *AccessRequestOk) MethodIdentifier() (uint16, uint16) {
+	return 30, 11
+}
+
+func (f *AccessRequestOk) MethodName() string {
+	return "AccessRequestOk"
+}
+
+func (f *AccessRequestOk) FrameType() byte {
+	return 1
+}
+
+// Reader
+func (f *AccessRequestOk) Read(reader io.Reader, strictMode bool) (err error) {
+
+	f.Ticket, err = ReadShort(reader)
+	if err != nil {
+		return errors.New("Error reading field Ticket: " + err.Error())
+	}
+
+	return
+}
+
+// Writer
+func (f *AccessRequestOk) Write(writer io.Writer) (err error) {
+	if err = WriteShort(writer, 30); err != nil {
+		return err
+	}
+	if err = WriteShort(writer, 11); err != nil {
+		return err
+	}
+
+	err = WriteShort(writer, f.Ticket)
+	if err != nil {
+		return errors.New("Error writing field Ticket")
+	}
+
+	return
+}
+
+// ReadAccessMethod reads an access class method, including its class and
+// method ids. It is the counterpart of ReadMethod for class 30.
+func ReadAccessMethod(reader io.Reader, strictMode bool) (MethodFrame, error) {
+	classIndex, err := ReadShort(reader)
+	if err != nil {
+		return nil, err
+	}
+	methodIndex, err := ReadShort(reader)
+	if err != nil {
+		return nil, err
+	}
+	if classIndex != ClassIdAccess {
+		return nil, &UnknownMethodError{ClassId: classIndex, MethodId: methodIndex}
+	}
+	var method MethodFrame
+	switch methodIndex {
+	case MethodIdAccessRequest:
+		method = &AccessRequest{}
+	case MethodIdAccessRequestOk:
+		method = &AccessRequestOk{}
+	default:
+		return nil, &UnknownMethodError{ClassId: classIndex, MethodId: methodIndex}
+	}
+	if err = method.Read(reader, strictMode); err != nil {
+		return nil, err
+	}
+	return method, nil
+}
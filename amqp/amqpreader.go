@@ -165,7 +165,7 @@ func readValue(reader io.Reader, strictMode bool) (*FieldValue, error) {
 			return nil, err
 		}
 		return &FieldValue{Value: &FieldValue_VInt8{VInt8: v}}, nil
-	case t == 'B' && strictMode:
+	case t == 'B':
 		var v uint8
 		if err = binary.Read(reader, binary.BigEndian, &v); err != nil {
 			return nil, err
@@ -177,7 +177,7 @@ func readValue(reader io.Reader, strictMode bool) (*FieldValue, error) {
 			return nil, err
 		}
 		return &FieldValue{Value: &FieldValue_VInt16{VInt16: v}}, nil
-	case t == 'u' && strictMode:
+	case t == 'u':
 		var v uint16
 		if err = binary.Read(reader, binary.BigEndian, &v); err != nil {
 			return nil, err
@@ -189,7 +189,7 @@ func readValue(reader io.Reader, strictMode bool) (*FieldValue, error) {
 			return nil, err
 		}
 		return &FieldValue{Value: &FieldValue_VInt32{VInt32: v}}, nil
-	case t == 'i' && strictMode:
+	case t == 'i':
 		var v uint32
 		if err = binary.Read(reader, binary.BigEndian, &v); err != nil {
 			return nil, err
@@ -8,6 +8,14 @@ import (
 )
 
 func WriteFrame(buf io.Writer, frame *WireFrame) {
+	// binary.LittleEndian since we want to stick to the system
+	// byte order and the other write functions are writing BigEndian
+	// TODO: error checking
+	binary.Write(buf, binary.LittleEndian, EncodeFrame(frame))
+}
+
+// The bytes of a frame as it goes on the wire
+func EncodeFrame(frame *WireFrame) []byte {
 	bb := make([]byte, 0, 1+2+4+len(frame.Payload)+2)
 	buf2 := bytes.NewBuffer(bb)
 	WriteOctet(buf2, frame.FrameType)
@@ -15,11 +23,7 @@ func WriteFrame(buf io.Writer, frame *WireFrame) {
 	WriteLongstr(buf2, frame.Payload)
 	// buf.Write(frame.Payload.Bytes())
 	WriteFrameEnd(buf2)
-
-	// binary.LittleEndian since we want to stick to the system
-	// byte order and the other write functions are writing BigEndian
-	// TODO: error checking
-	binary.Write(buf, binary.LittleEndian, buf2.Bytes())
+	return buf2.Bytes()
 }
 
 // Constants
@@ -83,30 +87,42 @@ func WriteTimestamp(buf io.Writer, timestamp uint64) error {
 	return binary.Write(buf, binary.BigEndian, timestamp)
 }
 
+// Write a table using the field types from the spec
 func WriteTable(writer io.Writer, table *Table) error {
+	return writeTable(writer, table, true)
+}
+
+// Outside of strict mode tables are written with the field types RabbitMQ
+// and most clients use, which is what ReadTable accepts outside of strict
+// mode. Those have no short strings and use 's' and 'l' for int16 and int64.
+func writeTable(writer io.Writer, table *Table, strictMode bool) error {
 	var buf = bytes.NewBuffer(make([]byte, 0))
 	for _, kv := range table.Table {
 		if err := WriteShortstr(buf, *kv.Key); err != nil {
 			return err
 		}
-		if err := writeValue(buf, kv.Value); err != nil {
+		if err := writeValue(buf, kv.Value, strictMode); err != nil {
 			return err
 		}
 	}
 	return WriteLongstr(writer, buf.Bytes())
 }
 
-func writeArray(writer io.Writer, array []*FieldValue) error {
+func writeArray(writer io.Writer, array []*FieldValue, strictMode bool) error {
 	var buf = bytes.NewBuffer([]byte{})
 	for _, v := range array {
-		if err := writeValue(buf, v); err != nil {
+		if err := writeValue(buf, v, strictMode); err != nil {
 			return err
 		}
 	}
 	return WriteLongstr(writer, buf.Bytes())
 }
 
-func writeValue(writer io.Writer, value *FieldValue) (err error) {
+func writeValue(writer io.Writer, value *FieldValue, strictMode bool) (err error) {
+	if value == nil {
+		// Void values read from the wire
+		return binary.Write(writer, binary.BigEndian, byte('V'))
+	}
 	switch v := value.Value.(type) {
 	case *FieldValue_VBoolean:
 		if err = binary.Write(writer, binary.BigEndian, byte('t')); err == nil {
@@ -125,7 +141,11 @@ func writeValue(writer io.Writer, value *FieldValue) (err error) {
 			err = binary.Write(writer, binary.BigEndian, uint8(v.VUint8))
 		}
 	case *FieldValue_VInt16:
-		if err = binary.Write(writer, binary.BigEndian, byte('U')); err == nil {
+		var tag = byte('s')
+		if strictMode {
+			tag = 'U'
+		}
+		if err = binary.Write(writer, binary.BigEndian, tag); err == nil {
 			err = binary.Write(writer, binary.BigEndian, int16(v.VInt16))
 		}
 	case *FieldValue_VUint16:
@@ -141,10 +161,15 @@ func writeValue(writer io.Writer, value *FieldValue) (err error) {
 			err = binary.Write(writer, binary.BigEndian, uint32(v.VUint32))
 		}
 	case *FieldValue_VInt64:
-		if err = binary.Write(writer, binary.BigEndian, byte('L')); err == nil {
+		var tag = byte('l')
+		if strictMode {
+			tag = 'L'
+		}
+		if err = binary.Write(writer, binary.BigEndian, tag); err == nil {
 			err = binary.Write(writer, binary.BigEndian, int64(v.VInt64))
 		}
 	case *FieldValue_VUint64:
+		// There is no unsigned 64 bit type outside of the spec
 		if err = binary.Write(writer, binary.BigEndian, byte('l')); err == nil {
 			err = binary.Write(writer, binary.BigEndian, uint64(v.VUint64))
 		}
@@ -163,7 +188,11 @@ func writeValue(writer io.Writer, value *FieldValue) (err error) {
 			}
 		}
 	case *FieldValue_VShortstr:
-		if err = WriteOctet(writer, byte('s')); err == nil {
+		if !strictMode {
+			if err = WriteOctet(writer, byte('S')); err == nil {
+				err = WriteLongstr(writer, []byte(v.VShortstr))
+			}
+		} else if err = WriteOctet(writer, byte('s')); err == nil {
 			err = WriteShortstr(writer, v.VShortstr)
 		}
 	case *FieldValue_VLongstr:
@@ -172,7 +201,7 @@ func writeValue(writer io.Writer, value *FieldValue) (err error) {
 		}
 	case *FieldValue_VArray:
 		if err = WriteOctet(writer, byte('A')); err == nil {
-			err = writeArray(writer, v.VArray.Value)
+			err = writeArray(writer, v.VArray.Value, strictMode)
 		}
 	case *FieldValue_VTimestamp:
 		if err = WriteOctet(writer, byte('T')); err == nil {
@@ -180,7 +209,11 @@ func writeValue(writer io.Writer, value *FieldValue) (err error) {
 		}
 	case *FieldValue_VTable:
 		if err = WriteOctet(writer, byte('F')); err == nil {
-			err = WriteTable(writer, v.VTable)
+			err = writeTable(writer, v.VTable, strictMode)
+		}
+	case *FieldValue_VBytes:
+		if err = WriteOctet(writer, byte('x')); err == nil {
+			err = WriteLongstr(writer, v.VBytes)
 		}
 	case nil:
 		err = binary.Write(writer, binary.BigEndian, byte('V'))
@@ -190,7 +223,9 @@ func writeValue(writer io.Writer, value *FieldValue) (err error) {
 	return
 }
 
-func (props *BasicContentHeaderProperties) WriteProps(writer io.Writer) (flags uint16, err error) {
+// Write the properties present along with the property flags they make up.
+// strictMode picks the field types used in the headers table, see writeTable.
+func (props *BasicContentHeaderProperties) WriteProps(writer io.Writer, strictMode bool) (flags uint16, err error) {
 	if props.ContentType != nil {
 		flags = flags | MaskContentType
 		err = WriteShortstr(writer, *props.ContentType)
@@ -207,7 +242,7 @@ func (props *BasicContentHeaderProperties) WriteProps(writer io.Writer) (flags u
 	}
 	if props.Headers != nil {
 		flags = flags | MaskHeaders
-		err = WriteTable(writer, props.Headers)
+		err = writeTable(writer, props.Headers, strictMode)
 		if err != nil {
 			return
 		}
@@ -1,5 +1,9 @@
 package amqp
 
+import (
+	"fmt"
+)
+
 // Soft error (close channel)
 
 type AMQPError struct {
@@ -31,3 +35,31 @@ func NewHardError(code uint16, msg string, class uint16, method uint16) *AMQPErr
 		Soft:   false,
 	}
 }
+
+// Pick soft or hard from the reply code. The spec makes 311, 312, 313, 403,
+// 404, 405 and 406 channel exceptions, and every other error code a
+// connection exception. Use this where the code comes from elsewhere.
+func NewError(code uint16, msg string, class uint16, method uint16) *AMQPError {
+	if IsChannelErrorCode(code) {
+		return NewSoftError(code, msg, class, method)
+	}
+	return NewHardError(code, msg, class, method)
+}
+
+func IsChannelErrorCode(code uint16) bool {
+	switch code {
+	case 311, 312, 313, 403, 404, 405, 406:
+		return true
+	}
+	return false
+}
+
+// A method frame with a class and method id pair the protocol doesn't have
+type UnknownMethodError struct {
+	ClassId  uint16
+	MethodId uint16
+}
+
+func (err *UnknownMethodError) Error() string {
+	return fmt.Sprintf("Bad method or class Id! classId: %d, methodIndex: %d", err.ClassId, err.MethodId)
+}
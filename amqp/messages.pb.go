@@ -253,6 +253,7 @@ type QueueMessage struct {
 	Durable              bool     `protobuf:"varint,3,opt,name=durable" json:"durable"`
 	MsgSize              uint32   `protobuf:"varint,4,opt,name=msgSize" json:"msgSize"`
 	LocalId              int64    `protobuf:"varint,5,opt,name=localId" json:"localId"`
+	Sequence             int64    `protobuf:"varint,6,opt,name=sequence" json:"sequence"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -326,6 +327,13 @@ func (m *QueueMessage) GetLocalId() int64 {
 	return 0
 }
 
+func (m *QueueMessage) GetSequence() int64 {
+	if m != nil {
+		return m.Sequence
+	}
+	return 0
+}
+
 type ContentHeaderFrame struct {
 	ContentClass         uint16                        `protobuf:"varint,1,opt,name=content_class,json=contentClass,casttype=uint16" json:"content_class"`
 	ContentWeight        uint16                        `protobuf:"varint,2,opt,name=content_weight,json=contentWeight,casttype=uint16" json:"content_weight"`
@@ -610,56 +618,56 @@ func init() {
 }
 
 var fileDescriptor_92dba33e41672625 = []byte{
-	// 771 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x54, 0xcb, 0x6e, 0x23, 0x45,
-	0x14, 0x4d, 0xfb, 0xed, 0xeb, 0xc7, 0x88, 0x12, 0x42, 0xad, 0x59, 0xd8, 0x51, 0x83, 0x18, 0x33,
-	0x08, 0x7b, 0xc6, 0x68, 0x10, 0x82, 0x15, 0x8e, 0x14, 0x91, 0x05, 0x28, 0x69, 0x8c, 0xb2, 0xb4,
-	0xca, 0x5d, 0xd7, 0xed, 0x96, 0xfb, 0x95, 0xaa, 0x6e, 0x88, 0x59, 0x23, 0xc4, 0x67, 0xc0, 0x1a,
-	0x81, 0xf8, 0x8c, 0x2c, 0xf3, 0x05, 0x11, 0xca, 0x67, 0xb0, 0x42, 0x55, 0x5d, 0xe5, 0x74, 0x70,
-	0x12, 0xd8, 0xb9, 0xcf, 0x39, 0x75, 0xeb, 0xdc, 0x73, 0x6f, 0x19, 0x5e, 0xfb, 0x41, 0xb6, 0xce,
-	0x97, 0x63, 0x2f, 0x89, 0x26, 0xc8, 0x63, 0x14, 0x19, 0xf7, 0x26, 0x2c, 0x10, 0x29, 0xcd, 0xbc,
-	0x35, 0x9b, 0xd0, 0xe8, 0x22, 0x9d, 0x44, 0x28, 0x04, 0xf5, 0x51, 0x8c, 0x53, 0x9e, 0x64, 0x09,
-	0xa9, 0x49, 0xf0, 0xf9, 0x47, 0xa5, 0x83, 0x7e, 0xe2, 0x27, 0x13, 0x45, 0x2e, 0xf3, 0x95, 0xfa,
-	0x52, 0x1f, 0xea, 0x57, 0x71, 0xe8, 0xf9, 0xe7, 0xff, 0xe3, 0x1e, 0xa5, 0xf4, 0x92, 0x70, 0xe1,
-	0x63, 0x8c, 0x9c, 0x66, 0xc8, 0x8a, 0xc3, 0xce, 0x4f, 0x16, 0xb4, 0xcf, 0x03, 0x8e, 0xc7, 0x9c,
-	0x46, 0x48, 0x3e, 0x84, 0xf6, 0x4a, 0xfe, 0x98, 0x6f, 0x53, 0xb4, 0xad, 0x43, 0x6b, 0xd4, 0x9b,
-	0xf5, 0xae, 0x6e, 0x86, 0x07, 0x7f, 0xdf, 0x0c, 0xeb, 0x79, 0x10, 0x67, 0x9f, 0xba, 0x77, 0x3c,
-	0x19, 0x41, 0xd3, 0x5b, 0xd3, 0x38, 0xc6, 0xd0, 0xae, 0x28, 0x69, 0x5f, 0x4b, 0x1b, 0x52, 0xfa,
-	0xfa, 0x13, 0xd7, 0xd0, 0xc4, 0x86, 0x66, 0x4a, 0xb7, 0x61, 0x42, 0x99, 0x5d, 0x3d, 0xb4, 0x46,
-	0x5d, 0xd7, 0x7c, 0x7e, 0xd6, 0xfa, 0xf9, 0x97, 0xe1, 0xc1, 0xf5, 0xaf, 0xc3, 0x03, 0xe7, 0x0f,
-	0x0b, 0xba, 0x27, 0x31, 0xc3, 0xcb, 0xaf, 0x8a, 0x48, 0xc8, 0xdb, 0x50, 0x09, 0x98, 0x32, 0x51,
-	0x9d, 0xd5, 0x64, 0x65, 0xb7, 0x12, 0x30, 0x62, 0x43, 0x8d, 0xe3, 0x4a, 0xa8, 0x1b, 0xeb, 0x1a,
-	0x57, 0x08, 0x19, 0x40, 0x93, 0xe5, 0x9c, 0x2e, 0x43, 0x54, 0x97, 0xb4, 0x34, 0x69, 0x40, 0xf2,
-	0x12, 0x7a, 0x0c, 0xc3, 0xe0, 0x3b, 0xe4, 0xdb, 0xa3, 0x24, 0x8f, 0x33, 0xbb, 0x56, 0x2a, 0x71,
-	0x9f, 0x22, 0x0e, 0xb4, 0x53, 0xe4, 0x22, 0x10, 0x19, 0x32, 0xbb, 0x5e, 0xaa, 0x76, 0x07, 0x3b,
-	0xbf, 0x55, 0xa0, 0xf9, 0xb4, 0xd7, 0x57, 0xd0, 0x58, 0x23, 0x65, 0xc8, 0x95, 0xdb, 0xce, 0xd4,
-	0x1e, 0xcb, 0x59, 0x8c, 0x8f, 0x92, 0x38, 0xc3, 0x38, 0xfb, 0x52, 0x51, 0x2a, 0x77, 0x57, 0xeb,
-	0xc8, 0x07, 0xe5, 0xa0, 0xaa, 0xa3, 0xce, 0xf4, 0x59, 0x71, 0x64, 0x37, 0xa1, 0x5d, 0x72, 0xe4,
-	0x10, 0x5a, 0x78, 0x29, 0x03, 0xf6, 0x51, 0x75, 0xd2, 0xd6, 0x17, 0xef, 0x50, 0xf2, 0x0e, 0x54,
-	0x37, 0xb8, 0x55, 0xf6, 0x0d, 0x29, 0x01, 0xf2, 0x12, 0x1a, 0x11, 0x66, 0xeb, 0x84, 0xd9, 0x0d,
-	0x65, 0x8b, 0x14, 0x77, 0xcc, 0xa8, 0x08, 0xbc, 0xd3, 0x7c, 0x19, 0x06, 0x62, 0xed, 0x6a, 0x05,
-	0x79, 0x1f, 0x3a, 0x1c, 0x75, 0x36, 0xc8, 0xec, 0xa6, 0x9a, 0x73, 0x51, 0xab, 0x4c, 0x90, 0x21,
-	0xb4, 0xc2, 0xc4, 0xa3, 0xe1, 0x22, 0x60, 0x76, 0xab, 0x14, 0x43, 0x53, 0xa1, 0x27, 0xcc, 0xf9,
-	0xd3, 0x82, 0xee, 0x59, 0x8e, 0x39, 0x3e, 0x1d, 0xd9, 0xde, 0x90, 0x2a, 0x8f, 0x0f, 0xe9, 0xbf,
-	0x06, 0x3e, 0x80, 0x66, 0x24, 0xfc, 0x6f, 0x82, 0x1f, 0x8a, 0x80, 0x8c, 0x6f, 0x03, 0x4a, 0x5e,
-	0xbb, 0x53, 0x19, 0xed, 0x59, 0xfe, 0xbd, 0x02, 0x64, 0x7f, 0x56, 0xe4, 0x63, 0xe8, 0x79, 0x05,
-	0xba, 0xf0, 0x42, 0x2a, 0x84, 0x7e, 0x27, 0xff, 0x5e, 0xfe, 0xae, 0x16, 0x1d, 0x49, 0x0d, 0x79,
-	0x03, 0x7d, 0x73, 0xe8, 0x7b, 0x0c, 0xfc, 0x75, 0xf6, 0xc8, 0x93, 0x31, 0xa5, 0xcf, 0x95, 0x88,
-	0xbc, 0x82, 0xb7, 0xcc, 0xb1, 0x65, 0xc2, 0xb6, 0x0b, 0x21, 0x9b, 0x91, 0xcd, 0xd6, 0xb4, 0xd9,
-	0x67, 0x9a, 0x9e, 0x25, 0x6c, 0xab, 0x9a, 0x7a, 0x03, 0xfd, 0x94, 0x27, 0x29, 0xf2, 0x6c, 0xbb,
-	0x58, 0x85, 0xd4, 0x17, 0xba, 0xf7, 0xbd, 0x8b, 0x8c, 0xea, 0x58, 0x8a, 0xc8, 0x0c, 0x40, 0x03,
-	0x01, 0x0a, 0x15, 0x47, 0x67, 0xea, 0x94, 0xf6, 0xe2, 0x5e, 0x0e, 0xa7, 0x3b, 0xa5, 0x5b, 0x3a,
-	0xe5, 0x9c, 0x41, 0x7b, 0xbe, 0x7b, 0xbd, 0x43, 0xa8, 0x46, 0xc2, 0x57, 0xd9, 0x74, 0xa6, 0xbd,
-	0xa2, 0x92, 0xe6, 0x5c, 0xc9, 0x90, 0x77, 0x01, 0x2e, 0xe4, 0x3e, 0x2c, 0x62, 0x1a, 0xa1, 0x4a,
-	0xc3, 0x2c, 0x69, 0x5b, 0xe1, 0x5f, 0xd3, 0x08, 0x9d, 0x1f, 0x2d, 0xa8, 0xcf, 0x2f, 0xbf, 0xf0,
-	0x36, 0x72, 0x99, 0x33, 0x5a, 0xd4, 0x33, 0xbd, 0x4b, 0x40, 0x3e, 0x83, 0x28, 0x0f, 0xb3, 0x20,
-	0x0d, 0x8b, 0x22, 0x66, 0x0b, 0x76, 0xa8, 0xfc, 0xc7, 0x88, 0xa9, 0xb7, 0xb9, 0xb7, 0x23, 0x0a,
-	0x21, 0x2f, 0xa0, 0xcb, 0xd1, 0x98, 0xf0, 0x36, 0x2a, 0xa9, 0xd6, 0xdd, 0x76, 0x6b, 0x1b, 0xde,
-	0x46, 0xda, 0xe8, 0x7f, 0x2b, 0x25, 0xc8, 0x4c, 0x7f, 0x2f, 0x40, 0x0e, 0x58, 0xe4, 0x11, 0xf2,
-	0x85, 0x31, 0x66, 0x1a, 0xe8, 0x18, 0x66, 0x4e, 0x7d, 0xf2, 0x5e, 0x11, 0x44, 0xa5, 0xfc, 0xd4,
-	0xca, 0x0f, 0xe1, 0xa1, 0x34, 0xaa, 0x0f, 0xa6, 0x31, 0xeb, 0x5e, 0xdd, 0x0e, 0xac, 0xeb, 0xdb,
-	0x81, 0xf5, 0xd7, 0xed, 0xc0, 0xfa, 0x27, 0x00, 0x00, 0xff, 0xff, 0xc6, 0x7d, 0xfc, 0x3f, 0x5f,
-	0x06, 0x00, 0x00,
+	// 781 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x54, 0xcb, 0x8e, 0x1b, 0x45,
+	0x14, 0x9d, 0x6e, 0xbf, 0xaf, 0xed, 0x89, 0x28, 0x21, 0x54, 0xca, 0xc2, 0x1e, 0x35, 0x88, 0x98,
+	0x20, 0xec, 0xc4, 0x28, 0x08, 0xc1, 0x0a, 0x8f, 0x14, 0x91, 0x05, 0x51, 0xd2, 0x18, 0x65, 0x69,
+	0x95, 0xbb, 0xae, 0xdb, 0x25, 0xf7, 0x6b, 0xaa, 0xba, 0x61, 0x9c, 0x35, 0x42, 0x7c, 0x06, 0xac,
+	0x11, 0x7c, 0x47, 0x96, 0x11, 0x1f, 0x10, 0xa1, 0xf9, 0x0c, 0x56, 0xa8, 0xaa, 0xbb, 0x9c, 0x1e,
+	0xc5, 0x19, 0xb2, 0xeb, 0x3a, 0xe7, 0xdc, 0x47, 0x9d, 0x7b, 0xab, 0xe1, 0x7e, 0x28, 0xf2, 0x6d,
+	0xb1, 0x9e, 0x06, 0x69, 0x3c, 0x43, 0x99, 0xa0, 0xca, 0x65, 0x30, 0xe3, 0x42, 0x65, 0x2c, 0x0f,
+	0xb6, 0x7c, 0xc6, 0xe2, 0x8b, 0x6c, 0x16, 0xa3, 0x52, 0x2c, 0x44, 0x35, 0xcd, 0x64, 0x9a, 0xa7,
+	0xa4, 0xa9, 0xc1, 0xdb, 0x9f, 0xd5, 0x02, 0xc3, 0x34, 0x4c, 0x67, 0x86, 0x5c, 0x17, 0x1b, 0x73,
+	0x32, 0x07, 0xf3, 0x55, 0x06, 0xdd, 0xfe, 0xfa, 0x1d, 0xea, 0x18, 0x65, 0x90, 0x46, 0xab, 0x10,
+	0x13, 0x94, 0x2c, 0x47, 0x5e, 0x06, 0x7b, 0xbf, 0x38, 0xd0, 0x7b, 0x26, 0x24, 0x3e, 0x94, 0x2c,
+	0x46, 0xf2, 0x29, 0xf4, 0x36, 0xfa, 0x63, 0xb9, 0xcf, 0x90, 0x3a, 0x67, 0xce, 0x64, 0xb8, 0x18,
+	0xbe, 0x78, 0x35, 0x3e, 0xf9, 0xf7, 0xd5, 0xb8, 0x55, 0x88, 0x24, 0xff, 0xd2, 0x7f, 0xcd, 0x93,
+	0x09, 0x74, 0x82, 0x2d, 0x4b, 0x12, 0x8c, 0xa8, 0x6b, 0xa4, 0xa7, 0x95, 0xb4, 0xad, 0xa5, 0xf7,
+	0xbf, 0xf0, 0x2d, 0x4d, 0x28, 0x74, 0x32, 0xb6, 0x8f, 0x52, 0xc6, 0x69, 0xe3, 0xcc, 0x99, 0x0c,
+	0x7c, 0x7b, 0xfc, 0xaa, 0xfb, 0xeb, 0x6f, 0xe3, 0x93, 0x97, 0xbf, 0x8f, 0x4f, 0xbc, 0xbf, 0x1c,
+	0x18, 0x3c, 0x4a, 0x38, 0x5e, 0x7e, 0x57, 0x5a, 0x42, 0xde, 0x07, 0x57, 0x70, 0xd3, 0x44, 0x63,
+	0xd1, 0xd4, 0x99, 0x7d, 0x57, 0x70, 0x42, 0xa1, 0x29, 0x71, 0xa3, 0x4c, 0xc5, 0x56, 0x85, 0x1b,
+	0x84, 0x8c, 0xa0, 0xc3, 0x0b, 0xc9, 0xd6, 0x11, 0x9a, 0x22, 0xdd, 0x8a, 0xb4, 0x20, 0xb9, 0x0b,
+	0x43, 0x8e, 0x91, 0xf8, 0x11, 0xe5, 0xfe, 0x3c, 0x2d, 0x92, 0x9c, 0x36, 0x6b, 0x29, 0xae, 0x53,
+	0xc4, 0x83, 0x5e, 0x86, 0x52, 0x09, 0x95, 0x23, 0xa7, 0xad, 0x5a, 0xb6, 0xd7, 0xb0, 0xf7, 0x87,
+	0x0b, 0x9d, 0x9b, 0x7b, 0xbd, 0x07, 0xed, 0x2d, 0x32, 0x8e, 0xd2, 0x74, 0xdb, 0x9f, 0xd3, 0xa9,
+	0x9e, 0xc5, 0xf4, 0x3c, 0x4d, 0x72, 0x4c, 0xf2, 0x6f, 0x0d, 0x65, 0x7c, 0xf7, 0x2b, 0x1d, 0xf9,
+	0xa4, 0x6e, 0x54, 0x63, 0xd2, 0x9f, 0xdf, 0x2a, 0x43, 0x0e, 0x13, 0x3a, 0x38, 0x47, 0xce, 0xa0,
+	0x8b, 0x97, 0xda, 0xe0, 0x10, 0xcd, 0x4d, 0x7a, 0x55, 0xe1, 0x03, 0x4a, 0x3e, 0x80, 0xc6, 0x0e,
+	0xf7, 0xb4, 0x55, 0x23, 0x35, 0x40, 0xee, 0x42, 0x3b, 0xc6, 0x7c, 0x9b, 0x72, 0xda, 0x36, 0x6d,
+	0x91, 0xb2, 0xc6, 0x82, 0x29, 0x11, 0x3c, 0x29, 0xd6, 0x91, 0x50, 0x5b, 0xbf, 0x52, 0x90, 0x8f,
+	0xa1, 0x2f, 0xb1, 0xf2, 0x06, 0x39, 0xed, 0x98, 0x39, 0x97, 0xb9, 0xea, 0x04, 0x19, 0x43, 0x37,
+	0x4a, 0x03, 0x16, 0xad, 0x04, 0xa7, 0xdd, 0x9a, 0x0d, 0x1d, 0x83, 0x3e, 0xe2, 0xde, 0xdf, 0x0e,
+	0x0c, 0x9e, 0x16, 0x58, 0xe0, 0xcd, 0x96, 0xbd, 0x31, 0x24, 0xf7, 0xed, 0x43, 0xfa, 0xbf, 0x81,
+	0x8f, 0xa0, 0x13, 0xab, 0xf0, 0x7b, 0xf1, 0xbc, 0x34, 0xc8, 0xf6, 0x6d, 0x41, 0xcd, 0x57, 0xdd,
+	0xd1, 0x56, 0xad, 0x0d, 0x0b, 0x6a, 0x87, 0x15, 0x5e, 0x14, 0x98, 0x04, 0x48, 0xdb, 0x35, 0xc1,
+	0x01, 0xf5, 0xfe, 0x74, 0x81, 0xbc, 0x39, 0x4d, 0xf2, 0x39, 0x0c, 0x83, 0x12, 0x5d, 0x05, 0x11,
+	0x53, 0x8a, 0x3a, 0x47, 0x9f, 0xc7, 0xa0, 0x12, 0x9d, 0x6b, 0x0d, 0x79, 0x00, 0xa7, 0x36, 0xe8,
+	0x27, 0x14, 0xe1, 0x36, 0x7f, 0xcb, 0xa3, 0xb2, 0xa9, 0x9f, 0x19, 0x11, 0xb9, 0x07, 0xef, 0xd9,
+	0xb0, 0x75, 0xca, 0xf7, 0x2b, 0x25, 0x9e, 0x97, 0x76, 0x34, 0xab, 0x6e, 0x6f, 0x55, 0xf4, 0x22,
+	0xe5, 0x7b, 0x73, 0xed, 0x07, 0x70, 0x9a, 0xc9, 0x34, 0x43, 0x99, 0xef, 0x57, 0x9b, 0x88, 0x85,
+	0x8a, 0x36, 0x8f, 0x17, 0xb2, 0xaa, 0x87, 0x5a, 0x44, 0x16, 0x00, 0x15, 0x20, 0x50, 0x19, 0xc3,
+	0xfa, 0x73, 0xaf, 0xb6, 0x39, 0xd7, 0x7c, 0x78, 0x72, 0x50, 0xfa, 0xb5, 0x28, 0xef, 0x29, 0xf4,
+	0x96, 0x87, 0xf7, 0x3d, 0x86, 0x46, 0xac, 0x42, 0xe3, 0x4d, 0x7f, 0x3e, 0x2c, 0x33, 0x55, 0x9c,
+	0xaf, 0x19, 0xf2, 0x21, 0xc0, 0x85, 0xde, 0x98, 0x55, 0xc2, 0x62, 0xa4, 0x6e, 0x6d, 0x8d, 0x7b,
+	0x06, 0x7f, 0xcc, 0x62, 0xf4, 0x7e, 0x76, 0xa0, 0xb5, 0xbc, 0xfc, 0x26, 0xd8, 0xe9, 0x75, 0xcf,
+	0x59, 0x99, 0xcf, 0xde, 0x5d, 0x03, 0x7a, 0x8c, 0x71, 0x11, 0xe5, 0x22, 0x8b, 0xca, 0x24, 0x76,
+	0x4f, 0x0e, 0xa8, 0xfe, 0xa7, 0x24, 0x2c, 0xd8, 0x5d, 0xdb, 0x22, 0x83, 0x90, 0x3b, 0x30, 0x90,
+	0x68, 0x9b, 0x08, 0x76, 0xb4, 0x59, 0x53, 0xf4, 0x2b, 0xe6, 0x31, 0x0b, 0x76, 0xba, 0x8d, 0xd3,
+	0x1f, 0xb4, 0x04, 0xb9, 0xbd, 0xdf, 0x1d, 0xd0, 0x03, 0x56, 0x45, 0x8c, 0x72, 0x65, 0x1b, 0xb3,
+	0x17, 0xe8, 0x5b, 0x66, 0xc9, 0x42, 0xf2, 0x51, 0x69, 0x84, 0x5b, 0x7f, 0x8c, 0xf5, 0xa7, 0x72,
+	0xcc, 0x8d, 0xc6, 0x51, 0x37, 0x16, 0x83, 0x17, 0x57, 0x23, 0xe7, 0xe5, 0xd5, 0xc8, 0xf9, 0xe7,
+	0x6a, 0xe4, 0xfc, 0x37, 0x00, 0xa3, 0x5e, 0xe9, 0x41, 0x81, 0x06, 0x00, 0x00,
 }
 
 func (m *WireFrame) Marshal() (dAtA []byte, err error) {
@@ -843,6 +851,9 @@ func (m *QueueMessage) MarshalTo(dAtA []byte) (int, error) {
 	dAtA[i] = 0x28
 	i++
 	i = encodeVarintMessages(dAtA, i, uint64(m.LocalId))
+	dAtA[i] = 0x30
+	i++
+	i = encodeVarintMessages(dAtA, i, uint64(m.Sequence))
 	if m.XXX_unrecognized != nil {
 		i += copy(dAtA[i:], m.XXX_unrecognized)
 	}
@@ -1099,6 +1110,7 @@ func (m *QueueMessage) Size() (n int) {
 	n += 2
 	n += 1 + sovMessages(uint64(m.MsgSize))
 	n += 1 + sovMessages(uint64(m.LocalId))
+	n += 1 + sovMessages(uint64(m.Sequence))
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -1874,6 +1886,25 @@ func (m *QueueMessage) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 6:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Sequence", wireType)
+			}
+			m.Sequence = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowMessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Sequence |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipMessages(dAtA[iNdEx:])
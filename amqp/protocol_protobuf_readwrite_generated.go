@@ -2,7 +2,6 @@ package amqp
 
 import (
 	"errors"
-	"fmt"
 	"io"
 )
 
@@ -4271,5 +4270,5 @@ func ReadMethod(reader io.Reader, strictMode bool) (MethodFrame, error) {
 
 	}
 
-	return nil, errors.New(fmt.Sprintf("Bad method or class Id! classId: %d, methodIndex: %d", classIndex, methodIndex))
+	return nil, &UnknownMethodError{ClassId: classIndex, MethodId: methodIndex}
 }
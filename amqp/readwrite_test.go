@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math/rand"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -145,7 +146,7 @@ func TestReadingContentHeaderProps(t *testing.T) {
 		Reserved:        sptr(""),
 	}
 	var outBuf = bytes.NewBuffer([]byte{})
-	flags, err := props.WriteProps(outBuf)
+	flags, err := props.WriteProps(outBuf, true)
 	if err != nil {
 		t.Errorf(err.Error())
 	}
@@ -171,7 +172,7 @@ func TestReadingContentHeaderProps(t *testing.T) {
 		t.Errorf("Bad content type: %s", *inProps.ContentType)
 	}
 	if *inProps.Timestamp != time {
-		t.Errorf("Bad timestamp: %s", *inProps.Timestamp)
+		t.Errorf("Bad timestamp: %d", *inProps.Timestamp)
 	}
 }
 
@@ -182,6 +183,23 @@ func TestReadArrayFailures(t *testing.T) {
 	}
 }
 
+func TestCheckExchangeOrQueueName(t *testing.T) {
+	var valid = []string{"", "q1", "a.b:c-d_e", strings.Repeat("q", MaxNameLength)}
+	for _, name := range valid {
+		if err := CheckExchangeOrQueueName(name); err != nil {
+			t.Errorf("Rejected valid name '%s': %s", name, err.Error())
+		}
+	}
+	// Names this long can't come off the wire, but the check doesn't rely
+	// on that
+	var invalid = []string{"a b", "q/1", strings.Repeat("q", MaxNameLength+1)}
+	for _, name := range invalid {
+		if err := CheckExchangeOrQueueName(name); err == nil {
+			t.Errorf("Accepted invalid name '%s'", name)
+		}
+	}
+}
+
 func TestWireFrame(t *testing.T) {
 	// Write frame to bytes
 	var outFrame = &WireFrame{
@@ -264,6 +282,14 @@ func methodsForTesting() []MethodFrame {
 			Exchange:    string("ex1"),
 			RoutingKey:  string("rk1"),
 		},
+		&AccessRequest{
+			Realm:      "/data",
+			Active:     true,
+			ReadAccess: true,
+		},
+		&AccessRequestOk{
+			Ticket: uint16(1),
+		},
 	}
 }
 
@@ -26,6 +26,87 @@ func (table *Table) GetKey(key string) *FieldValue {
 	return nil
 }
 
+// Get a string value, which clients may send as either a short or a long
+// string. Reports false if the key is missing or isn't a string.
+func (table *Table) GetString(key string) (string, bool) {
+	if table == nil {
+		return "", false
+	}
+	var value = table.GetKey(key)
+	if value == nil {
+		return "", false
+	}
+	switch v := value.Value.(type) {
+	case *FieldValue_VShortstr:
+		return v.VShortstr, true
+	case *FieldValue_VLongstr:
+		return string(v.VLongstr), true
+	}
+	return "", false
+}
+
+// Get an integer value of any width. Reports false if the key is missing or
+// isn't an integer.
+func (table *Table) GetInt(key string) (int64, bool) {
+	if table == nil {
+		return 0, false
+	}
+	var value = table.GetKey(key)
+	if value == nil {
+		return 0, false
+	}
+	switch v := value.Value.(type) {
+	case *FieldValue_VInt8:
+		return int64(v.VInt8), true
+	case *FieldValue_VUint8:
+		return int64(v.VUint8), true
+	case *FieldValue_VInt16:
+		return int64(v.VInt16), true
+	case *FieldValue_VUint16:
+		return int64(v.VUint16), true
+	case *FieldValue_VInt32:
+		return int64(v.VInt32), true
+	case *FieldValue_VUint32:
+		return int64(v.VUint32), true
+	case *FieldValue_VInt64:
+		return v.VInt64, true
+	case *FieldValue_VUint64:
+		return int64(v.VUint64), true
+	}
+	return 0, false
+}
+
+// Get a boolean value. Reports false if the key is missing or isn't a
+// boolean.
+func (table *Table) GetBool(key string) (bool, bool) {
+	if table == nil {
+		return false, false
+	}
+	var value = table.GetKey(key)
+	if value == nil {
+		return false, false
+	}
+	if v, ok := value.Value.(*FieldValue_VBoolean); ok {
+		return v.VBoolean, true
+	}
+	return false, false
+}
+
+// Get a nested table. Reports false if the key is missing or isn't a table.
+func (table *Table) GetTable(key string) (*Table, bool) {
+	if table == nil {
+		return nil, false
+	}
+	var value = table.GetKey(key)
+	if value == nil {
+		return nil, false
+	}
+	if v, ok := value.Value.(*FieldValue_VTable); ok {
+		return v.VTable, true
+	}
+	return nil, false
+}
+
 func (table *Table) SetKey(key string, value interface{}) error {
 	var fieldValue *FieldValue = nil
 	for _, kv := range table.Table {
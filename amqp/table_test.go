@@ -88,6 +88,42 @@ func TestTableTypes(t *testing.T) {
 	}
 }
 
+func TestTableTypesNotStrict(t *testing.T) {
+	var inTable = EverythingTable()
+	// Byte arrays and voids only come from the wire
+	inTable.Table = append(inTable.Table,
+		&FieldValuePair{Key: sptr("bytes"), Value: &FieldValue{Value: &FieldValue_VBytes{VBytes: []byte{1, 2}}}},
+		&FieldValuePair{Key: sptr("void"), Value: nil},
+	)
+
+	writer := bytes.NewBuffer(make([]byte, 0))
+	if err := writeTable(writer, inTable, false); err != nil {
+		t.Fatalf(err.Error())
+	}
+	outTable, err := ReadTable(bytes.NewReader(writer.Bytes()), false)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Short strings become long strings and uint64 has to become int64,
+	// everything else comes back the same
+	var changed = map[string]bool{"string": true, "uint64": true, "*Table": true}
+	for _, kv := range inTable.Table {
+		if changed[*kv.Key] {
+			continue
+		}
+		if !reflect.DeepEqual(kv.Value, outTable.GetKey(*kv.Key)) {
+			t.Errorf("Field %s changed: %v", *kv.Key, outTable.GetKey(*kv.Key))
+		}
+	}
+	if s, _ := outTable.GetString("string"); s != "string value" {
+		t.Errorf("Short string was not written as a long string")
+	}
+	if v, _ := outTable.GetInt("uint64"); v != 9 {
+		t.Errorf("uint64 was not written as an int64")
+	}
+}
+
 func (table *Table) Generator(rand *rand.Rand, size int) reflect.Value {
 	return reflect.ValueOf(EverythingTable())
 }
@@ -113,7 +149,7 @@ func EverythingTable() *Table {
 	// Decimal
 	var scale = uint8(12)
 	var value = int32(-13)
-	inTable.SetKey("*Decimal", &Decimal{&scale, &value})
+	inTable.SetKey("*Decimal", &Decimal{Scale: &scale, Value: &value})
 	// Field Array
 	var fa = NewFieldArray()
 	fa.AppendFA(int8(101))
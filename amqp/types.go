@@ -6,6 +6,7 @@ import (
 	"github.com/karelbilek/amqp-test-server/util"
 	"io"
 	"regexp"
+	"strings"
 )
 
 type Frame interface {
@@ -76,24 +77,42 @@ func NewQueueMessage(id int64, deliveryCount int32, durable bool, msgSize uint32
 	}
 }
 
+// Whether the message was added to the store before the other one. Messages
+// saved before queue messages had a sequence number have 0 and go first, in
+// the order of their ids.
+func (qm *QueueMessage) PublishedBefore(other *QueueMessage) bool {
+	if qm.Sequence != other.Sequence {
+		return qm.Sequence < other.Sequence
+	}
+	return qm.Id < other.Id
+}
+
 func (frame *ContentHeaderFrame) FrameType() byte {
 	return 2
 }
 
 var exchangeNameRegex = regexp.MustCompile(`^[a-zA-Z0-9-_.:]*$`)
 
+// The spec's domain limit is 127, but clients and other brokers use the
+// whole short string, so names are limited to what one can hold
+const MaxNameLength = 255
+
 func CheckExchangeOrQueueName(s string) error {
-	// Is it possible this length check is generally ignored since a short
-	// string is only twice as long?
-	if len(s) > 127 {
-		return fmt.Errorf("Exchange name too long: %d", len(s))
+	if len(s) > MaxNameLength {
+		return fmt.Errorf("Name too long: %d", len(s))
 	}
 	if !exchangeNameRegex.MatchString(s) {
-		return fmt.Errorf("Exchange name invalid: %s", s)
+		return fmt.Errorf("Name invalid: %s", s)
 	}
 	return nil
 }
 
+// Names starting with "amq." belong to the server. Clients may use them
+// passively but not declare them.
+func IsReservedName(s string) bool {
+	return strings.HasPrefix(s, "amq.")
+}
+
 func (frame *ContentHeaderFrame) Read(reader io.Reader, strictMode bool) (err error) {
 	frame.ContentClass, err = ReadShort(reader)
 	if err != nil {
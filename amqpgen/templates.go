@@ -53,7 +53,6 @@ package amqp
 import (
   "io"
   "errors"
-  "fmt"
 )
 
 {{range $class := .Amqp.Classes}}
@@ -172,7 +171,7 @@ func ReadMethod(reader io.Reader, strictMode bool) (MethodFrame, error) {
 {{end}}
   }
 
-  return nil, errors.New(fmt.Sprintf("Bad method or class Id! classId: %d, methodIndex: %d", classIndex, methodIndex))
+  return nil, &UnknownMethodError{ClassId: classIndex, MethodId: methodIndex}
 }
   `)
 	if err != nil {
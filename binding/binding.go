@@ -5,7 +5,9 @@ import (
 	"crypto/sha1"
 	"encoding/json"
 	"fmt"
+	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/gogo/protobuf/proto"
@@ -23,14 +25,39 @@ func (bsf *BindingStateFactory) New() proto.Unmarshaler {
 
 var BINDINGS_BUCKET_NAME = []byte("bindings")
 
+// Exchange-to-exchange bindings are kept in their own bucket since the
+// binding state has no field to tell them apart from queue bindings
+var EXCHANGE_BINDINGS_BUCKET_NAME = []byte("exchange_bindings")
+
 type Binding struct {
 	gen.BindingState
 	topicMatcher *regexp.Regexp
+	// ToExchange is set on exchange-to-exchange bindings, in which case
+	// QueueName holds the name of the destination exchange
+	ToExchange bool
+	// headers is set on bindings from headers exchanges, where the arguments
+	// are part of the binding's identity, see SetHeaders
+	headers bool
+}
+
+func (binding *Binding) bucketName() []byte {
+	if binding.ToExchange {
+		return EXCHANGE_BINDINGS_BUCKET_NAME
+	}
+	return BINDINGS_BUCKET_NAME
 }
 
 var topicRoutingPatternPattern, _ = regexp.Compile(`^((\w+|\*|#)(\.(\w+|\*|#))*|)$`)
 
 func (binding *Binding) MarshalJSON() ([]byte, error) {
+	if binding.ToExchange {
+		return json.Marshal(map[string]interface{}{
+			"destination":  binding.QueueName,
+			"exchangeName": binding.ExchangeName,
+			"key":          binding.Key,
+			"arguments":    binding.Arguments,
+		})
+	}
 	return json.Marshal(map[string]interface{}{
 		"queueName":    binding.QueueName,
 		"exchangeName": binding.ExchangeName,
@@ -39,21 +66,74 @@ func (binding *Binding) MarshalJSON() ([]byte, error) {
 	})
 }
 
+// Copy returns a copy that can be handed out, e.g. for JSON serialization,
+// without holding the lock of the exchange the binding belongs to
+func (binding *Binding) Copy() *Binding {
+	var ret = *binding
+	return &ret
+}
+
+// Bindings which differ only in their arguments are the same binding, unless
+// they are from a headers exchange. The arguments are what headers bindings
+// match on, so one queue can be bound several times with different ones.
+// Direct, fanout and topic exchanges ignore them and keep the first ones given.
 func (binding *Binding) Equals(other *Binding) bool {
 	if other == nil || binding == nil {
 		return false
 	}
-	return binding.QueueName == other.QueueName &&
+	var same = binding.ToExchange == other.ToExchange &&
+		binding.QueueName == other.QueueName &&
 		binding.ExchangeName == other.ExchangeName &&
 		binding.Key == other.Key
+	if same && (binding.headers || other.headers) {
+		return bytes.Equal(encodeArguments(binding.Arguments), encodeArguments(other.Arguments))
+	}
+	return same
 }
 
+// Mark the binding as one from a headers exchange, making its arguments part
+// of its identity in Equals and its ID
+func (binding *Binding) SetHeaders() {
+	binding.headers = true
+	if binding.ToExchange {
+		binding.Id = calcExchangeBindingId(binding.QueueName, binding.ExchangeName, binding.Key, binding.Arguments)
+	} else {
+		binding.Id = calcId(binding.QueueName, binding.ExchangeName, binding.Key, binding.Arguments)
+	}
+}
+
+// The arguments as they are written on the wire, so tables with the same
+// fields compare equal
+func encodeArguments(arguments *amqp.Table) []byte {
+	var buffer = bytes.NewBuffer(make([]byte, 0))
+	amqp.WriteTable(buffer, sortedArguments(arguments))
+	return buffer.Bytes()
+}
+
+// A copy of the arguments sorted by key. Clients don't keep the order of the
+// fields they were given, so the same table can arrive in any order. A missing
+// table is the same as an empty one.
+func sortedArguments(arguments *amqp.Table) *amqp.Table {
+	var ret = amqp.NewTable()
+	if arguments != nil {
+		ret.Table = append(ret.Table, arguments.Table...)
+	}
+	sort.SliceStable(ret.Table, func(i, j int) bool {
+		return *ret.Table[i].Key < *ret.Table[j].Key
+	})
+	return ret
+}
+
+// Depersisting a binding which was never persisted is a no-op, so unbinding
+// a non-existent binding succeeds
 func (binding *Binding) Depersist(db *bolt.DB) error {
-	return persist.DepersistOne(db, BINDINGS_BUCKET_NAME, string(binding.Id))
+	return db.Update(func(tx *bolt.Tx) error {
+		return binding.DepersistBoltTx(tx)
+	})
 }
 
 func (binding *Binding) DepersistBoltTx(tx *bolt.Tx) error {
-	bucket, err := tx.CreateBucketIfNotExists(BINDINGS_BUCKET_NAME)
+	bucket, err := tx.CreateBucketIfNotExists(binding.bucketName())
 	if err != nil { // pragma: nocover
 		// If we're hitting this it means the disk is full, the db is readonly,
 		// or something else has gone irrecoverably wrong
@@ -91,7 +171,7 @@ func NewBinding(queueName string, exchangeName string, key string, arguments *am
 
 	return &Binding{
 		BindingState: gen.BindingState{
-			Id:           calcId(queueName, exchangeName, key, arguments),
+			Id:           calcId(queueName, exchangeName, key, amqp.NewTable()),
 			QueueName:    queueName,
 			ExchangeName: exchangeName,
 			Key:          key,
@@ -102,6 +182,34 @@ func NewBinding(queueName string, exchangeName string, key string, arguments *am
 	}, nil
 }
 
+// Create a binding that routes messages from the source exchange on to the
+// destination exchange
+func NewExchangeBinding(destination string, source string, key string, arguments *amqp.Table, topic bool) (*Binding, error) {
+	var b, err = NewBinding(destination, source, key, arguments, topic)
+	if err != nil {
+		return nil, err
+	}
+	b.Id = calcExchangeBindingId(destination, source, key, amqp.NewTable())
+	b.ToExchange = true
+	return b, nil
+}
+
+func LoadAllExchangeBindings(db *bolt.DB) (map[string]*Binding, error) {
+	var stateMap, err = persist.LoadAll(db, EXCHANGE_BINDINGS_BUCKET_NAME, &BindingStateFactory{})
+	if err != nil {
+		return nil, err
+	}
+	var ret = make(map[string]*Binding)
+	for key, state := range stateMap {
+		var sb = state.(*gen.BindingState)
+		ret[key], err = NewExchangeBinding(sb.QueueName, sb.ExchangeName, sb.Key, sb.Arguments, sb.Topic)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
 func LoadAllBindings(db *bolt.DB) (map[string]*Binding, error) {
 	exStateMap, err := persist.LoadAll(db, BINDINGS_BUCKET_NAME, &BindingStateFactory{})
 	if err != nil {
@@ -121,7 +229,7 @@ func LoadAllBindings(db *bolt.DB) (map[string]*Binding, error) {
 }
 
 func (b *Binding) Persist(db *bolt.DB) error {
-	return persist.PersistOne(db, BINDINGS_BUCKET_NAME, string(b.Id), b)
+	return persist.PersistOne(db, b.bucketName(), string(b.Id), b)
 }
 
 func (b *Binding) MatchDirect(message *amqp.BasicPublish) bool {
@@ -138,14 +246,82 @@ func (b *Binding) MatchTopic(message *amqp.BasicPublish) bool {
 	return ex && match
 }
 
+// The x-match values of headers bindings. "all" and "any" leave headers
+// starting with "x-" out of the match, "all-with-x" and "any-with-x" match
+// on them like on any other header. x-match itself is never matched on.
+var headersMatchModes = map[string]bool{
+	"all":        true,
+	"any":        true,
+	"all-with-x": true,
+	"any-with-x": true,
+}
+
+// Check the x-match argument of a headers binding. Leaving it out means
+// "all".
+func CheckHeadersMatch(arguments *amqp.Table) error {
+	if arguments == nil || arguments.GetKey("x-match") == nil {
+		return nil
+	}
+	var mode, ok = arguments.GetString("x-match")
+	if !ok || !headersMatchModes[mode] {
+		return fmt.Errorf("Invalid x-match field value %v", arguments.GetKey("x-match").Value)
+	}
+	return nil
+}
+
+// Match the headers of a message against the binding's arguments. With
+// "all" every argument must be among the headers with the same value, with
+// "any" one is enough. An argument without a value only needs the header to
+// be there.
+func (b *Binding) MatchHeaders(headers *amqp.Table) bool {
+	var mode, _ = b.Arguments.GetString("x-match")
+	var any = strings.HasPrefix(mode, "any")
+	var withX = strings.HasSuffix(mode, "-with-x")
+	if b.Arguments == nil {
+		return !any
+	}
+	for _, kv := range b.Arguments.Table {
+		var key = *kv.Key
+		if key == "x-match" || (!withX && strings.HasPrefix(key, "x-")) {
+			continue
+		}
+		var matched = headerMatches(headers, b.Arguments, key)
+		if any && matched {
+			return true
+		}
+		if !any && !matched {
+			return false
+		}
+	}
+	return !any
+}
+
+func headerMatches(headers *amqp.Table, arguments *amqp.Table, key string) bool {
+	if headers == nil || headers.GetKey(key) == nil {
+		return false
+	}
+	var expected = arguments.GetKey(key)
+	if expected == nil || expected.Value == nil {
+		return true
+	}
+	// Clients send strings as either short or long strings
+	if want, ok := arguments.GetString(key); ok {
+		var got, isString = headers.GetString(key)
+		return isString && got == want
+	}
+	return reflect.DeepEqual(expected.Value, headers.GetKey(key).Value)
+}
+
 // Calculate an ID by encoding the QueueBind call that created this binding and
-// taking a hash of it.
+// taking a hash of it. Like Equals the arguments only count on headers
+// exchanges, the other bindings are given an empty table so bindings made
+// without any keep their old IDs.
 func calcId(queueName string, exchangeName string, key string, arguments *amqp.Table) []byte {
 	var method = &amqp.QueueBind{
 		Queue:      queueName,
 		Exchange:   exchangeName,
 		RoutingKey: key,
-		Arguments:  arguments,
+		Arguments:  sortedArguments(arguments),
 	}
 	var buffer = bytes.NewBuffer(make([]byte, 0))
 	method.Write(buffer)
@@ -157,3 +333,20 @@ func calcId(queueName string, exchangeName string, key string, arguments *amqp.T
 	hash.Write(value)
 	return []byte(hash.Sum(nil))
 }
+
+// Same as calcId, but based on the ExchangeBind call. QueueBind and
+// ExchangeBind have the same field layout, so the class/method bytes are
+// kept to stop an exchange binding sharing an ID with a queue binding.
+func calcExchangeBindingId(destination string, source string, key string, arguments *amqp.Table) []byte {
+	var method = &amqp.ExchangeBind{
+		Destination: destination,
+		Source:      source,
+		RoutingKey:  key,
+		Arguments:   sortedArguments(arguments),
+	}
+	var buffer = bytes.NewBuffer(make([]byte, 0))
+	method.Write(buffer)
+	hash := sha1.New()
+	hash.Write(buffer.Bytes())
+	return []byte(hash.Sum(nil))
+}
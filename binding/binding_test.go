@@ -1,6 +1,7 @@
 package binding
 
 import (
+	"bytes"
 	"encoding/json"
 
 	"github.com/karelbilek/amqp-test-server/amqp"
@@ -41,6 +42,9 @@ func TestEquals(t *testing.T) {
 	diffQ, _ := NewBinding("DIFF", "e1", "rk", amqp.NewTable(), false)
 	diffE, _ := NewBinding("q1", "DIFF", "rk", amqp.NewTable(), false)
 	diffR, _ := NewBinding("q1", "e1", "DIFF", amqp.NewTable(), false)
+	var args = amqp.NewTable()
+	args.SetKey("a", "1")
+	diffArgs, _ := NewBinding("q1", "e1", "rk", args, false)
 
 	if b == nil || same == nil || diffQ == nil || diffE == nil || diffR == nil {
 		t.Errorf("Failed to construct bindings")
@@ -60,7 +64,29 @@ func TestEquals(t *testing.T) {
 	if b.Equals(diffR) {
 		t.Errorf("Equals returns true on routing key diff!")
 	}
+	if !b.Equals(diffArgs) || !bytes.Equal(b.Id, diffArgs.Id) {
+		t.Errorf("Bindings differing only in arguments aren't the same!")
+	}
 
+	// Headers bindings match on their arguments, in any order
+	b.SetHeaders()
+	diffArgs.SetHeaders()
+	if b.Equals(diffArgs) || bytes.Equal(b.Id, diffArgs.Id) {
+		t.Errorf("Headers bindings with different arguments are the same!")
+	}
+	var ordered = amqp.NewTable()
+	ordered.SetKey("a", "1")
+	ordered.SetKey("b", "2")
+	var reordered = amqp.NewTable()
+	reordered.SetKey("b", "2")
+	reordered.SetKey("a", "1")
+	orderedArgs, _ := NewBinding("q1", "e1", "rk", ordered, false)
+	orderedArgs.SetHeaders()
+	reorderedArgs, _ := NewBinding("q1", "e1", "rk", reordered, false)
+	reorderedArgs.SetHeaders()
+	if !orderedArgs.Equals(reorderedArgs) || !bytes.Equal(orderedArgs.Id, reorderedArgs.Id) {
+		t.Errorf("Headers bindings with reordered arguments aren't the same!")
+	}
 }
 
 func TestTopicRouting(t *testing.T) {
@@ -96,6 +122,65 @@ func TestTopicRouting(t *testing.T) {
 
 }
 
+func TestHeadersMatch(t *testing.T) {
+	var table = func(pairs ...interface{}) *amqp.Table {
+		var ret = amqp.NewTable()
+		for i := 0; i < len(pairs); i += 2 {
+			ret.SetKey(pairs[i].(string), pairs[i+1])
+		}
+		return ret
+	}
+	var bind = func(args *amqp.Table) *Binding {
+		b, _ := NewBinding("q1", "e1", "", args, false)
+		return b
+	}
+	var headers = table("color", "red", "size", int32(3), "x-tenant", []byte("a"))
+
+	// all needs every header, x- ones aside
+	if !bind(table("x-match", "all", "color", "red", "size", int32(3))).MatchHeaders(headers) {
+		t.Errorf("all didn't match matching headers")
+	}
+	if bind(table("x-match", "all", "color", "red", "size", int32(4))).MatchHeaders(headers) {
+		t.Errorf("all matched with a header of another value")
+	}
+	if !bind(table("color", "red")).MatchHeaders(headers) {
+		t.Errorf("Leaving out x-match didn't default to all")
+	}
+	if !bind(table("x-match", "all", "color", "red", "x-tenant", "b")).MatchHeaders(headers) {
+		t.Errorf("all didn't ignore x- headers")
+	}
+	if bind(table("x-match", "all-with-x", "color", "red", "x-tenant", "b")).MatchHeaders(headers) {
+		t.Errorf("all-with-x ignored x- headers")
+	}
+	if !bind(table("x-match", "all-with-x", "color", "red", "x-tenant", "a")).MatchHeaders(headers) {
+		t.Errorf("all-with-x didn't match x- headers")
+	}
+
+	// any needs one of them, x- ones aside
+	if !bind(table("x-match", "any", "color", "blue", "size", int32(3))).MatchHeaders(headers) {
+		t.Errorf("any didn't match with one matching header")
+	}
+	if bind(table("x-match", "any", "x-tenant", "a")).MatchHeaders(headers) {
+		t.Errorf("any matched on an x- header")
+	}
+	if !bind(table("x-match", "any-with-x", "x-tenant", "a")).MatchHeaders(headers) {
+		t.Errorf("any-with-x didn't match on an x- header")
+	}
+	if bind(table("x-match", "any-with-x", "x-tenant", "b")).MatchHeaders(headers) {
+		t.Errorf("any-with-x matched an x- header of another value")
+	}
+	if bind(table("x-match", "any", "color", "red")).MatchHeaders(nil) {
+		t.Errorf("any matched a message without headers")
+	}
+
+	if err := CheckHeadersMatch(table("x-match", "any-with-x")); err != nil {
+		t.Errorf(err.Error())
+	}
+	if err := CheckHeadersMatch(table("x-match", "some")); err == nil {
+		t.Errorf("Accepted a bad x-match")
+	}
+}
+
 func basicPublish(e string, key string) *amqp.BasicPublish {
 	return &amqp.BasicPublish{
 		Exchange:   e,
@@ -169,3 +254,47 @@ func TestPersistence(t *testing.T) {
 	}
 
 }
+
+func TestExchangeBindingPersistence(t *testing.T) {
+	var dbFile = "TestExchangeBindingPersistence.db"
+	os.Remove(dbFile)
+	defer os.Remove(dbFile)
+	db, err := bolt.Open(dbFile, 0600, nil)
+	if err != nil {
+		t.Errorf("Failed to create db")
+	}
+
+	qb, _ := NewBinding("dest", "src", "rk1", amqp.NewTable(), false)
+	eb, err := NewExchangeBinding("dest", "src", "rk1", amqp.NewTable(), false)
+	if err != nil {
+		t.Errorf("Error in NewExchangeBinding")
+	}
+	if eb.Equals(qb) || string(eb.Id) == string(qb.Id) {
+		t.Errorf("Exchange binding collides with queue binding")
+	}
+	qb.Persist(db)
+	eb.Persist(db)
+
+	bMap, err := LoadAllExchangeBindings(db)
+	if err != nil {
+		t.Errorf("Error in LoadAllExchangeBindings")
+	}
+	if len(bMap) != 1 {
+		t.Errorf("Wrong number of bindings")
+	}
+	for _, b2 := range bMap {
+		if !b2.Equals(eb) {
+			t.Errorf("Did not get the same binding from the db")
+		}
+	}
+
+	eb.Depersist(db)
+	bMap, _ = LoadAllExchangeBindings(db)
+	if len(bMap) != 0 {
+		t.Errorf("Wrong number of bindings")
+	}
+	bMap, _ = LoadAllBindings(db)
+	if len(bMap) != 1 {
+		t.Errorf("Queue binding was removed")
+	}
+}
@@ -3,6 +3,8 @@ package consumer
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"strings"
 	"sync"
 
 	"github.com/karelbilek/amqp-test-server/amqp"
@@ -31,6 +33,8 @@ type Consumer struct {
 	stopped       bool
 	StatCount     uint64
 	localId       int64
+	// From the x-filter-jmespath argument, nil without one
+	filter *Filter
 	// stats
 	statConsumeOneGetOne stats.Histogram
 	statConsumeOne       stats.Histogram
@@ -40,8 +44,15 @@ type Consumer struct {
 }
 
 type ConsumerQueue interface {
-	GetOne(rhs ...amqp.MessageResourceHolder) (*amqp.QueueMessage, *amqp.Message)
+	GetOneFiltered(accept func(*amqp.QueueMessage) bool, rhs ...amqp.MessageResourceHolder) (*amqp.QueueMessage, *amqp.Message)
 	MaybeReady() chan bool
+	// False for consumers standing by on a single-active-consumer queue
+	IsActiveConsumer(c *Consumer) bool
+	// Put back a message which couldn't be delivered after all
+	PutBack(qm *amqp.QueueMessage)
+	// Count a delivery waiting on an ack. The consumer does this rather than
+	// the channel, which would need to look the queue up by name.
+	AddUnacked()
 }
 
 // The methods necessary for a consumer to interact with a channel
@@ -50,7 +61,13 @@ type ConsumerChannel interface {
 	SendContent(method amqp.MethodFrame, msg *amqp.Message)
 	SendMethod(method amqp.MethodFrame)
 	FlowActive() bool
-	AddUnackedMessage(consumerTag string, qm *amqp.QueueMessage, queueName string) uint64
+	// Returns false once the channel has shut down, since nothing would ever
+	// ack or requeue the message
+	AddUnackedMessage(consumerTag string, qm *amqp.QueueMessage, queueName string) (uint64, bool)
+	// Copy a delivered message to the firehose, if it is enabled
+	TraceDelivery(queueName string, msg *amqp.Message)
+	// Tell the client the server cancelled one of its consumers
+	ConsumerCancelled(consumerTag string, queueName string)
 }
 
 func NewConsumer(
@@ -88,9 +105,20 @@ func NewConsumer(
 		statConsumeOneAck:    stats.MakeHistogram("Consume-One-Ack"),
 		statConsumeOneSend:   stats.MakeHistogram("Consume-One-Send"),
 		ctx:                  ctx,
+		filter:               argumentFilter(arguments),
 	}
 }
 
+// The filter of consume arguments which ValidateArguments accepted
+func argumentFilter(arguments *amqp.Table) *Filter {
+	var expr, ok = arguments.GetString(FilterArgument)
+	if !ok {
+		return nil
+	}
+	var filter, _ = ParseFilter(expr)
+	return filter
+}
+
 func (consumer *Consumer) MarshalJSON() ([]byte, error) {
 	return json.Marshal(map[string]interface{}{
 		"tag": consumer.ConsumerTag,
@@ -103,8 +131,70 @@ func (consumer *Consumer) MarshalJSON() ([]byte, error) {
 	})
 }
 
+// The x- arguments basic.consume understands. x-cancel-on-ha-failover is
+// accepted for compatibility, a single server has nothing to fail over to.
+var knownArguments = map[string]bool{
+	"x-priority":              true,
+	"x-cancel-on-ha-failover": true,
+	FilterArgument:            true,
+}
+
+// Check the basic.consume arguments. Known arguments must have the right
+// type. Unknown x- arguments are an error in strict mode and ignored
+// otherwise, like any argument without the x- prefix.
+func ValidateArguments(arguments *amqp.Table, strict bool) error {
+	if arguments == nil {
+		return nil
+	}
+	for _, kv := range arguments.Table {
+		var key = *kv.Key
+		switch {
+		case key == "x-priority":
+			if _, ok := arguments.GetInt(key); !ok {
+				return fmt.Errorf("Consumer argument '%s' must be an integer", key)
+			}
+		case key == "x-cancel-on-ha-failover":
+			if _, ok := arguments.GetBool(key); !ok {
+				return fmt.Errorf("Consumer argument '%s' must be a boolean", key)
+			}
+		case key == FilterArgument:
+			var expr, ok = arguments.GetString(key)
+			if !ok {
+				return fmt.Errorf("Consumer argument '%s' must be a string", key)
+			}
+			if _, err := ParseFilter(expr); err != nil {
+				return err
+			}
+		case strict && strings.HasPrefix(key, "x-") && !knownArguments[key]:
+			return fmt.Errorf("Unknown consumer argument '%s'", key)
+		}
+	}
+	return nil
+}
+
+// The arguments the consumer was declared with
+func (consumer *Consumer) Arguments() *amqp.Table {
+	return consumer.arguments
+}
+
+// Consumers declared with a higher x-priority are offered messages before
+// lower ones. The default is 0.
+func (consumer *Consumer) Priority() int64 {
+	var priority, _ = consumer.arguments.GetInt("x-priority")
+	return priority
+}
+
+func (consumer *Consumer) QueueName() string {
+	return consumer.queueName
+}
+
 // TODO: make this a field that we construct on init
+// No-ack deliveries are never outstanding, so they don't count against the
+// channel's prefetch limits.
 func (consumer *Consumer) MessageResourceHolders() []amqp.MessageResourceHolder {
+	if consumer.noAck {
+		return []amqp.MessageResourceHolder{consumer}
+	}
 	return []amqp.MessageResourceHolder{consumer, consumer.cchannel}
 }
 
@@ -122,7 +212,7 @@ func (consumer *Consumer) AcquireResources(qm *amqp.QueueMessage) bool {
 	defer consumer.limitLock.Unlock()
 
 	// If no-local was set on the consumer, reject messages
-	if consumer.noLocal && qm.LocalId == consumer.localId {
+	if !consumer.acceptsLocal(qm) {
 		return false
 	}
 
@@ -142,7 +232,7 @@ func (consumer *Consumer) AcquireResources(qm *amqp.QueueMessage) bool {
 	}
 
 	// Calculate whether we're over either of the size and count limits
-	var sizeOk = consumer.prefetchSize == 0 || consumer.activeSize < consumer.prefetchSize
+	var sizeOk = PrefetchSizeOk(consumer.prefetchSize, consumer.activeSize, consumer.activeCount, qm.MsgSize)
 	var countOk = consumer.prefetchCount == 0 || consumer.activeCount < consumer.prefetchCount
 	if sizeOk && countOk {
 		consumer.activeCount += 1
@@ -152,6 +242,37 @@ func (consumer *Consumer) AcquireResources(qm *amqp.QueueMessage) bool {
 	return false
 }
 
+// Whether a message of msgSize bytes fits in the prefetch window, given
+// what is already unacked. A message bigger than the whole window is still
+// sent once nothing is unacked, or it could never be delivered at all.
+func PrefetchSizeOk(prefetchSize uint32, activeSize uint32, activeCount uint16, msgSize uint32) bool {
+	if prefetchSize == 0 || activeCount == 0 {
+		return true
+	}
+	return uint64(activeSize)+uint64(msgSize) <= uint64(prefetchSize)
+}
+
+// Whether the consumer takes the message when it looks through the queue.
+// Messages it doesn't take are left for the other consumers.
+func (consumer *Consumer) accepts(qm *amqp.QueueMessage) bool {
+	if !consumer.acceptsLocal(qm) {
+		return false
+	}
+	if consumer.filter == nil {
+		return true
+	}
+	var msg, found = consumer.msgStore.GetNoChecks(qm.Id)
+	return found && consumer.filter.Matches(msg)
+}
+
+// A no-local consumer doesn't take messages published on its own connection.
+// They stay on the queue for other consumers. This is the no-local check
+// alone, which doesn't need the message itself. Used when acquiring
+// resources, where the message store is already locked.
+func (consumer *Consumer) acceptsLocal(qm *amqp.QueueMessage) bool {
+	return !consumer.noLocal || qm.LocalId != consumer.localId
+}
+
 func (consumer *Consumer) ReleaseResources(qm *amqp.QueueMessage) {
 	consumer.limitLock.Lock()
 	consumer.activeCount -= 1
@@ -180,36 +301,60 @@ func (consumer *Consumer) consume(id uint16) {
 	consumer.cqueue.MaybeReady() <- false
 	for {
 		select {
-		case <-consumer.incoming:
-			consumer.consumeOne()
+		case _, ok := <-consumer.incoming:
+			if !ok {
+				// Stop closed the channel, this consumer is finished
+				return
+			}
+			consumer.ConsumeOne()
 		case <-consumer.ctx.Done():
 			return
 		}
 	}
 }
 
-func (consumer *Consumer) consumeOne() {
+// Try to deliver the next message on the queue to this consumer. Returns
+// false if there was no message or this consumer couldn't take it, for
+// instance because it is at its prefetch limit.
+func (consumer *Consumer) ConsumeOne() bool {
 	defer stats.RecordHisto(consumer.statConsumeOne, stats.Start())
 	var err error
 	// Check local limit
 	consumer.consumeLock.Lock()
 	defer consumer.consumeLock.Unlock()
+	consumer.stopLock.Lock()
+	var stopped = consumer.stopped
+	consumer.stopLock.Unlock()
+	if stopped || !consumer.cqueue.IsActiveConsumer(consumer) {
+		return false
+	}
 	// Try to get message/check channel limit
 
 	var start = stats.Start()
-	var qm, msg = consumer.cqueue.GetOne(consumer.cchannel, consumer)
+	var rhs = consumer.MessageResourceHolders()
+	var qm, msg = consumer.cqueue.GetOneFiltered(consumer.accepts, rhs...)
 	stats.RecordHisto(consumer.statConsumeOneGetOne, start)
 	if qm == nil {
-		return
+		return false
 	}
 	var tag uint64 = 0
+	// Read before the message awaits an ack, since a nack or ack timeout
+	// may requeue it and count another delivery from then on
+	var redelivered = qm.DeliveryCount > 0
 	start = stats.Start()
 	if !consumer.noAck {
-		tag = consumer.cchannel.AddUnackedMessage(consumer.ConsumerTag, qm, consumer.queueName)
+		var added bool
+		tag, added = consumer.cchannel.AddUnackedMessage(consumer.ConsumerTag, qm, consumer.queueName)
+		if !added {
+			// The channel closed while the message was being taken
+			consumer.releaseResources(qm, rhs)
+			consumer.cqueue.PutBack(qm)
+			return false
+		}
+		consumer.cqueue.AddUnacked()
 	} else {
 		// We aren't expecting an ack, so this is the last time the message
 		// will be referenced.
-		var rhs = []amqp.MessageResourceHolder{consumer.cchannel, consumer}
 		err = consumer.msgStore.RemoveRef(qm, consumer.queueName, rhs)
 		if err != nil {
 			panic("Error getting queue message")
@@ -220,29 +365,55 @@ func (consumer *Consumer) consumeOne() {
 	consumer.cchannel.SendContent(&amqp.BasicDeliver{
 		ConsumerTag: consumer.ConsumerTag,
 		DeliveryTag: tag,
-		Redelivered: qm.DeliveryCount > 0,
+		Redelivered: redelivered,
 		Exchange:    msg.Exchange,
 		RoutingKey:  msg.Key,
 	}, msg)
+	consumer.cchannel.TraceDelivery(consumer.queueName, msg)
 	stats.RecordHisto(consumer.statConsumeOneSend, start)
 	consumer.StatCount += 1
-	// Since we succeeded in processing a message, ping so that we try again
-	consumer.Ping()
+	// Since we succeeded in processing a message there may be more. Let the
+	// queue offer the next one, which goes to the next consumer in turn.
+	select {
+	case consumer.cqueue.MaybeReady() <- true:
+	default:
+	}
+	return true
+}
+
+func (consumer *Consumer) releaseResources(qm *amqp.QueueMessage, rhs []amqp.MessageResourceHolder) {
+	for _, rh := range rhs {
+		rh.ReleaseResources(qm)
+	}
 }
 
 func (consumer *Consumer) SendCancel() {
-	var cancel amqp.BasicCancel
-	cancel.ConsumerTag = consumer.ConsumerTag
-	cancel.NoWait = true
-	consumer.cchannel.SendMethod(&cancel)
+	consumer.cchannel.ConsumerCancelled(consumer.ConsumerTag, consumer.queueName)
 }
 
 func (consumer *Consumer) ConsumeImmediate(qm *amqp.QueueMessage, msg *amqp.Message) bool {
 	consumer.consumeLock.Lock()
 	defer consumer.consumeLock.Unlock()
+	if !consumer.accepts(qm) {
+		// Filtered out, the queue offers the message to another consumer
+		consumer.releaseResources(qm, consumer.MessageResourceHolders())
+		return false
+	}
 	var tag uint64 = 0
 	if !consumer.noAck {
-		tag = consumer.cchannel.AddUnackedMessage(consumer.ConsumerTag, qm, consumer.queueName)
+		var added bool
+		tag, added = consumer.cchannel.AddUnackedMessage(consumer.ConsumerTag, qm, consumer.queueName)
+		if !added {
+			// The queue offers the message to another consumer instead
+			consumer.releaseResources(qm, consumer.MessageResourceHolders())
+			return false
+		}
+		consumer.cqueue.AddUnacked()
+	} else {
+		var err = consumer.msgStore.RemoveRef(qm, consumer.queueName, consumer.MessageResourceHolders())
+		if err != nil {
+			panic("Error getting queue message")
+		}
 	}
 	consumer.cchannel.SendContent(&amqp.BasicDeliver{
 		ConsumerTag: consumer.ConsumerTag,
@@ -251,6 +422,7 @@ func (consumer *Consumer) ConsumeImmediate(qm *amqp.QueueMessage, msg *amqp.Mess
 		Exchange:    msg.Exchange,
 		RoutingKey:  msg.Key,
 	}, msg)
+	consumer.cchannel.TraceDelivery(consumer.queueName, msg)
 	consumer.StatCount += 1
 	return true
 }
@@ -2,8 +2,54 @@ package consumer
 
 import (
 	"testing"
+
+	"github.com/karelbilek/amqp-test-server/amqp"
 )
 
 func TestMarshalJson(t *testing.T) {
 
 }
+
+func TestFilter(t *testing.T) {
+	var headers = amqp.NewTable()
+	headers.SetKey("region", "eu")
+	headers.SetKey("retry-count", int32(4))
+	var contentType = "application/json"
+	var msg = &amqp.Message{
+		Exchange: "ex",
+		Key:      "orders.new",
+		Header: &amqp.ContentHeaderFrame{
+			Properties: &amqp.BasicContentHeaderProperties{
+				ContentType: &contentType,
+				Headers:     headers,
+			},
+		},
+	}
+	var cases = map[string]bool{
+		"headers.region == 'eu'":                                            true,
+		"headers.region != 'eu'":                                            false,
+		"headers.region == 'us' || routing_key == 'orders.new'":             true,
+		"headers.\"retry-count\" > `3`":                                     true,
+		"headers.\"retry-count\" <= `3`":                                    false,
+		"properties.content_type == 'application/json' && exchange == 'ex'": true,
+		"headers.tenant":                                                    false,
+		"!headers.tenant":                                                   true,
+		"!(headers.region == 'eu' && headers.region)":                       false,
+		"headers.region > `1`":                                              false,
+	}
+	for expr, expected := range cases {
+		var filter, err = ParseFilter(expr)
+		if err != nil {
+			t.Errorf("Failed to parse %s: %s", expr, err.Error())
+			continue
+		}
+		if filter.Matches(msg) != expected {
+			t.Errorf("Expected %s to be %v", expr, expected)
+		}
+	}
+	for _, expr := range []string{"", "headers.", "a == ", "(a", "'open", "a ~ b", "`{`"} {
+		if _, err := ParseFilter(expr); err == nil {
+			t.Errorf("Expected an error parsing '%s'", expr)
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/karelbilek/amqp-test-server/amqp"
+)
+
+// The basic.consume argument holding a filter on the messages the consumer
+// is given. Messages which don't match stay in the queue for other
+// consumers.
+const FilterArgument = "x-filter-jmespath"
+
+// A filter expression, in the subset of JMESPath made of field paths,
+// comparisons and the logical operators:
+//
+//	headers.region == 'eu' && properties.content_type != 'text/plain'
+//	headers."retry-count" > `3` || !headers.tenant
+//
+// Expressions are evaluated against an object with the message's headers,
+// its properties under their AMQP names (content_type, delivery_mode and so
+// on), exchange and routing_key. A message matches when the expression is
+// true in the JMESPath sense: anything but false, null and empty strings,
+// arrays and objects.
+type Filter struct {
+	expr filterNode
+}
+
+func ParseFilter(expr string) (*Filter, error) {
+	var tokens, err = lexFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	var parser = &filterParser{tokens: tokens}
+	node, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.peek().kind != tokEnd {
+		return nil, fmt.Errorf("Unexpected '%s' in filter", parser.peek().text)
+	}
+	return &Filter{expr: node}, nil
+}
+
+func (filter *Filter) Matches(msg *amqp.Message) bool {
+	return truthy(filter.expr.eval(MessageData(msg)))
+}
+
+// The object filters are evaluated against: the message's headers,
+// properties, exchange and routing key as JSON values
+func MessageData(msg *amqp.Message) map[string]interface{} {
+	var data = map[string]interface{}{
+		"exchange":    msg.Exchange,
+		"routing_key": msg.Key,
+	}
+	if msg.Header == nil || msg.Header.Properties == nil {
+		return data
+	}
+	var props = msg.Header.Properties
+	var properties = make(map[string]interface{})
+	var addString = func(name string, value *string) {
+		if value != nil {
+			properties[name] = *value
+		}
+	}
+	addString("content_type", props.ContentType)
+	addString("content_encoding", props.ContentEncoding)
+	addString("correlation_id", props.CorrelationId)
+	addString("reply_to", props.ReplyTo)
+	addString("expiration", props.Expiration)
+	addString("message_id", props.MessageId)
+	addString("type", props.Type)
+	addString("user_id", props.UserId)
+	addString("app_id", props.AppId)
+	if props.DeliveryMode != nil {
+		properties["delivery_mode"] = float64(*props.DeliveryMode)
+	}
+	if props.Priority != nil {
+		properties["priority"] = float64(*props.Priority)
+	}
+	if props.Timestamp != nil {
+		properties["timestamp"] = float64(*props.Timestamp)
+	}
+	data["properties"] = properties
+	if props.Headers != nil {
+		data["headers"] = tableData(props.Headers)
+	}
+	return data
+}
+
+func tableData(table *amqp.Table) map[string]interface{} {
+	var data = make(map[string]interface{}, len(table.Table))
+	for _, kv := range table.Table {
+		data[*kv.Key] = fieldData(kv.Value)
+	}
+	return data
+}
+
+// Header values as JSON would have them, so literals compare equal to them
+func fieldData(value *amqp.FieldValue) interface{} {
+	if value == nil {
+		return nil
+	}
+	switch v := value.Value.(type) {
+	case *amqp.FieldValue_VBoolean:
+		return v.VBoolean
+	case *amqp.FieldValue_VInt8:
+		return float64(v.VInt8)
+	case *amqp.FieldValue_VUint8:
+		return float64(v.VUint8)
+	case *amqp.FieldValue_VInt16:
+		return float64(v.VInt16)
+	case *amqp.FieldValue_VUint16:
+		return float64(v.VUint16)
+	case *amqp.FieldValue_VInt32:
+		return float64(v.VInt32)
+	case *amqp.FieldValue_VUint32:
+		return float64(v.VUint32)
+	case *amqp.FieldValue_VInt64:
+		return float64(v.VInt64)
+	case *amqp.FieldValue_VUint64:
+		return float64(v.VUint64)
+	case *amqp.FieldValue_VFloat:
+		return float64(v.VFloat)
+	case *amqp.FieldValue_VDouble:
+		return v.VDouble
+	case *amqp.FieldValue_VShortstr:
+		return v.VShortstr
+	case *amqp.FieldValue_VLongstr:
+		return string(v.VLongstr)
+	case *amqp.FieldValue_VTimestamp:
+		return float64(v.VTimestamp)
+	case *amqp.FieldValue_VTable:
+		return tableData(v.VTable)
+	case *amqp.FieldValue_VArray:
+		var values = make([]interface{}, 0, len(v.VArray.Value))
+		for _, item := range v.VArray.Value {
+			values = append(values, fieldData(item))
+		}
+		return values
+	}
+	return nil
+}
+
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) != 0
+	case map[string]interface{}:
+		return len(v) != 0
+	}
+	return true
+}
+
+type filterNode interface {
+	eval(data interface{}) interface{}
+}
+
+type fieldNode struct {
+	path []string
+}
+
+func (node *fieldNode) eval(data interface{}) interface{} {
+	for _, name := range node.path {
+		var object, ok = data.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		data = object[name]
+	}
+	return data
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (node *literalNode) eval(data interface{}) interface{} {
+	return node.value
+}
+
+type compareNode struct {
+	op          string
+	left, right filterNode
+}
+
+// Ordering comparisons are only defined on numbers and are null otherwise
+func (node *compareNode) eval(data interface{}) interface{} {
+	var left, right = node.left.eval(data), node.right.eval(data)
+	switch node.op {
+	case "==":
+		return reflect.DeepEqual(left, right)
+	case "!=":
+		return !reflect.DeepEqual(left, right)
+	}
+	l, lok := left.(float64)
+	r, rok := right.(float64)
+	if !lok || !rok {
+		return nil
+	}
+	switch node.op {
+	case "<":
+		return l < r
+	case "<=":
+		return l <= r
+	case ">":
+		return l > r
+	}
+	return l >= r
+}
+
+type andNode struct {
+	left, right filterNode
+}
+
+func (node *andNode) eval(data interface{}) interface{} {
+	var left = node.left.eval(data)
+	if !truthy(left) {
+		return left
+	}
+	return node.right.eval(data)
+}
+
+type orNode struct {
+	left, right filterNode
+}
+
+func (node *orNode) eval(data interface{}) interface{} {
+	var left = node.left.eval(data)
+	if truthy(left) {
+		return left
+	}
+	return node.right.eval(data)
+}
+
+type notNode struct {
+	expr filterNode
+}
+
+func (node *notNode) eval(data interface{}) interface{} {
+	return !truthy(node.expr.eval(data))
+}
+
+type tokenKind int
+
+const (
+	tokEnd tokenKind = iota
+	tokIdent
+	tokLiteral
+	tokOp
+)
+
+type filterToken struct {
+	kind tokenKind
+	text string
+	// For identifiers the name, for literals the value
+	value interface{}
+}
+
+var filterOps = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "."}
+
+func lexFilter(expr string) ([]filterToken, error) {
+	var tokens = make([]filterToken, 0)
+	var i = 0
+	for i < len(expr) {
+		var c = expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			var start = i
+			for i < len(expr) && isIdentChar(expr[i]) {
+				i++
+			}
+			tokens = append(tokens, filterToken{kind: tokIdent, text: expr[start:i], value: expr[start:i]})
+		case c == '"':
+			// A quoted identifier, for names which aren't plain identifiers
+			var end = closingQuote(expr, i, '"')
+			if end < 0 {
+				return nil, fmt.Errorf("Unterminated quoted identifier in filter")
+			}
+			var name string
+			if err := json.Unmarshal([]byte(expr[i:end+1]), &name); err != nil {
+				return nil, fmt.Errorf("Bad quoted identifier %s in filter", expr[i:end+1])
+			}
+			tokens = append(tokens, filterToken{kind: tokIdent, text: expr[i : end+1], value: name})
+			i = end + 1
+		case c == '\'':
+			var end = closingQuote(expr, i, '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("Unterminated string in filter")
+			}
+			var value = strings.ReplaceAll(expr[i+1:end], "\\'", "'")
+			tokens = append(tokens, filterToken{kind: tokLiteral, text: expr[i : end+1], value: value})
+			i = end + 1
+		case c == '`':
+			var end = closingQuote(expr, i, '`')
+			if end < 0 {
+				return nil, fmt.Errorf("Unterminated literal in filter")
+			}
+			var value interface{}
+			var raw = strings.ReplaceAll(expr[i+1:end], "\\`", "`")
+			if err := json.Unmarshal([]byte(raw), &value); err != nil {
+				return nil, fmt.Errorf("Bad literal %s in filter", expr[i:end+1])
+			}
+			tokens = append(tokens, filterToken{kind: tokLiteral, text: expr[i : end+1], value: value})
+			i = end + 1
+		default:
+			var op = ""
+			for _, candidate := range filterOps {
+				if strings.HasPrefix(expr[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("Unexpected '%c' in filter", c)
+			}
+			tokens = append(tokens, filterToken{kind: tokOp, text: op})
+			i += len(op)
+		}
+	}
+	return append(tokens, filterToken{kind: tokEnd, text: "end of filter"}), nil
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// The index of the quote closing the one at start, skipping escaped ones
+func closingQuote(expr string, start int, quote byte) int {
+	for i := start + 1; i < len(expr); i++ {
+		switch expr[i] {
+		case '\\':
+			i++
+		case quote:
+			return i
+		}
+	}
+	return -1
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (parser *filterParser) peek() filterToken {
+	return parser.tokens[parser.pos]
+}
+
+func (parser *filterParser) next() filterToken {
+	var token = parser.tokens[parser.pos]
+	if token.kind != tokEnd {
+		parser.pos++
+	}
+	return token
+}
+
+func (parser *filterParser) accept(op string) bool {
+	if token := parser.peek(); token.kind == tokOp && token.text == op {
+		parser.pos++
+		return true
+	}
+	return false
+}
+
+func (parser *filterParser) parseOr() (filterNode, error) {
+	var left, err = parser.parseAnd()
+	for err == nil && parser.accept("||") {
+		var right filterNode
+		if right, err = parser.parseAnd(); err == nil {
+			left = &orNode{left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (parser *filterParser) parseAnd() (filterNode, error) {
+	var left, err = parser.parseNot()
+	for err == nil && parser.accept("&&") {
+		var right filterNode
+		if right, err = parser.parseNot(); err == nil {
+			left = &andNode{left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (parser *filterParser) parseNot() (filterNode, error) {
+	if parser.accept("!") {
+		var expr, err = parser.parseNot()
+		return &notNode{expr: expr}, err
+	}
+	return parser.parseComparison()
+}
+
+func (parser *filterParser) parseComparison() (filterNode, error) {
+	var left, err = parser.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if parser.accept(op) {
+			right, err := parser.parsePrimary()
+			if err != nil {
+				return nil, err
+			}
+			return &compareNode{op: op, left: left, right: right}, nil
+		}
+	}
+	return left, nil
+}
+
+func (parser *filterParser) parsePrimary() (filterNode, error) {
+	var token = parser.next()
+	switch {
+	case token.kind == tokOp && token.text == "(":
+		var expr, err = parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !parser.accept(")") {
+			return nil, fmt.Errorf("Expected ')' in filter, got '%s'", parser.peek().text)
+		}
+		return expr, nil
+	case token.kind == tokLiteral:
+		return &literalNode{value: token.value}, nil
+	case token.kind == tokIdent:
+		var path = []string{token.value.(string)}
+		for parser.accept(".") {
+			var name = parser.next()
+			if name.kind != tokIdent {
+				return nil, fmt.Errorf("Expected a field name after '.' in filter, got '%s'", name.text)
+			}
+			path = append(path, name.value.(string))
+		}
+		return &fieldNode{path: path}, nil
+	}
+	return nil, fmt.Errorf("Unexpected '%s' in filter", token.text)
+}
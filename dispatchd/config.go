@@ -1,26 +1,123 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
+
+	"github.com/karelbilek/amqp-test-server/server"
 )
 
 var amqpPort int
 var amqpPortDefault = 5672
 var adminPort int
 var adminPortDefault = 8080
+var websocketPort int
+var websocketPortDefault = 0
+var unixSocket string
+var unixSocketDefault = ""
+var tlsPort int
+var tlsPortDefault = 0
+var tlsCert string
+var tlsCertDefault = ""
+var tlsKey string
+var tlsKeyDefault = ""
+var tlsCA string
+var tlsCADefault = ""
 var persistDir string
 var persistDirDefault = "/data/dispatchd/"
 var configFile string
 var configFileDefault = ""
 var strictMode bool
+var timestampMessages bool
+var maxChannels int
+var maxChannelsDefault = 4096
+var maxFrameSize int
+var maxFrameSizeDefault = 65536
+var maxMessageSize int
+var maxMessageSizeDefault = 0
+var maxInMemoryLength int
+var maxInMemoryLengthDefault = 0
+var rateLimitMessages int
+var rateLimitMessagesDefault = 0
+var rateLimitBytes int
+var rateLimitBytesDefault = 0
+var heartbeat int
+var heartbeatDefault = 10
+var maxConnections int
+var maxConnectionsDefault = 0
+var idleTimeout int
+var idleTimeoutDefault = 600
+var closeTimeout int
+var closeTimeoutDefault = 10
+var probeInterval int
+var probeIntervalDefault = 0
+var probeFailures int
+var probeFailuresDefault = 3
+var writeRetries int
+var writeRetriesDefault = 3
+var writeBackoff int
+var writeBackoffDefault = 10
+var ackTimeout int
+var ackTimeoutDefault = 0
+var ackTimeoutAction string
+var ackTimeoutActionDefault = "close"
+var flushPolicy string
+var flushPolicyDefault = "interval"
+var flushInterval int
+var flushIntervalDefault = 200
+var compression string
+var compressionDefault = "none"
+var compressionThreshold int
+var compressionThresholdDefault = 4096
+var acceptBacklog int
+var acceptBacklogDefault = 0
+var channelWorkers int
+var channelWorkersDefault = 0
+var tcpKeepAlive int
+var tcpKeepAliveDefault = 15
+var proxyProtocol string
+var proxyProtocolDefault = "off"
 
 func init() {
 	flag.IntVar(&amqpPort, "amqp-port", 0, "Port for amqp protocol messages. Default: 5672")
 	flag.IntVar(&adminPort, "admin-port", 0, "Port for admin server. Default: 8080")
+	flag.IntVar(&websocketPort, "websocket-port", 0, "Port for amqp over WebSocket. Default: disabled")
+	flag.StringVar(&unixSocket, "unix-socket", "", "Path of a Unix domain socket for amqp, as well as the TCP port. Default: disabled")
+	flag.IntVar(&tlsPort, "tls-port", 0, "Port for amqp over TLS. Needs tls-cert and tls-key. Default: disabled")
+	flag.StringVar(&tlsCert, "tls-cert", "", "PEM file with the server's TLS certificate chain")
+	flag.StringVar(&tlsKey, "tls-key", "", "PEM file with the key of the server's TLS certificate")
+	flag.StringVar(&tlsCA, "tls-ca", "", "PEM file with the CAs client certificates are verified against, for users logging in with a certificate. Default: client certificates aren't asked for")
 	flag.StringVar(&persistDir, "persist-dir", "", "Directory for the server and message database files. Default: /data/dispatchd/")
+	flag.IntVar(&maxChannels, "max-channels", 0, "Highest channel number a client may open. 0 in the config file means no limit. Default: 4096")
+	flag.IntVar(&maxFrameSize, "max-frame-size", 0, "Largest frame in bytes a client may send. 0 in the config file means no limit. Default: 65536")
+	flag.IntVar(&maxMessageSize, "max-message-size", 0, "Largest message body in bytes a client may publish. Default: no limit")
+	flag.IntVar(&maxInMemoryLength, "max-in-memory-length", 0, "Messages a queue keeps in memory before paging new ones to disk, unless declared with x-max-in-memory-length. Default: no limit")
+	flag.IntVar(&rateLimitMessages, "rate-limit-messages", 0, "Publishes per second each connection may send. Default: no limit")
+	flag.IntVar(&rateLimitBytes, "rate-limit-bytes", 0, "Bytes per second each connection may send. Default: no limit")
+	flag.IntVar(&heartbeat, "heartbeat", 0, "Seconds between heartbeats proposed to clients. 0 in the config file disables them. Default: 10")
+	flag.IntVar(&maxConnections, "max-connections", 0, "Connections which may be open at once. Default: no limit")
+	flag.IntVar(&idleTimeout, "idle-timeout", 0, "Seconds a connection may send nothing before it is closed. 0 in the config file disables it. Default: 600")
+	flag.IntVar(&closeTimeout, "close-timeout", 0, "Seconds a client has to answer the server's connection.close before the socket is closed. Default: 10")
+	flag.IntVar(&probeInterval, "probe-interval", 0, "Seconds a connection may be quiet before it is probed with a heartbeat. Default: disabled")
+	flag.IntVar(&probeFailures, "probe-failures", 0, "Unanswered probes after which a connection is closed. Default: 3")
+	flag.IntVar(&writeRetries, "write-retries", 0, "Times a network write failing with a temporary error is retried before the connection is closed. Negative disables retrying. Default: 3")
+	flag.IntVar(&writeBackoff, "write-backoff", 0, "Milliseconds to wait before the first write retry, doubling for each one after. Default: 10")
+	flag.IntVar(&ackTimeout, "ack-timeout", 0, "Seconds a delivery may stay unacked before ack-timeout-action is taken. Default: disabled")
+	flag.StringVar(&ackTimeoutAction, "ack-timeout-action", "", "What to do with a consumer past the ack timeout, close or requeue. Default: close")
+	flag.StringVar(&flushPolicy, "flush-policy", "", "When durable messages are synced to disk: every-write, interval or never. Default: interval")
+	flag.IntVar(&flushInterval, "flush-interval", 0, "Milliseconds between batched writes of durable messages. Default: 200")
+	flag.StringVar(&compression, "compression", "", "How message bodies are compressed on disk: none or gzip. Default: none")
+	flag.IntVar(&compressionThreshold, "compression-threshold", 0, "Smallest message body in bytes which is compressed. Default: 4096")
+	flag.IntVar(&acceptBacklog, "accept-backlog", 0, "Length of the listener's accept queue. Default: the system default")
+	flag.IntVar(&channelWorkers, "channel-workers", 0, "Goroutines shared by all channels to handle their frames. Default: a goroutine per channel")
+	flag.IntVar(&tcpKeepAlive, "tcp-keepalive", 0, "Seconds between TCP keepalive probes on client sockets. Negative disables them. Default: 15")
+	flag.StringVar(&proxyProtocol, "proxy-protocol", "", "Whether amqp connections start with a PROXY protocol header, on or off. Default: off")
 	flag.BoolVar(&strictMode, "strict-mode", false, "Obey the AMQP spec even where it differs from common implementations")
+	flag.BoolVar(&timestampMessages, "timestamp-messages", false, "Set the timestamp property of published messages which don't have one to the time they were received")
 	flag.StringVar(
 		&configFile,
 		"config-file",
@@ -38,8 +135,39 @@ func configure() map[string]interface{} {
 	}
 	configureIntParam(&amqpPort, amqpPortDefault, "amqp-port", config)
 	configureIntParam(&adminPort, adminPortDefault, "admin-port", config)
+	configureIntParam(&websocketPort, websocketPortDefault, "websocket-port", config)
+	configureStringParam(&unixSocket, unixSocketDefault, "unix-socket", config)
+	configureIntParam(&tlsPort, tlsPortDefault, "tls-port", config)
+	configureStringParam(&tlsCert, tlsCertDefault, "tls-cert", config)
+	configureStringParam(&tlsKey, tlsKeyDefault, "tls-key", config)
+	configureStringParam(&tlsCA, tlsCADefault, "tls-ca", config)
 	configureStringParam(&persistDir, persistDirDefault, "persist-dir", config)
 	configureBoolParam(&strictMode, "strict-mode", config)
+	configureBoolParam(&timestampMessages, "timestamp-messages", config)
+	configureIntParam(&maxChannels, maxChannelsDefault, "max-channels", config)
+	configureIntParam(&maxFrameSize, maxFrameSizeDefault, "max-frame-size", config)
+	configureIntParam(&maxMessageSize, maxMessageSizeDefault, "max-message-size", config)
+	configureIntParam(&maxInMemoryLength, maxInMemoryLengthDefault, "max-in-memory-length", config)
+	configureIntParam(&rateLimitMessages, rateLimitMessagesDefault, "rate-limit-messages", config)
+	configureIntParam(&rateLimitBytes, rateLimitBytesDefault, "rate-limit-bytes", config)
+	configureIntParam(&heartbeat, heartbeatDefault, "heartbeat", config)
+	configureIntParam(&maxConnections, maxConnectionsDefault, "max-connections", config)
+	configureIntParam(&idleTimeout, idleTimeoutDefault, "idle-timeout", config)
+	configureIntParam(&closeTimeout, closeTimeoutDefault, "close-timeout", config)
+	configureIntParam(&probeInterval, probeIntervalDefault, "probe-interval", config)
+	configureIntParam(&probeFailures, probeFailuresDefault, "probe-failures", config)
+	configureIntParam(&writeRetries, writeRetriesDefault, "write-retries", config)
+	configureIntParam(&writeBackoff, writeBackoffDefault, "write-backoff", config)
+	configureIntParam(&ackTimeout, ackTimeoutDefault, "ack-timeout", config)
+	configureStringParam(&ackTimeoutAction, ackTimeoutActionDefault, "ack-timeout-action", config)
+	configureStringParam(&flushPolicy, flushPolicyDefault, "flush-policy", config)
+	configureIntParam(&flushInterval, flushIntervalDefault, "flush-interval", config)
+	configureStringParam(&compression, compressionDefault, "compression", config)
+	configureIntParam(&compressionThreshold, compressionThresholdDefault, "compression-threshold", config)
+	configureIntParam(&acceptBacklog, acceptBacklogDefault, "accept-backlog", config)
+	configureIntParam(&channelWorkers, channelWorkersDefault, "channel-workers", config)
+	configureIntParam(&tcpKeepAlive, tcpKeepAliveDefault, "tcp-keepalive", config)
+	configureStringParam(&proxyProtocol, proxyProtocolDefault, "proxy-protocol", config)
 	_, ok := config["users"]
 	if !ok {
 		config["users"] = make(map[string]interface{})
@@ -62,6 +190,10 @@ func configureIntParam(param *int, defaultValue int, configName string, config m
 }
 
 func configureBoolParam(param *bool, configName string, config map[string]interface{}) {
+	// Set on the command line
+	if *param {
+		return
+	}
 	if len(configName) != 0 {
 		value, ok := config[configName]
 		if ok {
@@ -86,6 +218,32 @@ func configureStringParam(param *string, defaultValue string, configName string,
 	*param = defaultValue
 }
 
+// The "vhost-limits" config entry, an object mapping each virtual host name
+// to its "max-queues", "max-exchanges", "max-connections" and "max-bytes"
+func configureVirtualHostLimits(config map[string]interface{}) map[string]server.VirtualHostLimits {
+	var ret = make(map[string]server.VirtualHostLimits)
+	entry, ok := config["vhost-limits"]
+	if !ok {
+		return ret
+	}
+	for name, value := range entry.(map[string]interface{}) {
+		var limits = value.(map[string]interface{})
+		var number = func(key string) float64 {
+			if n, ok := limits[key]; ok {
+				return n.(float64)
+			}
+			return 0
+		}
+		ret[name] = server.VirtualHostLimits{
+			MaxQueues:      int(number("max-queues")),
+			MaxExchanges:   int(number("max-exchanges")),
+			MaxConnections: int(number("max-connections")),
+			MaxBytes:       uint64(number("max-bytes")),
+		}
+	}
+	return ret
+}
+
 func parseConfigFile(path string) map[string]interface{} {
 	ret := make(map[string]interface{})
 	data, err := ioutil.ReadFile(path)
@@ -98,3 +256,26 @@ func parseConfigFile(path string) map[string]interface{} {
 	}
 	return ret
 }
+
+// The TLS listener's config. With a CA file, clients may present a
+// certificate signed by one of its CAs to log in as the user it is mapped to.
+func loadTLSConfig(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	var config = &tls.Config{Certificates: []tls.Certificate{cert}}
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		var pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No certificates found in %s", caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
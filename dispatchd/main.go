@@ -4,43 +4,124 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"net"
+	"net/http"
 
 	// _ "net/http/pprof" // uncomment for debugging
 	"os"
 	"path/filepath"
 	"runtime"
+	"time"
 
 	"github.com/karelbilek/amqp-test-server/adminserver"
+	"github.com/karelbilek/amqp-test-server/msgstore"
 	"github.com/karelbilek/amqp-test-server/server"
 )
 
-func handleConnection(server *server.Server, conn net.Conn) {
-	server.OpenConnection(conn)
-}
-
 func main() {
 	flag.Parse()
 	config := configure()
 	runtime.SetBlockProfileRate(1)
 	serverDbPath := filepath.Join(persistDir, "dispatchd-server.db")
 	msgDbPath := filepath.Join(persistDir, "messages.db")
+	ackAction, err := server.ParseAckTimeoutAction(ackTimeoutAction)
+	if err != nil {
+		panic(err.Error())
+	}
+	flush, err := msgstore.ParseFlushPolicy(flushPolicy)
+	if err != nil {
+		panic(err.Error())
+	}
+	codec, err := msgstore.ParseCompression(compression)
+	if err != nil {
+		panic(err.Error())
+	}
+	if proxyProtocol != "on" && proxyProtocol != "off" {
+		panic("proxy-protocol must be on or off, got " + proxyProtocol)
+	}
+	var reloadable = server.Config{
+		HeartbeatInterval: time.Duration(heartbeat) * time.Second,
+		RateLimit: server.RateLimit{
+			MessagesPerSecond: uint32(rateLimitMessages),
+			BytesPerSecond:    uint64(rateLimitBytes),
+		},
+		MaxConnections:    maxConnections,
+		VirtualHostLimits: configureVirtualHostLimits(config),
+	}
 	var server = server.NewServer(context.Background(), serverDbPath, msgDbPath, config["users"].(map[string]interface{}), strictMode)
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", amqpPort))
+	server.SetMaxChannels(uint16(maxChannels))
+	server.SetMaxFrameSize(uint32(maxFrameSize))
+	server.SetMaxMessageSize(uint64(maxMessageSize))
+	server.SetTimestampMessages(timestampMessages)
+	server.SetMaxInMemoryLength(int64(maxInMemoryLength))
+	server.SetProxyProtocol(proxyProtocol == "on")
+	server.SetIdleTimeout(time.Duration(idleTimeout) * time.Second)
+	server.SetCloseTimeout(time.Duration(closeTimeout) * time.Second)
+	server.SetProbe(time.Duration(probeInterval)*time.Second, probeFailures)
+	server.SetWriteRetry(writeRetries, time.Duration(writeBackoff)*time.Millisecond)
+	server.SetAckTimeout(time.Duration(ackTimeout)*time.Second, ackAction)
+	server.SetChannelWorkers(channelWorkers)
+	if err := server.SetFlushPolicy(flush, time.Duration(flushInterval)*time.Millisecond); err != nil {
+		panic(err.Error())
+	}
+	server.SetCompression(codec, uint32(compressionThreshold))
+	if vhosts, ok := config["vhosts"]; ok {
+		for _, name := range vhosts.([]interface{}) {
+			// The default virtual host always exists
+			if name.(string) == "/" {
+				continue
+			}
+			if err := server.AddVirtualHost(name.(string)); err != nil {
+				panic(err.Error())
+			}
+		}
+	}
+	// The settings which may change later, once the virtual hosts exist
+	if err := server.Reload(reloadable); err != nil {
+		panic(err.Error())
+	}
+	server.SetAcceptBacklog(acceptBacklog)
+	server.SetKeepAlive(time.Duration(tcpKeepAlive) * time.Second)
+	ln, err := server.Listen(fmt.Sprintf(":%d", amqpPort))
 	if err != nil {
 		fmt.Printf("Error!\n")
 		os.Exit(1)
 	}
 	fmt.Printf("Listening on port %d\n", amqpPort)
-	go func() {
-		adminserver.StartAdminServer(server, adminPort)
-	}()
-	for {
-		conn, err := ln.Accept()
+	if unixSocket != "" {
+		unixLn, err := server.ListenUnix(unixSocket)
+		if err != nil {
+			fmt.Printf("Error listening on %s: %s\n", unixSocket, err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("Listening on %s\n", unixSocket)
+		go server.Serve(unixLn)
+	}
+	if tlsPort != 0 {
+		tlsConfig, err := loadTLSConfig(tlsCert, tlsKey, tlsCA)
 		if err != nil {
-			fmt.Printf("Error accepting connection!\n")
+			fmt.Printf("Error loading TLS configuration: %s\n", err.Error())
 			os.Exit(1)
 		}
-		go handleConnection(server, conn)
+		tlsLn, err := server.ListenTLS(fmt.Sprintf(":%d", tlsPort), tlsConfig)
+		if err != nil {
+			fmt.Printf("Error listening on TLS port %d: %s\n", tlsPort, err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("Listening on TLS port %d\n", tlsPort)
+		go server.Serve(tlsLn)
+	}
+	go func() {
+		adminserver.StartAdminServer(server, adminPort)
+	}()
+	if websocketPort != 0 {
+		go func() {
+			fmt.Printf("WebSocket listener on port %d\n", websocketPort)
+			err := http.ListenAndServe(fmt.Sprintf(":%d", websocketPort), server.WebSocketHandler())
+			fmt.Printf("WebSocket listener stopped: %s\n", err.Error())
+		}()
+	}
+	if err = server.Serve(ln); err != nil {
+		fmt.Printf("Error accepting connection!\n")
+		os.Exit(1)
 	}
 }
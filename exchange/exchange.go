@@ -11,6 +11,8 @@ import (
 	"github.com/karelbilek/amqp-test-server/binding"
 	"github.com/karelbilek/amqp-test-server/gen"
 	"github.com/karelbilek/amqp-test-server/persist"
+	"github.com/karelbilek/amqp-test-server/stats"
+	"github.com/karelbilek/amqp-test-server/util"
 	bolt "go.etcd.io/bbolt"
 )
 
@@ -32,26 +34,72 @@ const (
 type Exchange struct {
 	gen.ExchangeState
 	bindings         []*binding.Binding
+	exchangeBindings []*binding.Binding
+	// Indexes over bindings and exchangeBindings for routing
+	queueIndex       *bindingIndex
+	exchangeIndex    *bindingIndex
 	bindingsLock     sync.Mutex
 	incoming         chan amqp.Frame
 	Closed           bool
 	deleteActive     time.Time
 	deleteChan       chan *Exchange
 	autodeletePeriod time.Duration
+	clock            util.Clock
+	statPublishIn    stats.Meter
+	statPublishOut   stats.Meter
+	statPrefix       string
 }
 
 func (exchange *Exchange) Close() {
 	exchange.Closed = true
 }
 
+// Use the given clock for the autodelete timeout instead of the real one
+func (exchange *Exchange) SetClock(clock util.Clock) {
+	exchange.clock = clock
+}
+
+func (exchange *Exchange) statNames() []string {
+	var prefix = exchange.statPrefix + "Exchange." + exchange.Name + "."
+	return []string{prefix + "PublishIn", prefix + "PublishOut"}
+}
+
+// Register the per-exchange meters. PublishIn counts messages published to
+// the exchange, PublishOut counts the queue copies they were routed to. The
+// prefix keeps exchanges of the same name in different virtual hosts apart.
+func (exchange *Exchange) RegisterStats(prefix string) {
+	exchange.statPrefix = prefix
+	var names = exchange.statNames()
+	exchange.statPublishIn = stats.MakeMeter(names[0])
+	exchange.statPublishOut = stats.MakeMeter(names[1])
+}
+
+func (exchange *Exchange) UnregisterStats() {
+	stats.Unregister(exchange.statNames()...)
+}
+
 func (exchange *Exchange) MarshalJSON() ([]byte, error) {
 	var typ, err = exchangeTypeToName(exchange.ExType)
 	if err != nil {
 		return nil, err
 	}
+	exchange.bindingsLock.Lock()
+	var bindings = copyBindings(exchange.bindings)
+	var exchangeBindingCount = len(exchange.exchangeBindings)
+	exchange.bindingsLock.Unlock()
 	return json.Marshal(map[string]interface{}{
-		"type":     typ,
-		"bindings": exchange.bindings,
+		"type":                 typ,
+		"durable":              exchange.Durable,
+		"internal":             exchange.Internal,
+		"autoDelete":           exchange.AutoDelete,
+		"arguments":            exchange.Arguments,
+		"bindings":             bindings,
+		"bindingCount":         len(bindings),
+		"exchangeBindingCount": exchangeBindingCount,
+		// Messages published to the exchange, and per second over the last
+		// minute
+		"publishInCount": exchange.statPublishIn.Count(),
+		"publishInRate":  stats.WindowRate(exchange.statPublishIn),
 	})
 }
 
@@ -79,7 +127,13 @@ func NewExchange(
 		// not passed in
 		incoming:         make(chan amqp.Frame),
 		bindings:         make([]*binding.Binding, 0),
+		exchangeBindings: make([]*binding.Binding, 0),
+		queueIndex:       newBindingIndex(nil),
+		exchangeIndex:    newBindingIndex(nil),
 		autodeletePeriod: 5 * time.Second,
+		clock:            util.RealClock,
+		statPublishIn:    stats.NilMeter(),
+		statPublishOut:   stats.NilMeter(),
 	}
 }
 
@@ -89,14 +143,20 @@ func NewFromExchangeState(exState *gen.ExchangeState, deleteChan chan *Exchange)
 		deleteChan:       deleteChan,
 		incoming:         make(chan amqp.Frame),
 		bindings:         make([]*binding.Binding, 0),
+		exchangeBindings: make([]*binding.Binding, 0),
+		queueIndex:       newBindingIndex(nil),
+		exchangeIndex:    newBindingIndex(nil),
 		autodeletePeriod: 5 * time.Second,
+		clock:            util.RealClock,
+		statPublishIn:    stats.NilMeter(),
+		statPublishOut:   stats.NilMeter(),
 	}
 }
 
 func NewFromMethod(method *amqp.ExchangeDeclare, system bool, exchangeDeleter chan *Exchange) (*Exchange, *amqp.AMQPError) {
 	var classId, methodId = method.MethodIdentifier()
 	var tp, err = ExchangeNameToType(method.Type)
-	if err != nil || tp == EX_TYPE_HEADERS {
+	if err != nil {
 		return nil, amqp.NewHardError(503, "Bad exchange type", classId, methodId)
 	}
 	var ex = NewExchange(
@@ -133,6 +193,21 @@ func (ex1 *Exchange) EquivalentExchanges(ex2 *Exchange) bool {
 	return true
 }
 
+// Whether declaring the exchange again with method would be a no-op. Like
+// EquivalentExchanges, but without building an exchange from the method
+// first, so that repeated declares stay cheap.
+func (exchange *Exchange) EquivalentDeclare(method *amqp.ExchangeDeclare) bool {
+	var tp, err = ExchangeNameToType(method.Type)
+	if err != nil {
+		return false
+	}
+	return exchange.Name == method.Exchange &&
+		exchange.ExType == tp &&
+		exchange.Durable == method.Durable &&
+		exchange.Internal == method.Internal &&
+		amqp.EquivalentTables(exchange.Arguments, method.Arguments)
+}
+
 func ExchangeNameToType(et string) (uint8, error) {
 	switch {
 	case et == "direct":
@@ -163,6 +238,12 @@ func exchangeTypeToName(et uint8) (string, error) {
 	}
 }
 
+// The type name the exchange was declared with, like "topic"
+func (exchange *Exchange) TypeName() string {
+	var name, _ = exchangeTypeToName(exchange.ExType)
+	return name
+}
+
 func LoadAllExchanges(db *bolt.DB, deleteChan chan *Exchange) (map[string]*Exchange, error) {
 	exStateMap, err := persist.LoadAll(db, EXCHANGES_BUCKET_NAME, &ExchangeStateFactory{})
 	if err != nil {
@@ -176,41 +257,100 @@ func LoadAllExchanges(db *bolt.DB, deleteChan chan *Exchange) (map[string]*Excha
 }
 
 func (exchange *Exchange) QueuesForPublish(msg *amqp.Message) (map[string]bool, *amqp.AMQPError) {
-	var queues = make(map[string]bool)
 	if msg.Method.Exchange != exchange.Name {
-		return queues, nil
+		return make(map[string]bool), nil
 	}
+	var queues, _ = exchange.Route(msg)
+	return queues, nil
+}
+
+// Route a message arriving at this exchange, either published to it directly
+// or forwarded by an exchange-to-exchange binding. Returns the queues and the
+// destination exchanges the message matched.
+func (exchange *Exchange) Route(msg *amqp.Message) (map[string]bool, map[string]bool) {
+	var queues = make(map[string]bool)
+	var exchanges = make(map[string]bool)
+	// Forwarded messages still carry the exchange they were published to, so
+	// match against a copy addressed to this exchange
+	var method = *msg.Method
+	method.Exchange = exchange.Name
+	var headers *amqp.Table
+	if msg.Header != nil && msg.Header.Properties != nil {
+		headers = msg.Header.Properties.Headers
+	}
+	exchange.statPublishIn.Mark(1)
+	defer func() { exchange.statPublishOut.Mark(int64(len(queues))) }()
+	if !exchange.acceptsContentType(msg) {
+		return queues, exchanges
+	}
+
+	exchange.bindingsLock.Lock()
+	defer exchange.bindingsLock.Unlock()
+	for _, binding := range exchange.candidates(exchange.queueIndex, exchange.bindings, &method, headers) {
+		if binding.ExchangeName == method.Exchange {
+			queues[binding.QueueName] = true
+		}
+	}
+	for _, binding := range exchange.candidates(exchange.exchangeIndex, exchange.exchangeBindings, &method, headers) {
+		if binding.ExchangeName == method.Exchange {
+			exchanges[binding.QueueName] = true
+		}
+	}
+	return queues, exchanges
+}
+
+// Topic and headers exchanges declared with x-content-type-filter only route
+// messages with that content-type. Other exchange types ignore the argument.
+func (exchange *Exchange) acceptsContentType(msg *amqp.Message) bool {
+	if exchange.ExType != EX_TYPE_TOPIC && exchange.ExType != EX_TYPE_HEADERS {
+		return true
+	}
+	var filter, ok = exchange.Arguments.GetString("x-content-type-filter")
+	if !ok {
+		return true
+	}
+	if msg.Header == nil || msg.Header.Properties == nil || msg.Header.Properties.ContentType == nil {
+		return false
+	}
+	return *msg.Header.Properties.ContentType == filter
+}
+
+// The bindings whose key matches the routing key, found through the index.
+// Gives the same bindings as filtering with matches, minus the exchange name
+// check. Headers exchanges ignore the routing key, so their bindings are
+// matched against the message headers one by one.
+func (exchange *Exchange) candidates(index *bindingIndex, bindings []*binding.Binding, method *amqp.BasicPublish, headers *amqp.Table) []*binding.Binding {
 	switch {
 	case exchange.ExType == EX_TYPE_DIRECT:
-		// In a direct exchange we can return the first match since there is
-		// only one queue with a particular name
-		for _, binding := range exchange.bindings {
-			if binding.MatchDirect(msg.Method) {
-				queues[binding.QueueName] = true
-				return queues, nil
-			}
-		}
+		return index.matchDirect(method.RoutingKey)
 	case exchange.ExType == EX_TYPE_FANOUT:
-		for _, binding := range exchange.bindings {
-			queues[binding.QueueName] = true
-		}
+		return bindings
 	case exchange.ExType == EX_TYPE_TOPIC:
-		for _, binding := range exchange.bindings {
-			if binding.MatchTopic(msg.Method) {
-				var _, alreadySeen = queues[binding.QueueName]
-				if alreadySeen {
-					continue
-				}
-				queues[binding.QueueName] = true
+		return index.matchTopic(method.RoutingKey)
+	case exchange.ExType == EX_TYPE_HEADERS:
+		var matched = make([]*binding.Binding, 0)
+		for _, b := range bindings {
+			if b.MatchHeaders(headers) {
+				matched = append(matched, b)
 			}
 		}
-	// case exchange.ExType == EX_TYPE_HEADERS:
-	// 	// TODO: implement
-	// 	panic("Headers is not implemented!")
+		return matched
+	default: // pragma: nocover
+		panic("Unknown exchange type created somehow. Server integrity error!")
+	}
+}
+
+func (exchange *Exchange) matches(binding *binding.Binding, method *amqp.BasicPublish) bool {
+	switch {
+	case exchange.ExType == EX_TYPE_DIRECT:
+		return binding.MatchDirect(method)
+	case exchange.ExType == EX_TYPE_FANOUT:
+		return binding.MatchFanout(method)
+	case exchange.ExType == EX_TYPE_TOPIC:
+		return binding.MatchTopic(method)
 	default: // pragma: nocover
 		panic("Unknown exchange type created somehow. Server integrity error!")
 	}
-	return queues, nil
 }
 
 func (exchange *Exchange) Persist(db *bolt.DB) error {
@@ -261,6 +401,11 @@ func (exchange *Exchange) Depersist(db *bolt.DB) error {
 				return err
 			}
 		}
+		for _, binding := range exchange.exchangeBindings {
+			if err := binding.DepersistBoltTx(tx); err != nil { // pragma: nocover
+				return err
+			}
+		}
 		return persist.DepersistOneBoltTx(bucket, exchange.Name)
 	})
 }
@@ -269,6 +414,10 @@ func (exchange *Exchange) IsTopic() bool {
 	return exchange.ExType == EX_TYPE_TOPIC
 }
 
+func (exchange *Exchange) IsHeaders() bool {
+	return exchange.ExType == EX_TYPE_HEADERS
+}
+
 func (exchange *Exchange) AddBinding(b *binding.Binding, connId int64) error {
 	exchange.bindingsLock.Lock()
 	defer exchange.bindingsLock.Unlock()
@@ -278,14 +427,49 @@ func (exchange *Exchange) AddBinding(b *binding.Binding, connId int64) error {
 			return nil
 		}
 	}
+	for _, b2 := range exchange.exchangeBindings {
+		if b.Equals(b2) {
+			return nil
+		}
+	}
 
 	if exchange.AutoDelete {
 		exchange.deleteActive = time.Unix(0, 0)
 	}
-	exchange.bindings = append(exchange.bindings, b)
+	if b.ToExchange {
+		exchange.exchangeBindings = append(exchange.exchangeBindings, b)
+		exchange.exchangeIndex.add(b)
+	} else {
+		exchange.bindings = append(exchange.bindings, b)
+		exchange.queueIndex.add(b)
+	}
 	return nil
 }
 
+// All bindings from this exchange, to queues and to other exchanges. The
+// bindings are copies, so they are safe to use without holding bindingsLock
+func (exchange *Exchange) Bindings() []*binding.Binding {
+	exchange.bindingsLock.Lock()
+	defer exchange.bindingsLock.Unlock()
+	return append(copyBindings(exchange.bindings), copyBindings(exchange.exchangeBindings)...)
+}
+
+// The number of bindings from this exchange, to queues and to other
+// exchanges
+func (exchange *Exchange) BindingCount() int {
+	exchange.bindingsLock.Lock()
+	defer exchange.bindingsLock.Unlock()
+	return len(exchange.bindings) + len(exchange.exchangeBindings)
+}
+
+func copyBindings(bindings []*binding.Binding) []*binding.Binding {
+	var ret = make([]*binding.Binding, 0, len(bindings))
+	for _, b := range bindings {
+		ret = append(ret, b.Copy())
+	}
+	return ret
+}
+
 func (exchange *Exchange) BindingsForQueue(queueName string) []*binding.Binding {
 	var ret = make([]*binding.Binding, 0)
 	exchange.bindingsLock.Lock()
@@ -308,32 +492,73 @@ func (exchange *Exchange) RemoveBindingsForQueue(queueName string) {
 		}
 	}
 	exchange.bindings = remaining
+	exchange.queueIndex = newBindingIndex(remaining)
+}
+
+// Exchange-to-exchange bindings from this exchange to the destination
+func (exchange *Exchange) BindingsForExchange(destination string) []*binding.Binding {
+	var ret = make([]*binding.Binding, 0)
+	exchange.bindingsLock.Lock()
+	defer exchange.bindingsLock.Unlock()
+	for _, b := range exchange.exchangeBindings {
+		if b.QueueName == destination {
+			ret = append(ret, b)
+		}
+	}
+	return ret
+}
+
+func (exchange *Exchange) RemoveBindingsForExchange(destination string) {
+	var remaining = make([]*binding.Binding, 0)
+	exchange.bindingsLock.Lock()
+	defer exchange.bindingsLock.Unlock()
+	for _, b := range exchange.exchangeBindings {
+		if b.QueueName != destination {
+			remaining = append(remaining, b)
+		}
+	}
+	exchange.exchangeBindings = remaining
+	exchange.exchangeIndex = newBindingIndex(remaining)
 }
 
+// Remove a binding from the exchange. Removing a binding which doesn't exist
+// is not an error. An auto-delete exchange left without any bindings, to
+// queues or to other exchanges, is deleted after the autodelete period.
 func (exchange *Exchange) RemoveBinding(binding *binding.Binding) error {
 	exchange.bindingsLock.Lock()
 	defer exchange.bindingsLock.Unlock()
 
-	// Delete binding
-	for i, b := range exchange.bindings {
+	var removed = false
+	if binding.ToExchange {
+		exchange.exchangeBindings, removed = removeBinding(exchange.exchangeBindings, binding)
+		exchange.exchangeIndex.remove(binding)
+	} else {
+		exchange.bindings, removed = removeBinding(exchange.bindings, binding)
+		exchange.queueIndex.remove(binding)
+	}
+	var unused = len(exchange.bindings) == 0 && len(exchange.exchangeBindings) == 0
+	if removed && exchange.AutoDelete && unused {
+		go exchange.autodeleteTimeout()
+	}
+	return nil
+}
+
+func removeBinding(bindings []*binding.Binding, binding *binding.Binding) ([]*binding.Binding, bool) {
+	for i, b := range bindings {
 		if binding.Equals(b) {
-			exchange.bindings = append(exchange.bindings[:i], exchange.bindings[i+1:]...)
-			if exchange.AutoDelete && len(exchange.bindings) == 0 {
-				go exchange.autodeleteTimeout()
-			}
-			return nil
+			return append(bindings[:i], bindings[i+1:]...), true
 		}
 	}
-	return nil
+	return bindings, false
 }
 
 func (exchange *Exchange) autodeleteTimeout() {
 	// There's technically a race condition here where a new binding could be
 	// added right as we check this, but after a 5 second wait with no activity
 	// I think this is probably safe enough.
-	var now = time.Now()
+	var now = exchange.clock.Now()
 	exchange.deleteActive = now
-	time.Sleep(exchange.autodeletePeriod)
+	exchange.clock.Sleep(exchange.autodeletePeriod)
 	if exchange.deleteActive == now {
 		exchange.deleteChan <- exchange
 	}
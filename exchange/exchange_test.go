@@ -3,8 +3,10 @@ package exchange
 import (
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -38,22 +40,49 @@ func TestClose(t *testing.T) {
 }
 
 func TestJSON(t *testing.T) {
-	var ex = exchangeForTest("ex", EX_TYPE_TOPIC)
-	var expected, err = json.Marshal(map[string]interface{}{
-		"type":     "topic",
-		"bindings": make([]int, 0),
-	})
-	if err != nil {
-		t.Errorf(err.Error())
+	var ex = NewExchange("ex", EX_TYPE_TOPIC, true, false, true, amqp.NewTable(), false, make(chan *Exchange))
+	ex.RegisterStats("TestJSON.")
+	defer ex.UnregisterStats()
+	ex.AddBinding(bindingHelper("q1", "ex", "a.*", true), -1)
+	ex.AddBinding(bindingHelper("q2", "ex", "#", true), -1)
+	var msg = amqp.RandomMessage(false)
+	msg.Method.Exchange = "ex"
+	for i := 0; i < 3; i++ {
+		ex.QueuesForPublish(msg)
 	}
-	got, err := json.Marshal(ex)
+
+	var got map[string]interface{}
+	b, err := json.Marshal(ex)
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Fatalf(err.Error())
+	}
+	if err = json.Unmarshal(b, &got); err != nil {
+		t.Fatalf(err.Error())
+	}
+	var expected = map[string]interface{}{
+		"type":                 "topic",
+		"durable":              true,
+		"internal":             true,
+		"autoDelete":           false,
+		"bindingCount":         float64(2),
+		"exchangeBindingCount": float64(0),
+		"publishInCount":       float64(3),
+	}
+	for key, value := range expected {
+		if got[key] != value {
+			t.Errorf("Expected %s to be %v, got %v", key, value, got[key])
+		}
 	}
-
-	if !reflect.DeepEqual(expected, got) {
-		t.Errorf("unequal!\nexpected:%v\ngot     :%v", expected, got)
+	if bindings, ok := got["bindings"].([]interface{}); !ok || len(bindings) != 2 {
+		t.Errorf("Wrong bindings: %v", got["bindings"])
 	}
+	if _, ok := got["publishInRate"].(float64); !ok {
+		t.Errorf("No publish rate: %v", got["publishInRate"])
+	}
+	if _, ok := got["arguments"]; !ok {
+		t.Errorf("No arguments")
+	}
+
 	ex.ExType = 123
 	_, err = json.Marshal(ex)
 	if err == nil {
@@ -191,7 +220,7 @@ func TestExchangeRoutingDirect(t *testing.T) {
 		t.Errorf(err.Msg)
 	}
 	if len(res) > 0 {
-		t.Errorf("Routed message which should not have routed", res)
+		t.Errorf("Routed message which should not have routed: %v", res)
 	}
 
 	// Test right exchange, wrong key
@@ -202,7 +231,7 @@ func TestExchangeRoutingDirect(t *testing.T) {
 		t.Errorf(err.Msg)
 	}
 	if len(res) > 0 {
-		t.Errorf("Routed message which should not have routed", res)
+		t.Errorf("Routed message which should not have routed: %v", res)
 	}
 
 	// Set the right values for routing
@@ -213,7 +242,17 @@ func TestExchangeRoutingDirect(t *testing.T) {
 		t.Errorf(err.Msg)
 	}
 	if _, found := res["q1"]; !found {
-		t.Errorf("Failed to route direct message: %s", res)
+		t.Errorf("Failed to route direct message: %v", res)
+	}
+
+	// Every queue bound with the key gets a copy
+	exDirect.AddBinding(bindingHelper("q2", "exd", "rk-1", false), -1)
+	res, err = exDirect.QueuesForPublish(msg)
+	if err != nil {
+		t.Errorf(err.Msg)
+	}
+	if len(res) != 2 {
+		t.Errorf("Failed to route direct message to every bound queue: %v", res)
 	}
 }
 
@@ -272,7 +311,7 @@ func TestExchangeRoutingTopic(t *testing.T) {
 		t.Errorf(err.Msg)
 	}
 	if len(res) > 0 {
-		t.Errorf("Routed message which should not have routed", res)
+		t.Errorf("Routed message which should not have routed: %v", res)
 	}
 
 	// one match on #
@@ -300,6 +339,106 @@ func TestExchangeRoutingTopic(t *testing.T) {
 
 }
 
+// Route by checking every binding, the way routing worked before the index
+func linearRoute(exchange *Exchange, routingKey string) map[string]bool {
+	var method = amqp.BasicPublish{Exchange: exchange.Name, RoutingKey: routingKey}
+	var queues = make(map[string]bool)
+	for _, b := range exchange.bindings {
+		if exchange.matches(b, &method) {
+			queues[b.QueueName] = true
+		}
+	}
+	return queues
+}
+
+func randomKey(r *rand.Rand, words []string) string {
+	var parts = make([]string, 1+r.Intn(4))
+	for i := range parts {
+		parts[i] = words[r.Intn(len(words))]
+	}
+	return strings.Join(parts, ".")
+}
+
+func TestIndexMatchesLinearRouting(t *testing.T) {
+	var r = rand.New(rand.NewSource(1234))
+	var patternWords = []string{"a", "b", "c", "*", "#"}
+	var keyWords = []string{"a", "b", "c", "d", "", "*", "#"}
+	for _, typ := range []uint8{EX_TYPE_DIRECT, EX_TYPE_FANOUT, EX_TYPE_TOPIC} {
+		var ex = exchangeForTest("ex", typ)
+		var topic = typ == EX_TYPE_TOPIC
+		var added = make([]*binding.Binding, 0)
+		for i := 0; i < 300; i++ {
+			var key = randomKey(r, patternWords)
+			if !topic {
+				key = randomKey(r, keyWords)
+			}
+			if i%50 == 0 {
+				key = ""
+			}
+			var b = bindingHelper(fmt.Sprintf("q%d", r.Intn(100)), "ex", key, topic)
+			ex.AddBinding(b, -1)
+			added = append(added, b)
+		}
+		// Exercise both ways of removing bindings
+		for _, b := range added[:30] {
+			ex.RemoveBinding(b)
+		}
+		ex.RemoveBindingsForQueue("q1")
+
+		for i := 0; i < 2000; i++ {
+			var key = randomKey(r, keyWords)
+			if i%100 == 0 {
+				key = ""
+			}
+			var msg = amqp.RandomMessage(false)
+			msg.Method.Exchange = "ex"
+			msg.Method.RoutingKey = key
+			var indexed, _ = ex.Route(msg)
+			var linear = linearRoute(ex, key)
+			if !reflect.DeepEqual(indexed, linear) {
+				t.Fatalf("Type %d, key '%s': index routed to %v, linear to %v", typ, key, indexed, linear)
+			}
+		}
+	}
+}
+
+func BenchmarkRoute(b *testing.B) {
+	var r = rand.New(rand.NewSource(1234))
+	var words = []string{"alpha", "beta", "gamma", "delta", "epsilon", "zeta", "eta", "theta"}
+	var setup = func(typ uint8) (*Exchange, []string) {
+		var ex = exchangeForTest("ex", typ)
+		for i := 0; i < 10000; i++ {
+			var key = fmt.Sprintf("%s.%d", randomKey(r, words), i)
+			if typ == EX_TYPE_TOPIC && i%10 == 0 {
+				key = randomKey(r, words) + ".*"
+			}
+			ex.AddBinding(bindingHelper(fmt.Sprintf("q%d", i), "ex", key, typ == EX_TYPE_TOPIC), -1)
+		}
+		var keys = make([]string, 1000)
+		for i := range keys {
+			keys[i] = fmt.Sprintf("%s.%d", randomKey(r, words), r.Intn(10000))
+		}
+		return ex, keys
+	}
+	for _, typ := range []uint8{EX_TYPE_DIRECT, EX_TYPE_TOPIC} {
+		var ex, keys = setup(typ)
+		var name, _ = exchangeTypeToName(typ)
+		var msg = amqp.RandomMessage(false)
+		msg.Method.Exchange = "ex"
+		b.Run(name+"-indexed", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				msg.Method.RoutingKey = keys[i%len(keys)]
+				ex.Route(msg)
+			}
+		})
+		b.Run(name+"-linear", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				linearRoute(ex, keys[i%len(keys)])
+			}
+		})
+	}
+}
+
 func TestPersistence(t *testing.T) {
 	// Create DB
 	var dbFile = "TestExchangePersistence.db"
@@ -481,6 +620,29 @@ func TestAutoDeleteTimeout(t *testing.T) {
 	}
 }
 
+func TestAutoDeleteAfterExchangeUnbind(t *testing.T) {
+	var deleter = make(chan *Exchange)
+	var ex = NewExchange("ex1", EX_TYPE_DIRECT, false, true, false, amqp.NewTable(), false, deleter)
+	ex.autodeletePeriod = 10 * time.Millisecond
+	var b, _ = binding.NewExchangeBinding("ex2", "ex1", "rk", amqp.NewTable(), false)
+	ex.AddBinding(b, -1)
+
+	// Removing a binding that was never added doesn't start the timeout
+	var other, _ = binding.NewExchangeBinding("ex3", "ex1", "rk", amqp.NewTable(), false)
+	ex.RemoveBinding(other)
+	select {
+	case <-deleter:
+		t.Fatalf("Exchange deleted while it still had a binding")
+	case <-time.After(30 * time.Millisecond):
+	}
+
+	ex.RemoveBinding(b)
+	var toDelete = <-deleter
+	if ex.Name != toDelete.Name {
+		t.Errorf("Integrity error in delete")
+	}
+}
+
 func TestNoExchangesBucket(t *testing.T) {
 	var dbFile = "TestNoExchangeBucket.db"
 	os.Remove(dbFile)
@@ -534,7 +696,7 @@ func TestNewFromMethod(t *testing.T) {
 		t.Errorf("Inconsistency between NewExchange and NewFromMethod")
 	}
 	// Bad exchange type
-	method.Type = "headers"
+	method.Type = "nonsense"
 	exMethod, err = NewFromMethod(method, true, make(chan *Exchange))
 	if err == nil {
 		t.Errorf("Parsed bad exchange method")
@@ -0,0 +1,114 @@
+package exchange
+
+import (
+	"strings"
+
+	"github.com/karelbilek/amqp-test-server/binding"
+)
+
+// bindingIndex finds the bindings matching a routing key without looking at
+// every binding. Direct bindings are looked up by key and topic bindings in a
+// trie of their patterns split on '.'. Fanout exchanges match every binding,
+// so they need no index.
+type bindingIndex struct {
+	direct map[string][]*binding.Binding
+	topic  *topicNode
+}
+
+type topicNode struct {
+	// Children keyed by the next word of the pattern, including "*" and "#"
+	children map[string]*topicNode
+	// Bindings whose pattern ends at this node
+	bindings []*binding.Binding
+}
+
+func newBindingIndex(bindings []*binding.Binding) *bindingIndex {
+	var index = &bindingIndex{
+		direct: make(map[string][]*binding.Binding),
+		topic:  newTopicNode(),
+	}
+	for _, b := range bindings {
+		index.add(b)
+	}
+	return index
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{children: make(map[string]*topicNode)}
+}
+
+func (index *bindingIndex) add(b *binding.Binding) {
+	index.direct[b.Key] = append(index.direct[b.Key], b)
+	if !b.Topic {
+		return
+	}
+	var node = index.topic
+	for _, word := range strings.Split(b.Key, ".") {
+		var child, found = node.children[word]
+		if !found {
+			child = newTopicNode()
+			node.children[word] = child
+		}
+		node = child
+	}
+	node.bindings = append(node.bindings, b)
+}
+
+func (index *bindingIndex) remove(b *binding.Binding) {
+	index.direct[b.Key], _ = removeBinding(index.direct[b.Key], b)
+	if len(index.direct[b.Key]) == 0 {
+		delete(index.direct, b.Key)
+	}
+	if !b.Topic {
+		return
+	}
+	// Empty nodes are left in place, they are cheap to walk past
+	var node = index.topic
+	for _, word := range strings.Split(b.Key, ".") {
+		var child, found = node.children[word]
+		if !found {
+			return
+		}
+		node = child
+	}
+	node.bindings, _ = removeBinding(node.bindings, b)
+}
+
+func (index *bindingIndex) matchDirect(routingKey string) []*binding.Binding {
+	return index.direct[routingKey]
+}
+
+// The same matches as the binding's topic regex: a literal word matches
+// itself, '*' one non-empty word and '#' one or more words of any content.
+// Unlike the spec's '#', that means "a.#" doesn't match "a".
+func (index *bindingIndex) matchTopic(routingKey string) []*binding.Binding {
+	var matches = make([]*binding.Binding, 0)
+	index.topic.match(strings.Split(routingKey, "."), &matches)
+	return matches
+}
+
+func (node *topicNode) match(words []string, matches *[]*binding.Binding) {
+	if len(words) == 0 {
+		*matches = append(*matches, node.bindings...)
+		return
+	}
+	// A "*" or "#" word in the routing key is only matched by wildcards,
+	// like any other word
+	if words[0] != "*" && words[0] != "#" {
+		if child, found := node.children[words[0]]; found {
+			child.match(words[1:], matches)
+		}
+	}
+	if child, found := node.children["*"]; found && len(words[0]) > 0 {
+		child.match(words[1:], matches)
+	}
+	if child, found := node.children["#"]; found {
+		for i := 1; i <= len(words); i++ {
+			// '#' is '.*' in the regex, which doesn't match newlines
+			if strings.Contains(words[i-1], "\n") {
+				break
+			}
+			child.match(words[i:], matches)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package exchange
+
+import (
+	"testing"
+
+	"github.com/karelbilek/amqp-test-server/amqp"
+	"github.com/karelbilek/amqp-test-server/binding"
+)
+
+func TestTopicIndexEdgeCases(t *testing.T) {
+	var cases = []struct {
+		pattern string
+		key     string
+		matches bool
+	}{
+		{"#", "", true},
+		{"#", "a.b.c", true},
+		{"", "", true},
+		{"", "a", false},
+		{"a.#", "a", false},
+		{"a.#", "a.", true},
+		{"a.#.c", "a..c", true},
+		{"a.#.c", "a.c", false},
+		{"#.#", "a", false},
+		{"#.#", "a.b", true},
+		{"*", "", false},
+		{"*", "*", true},
+		{"a.*", "a.#", true},
+		{"a.b", "a.#", false},
+	}
+	for _, c := range cases {
+		var index = newBindingIndex([]*binding.Binding{bindingHelper("q1", "ex", c.pattern, true)})
+		var found = len(index.matchTopic(c.key)) > 0
+		if found != c.matches {
+			t.Errorf("Pattern '%s', key '%s': matched %v", c.pattern, c.key, found)
+		}
+	}
+}
+
+// The trie has to agree with the binding's own regex for every pattern the
+// binding accepts
+func FuzzTopicIndex(f *testing.F) {
+	f.Add("api.*.json", "api.msg.json")
+	f.Add("log.#", "log.msg.home")
+	f.Add("#.b.*", "a.b.c")
+	f.Add("*.*", "a..b")
+	f.Add("#", "")
+	f.Add("#", "\n")
+	f.Fuzz(func(t *testing.T, pattern string, key string) {
+		b, err := binding.NewBinding("q1", "ex", pattern, amqp.NewTable(), true)
+		if err != nil {
+			return
+		}
+		var index = newBindingIndex([]*binding.Binding{b})
+		var method = &amqp.BasicPublish{Exchange: "ex", RoutingKey: key}
+		var found = len(index.matchTopic(key)) > 0
+		if found != b.MatchTopic(method) {
+			t.Errorf("Pattern '%s', key '%s': trie matched %v, regex %v", pattern, key, found, !found)
+		}
+	})
+}
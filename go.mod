@@ -6,6 +6,7 @@ toolchain go1.24.1
 
 require (
 	github.com/gogo/protobuf v1.2.1
+	github.com/gorilla/websocket v1.5.3
 	github.com/rcrowley/go-metrics v0.0.0-20190706150252-9beb055b7962
 	github.com/streadway/amqp v0.0.0-20190404075320-75d898a42a94
 	go.etcd.io/bbolt v1.4.0
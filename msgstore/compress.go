@@ -0,0 +1,108 @@
+package msgstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/karelbilek/amqp-test-server/amqp"
+)
+
+// How message bodies written to disk are compressed. Messages are always
+// kept uncompressed in memory, and what is on disk can be read whatever the
+// current setting is.
+type Compression uint8
+
+const (
+	// Write messages as they are. This is the default
+	COMPRESS_NONE Compression = iota
+	COMPRESS_GZIP
+)
+
+// Bodies smaller than this aren't worth compressing
+const DefaultCompressionThreshold uint32 = 4096
+
+// Compressed records start with this byte and then the codec. No encoded
+// message starts with it, since protobuf has no field 0.
+const compressedMarker byte = 0
+
+func ParseCompression(name string) (Compression, error) {
+	switch name {
+	case "none":
+		return COMPRESS_NONE, nil
+	case "gzip":
+		return COMPRESS_GZIP, nil
+	}
+	return 0, fmt.Errorf("Unknown compression '%s'", name)
+}
+
+// Set how messages whose body is at least threshold bytes are compressed
+// when they are written to disk afterwards. 0 keeps the current threshold.
+func (ms *MessageStore) SetCompression(codec Compression, threshold uint32) {
+	ms.persistLock.Lock()
+	defer ms.persistLock.Unlock()
+	ms.compression = codec
+	if threshold > 0 {
+		ms.compressionThreshold = threshold
+	}
+}
+
+func (ms *MessageStore) currentCompression() (Compression, uint32) {
+	ms.persistLock.Lock()
+	defer ms.persistLock.Unlock()
+	return ms.compression, ms.compressionThreshold
+}
+
+// Encode a message for the content or paged buckets. It is left
+// uncompressed if compressing doesn't make it smaller.
+func (ms *MessageStore) encodeMessage(msg *amqp.Message) ([]byte, error) {
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	var codec, threshold = ms.currentCompression()
+	if codec == COMPRESS_NONE || messageSize(msg) < threshold {
+		return b, nil
+	}
+	var buf = bytes.NewBuffer([]byte{compressedMarker, byte(codec)})
+	var writer = gzip.NewWriter(buf)
+	if _, err = writer.Write(b); err != nil {
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	if buf.Len() >= len(b) {
+		return b, nil
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeMessage(data []byte, msg *amqp.Message) error {
+	if len(data) == 0 || data[0] != compressedMarker {
+		return proto.Unmarshal(data, msg)
+	}
+	if len(data) < 2 || Compression(data[1]) != COMPRESS_GZIP {
+		return fmt.Errorf("Unknown message compression")
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data[2:]))
+	if err != nil {
+		return err
+	}
+	b, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(b, msg)
+}
+
+// Decodes records of the content bucket, compressed or not
+type storedMessage struct {
+	amqp.Message
+}
+
+func (sm *storedMessage) Unmarshal(data []byte) error {
+	return decodeMessage(data, &sm.Message)
+}
@@ -0,0 +1,75 @@
+package msgstore
+
+import (
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// When changes to durable messages are written out and synced to disk
+type FlushPolicy uint8
+
+const (
+	// Write and fsync in batches every flush interval. This is the default
+	FLUSH_INTERVAL FlushPolicy = iota
+	// Write and fsync before the add, delivery or removal returns
+	FLUSH_EVERY_WRITE
+	// Write in batches every flush interval but leave syncing to the OS
+	FLUSH_NEVER
+)
+
+const DefaultFlushInterval = 200 * time.Millisecond
+
+func ParseFlushPolicy(name string) (FlushPolicy, error) {
+	switch name {
+	case "every-write":
+		return FLUSH_EVERY_WRITE, nil
+	case "interval":
+		return FLUSH_INTERVAL, nil
+	case "never":
+		return FLUSH_NEVER, nil
+	}
+	return 0, fmt.Errorf("Unknown flush policy '%s'", name)
+}
+
+// Set when durable changes are written to disk. interval is how often the
+// batches are written under FLUSH_INTERVAL and FLUSH_NEVER; 0 keeps the
+// current interval. In-memory stores ignore the policy.
+func (ms *MessageStore) SetFlushPolicy(policy FlushPolicy, interval time.Duration) error {
+	ms.persistLock.Lock()
+	ms.flushPolicy = policy
+	if interval > 0 {
+		ms.flushInterval = interval
+	}
+	ms.persistLock.Unlock()
+	if ms.InMemory() {
+		return nil
+	}
+	// bolt reads NoSync when committing, so only change it while holding
+	// the write transaction
+	return ms.db.Update(func(tx *bolt.Tx) error {
+		ms.db.NoSync = policy == FLUSH_NEVER
+		return nil
+	})
+}
+
+func (ms *MessageStore) FlushPolicy() FlushPolicy {
+	ms.persistLock.Lock()
+	defer ms.persistLock.Unlock()
+	return ms.flushPolicy
+}
+
+func (ms *MessageStore) currentFlushInterval() time.Duration {
+	ms.persistLock.Lock()
+	defer ms.persistLock.Unlock()
+	return ms.flushInterval
+}
+
+// Called after queueing durable persist ops. Under FLUSH_EVERY_WRITE they
+// are on disk by the time this returns.
+func (ms *MessageStore) flushWrite() {
+	if ms.FlushPolicy() == FLUSH_EVERY_WRITE {
+		ms.persistOnce()
+	}
+}
@@ -0,0 +1,52 @@
+package msgstore
+
+// Counts of the messages a store holds. A dead message is a durable one no
+// queue references any more, which stays in memory and on disk until the
+// pending deletes are written out by the next flush or a Compact.
+type StoreStats struct {
+	LiveEntries int
+	DeadEntries int
+	// Body sizes. LiveBytes leaves out bodies paged out for lazy queues
+	LiveBytes uint64
+	DeadBytes uint64
+}
+
+func (ms *MessageStore) Stats() StoreStats {
+	// Without a flush in progress the pending deletes and the refs in the
+	// index agree with each other
+	ms.flushLock.Lock()
+	defer ms.flushLock.Unlock()
+	// Removed references per message, and the body size of each
+	ms.persistLock.Lock()
+	var removed = make(map[int64]int32)
+	var sizes = make(map[int64]uint32)
+	for pk, qm := range ms.delOps {
+		removed[pk.id] += 1
+		sizes[pk.id] = qm.MsgSize
+	}
+	ms.persistLock.Unlock()
+
+	var ret = StoreStats{}
+	ms.msgLock.RLock()
+	ms.indexLock.RLock()
+	defer ms.indexLock.RUnlock()
+	defer ms.msgLock.RUnlock()
+	for id, im := range ms.index {
+		if removed[id] >= im.Refs {
+			ret.DeadEntries += 1
+			ret.DeadBytes += uint64(sizes[id])
+			continue
+		}
+		ret.LiveEntries += 1
+		if msg, found := ms.messages[id]; found {
+			ret.LiveBytes += uint64(messageSize(msg))
+		}
+	}
+	return ret
+}
+
+// Reclaim dead messages now instead of waiting for the next flush. In-memory
+// stores never have any.
+func (ms *MessageStore) Compact() {
+	ms.persistOnce()
+}
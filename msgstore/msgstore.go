@@ -5,8 +5,11 @@ import (
 	"container/list"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gogo/protobuf/proto"
@@ -19,6 +22,15 @@ import (
 var MESSAGE_INDEX_BUCKET = []byte("message_index")
 var MESSAGE_CONTENT_BUCKET = []byte("message_content")
 
+// Bodies of messages which only lazy queues hold. Unlike the content bucket
+// this is scratch space: it is emptied when the store is loaded.
+var PAGED_CONTENT_BUCKET = []byte("paged_message_content")
+
+// Holds the latest sequence number given to a queue message, so numbers
+// given after a restart follow on from those already on disk
+var MESSAGE_SEQUENCE_BUCKET = []byte("message_sequence")
+var sequenceKey = []byte("sequence")
+
 type IndexMessageFactory struct{}
 
 func (imf *IndexMessageFactory) New() proto.Unmarshaler {
@@ -28,7 +40,7 @@ func (imf *IndexMessageFactory) New() proto.Unmarshaler {
 type MessageContentFactory struct{}
 
 func (mcf *MessageContentFactory) New() proto.Unmarshaler {
-	return &amqp.Message{}
+	return &storedMessage{}
 }
 
 type QueueMessageFactory struct{}
@@ -49,18 +61,44 @@ type PersistKey struct {
 }
 
 type MessageStore struct {
-	ctx           context.Context
-	index         map[int64]*amqp.IndexMessage
-	messages      map[int64]*amqp.Message
-	addOps        map[PersistKey]*amqp.QueueMessage
-	delOps        map[PersistKey]*amqp.QueueMessage
-	deliveredOps  map[PersistKey]*amqp.QueueMessage
-	persistLock   sync.Mutex
-	db            *bolt.DB
+	ctx          context.Context
+	cancel       context.CancelFunc
+	persistDone  chan bool
+	index        map[int64]*amqp.IndexMessage
+	messages     map[int64]*amqp.Message
+	addOps       map[PersistKey]*amqp.QueueMessage
+	delOps       map[PersistKey]*amqp.QueueMessage
+	deliveredOps map[PersistKey]*amqp.QueueMessage
+	persistLock  sync.Mutex
+	// Held for a whole persistOnce, so a flush can wait on one in progress
+	flushLock     sync.Mutex
+	flushPolicy   FlushPolicy
+	flushInterval time.Duration
+	db            *bolt.DB // nil for stores which only keep messages in memory
 	msgLock       sync.RWMutex
 	indexLock     sync.RWMutex
+	// Messages whose body lives in PAGED_CONTENT_BUCKET instead of messages
+	paged         map[int64]bool
+	lazyQueues    map[string]bool
+	spilling      map[string]bool // Queues over their in-memory length
+	lazyLock      sync.RWMutex
 	statAdd       stats.Histogram
 	statRemoveRef stats.Histogram
+	// The error from the latest write to disk, nil if it succeeded
+	writeErr     error
+	writeErrLock sync.Mutex
+	// Flushes started and finished, the one after the latest that failed
+	// and its error, see WaitFlushed. Guarded by persistLock.
+	flushStarted uint64
+	flushDone    uint64
+	flushFailed  uint64
+	flushErr     error
+	flushed      *sync.Cond
+	// How bodies are compressed on disk, see compress.go
+	compression          Compression
+	compressionThreshold uint32
+	// The latest sequence number given to a queue message, used atomically
+	sequence int64
 }
 
 func NewMessageStore(ctx context.Context, fileName string) (*MessageStore, error) {
@@ -68,26 +106,87 @@ func NewMessageStore(ctx context.Context, fileName string) (*MessageStore, error
 	if err != nil {
 		return nil, err
 	}
+	return newMessageStore(ctx, db), nil
+}
+
+// Create a message store which never touches disk. Durable messages are
+// kept in memory like transient ones, so nothing survives a restart, and
+// lazy queues keep their bodies in memory as well.
+func NewMemoryMessageStore(ctx context.Context) *MessageStore {
+	return newMessageStore(ctx, nil)
+}
+
+func newMessageStore(ctx context.Context, db *bolt.DB) *MessageStore {
+	ctx, cancel := context.WithCancel(ctx)
 	ms := &MessageStore{
-		index:        make(map[int64]*amqp.IndexMessage),
-		messages:     make(map[int64]*amqp.Message),
-		db:           db,
-		addOps:       make(map[PersistKey]*amqp.QueueMessage),
-		delOps:       make(map[PersistKey]*amqp.QueueMessage),
-		deliveredOps: make(map[PersistKey]*amqp.QueueMessage),
-		ctx:          ctx,
-	}
+		index:         make(map[int64]*amqp.IndexMessage),
+		messages:      make(map[int64]*amqp.Message),
+		db:            db,
+		addOps:        make(map[PersistKey]*amqp.QueueMessage),
+		delOps:        make(map[PersistKey]*amqp.QueueMessage),
+		deliveredOps:  make(map[PersistKey]*amqp.QueueMessage),
+		paged:         make(map[int64]bool),
+		lazyQueues:    make(map[string]bool),
+		spilling:      make(map[string]bool),
+		ctx:           ctx,
+		cancel:        cancel,
+		flushPolicy:   FLUSH_INTERVAL,
+		flushInterval: DefaultFlushInterval,
+		// Compression is off until SetCompression
+		compressionThreshold: DefaultCompressionThreshold,
+	}
+	ms.flushed = sync.NewCond(&ms.persistLock)
 	// Stats
 	ms.statAdd = stats.MakeHistogram("add-message")
 	ms.statRemoveRef = stats.MakeHistogram("remove-ref")
 
-	return ms, nil
+	return ms
 }
 
 func (ms *MessageStore) Start() {
+	if ms.InMemory() {
+		return
+	}
+	ms.persistDone = make(chan bool)
 	go ms.periodicPersist()
 }
 
+// Why the store can't take messages, or nil if it can: it was closed, or
+// its latest write to disk failed
+func (ms *MessageStore) Health() error {
+	if ms.ctx.Err() != nil {
+		return errors.New("Message store is closed")
+	}
+	ms.writeErrLock.Lock()
+	defer ms.writeErrLock.Unlock()
+	return ms.writeErr
+}
+
+func (ms *MessageStore) recordWrite(err error) {
+	ms.writeErrLock.Lock()
+	defer ms.writeErrLock.Unlock()
+	ms.writeErr = err
+}
+
+// Whether this store keeps everything in memory and never touches disk
+func (ms *MessageStore) InMemory() bool {
+	return ms.db == nil
+}
+
+// Close stops the periodic persist, flushes any pending operations to disk
+// and closes the database file.
+func (ms *MessageStore) Close() error {
+	ms.cancel()
+	if ms.InMemory() {
+		return nil
+	}
+	if ms.persistDone != nil {
+		<-ms.persistDone
+	}
+	ms.persistOnce()
+	return ms.db.Close()
+}
+
 func (ms *MessageStore) MessageCount() int {
 	return len(ms.messages)
 }
@@ -96,6 +195,38 @@ func (ms *MessageStore) IndexCount() int {
 	return len(ms.index)
 }
 
+// The number of messages whose body is kept on disk rather than in memory
+func (ms *MessageStore) PagedCount() int {
+	ms.msgLock.RLock()
+	defer ms.msgLock.RUnlock()
+	return len(ms.paged)
+}
+
+// Mark a queue as lazy. Bodies of messages added only to lazy queues are
+// written to disk straight away and read back when they are delivered.
+func (ms *MessageStore) SetQueueLazy(queueName string, lazy bool) {
+	ms.lazyLock.Lock()
+	defer ms.lazyLock.Unlock()
+	if lazy {
+		ms.lazyQueues[queueName] = true
+	} else {
+		delete(ms.lazyQueues, queueName)
+	}
+}
+
+// Mark a queue as holding more messages than it keeps in memory. Like lazy
+// queues, bodies of messages added only to spilling queues are written to
+// disk straight away, but messages already in memory stay there.
+func (ms *MessageStore) SetQueueSpilling(queueName string, spilling bool) {
+	ms.lazyLock.Lock()
+	defer ms.lazyLock.Unlock()
+	if spilling {
+		ms.spilling[queueName] = true
+	} else {
+		delete(ms.spilling, queueName)
+	}
+}
+
 func messageSize(message *amqp.Message) uint32 {
 	// TODO: include header size
 	var size uint32 = 0
@@ -114,8 +245,8 @@ func isDurable(msg *amqp.Message) bool {
 }
 
 func (ms *MessageStore) periodicPersist() {
-	var defaultSleepTime = time.Duration(200 * time.Millisecond)
-	var sleepTime = defaultSleepTime
+	defer close(ms.persistDone)
+	var sleepTime = ms.currentFlushInterval()
 	for {
 		select {
 		case <-ms.ctx.Done():
@@ -124,11 +255,12 @@ func (ms *MessageStore) periodicPersist() {
 		}
 		start := time.Now()
 		ms.persistOnce()
+		var interval = ms.currentFlushInterval()
 		var diff = start.Sub(time.Now())
-		if diff > defaultSleepTime {
-			sleepTime = defaultSleepTime
+		if diff > interval {
+			sleepTime = interval
 		} else {
-			sleepTime = defaultSleepTime - diff
+			sleepTime = interval - diff
 		}
 	}
 }
@@ -140,6 +272,11 @@ func (ms *MessageStore) clearOps() {
 }
 
 func (ms *MessageStore) persistOnce() {
+	if ms.InMemory() {
+		return
+	}
+	ms.flushLock.Lock()
+	defer ms.flushLock.Unlock()
 	// fmt.Println("Starting persist")
 	// Snapshot so we can keep queueing persist ops
 	ms.persistLock.Lock()
@@ -147,15 +284,20 @@ func (ms *MessageStore) persistOnce() {
 	addOps := ms.addOps
 	deliveredOps := ms.deliveredOps
 	ms.clearOps()
+	var flush = ms.flushStarted
+	ms.flushStarted += 1
 	ms.persistLock.Unlock()
 
 	// We don't need to add or mark delivered anything we are going to delete
-	// We don't need to delete anything we haven't added yet
+	// We don't need to delete anything we haven't added yet, but the
+	// reference it held still has to be dropped
 	noDelete := make([]PersistKey, 0, len(addOps))
+	cancelledRefs := make(map[int64]int32)
 	for id, _ := range delOps {
 		if _, ok := addOps[id]; ok {
 			delete(addOps, id)
 			noDelete = append(noDelete, id)
+			cancelledRefs[id.id] += 1
 		}
 		delete(deliveredOps, id)
 	}
@@ -164,12 +306,20 @@ func (ms *MessageStore) persistOnce() {
 	}
 	// fmt.Printf("Persist: add:%d, del:%d, delivery:%d\n", len(addOps), len(delOps), len(deliveredOps))
 	err := ms.db.Update(func(tx *bolt.Tx) error {
+		// None of these messages are on disk yet, so only memory is updated.
+		// That happens first so the index saved below has the right refs.
+		for id, count := range cancelledRefs {
+			if err := ms.dropMemoryRefs(tx, id, count); err != nil {
+				return err
+			}
+		}
+
 		// Add
 		msgsAdded := make(map[int64]bool)
 		for pk, qm := range addOps {
 			// Add -- Save messages to content/index stores
 			if _, ok := msgsAdded[pk.id]; !ok {
-				msg, okM := ms.GetNoChecks(pk.id)
+				msg, okM := ms.getInTx(tx, pk.id)
 				im, okI := ms.GetIndex(pk.id)
 				if okM != okI {
 					panic("Message index integrity error")
@@ -180,16 +330,29 @@ func (ms *MessageStore) persistOnce() {
 					// need to add it now
 					continue
 				}
-				persistMessage(tx, msg)
-				persistIndexMessage(tx, im)
+				if err := ms.persistMessage(tx, msg); err != nil {
+					return err
+				}
+				if err := persistIndexMessage(tx, im); err != nil {
+					return err
+				}
 			}
 			// Add -- Add messages to queues
-			persistQueueMessage(tx, pk.queueName, qm)
+			if err := persistQueueMessage(tx, pk.queueName, qm); err != nil {
+				return err
+			}
+		}
+		if len(addOps) > 0 {
+			if err := persistSequence(tx, atomic.LoadInt64(&ms.sequence)); err != nil {
+				return err
+			}
 		}
 
 		// Update Delivered
 		for pk, qm := range deliveredOps {
-			persistQueueMessage(tx, pk.queueName, qm)
+			if err := persistQueueMessage(tx, pk.queueName, qm); err != nil {
+				return err
+			}
 		}
 
 		// Delete
@@ -205,19 +368,79 @@ func (ms *MessageStore) persistOnce() {
 			}
 			// Delete -- Delete message all together if there are no references left
 			if remaining == 0 {
-				return depersistMessage(tx, qm.Id)
+				if err := depersistMessage(tx, qm.Id); err != nil {
+					return err
+				}
 			}
 		}
 		return nil
 	})
-	// TODO: this should probably just print a critical log message rather than
-	//       killing the server
+	// The changes are lost, but the messages are still served from memory.
+	// Health reports the error, and publishers waiting on confirms are told.
+	if err != nil {
+		fmt.Println("Failed to persist:", err.Error())
+	}
+	ms.recordWrite(err)
+	ms.persistLock.Lock()
+	ms.flushDone += 1
 	if err != nil {
-		panic("Failed to persist: " + err.Error())
+		ms.flushFailed = flush + 1
+		ms.flushErr = err
+	}
+	ms.flushed.Broadcast()
+	ms.persistLock.Unlock()
+}
+
+// The flush durable changes made from now on are written in, at the
+// earliest. Pass it to WaitFlushed after making the changes.
+func (ms *MessageStore) FlushGeneration() uint64 {
+	ms.persistLock.Lock()
+	defer ms.persistLock.Unlock()
+	return ms.flushStarted
+}
+
+// Wait until the durable changes made so far are on disk. Reports an error
+// if a flush since the FlushGeneration gen failed, which may have lost the
+// changes, or if the store closed first.
+func (ms *MessageStore) WaitFlushed(gen uint64) error {
+	if ms.InMemory() {
+		return nil
+	}
+	ms.persistLock.Lock()
+	defer ms.persistLock.Unlock()
+	var target = ms.flushStarted
+	if len(ms.addOps) > 0 || len(ms.delOps) > 0 || len(ms.deliveredOps) > 0 {
+		target += 1
 	}
+	// Close cancels ctx before its last flush, so this either sees it
+	// cancelled or is woken by that flush
+	for ms.flushDone < target && ms.ctx.Err() == nil {
+		ms.flushed.Wait()
+	}
+	if ms.flushDone < target {
+		return errors.New("Message store is closed")
+	}
+	if ms.flushFailed > gen {
+		return ms.flushErr
+	}
+	return nil
 }
 
 func (ms *MessageStore) LoadMessages() error {
+	if ms.InMemory() {
+		return nil
+	}
+	// Paged bodies of transient messages didn't survive the restart, and
+	// durable ones are also in the content bucket
+	err := ms.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(PAGED_CONTENT_BUCKET) == nil {
+			return nil
+		}
+		return tx.DeleteBucket(PAGED_CONTENT_BUCKET)
+	})
+	if err != nil {
+		return err
+	}
 	// Index
 	imMap, err := persist.LoadAll(ms.db, MESSAGE_INDEX_BUCKET, &IndexMessageFactory{})
 	if err != nil {
@@ -227,6 +450,20 @@ func (ms *MessageStore) LoadMessages() error {
 		var im = unmarshaler.(*amqp.IndexMessage)
 		ms.index[im.Id] = im
 	}
+	// Sequence
+	err = ms.db.View(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket(MESSAGE_SEQUENCE_BUCKET)
+		if bucket == nil {
+			return nil
+		}
+		if value := bucket.Get(sequenceKey); value != nil {
+			atomic.StoreInt64(&ms.sequence, bytesToInt64(value))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 	// Content
 	// TODO: don't load all content if it won't fit in memory
 	mMap, err := persist.LoadAll(ms.db, MESSAGE_CONTENT_BUCKET, &MessageContentFactory{})
@@ -234,7 +471,7 @@ func (ms *MessageStore) LoadMessages() error {
 		return err
 	}
 	for _, unmarshaler := range mMap {
-		var msg = unmarshaler.(*amqp.Message)
+		var msg = &unmarshaler.(*storedMessage).Message
 		ms.messages[msg.Id] = msg
 	}
 	return nil
@@ -242,18 +479,52 @@ func (ms *MessageStore) LoadMessages() error {
 
 func (ms *MessageStore) LoadQueueFromDisk(queueName string) (*list.List, error) { // list[amqp.QueueMessage]
 	var ret = list.New()
+	qms, err := ms.LoadQueueMessagesInOrder(queueName)
+	if err != nil {
+		return nil, err
+	}
+	for _, qm := range qms {
+		ret.PushBack(qm)
+	}
+	return ret, nil
+}
+
+// Load the persisted messages for a queue in the order they were published,
+// which is the order of their sequence numbers
+func (ms *MessageStore) LoadQueueMessagesInOrder(queueName string) ([]*amqp.QueueMessage, error) {
+	if ms.InMemory() {
+		return make([]*amqp.QueueMessage, 0), nil
+	}
 	qmMap, err := persist.LoadAll(ms.db, []byte(fmt.Sprintf("queue_%s", queueName)), &QueueMessageFactory{})
 	if err != nil {
 		return nil, err
 	}
+	var ret = make([]*amqp.QueueMessage, 0, len(qmMap))
 	for _, unmarshaler := range qmMap {
 		var qm = unmarshaler.(*amqp.QueueMessage)
 		qm.LocalId = -1
-		ret.PushFront(qm)
+		ret = append(ret, qm)
 	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].PublishedBefore(ret[j])
+	})
 	return ret, nil
 }
 
+// Give out the next sequence number, which orders queue messages by when
+// they were added to the store
+func (ms *MessageStore) nextSequence() int64 {
+	return atomic.AddInt64(&ms.sequence, 1)
+}
+
+func persistSequence(tx *bolt.Tx, sequence int64) error {
+	bucket, err := tx.CreateBucketIfNotExists(MESSAGE_SEQUENCE_BUCKET)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(sequenceKey, binaryId(sequence))
+}
+
 func (ms *MessageStore) Fsck() ([]int64, []int64) {
 	// TODO: make a function to find dangling or missing messages
 	return make([]int64, 0), make([]int64, 0)
@@ -273,7 +544,7 @@ func (ms *MessageStore) Get(qm *amqp.QueueMessage, rhs []amqp.MessageResourceHol
 
 	// Success! Return the message
 	if len(acquired) == len(rhs) {
-		var msg, found = ms.messages[qm.Id]
+		var msg, found = ms.lookup(qm.Id)
 		if !found {
 			panic("Integrity error! Message not found")
 		}
@@ -290,8 +561,79 @@ func (ms *MessageStore) Get(qm *amqp.QueueMessage, rhs []amqp.MessageResourceHol
 func (ms *MessageStore) GetNoChecks(id int64) (msg *amqp.Message, found bool) {
 	ms.msgLock.RLock()
 	defer ms.msgLock.RUnlock()
-	msg, found = ms.messages[id]
-	return
+	return ms.lookup(id)
+}
+
+// Find a message in memory or, if it was paged out, on disk. The caller
+// holds msgLock.
+func (ms *MessageStore) lookup(id int64) (msg *amqp.Message, found bool) {
+	if msg, found = ms.messages[id]; found || !ms.paged[id] {
+		return
+	}
+	ms.db.View(func(tx *bolt.Tx) error {
+		msg = readPaged(tx, id)
+		return nil
+	})
+	return msg, true
+}
+
+// Like GetNoChecks, but reads paged messages with an open transaction since
+// bolt can deadlock when a goroutine opens a second one
+func (ms *MessageStore) getInTx(tx *bolt.Tx, id int64) (msg *amqp.Message, found bool) {
+	ms.msgLock.RLock()
+	defer ms.msgLock.RUnlock()
+	if msg, found = ms.messages[id]; found || !ms.paged[id] {
+		return
+	}
+	return readPaged(tx, id), true
+}
+
+func readPaged(tx *bolt.Tx, id int64) *amqp.Message {
+	var bucket = tx.Bucket(PAGED_CONTENT_BUCKET)
+	if bucket == nil {
+		panic("Integrity error! Paged content bucket not found")
+	}
+	var data = bucket.Get(binaryId(id))
+	if data == nil {
+		panic(fmt.Sprintf("Integrity error! Paged message not found: %d", id))
+	}
+	var msg = &amqp.Message{}
+	if err := decodeMessage(data, msg); err != nil {
+		panic("Integrity error! Could not load paged message: " + err.Error())
+	}
+	return msg
+}
+
+// Whether every queue the message goes to is lazy or spilling
+func (ms *MessageStore) onlyLazy(queues []string) bool {
+	if ms.InMemory() {
+		return false
+	}
+	ms.lazyLock.RLock()
+	defer ms.lazyLock.RUnlock()
+	for _, q := range queues {
+		if !ms.lazyQueues[q] && !ms.spilling[q] {
+			return false
+		}
+	}
+	return len(queues) > 0
+}
+
+// Forget a paged message. The caller holds msgLock.
+func (ms *MessageStore) unpage(tx *bolt.Tx, id int64) error {
+	if !ms.paged[id] {
+		return nil
+	}
+	delete(ms.paged, id)
+	return deletePaged(tx, id)
+}
+
+func deletePaged(tx *bolt.Tx, id int64) error {
+	var bucket = tx.Bucket(PAGED_CONTENT_BUCKET)
+	if bucket == nil {
+		return nil
+	}
+	return bucket.Delete(binaryId(id))
 }
 
 func (ms *MessageStore) GetIndex(id int64) (msg *amqp.IndexMessage, found bool) {
@@ -342,10 +684,11 @@ func (ms *MessageStore) AddTxMessages(msgs []*amqp.TxMessage) (map[string][]*amq
 			messageSize(msg.Msg),
 			msg.Msg.LocalId,
 		)
+		qm.Sequence = ms.nextSequence()
 		queueMessages[msg.QueueName] = append(queues, qm)
 	}
 	// if any are durable, persist those ones
-	if anyDurable {
+	if anyDurable && !ms.InMemory() {
 		ms.persistLock.Lock()
 		for q, qms := range queueMessages {
 			for _, qm := range qms {
@@ -354,25 +697,70 @@ func (ms *MessageStore) AddTxMessages(msgs []*amqp.TxMessage) (map[string][]*amq
 		}
 		ms.persistLock.Unlock()
 	}
+	// Messages only lazy or spilling queues hold are paged out right away
+	var queuesByMsg = make(map[int64][]string)
+	var msgsById = make(map[int64]*amqp.Message)
+	for _, msg := range msgs {
+		queuesByMsg[msg.Msg.Id] = append(queuesByMsg[msg.Msg.Id], msg.QueueName)
+		msgsById[msg.Msg.Id] = msg.Msg
+	}
+	var toPage = make([]*amqp.Message, 0)
+	for id, queues := range queuesByMsg {
+		if ms.onlyLazy(queues) {
+			toPage = append(toPage, msgsById[id])
+		}
+	}
+	if len(toPage) > 0 {
+		err := ms.db.Update(func(tx *bolt.Tx) error {
+			bucket, err := tx.CreateBucketIfNotExists(PAGED_CONTENT_BUCKET)
+			if err != nil {
+				return err
+			}
+			for _, msg := range toPage {
+				b, err := ms.encodeMessage(msg)
+				if err != nil {
+					return err
+				}
+				if err = bucket.Put(binaryId(msg.Id), b); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		ms.recordWrite(err)
+		if err != nil {
+			return nil, err
+		}
+	}
 	// Add to memory message store
 	ms.msgLock.Lock()
-	defer ms.msgLock.Unlock()
 	ms.indexLock.Lock()
-	defer ms.indexLock.Unlock()
+	for _, msg := range toPage {
+		ms.paged[msg.Id] = true
+	}
 	for _, msg := range msgs {
 		// fmt.Printf("Adding to index: %d\n", msg.Msg.Id)
 		ms.index[msg.Msg.Id] = indexMessages[msg.Msg.Id]
-		ms.messages[msg.Msg.Id] = msg.Msg
+		if !ms.paged[msg.Msg.Id] {
+			ms.messages[msg.Msg.Id] = msg.Msg
+		}
+	}
+	ms.indexLock.Unlock()
+	ms.msgLock.Unlock()
+	// Only now, since persisting reads the messages back from memory
+	if anyDurable && !ms.InMemory() {
+		ms.flushWrite()
 	}
 	return queueMessages, nil
 }
 
 func (ms *MessageStore) IncrDeliveryCount(queueName string, qm *amqp.QueueMessage) (err error) {
 	qm.DeliveryCount += 1
-	if qm.Durable {
+	if qm.Durable && !ms.InMemory() {
 		ms.persistLock.Lock()
 		ms.deliveredOps[PersistKey{qm.Id, queueName}] = qm
 		ms.persistLock.Unlock()
+		ms.flushWrite()
 	}
 	return
 }
@@ -398,17 +786,26 @@ func (ms *MessageStore) RemoveRef(qm *amqp.QueueMessage, queueName string, rhs [
 		panic("Bad queue name!")
 	}
 	// Update disk
-	if im.Durable {
+	if im.Durable && !ms.InMemory() {
 		ms.persistLock.Lock()
 		ms.delOps[PersistKey{im.Id, queueName}] = qm
 		ms.persistLock.Unlock()
+		ms.flushWrite()
 	} else {
 		// Update if only memory
 		im.Refs -= 1
 		if im.Refs == 0 {
 			ms.msgLock.Lock()
 			delete(ms.index, qm.Id)
+			var wasPaged = ms.paged[qm.Id]
+			delete(ms.paged, qm.Id)
 			ms.msgLock.Unlock()
+			// Not under msgLock, persistOnce takes it inside its transaction
+			if wasPaged {
+				ms.db.Update(func(tx *bolt.Tx) error {
+					return deletePaged(tx, qm.Id)
+				})
+			}
 
 			ms.indexLock.Lock()
 			delete(ms.messages, qm.Id)
@@ -430,6 +827,33 @@ func depersistMessage(tx *bolt.Tx, id int64) error {
 	return content_bucket.Delete(binaryId(id))
 }
 
+// Drop references to a durable message which were removed before it was
+// ever persisted, forgetting the message once none are left
+func (ms *MessageStore) dropMemoryRefs(tx *bolt.Tx, id int64, count int32) error {
+	ms.msgLock.Lock()
+	im, found := ms.index[id]
+	if !found {
+		ms.msgLock.Unlock()
+		return nil
+	}
+	im.Refs -= count
+	if im.Refs > 0 {
+		ms.msgLock.Unlock()
+		return nil
+	}
+	delete(ms.index, id)
+	err := ms.unpage(tx, id)
+	ms.msgLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ms.indexLock.Lock()
+	delete(ms.messages, id)
+	ms.indexLock.Unlock()
+	return nil
+}
+
 func decrIndexMessage(tx *bolt.Tx, id int64, ms *MessageStore) (int32, error) {
 	// bucket
 	index_bucket, err := tx.CreateBucketIfNotExists(MESSAGE_INDEX_BUCKET)
@@ -452,13 +876,23 @@ func decrIndexMessage(tx *bolt.Tx, id int64, ms *MessageStore) (int32, error) {
 	if im.Refs == 0 {
 		ms.msgLock.Lock()
 		delete(ms.index, id)
+		err = ms.unpage(tx, id)
 		ms.msgLock.Unlock()
+		if err != nil {
+			return -1, err
+		}
 
 		ms.indexLock.Lock()
 		delete(ms.messages, id)
 		ms.indexLock.Unlock()
 		return 0, index_bucket.Delete(bId)
 	}
+	// Keep the in-memory count in step, Stats relies on it
+	ms.msgLock.Lock()
+	if memIm, found := ms.index[id]; found {
+		memIm.Refs = im.Refs
+	}
+	ms.msgLock.Unlock()
 	newBytes, err := proto.Marshal(im)
 	if err != nil {
 		return -1, err
@@ -494,9 +928,9 @@ func bytesToInt64(bId []byte) int64 {
 	return id
 }
 
-func persistMessage(tx *bolt.Tx, msg *amqp.Message) error {
+func (ms *MessageStore) persistMessage(tx *bolt.Tx, msg *amqp.Message) error {
 	content_bucket, err := tx.CreateBucketIfNotExists(MESSAGE_CONTENT_BUCKET)
-	b, err := proto.Marshal(msg)
+	b, err := ms.encodeMessage(msg)
 	if err != nil {
 		return err
 	}
@@ -2,12 +2,15 @@ package msgstore
 
 import (
 	// "container/list"
+	"bytes"
 	"context"
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/karelbilek/amqp-test-server/amqp"
+	bolt "go.etcd.io/bbolt"
 )
 
 func TestWrite(t *testing.T) {
@@ -59,3 +62,393 @@ func TestWrite(t *testing.T) {
 		return
 	}
 }
+
+func TestLoadInSequenceOrder(t *testing.T) {
+	var dbFile = "TestLoadInSequenceOrder.db"
+	os.Remove(dbFile)
+	defer os.Remove(dbFile)
+	var open = func() *MessageStore {
+		ms, err := NewMessageStore(context.Background(), dbFile)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if err = ms.LoadMessages(); err != nil {
+			t.Fatalf(err.Error())
+		}
+		return ms
+	}
+	var expectOrder = func(ms *MessageStore, ids ...int64) {
+		qms, err := ms.LoadQueueMessagesInOrder("some-queue")
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if len(qms) != len(ids) {
+			t.Fatalf("Expected %d messages, got %d", len(ids), len(qms))
+		}
+		for i, qm := range qms {
+			if qm.Id != ids[i] {
+				t.Fatalf("Message %d has id %d, expected %d", i, qm.Id, ids[i])
+			}
+		}
+	}
+	var add = func(ms *MessageStore, id int64) {
+		var msg = amqp.RandomMessage(true)
+		msg.Id = id
+		if _, err := ms.AddMessage(msg, []string{"some-queue"}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	// Ids don't decide the order, the sequence the store gives out does
+	var ms = open()
+	add(ms, 300)
+	add(ms, 200)
+	add(ms, 100)
+	ms.Close()
+	ms = open()
+	expectOrder(ms, 300, 200, 100)
+
+	// The sequence carries on from where it was after a restart
+	add(ms, 50)
+	ms.Close()
+	ms = open()
+	defer ms.Close()
+	expectOrder(ms, 300, 200, 100, 50)
+}
+
+func TestPaging(t *testing.T) {
+	var dbFile = "TestPaging.db"
+	os.Remove(dbFile)
+	defer os.Remove(dbFile)
+	ms, err := NewMessageStore(context.Background(), dbFile)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer ms.Close()
+	rhs := []amqp.MessageResourceHolder{&TestResourceHolder{}}
+	ms.SetQueueLazy("lazy", true)
+
+	// A normal queue needs the body in memory anyway
+	mixed := amqp.RandomMessage(false)
+	ms.AddMessage(mixed, []string{"lazy", "normal"})
+	if ms.PagedCount() != 0 {
+		t.Errorf("Paged a message a normal queue holds")
+	}
+
+	lazy := amqp.RandomMessage(false)
+	qms, err := ms.AddMessage(lazy, []string{"lazy"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if ms.PagedCount() != 1 || ms.MessageCount() != 1 {
+		t.Fatalf("Wrong counts. paged: %d, in memory: %d", ms.PagedCount(), ms.MessageCount())
+	}
+	msg, err := ms.GetAndDecrRef(qms["lazy"][0], "lazy", rhs)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if msg.Id != lazy.Id || len(msg.Payload) != len(lazy.Payload) {
+		t.Errorf("Paged message did not load back")
+	}
+	if ms.PagedCount() != 0 {
+		t.Errorf("Removed message is still paged")
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	ms := NewMemoryMessageStore(context.Background())
+	ms.Start()
+	defer ms.Close()
+	rhs := []amqp.MessageResourceHolder{&TestResourceHolder{}}
+	// Lazy queues and durable messages stay in memory too
+	ms.SetQueueLazy("lazy", true)
+
+	durable := amqp.RandomMessage(true)
+	qms, err := ms.AddMessage(durable, []string{"lazy", "normal"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if ms.PagedCount() != 0 || ms.MessageCount() != 1 {
+		t.Fatalf("Wrong counts. paged: %d, in memory: %d", ms.PagedCount(), ms.MessageCount())
+	}
+	for _, q := range []string{"lazy", "normal"} {
+		if err = ms.RemoveRef(qms[q][0], q, rhs); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if ms.MessageCount() != 0 || ms.IndexCount() != 0 {
+		t.Errorf("Message was not removed once every queue let go of it")
+	}
+
+	if err = ms.LoadMessages(); err != nil {
+		t.Errorf(err.Error())
+	}
+	queue, err := ms.LoadQueueFromDisk("normal")
+	if err != nil || queue.Len() != 0 {
+		t.Errorf("Loaded messages for an in-memory store")
+	}
+}
+
+func TestDeadEntries(t *testing.T) {
+	var dbFile = "TestDeadEntries.db"
+	os.Remove(dbFile)
+	defer os.Remove(dbFile)
+	ms, err := NewMessageStore(context.Background(), dbFile)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer ms.Close()
+	rhs := []amqp.MessageResourceHolder{&TestResourceHolder{}}
+	var check = func(live int, dead int) StoreStats {
+		var s = ms.Stats()
+		if s.LiveEntries != live || s.DeadEntries != dead {
+			t.Fatalf("Wrong counts. live: %d, dead: %d, expected %d and %d", s.LiveEntries, s.DeadEntries, live, dead)
+		}
+		return s
+	}
+
+	// No periodic persist, so nothing is reclaimed behind the test's back
+	shared := amqp.RandomMessage(true)
+	sharedQms, _ := ms.AddMessage(shared, []string{"q1", "q2"})
+	acked := amqp.RandomMessage(true)
+	ackedQms, _ := ms.AddMessage(acked, []string{"q1"})
+	ms.AddMessage(amqp.RandomMessage(false), []string{"q1"})
+	ms.persistOnce()
+	check(3, 0)
+
+	ms.RemoveRef(ackedQms["q1"][0], "q1", rhs)
+	ms.RemoveRef(sharedQms["q1"][0], "q1", rhs)
+	var s = check(2, 1)
+	if s.DeadBytes != uint64(messageSize(acked)) {
+		t.Errorf("Wrong dead bytes: %d", s.DeadBytes)
+	}
+	// Removed before it was ever written out
+	unflushed := amqp.RandomMessage(true)
+	unflushedQms, _ := ms.AddMessage(unflushed, []string{"q1"})
+	ms.RemoveRef(unflushedQms["q1"][0], "q1", rhs)
+	check(2, 2)
+
+	ms.Compact()
+	check(2, 0)
+	if ms.IndexCount() != 2 || ms.MessageCount() != 2 {
+		t.Fatalf("Dead messages were left in memory")
+	}
+
+	// The shared message dies with its last reference
+	ms.RemoveRef(sharedQms["q2"][0], "q2", rhs)
+	check(1, 1)
+	ms.Compact()
+	check(1, 0)
+	var onDisk map[int64]bool
+	ms.db.View(func(tx *bolt.Tx) error {
+		onDisk, err = keysForBucket(tx, MESSAGE_CONTENT_BUCKET)
+		return err
+	})
+	if len(onDisk) != 0 {
+		t.Errorf("Dead messages were left on disk: %v", onDisk)
+	}
+}
+
+func TestFlushEveryWrite(t *testing.T) {
+	var dbFile = "TestFlushEveryWrite.db"
+	os.Remove(dbFile)
+	defer os.Remove(dbFile)
+	rhs := []amqp.MessageResourceHolder{&TestResourceHolder{}}
+	ms, err := NewMessageStore(context.Background(), dbFile)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer ms.Close()
+	if err = ms.SetFlushPolicy(FLUSH_EVERY_WRITE, 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+	var onDisk = func() map[int64]bool {
+		var keys map[int64]bool
+		ms.db.View(func(tx *bolt.Tx) error {
+			keys, err = keysForBucket(tx, MESSAGE_CONTENT_BUCKET)
+			return err
+		})
+		return keys
+	}
+
+	// No persistOnce and no periodic persist, so only the policy wrote these
+	msg := amqp.RandomMessage(true)
+	qms, err := ms.AddMessage(msg, []string{"some-queue"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !onDisk()[msg.Id] {
+		t.Fatalf("Durable message was not on disk once added")
+	}
+	if err = ms.RemoveRef(qms["some-queue"][0], "some-queue", rhs); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if onDisk()[msg.Id] {
+		t.Errorf("Durable message was still on disk once removed")
+	}
+}
+
+func TestWaitFlushed(t *testing.T) {
+	var dbFile = "TestWaitFlushed.db"
+	os.Remove(dbFile)
+	defer os.Remove(dbFile)
+	ms, err := NewMessageStore(context.Background(), dbFile)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	ms.SetFlushPolicy(FLUSH_INTERVAL, 10*time.Millisecond)
+	ms.Start()
+	defer ms.Close()
+
+	var gen = ms.FlushGeneration()
+	var msg = amqp.RandomMessage(true)
+	if _, err = ms.AddMessage(msg, []string{"some-queue"}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err = ms.WaitFlushed(gen); err != nil {
+		t.Fatalf("Flush failed: %s", err.Error())
+	}
+	var keys map[int64]bool
+	ms.db.View(func(tx *bolt.Tx) error {
+		keys, err = keysForBucket(tx, MESSAGE_CONTENT_BUCKET)
+		return err
+	})
+	if !keys[msg.Id] {
+		t.Fatalf("Durable message was not on disk once flushed")
+	}
+
+	// Writes fail once the database is closed under the store
+	ms.db.Close()
+	gen = ms.FlushGeneration()
+	if _, err = ms.AddMessage(amqp.RandomMessage(true), []string{"some-queue"}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err = ms.WaitFlushed(gen); err == nil {
+		t.Fatalf("Failed flush wasn't reported")
+	}
+	if ms.Health() == nil {
+		t.Errorf("Failed flush didn't make the store unhealthy")
+	}
+}
+
+func BenchmarkFlushPolicy(b *testing.B) {
+	var bench = func(b *testing.B, policy FlushPolicy) {
+		var dbFile = "BenchmarkFlushPolicy.db"
+		os.Remove(dbFile)
+		defer os.Remove(dbFile)
+		ms, err := NewMessageStore(context.Background(), dbFile)
+		if err != nil {
+			b.Fatalf(err.Error())
+		}
+		defer ms.Close()
+		ms.SetFlushPolicy(policy, 0)
+		ms.Start()
+		rhs := []amqp.MessageResourceHolder{&TestResourceHolder{}}
+		var msgs = make([]*amqp.Message, b.N)
+		for i := range msgs {
+			msgs[i] = amqp.RandomMessage(true)
+		}
+		b.ResetTimer()
+		for _, msg := range msgs {
+			qms, err := ms.AddMessage(msg, []string{"some-queue"})
+			if err != nil {
+				b.Fatalf(err.Error())
+			}
+			ms.RemoveRef(qms["some-queue"][0], "some-queue", rhs)
+		}
+		// Count the batched writes still pending as well
+		ms.persistOnce()
+	}
+	b.Run("every-write", func(b *testing.B) { bench(b, FLUSH_EVERY_WRITE) })
+	b.Run("interval", func(b *testing.B) { bench(b, FLUSH_INTERVAL) })
+	b.Run("never", func(b *testing.B) { bench(b, FLUSH_NEVER) })
+}
+
+func BenchmarkAddMessage(b *testing.B) {
+	var bench = func(b *testing.B, ms *MessageStore) {
+		rhs := []amqp.MessageResourceHolder{&TestResourceHolder{}}
+		var msgs = make([]*amqp.Message, b.N)
+		for i := range msgs {
+			msgs[i] = amqp.RandomMessage(true)
+		}
+		b.ResetTimer()
+		for _, msg := range msgs {
+			qms, err := ms.AddMessage(msg, []string{"some-queue"})
+			if err != nil {
+				b.Fatalf(err.Error())
+			}
+			ms.RemoveRef(qms["some-queue"][0], "some-queue", rhs)
+		}
+		ms.persistOnce()
+	}
+	b.Run("memory", func(b *testing.B) {
+		ms := NewMemoryMessageStore(context.Background())
+		defer ms.Close()
+		bench(b, ms)
+	})
+	b.Run("disk", func(b *testing.B) {
+		var dbFile = "BenchmarkAddMessage.db"
+		os.Remove(dbFile)
+		defer os.Remove(dbFile)
+		ms, err := NewMessageStore(context.Background(), dbFile)
+		if err != nil {
+			b.Fatalf(err.Error())
+		}
+		defer ms.Close()
+		bench(b, ms)
+	})
+}
+
+func TestCompression(t *testing.T) {
+	var dbFile = "TestCompression.db"
+	os.Remove(dbFile)
+	defer os.Remove(dbFile)
+	ms, err := NewMessageStore(context.Background(), dbFile)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	ms.SetCompression(COMPRESS_GZIP, 1024)
+	var body = bytes.Repeat([]byte("dispatchd "), 100000)
+	msg := amqp.RandomMessage(true)
+	msg.Payload[0].Payload = body
+	msg.Header.ContentBodySize = uint64(len(body))
+	small := amqp.RandomMessage(true)
+	ms.AddMessage(msg, []string{"some-queue"})
+	ms.AddMessage(small, []string{"some-queue"})
+	ms.persistOnce()
+
+	var stored, storedSmall []byte
+	ms.db.View(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket(MESSAGE_CONTENT_BUCKET)
+		stored = append(stored, bucket.Get(binaryId(msg.Id))...)
+		storedSmall = append(storedSmall, bucket.Get(binaryId(small.Id))...)
+		return nil
+	})
+	if len(stored) == 0 || len(stored) > len(body)/10 {
+		t.Errorf("Body of %d bytes took %d bytes on disk", len(body), len(stored))
+	}
+	if len(storedSmall) == 0 || storedSmall[0] == compressedMarker {
+		t.Errorf("Message under the threshold was compressed")
+	}
+	ms.Close()
+
+	// Compressed messages load whatever the setting is now
+	ms2, err := NewMessageStore(context.Background(), dbFile)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer ms2.Close()
+	if err = ms2.LoadMessages(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	loaded, found := ms2.GetNoChecks(msg.Id)
+	if !found {
+		t.Fatalf("Compressed message was not loaded")
+	}
+	if !bytes.Equal(loaded.Payload[0].Payload, body) {
+		t.Errorf("Body changed on its way through the disk")
+	}
+	if _, found = ms2.GetNoChecks(small.Id); !found {
+		t.Errorf("Uncompressed message was not loaded")
+	}
+}
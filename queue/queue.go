@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gogo/protobuf/proto"
@@ -16,11 +17,16 @@ import (
 	"github.com/karelbilek/amqp-test-server/msgstore"
 	"github.com/karelbilek/amqp-test-server/persist"
 	"github.com/karelbilek/amqp-test-server/stats"
+	"github.com/karelbilek/amqp-test-server/util"
 	bolt "go.etcd.io/bbolt"
 )
 
 var QUEUE_BUCKET_NAME = []byte("queues")
 
+// The x-queue-type every queue has. RabbitMQ's quorum and stream queues are
+// recognized but not implemented.
+const QUEUE_TYPE_CLASSIC = "classic"
+
 type QueueStateFactory struct{}
 
 func (qsf *QueueStateFactory) New() proto.Unmarshaler {
@@ -36,20 +42,53 @@ type Queue struct {
 	objLock         sync.RWMutex
 	queue           *list.List // int64
 	queueLock       sync.Mutex
+	readyBytes      uint64 // Body bytes of the messages in queue
 	consumerLock    sync.RWMutex
 	consumers       []*consumer.Consumer // *Consumer
 	currentConsumer int
 	statCount       uint64
 	maybeReady      chan bool
 	soleConsumer    *consumer.Consumer
+	// On single-active-consumer queues, the consumer which gets the
+	// messages. Guarded by activeLock so consumers can check it while the
+	// queue holds consumerLock.
+	activeConsumer *consumer.Consumer
+	activeLock     sync.Mutex
+	// The most recently published message ids, newest first, on queues
+	// with a dedup window
+	dedupIds        map[string]*list.Element
+	dedupOrder      *list.List // *dedupEntry
+	dedupLock       sync.Mutex
+	expiresTimer    util.Timer // Fires x-expires after the latest use
+	expiresLock     sync.Mutex
 	ConnId          int64
 	deleteActive    time.Time
 	hasHadConsumers bool
 	msgStore        *msgstore.MessageStore
-	statProcOne     stats.Histogram
-	deleteChan      chan *Queue
+	unackedCount    int64
+	// Unix nanoseconds of the latest activity, 0 for never
+	lastPublish int64
+	lastDeliver int64
+	lastAck     int64
+	// Unix nanoseconds of the latest use, for x-expires
+	lastUsed    int64
+	clock       util.Clock
+	maxInMemory int64 // The server's x-max-in-memory-length
+	spilling    bool  // Whether the queue is over its in-memory length
+	statProcOne stats.Histogram
+	statPublish stats.Meter
+	statDeliver stats.Meter
+	statAck     stats.Meter
+	statPrefix  string
+	deleteChan  chan *Queue
+	deadLetter  DeadLetterFunc
 }
 
+// Called with a message the queue is giving up on, before the queue drops
+// its reference to it. reason is the one RabbitMQ gives in x-death headers,
+// like delivery_limit.
+type DeadLetterFunc func(q *Queue, qm *amqp.QueueMessage, reason string)
+
 func NewQueue(
 	ctx context.Context,
 	name string,
@@ -74,9 +113,13 @@ func NewQueue(
 		deleteChan: deleteChan,
 		// Fields that aren't passed in
 		statProcOne: stats.MakeHistogram("queue-proc-one"),
+		statPublish: stats.NilMeter(),
+		statDeliver: stats.NilMeter(),
+		statAck:     stats.NilMeter(),
 		queue:       list.New(),
 		consumers:   make([]*consumer.Consumer, 0, 1),
 		maybeReady:  make(chan bool, 1),
+		clock:       util.RealClock,
 		ctx:         ctx,
 	}
 }
@@ -91,9 +134,13 @@ func NewFromPersistedState(ctx context.Context, state *gen.QueueState, msgStore
 		deleteChan: deleteChan,
 		// Fields that aren't passed in
 		statProcOne: stats.MakeHistogram("queue-proc-one"),
+		statPublish: stats.NilMeter(),
+		statDeliver: stats.NilMeter(),
+		statAck:     stats.NilMeter(),
 		queue:       list.New(),
 		consumers:   make([]*consumer.Consumer, 0, 1),
 		maybeReady:  make(chan bool, 1),
+		clock:       util.RealClock,
 		ctx:         ctx,
 	}
 }
@@ -123,7 +170,18 @@ func (q1 *Queue) EquivalentQueues(q2 *Queue) bool {
 	return true
 }
 
+// Whether declaring the queue again with method would be a no-op. Like
+// EquivalentQueues, but without building a queue from the method first.
+func (q *Queue) EquivalentDeclare(method *amqp.QueueDeclare) bool {
+	return q.Name == method.Queue &&
+		q.Durable == method.Durable &&
+		q.exclusive == method.Exclusive &&
+		amqp.EquivalentTables(q.Arguments, method.Arguments)
+}
+
 func (q *Queue) Len() uint32 {
+	q.queueLock.Lock()
+	defer q.queueLock.Unlock()
 	var l = q.queue.Len()
 	if l < 0 {
 		panic("Queue length overflow!")
@@ -131,21 +189,178 @@ func (q *Queue) Len() uint32 {
 	return uint32(l)
 }
 
+// The total body size of the messages ready in the queue. Unacked messages
+// don't count until they are requeued.
+func (q *Queue) ReadyBytes() uint64 {
+	q.queueLock.Lock()
+	defer q.queueLock.Unlock()
+	return q.readyBytes
+}
+
+// Copies of up to limit messages from the front of the queue, leaving them
+// where they are
+func (q *Queue) Peek(limit int) []amqp.QueueMessage {
+	q.queueLock.Lock()
+	defer q.queueLock.Unlock()
+	var ret = make([]amqp.QueueMessage, 0)
+	for e := q.queue.Front(); e != nil && len(ret) < limit; e = e.Next() {
+		ret = append(ret, *e.Value.(*amqp.QueueMessage))
+	}
+	return ret
+}
+
+// Every change to the ready messages goes through these, which keep
+// readyBytes up to date. The caller holds queueLock.
+func (q *Queue) pushNotThreadSafe(qm *amqp.QueueMessage, before *list.Element) {
+	if before == nil {
+		q.queue.PushBack(qm)
+	} else {
+		q.queue.InsertBefore(qm, before)
+	}
+	q.readyBytes += uint64(qm.MsgSize)
+}
+
+func (q *Queue) removeNotThreadSafe(elem *list.Element) *amqp.QueueMessage {
+	var qm = q.queue.Remove(elem).(*amqp.QueueMessage)
+	q.readyBytes -= uint64(qm.MsgSize)
+	return qm
+}
+
 func (q *Queue) ActiveConsumerCount() uint32 {
 	// TODO(MUST): don't count consumers in the Channel.Flow state once
 	// that is implemented
+	q.consumerLock.RLock()
+	defer q.consumerLock.RUnlock()
 	return uint32(len(q.consumers))
 }
 
+// The number of messages from this queue which have been delivered and are
+// waiting on an ack
+func (q *Queue) UnackedCount() uint32 {
+	return uint32(atomic.LoadInt64(&q.unackedCount))
+}
+
+// Called by the consumer when a message from this queue starts waiting on
+// an ack
+func (q *Queue) AddUnacked() {
+	atomic.AddInt64(&q.unackedCount, 1)
+}
+
+// Called by the channel when a message from this queue is no longer waiting
+// on an ack, either because it was acked or because it was nacked/requeued
+func (q *Queue) RemoveUnacked(acked bool) {
+	atomic.AddInt64(&q.unackedCount, -1)
+	if acked {
+		q.statAck.Mark(1)
+		q.touch(&q.lastAck)
+	}
+}
+
+func (q *Queue) touch(timestamp *int64) {
+	atomic.StoreInt64(timestamp, q.clock.Now().UnixNano())
+}
+
+func loadTimestamp(timestamp *int64) time.Time {
+	var nanos = atomic.LoadInt64(timestamp)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// When a message was last added to the queue. Zero if never.
+func (q *Queue) LastPublish() time.Time {
+	return loadTimestamp(&q.lastPublish)
+}
+
+// When a message was last delivered from the queue, to a consumer or by
+// basic.get. Zero if never.
+func (q *Queue) LastDeliver() time.Time {
+	return loadTimestamp(&q.lastDeliver)
+}
+
+// When a message delivered from the queue was last acked. Zero if never.
+func (q *Queue) LastAck() time.Time {
+	return loadTimestamp(&q.lastAck)
+}
+
+// Timestamps which were never set are null in the queue's JSON
+func jsonTimestamp(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+func (q *Queue) statNames() []string {
+	var prefix = q.statPrefix + "Queue." + q.Name + "."
+	return []string{
+		prefix + "MessagesReady",
+		prefix + "MessagesUnacked",
+		prefix + "Publish",
+		prefix + "Deliver",
+		prefix + "Ack",
+	}
+}
+
+// Use the given clock for the autodelete and x-expires timeouts and the
+// activity timestamps instead of the real one
+func (q *Queue) SetClock(clock util.Clock) {
+	q.clock = clock
+}
+
+// Pass the messages the queue gives up on to deadLetter, which can publish
+// them to the queue's x-dead-letter-exchange. Without one they are dropped.
+func (q *Queue) SetDeadLetter(deadLetter DeadLetterFunc) {
+	q.deadLetter = deadLetter
+}
+
+// Register the per-queue gauges and meters. This is done by the server when
+// the queue is added, not in the constructor, since queues are also created
+// just to check equivalence with an existing queue. The prefix keeps queues
+// of the same name in different virtual hosts apart.
+func (q *Queue) RegisterStats(prefix string) {
+	q.statPrefix = prefix
+	var names = q.statNames()
+	stats.MakeGauge(names[0], func() int64 { return int64(q.Len()) })
+	stats.MakeGauge(names[1], func() int64 { return int64(q.UnackedCount()) })
+	q.statPublish = stats.MakeMeter(names[2])
+	q.statDeliver = stats.MakeMeter(names[3])
+	q.statAck = stats.MakeMeter(names[4])
+}
+
+func (q *Queue) UnregisterStats() {
+	stats.Unregister(q.statNames()...)
+}
+
 func (q *Queue) MarshalJSON() ([]byte, error) {
+	// The counts change under the queue's feet, so read them under the locks
+	var ready = q.Len()
+	q.consumerLock.RLock()
+	var consumers = make([]*consumer.Consumer, len(q.consumers))
+	copy(consumers, q.consumers)
+	q.consumerLock.RUnlock()
 	return json.Marshal(map[string]interface{}{
-		"name":       q.Name,
-		"durable":    q.Durable,
-		"exclusive":  q.exclusive,
-		"connId":     q.ConnId,
-		"autoDelete": q.autoDelete,
-		"size":       q.queue.Len(),
-		"consumers":  q.consumers,
+		"name":            q.Name,
+		"durable":         q.Durable,
+		"exclusive":       q.exclusive,
+		"connId":          q.ConnId,
+		"autoDelete":      q.autoDelete,
+		"type":            q.Type(),
+		"arguments":       q.Arguments,
+		"size":            ready,
+		"messagesReady":   ready,
+		"bytesReady":      q.ReadyBytes(),
+		"messagesUnacked": q.UnackedCount(),
+		"consumerCount":   len(consumers),
+		"consumers":       consumers,
+		"lastPublish":     jsonTimestamp(q.LastPublish()),
+		"lastDeliver":     jsonTimestamp(q.LastDeliver()),
+		"lastAck":         jsonTimestamp(q.LastAck()),
+		// Per second over the last minute
+		"publishRate": stats.WindowRate(q.statPublish),
+		"deliverRate": stats.WindowRate(q.statDeliver),
+		"ackRate":     stats.WindowRate(q.statAck),
 	})
 }
 
@@ -182,7 +397,14 @@ func (q *Queue) LoadFromMsgStore(msgStore *msgstore.MessageStore) {
 	if err != nil {
 		panic("Integrity error reading queue from disk! " + err.Error())
 	}
+	q.queueLock.Lock()
 	q.queue = queueList
+	q.readyBytes = 0
+	for e := q.queue.Front(); e != nil; e = e.Next() {
+		q.readyBytes += uint64(e.Value.(*amqp.QueueMessage).MsgSize)
+	}
+	q.updateSpillingNotThreadSafe()
+	q.queueLock.Unlock()
 	select {
 	case q.maybeReady <- true:
 	default:
@@ -195,6 +417,11 @@ func (q *Queue) Close() {
 	q.queueLock.Lock()
 	defer q.queueLock.Unlock()
 	q.Closed = true
+	q.expiresLock.Lock()
+	defer q.expiresLock.Unlock()
+	if q.expiresTimer != nil {
+		q.expiresTimer.Stop()
+	}
 }
 
 func (q *Queue) Purge() uint32 {
@@ -206,6 +433,8 @@ func (q *Queue) Purge() uint32 {
 func (q *Queue) purgeNotThreadSafe() uint32 {
 	var length = q.queue.Len()
 	q.queue.Init()
+	q.readyBytes = 0
+	q.updateSpillingNotThreadSafe()
 	return uint32(length)
 }
 
@@ -216,7 +445,11 @@ func (q *Queue) Add(qm *amqp.QueueMessage) bool {
 	defer q.queueLock.Unlock()
 	if !q.Closed {
 		q.statCount += 1
-		q.queue.PushBack(qm)
+		q.statPublish.Mark(1)
+		q.touch(&q.lastPublish)
+		q.pushNotThreadSafe(qm, nil)
+		q.dropHeadNotThreadSafe()
+		q.updateSpillingNotThreadSafe()
 		select {
 		case q.maybeReady <- true:
 		default:
@@ -227,21 +460,87 @@ func (q *Queue) Add(qm *amqp.QueueMessage) bool {
 	}
 }
 
+// The x-max-length argument, the most ready messages the queue holds, or
+// false if it is unbounded
+func (q *Queue) MaxLength() (uint32, bool) {
+	var max, found = q.Arguments.GetInt("x-max-length")
+	if !found || max < 0 {
+		return 0, false
+	}
+	return uint32(max), true
+}
+
+// The x-delivery-limit argument, how many times a message may be requeued.
+// Requeued once more, it is dead lettered instead.
+func (q *Queue) DeliveryLimit() (int64, bool) {
+	var limit, found = q.Arguments.GetInt("x-delivery-limit")
+	if !found || limit < 0 {
+		return 0, false
+	}
+	return limit, true
+}
+
+func (q *Queue) deadLetterMessage(qm *amqp.QueueMessage, reason string) {
+	if q.deadLetter != nil {
+		q.deadLetter(q, qm, reason)
+	}
+	q.msgStore.RemoveRef(qm, q.Name, []amqp.MessageResourceHolder{})
+}
+
+// Whether publishes to the queue are refused once it reaches its max length.
+// Otherwise the oldest messages are dropped to make room, like RabbitMQ's
+// default drop-head overflow.
+func (q *Queue) RejectsPublish() bool {
+	var overflow, _ = q.Arguments.GetString("x-overflow")
+	return overflow == "reject-publish"
+}
+
+// Whether the queue is at its max length and refuses publishes
+func (q *Queue) Full() bool {
+	var max, bounded = q.MaxLength()
+	return bounded && q.RejectsPublish() && q.Len() >= max
+}
+
+func (q *Queue) dropHeadNotThreadSafe() {
+	var max, bounded = q.MaxLength()
+	if !bounded || q.RejectsPublish() {
+		return
+	}
+	for uint32(q.queue.Len()) > max {
+		var qm = q.removeNotThreadSafe(q.queue.Front())
+		q.msgStore.RemoveRef(qm, q.Name, []amqp.MessageResourceHolder{})
+	}
+}
+
 func (q *Queue) ConsumeImmediate(qm *amqp.QueueMessage) bool {
 	// TODO: randomize or round-robin through consumers
 	q.consumerLock.RLock()
 	defer q.consumerLock.RUnlock()
 	for _, consumer := range q.consumers {
 		var msg, acquired = q.msgStore.Get(qm, consumer.MessageResourceHolders())
-		if acquired {
-			consumer.ConsumeImmediate(qm, msg)
+		if acquired && consumer.ConsumeImmediate(qm, msg) {
+			q.statDeliver.Mark(1)
+			q.touch(&q.lastDeliver)
 			return true
 		}
 	}
 	return false
 }
 
-func (q *Queue) Delete(ifUnused bool, ifEmpty bool) (uint32, error) {
+// Check the if-unused and if-empty conditions of queue.delete
+func (q *Queue) CanDelete(ifUnused bool, ifEmpty bool) error {
+	if ifUnused && q.ActiveConsumerCount() != 0 {
+		return errors.New("if-unused specified and there are consumers")
+	}
+	if ifEmpty && q.Len() != 0 {
+		return errors.New("if-empty specified and there are messages in the queue")
+	}
+	return nil
+}
+
+// Cancel the consumers and drop the messages of a closed queue. Returns how
+// many messages were dropped.
+func (q *Queue) Delete() uint32 {
 	// Lock
 	if !q.Closed {
 		panic("Queue deleted before it was closed!")
@@ -249,35 +548,49 @@ func (q *Queue) Delete(ifUnused bool, ifEmpty bool) (uint32, error) {
 	q.queueLock.Lock()
 	defer q.queueLock.Unlock()
 
-	// Check
-	var usedOk = !ifUnused || len(q.consumers) == 0
-	var emptyOk = !ifEmpty || q.queue.Len() == 0
-	if !usedOk {
-		return 0, errors.New("if-unused specified and there are consumers")
-	}
-	if !emptyOk {
-		return 0, errors.New("if-empty specified and there are messages in the queue")
-	}
 	// Purge
 	q.cancelConsumers()
-	return q.purgeNotThreadSafe(), nil
+	if q.msgStore != nil {
+		q.msgStore.SetQueueLazy(q.Name, false)
+	}
+	return q.purgeNotThreadSafe()
 }
 
 func (q *Queue) Readd(queueName string, msg *amqp.QueueMessage) {
 	// TODO: if there is a consumer available, dispatch
-	q.queueLock.Lock()
-	defer q.queueLock.Unlock()
 	// this method is only called when we get a nack or we shut down a channel,
 	// so it means the message was not acked.
 	q.msgStore.IncrDeliveryCount(queueName, msg)
-	q.queue.PushFront(msg)
+	if limit, found := q.DeliveryLimit(); found && int64(msg.DeliveryCount) > limit {
+		// Not under queueLock, since the dead letter exchange may route the
+		// message back to this queue
+		q.deadLetterMessage(msg, "delivery_limit")
+		return
+	}
+	q.PutBack(msg)
+}
+
+// Put back a message which was taken for a consumer but never delivered. It
+// doesn't count as a delivery, so it can't reach x-delivery-limit.
+func (q *Queue) PutBack(msg *amqp.QueueMessage) {
+	q.queueLock.Lock()
+	defer q.queueLock.Unlock()
+	// Put the message back ahead of anything published after it. Requeues
+	// of several messages come in no particular order, and this keeps them
+	// in their original order whichever goes first.
+	var next = q.queue.Front()
+	for next != nil && next.Value.(*amqp.QueueMessage).PublishedBefore(msg) {
+		next = next.Next()
+	}
+	q.pushNotThreadSafe(msg, next)
+	q.updateSpillingNotThreadSafe()
 	select {
 	case q.maybeReady <- true:
 	default:
 	}
 }
 
-func (q *Queue) removeConsumer(consumerTag string) {
+func (q *Queue) RemoveConsumer(consumerTag string) {
 	q.consumerLock.Lock()
 	defer q.consumerLock.Unlock()
 	if q.soleConsumer != nil && q.soleConsumer.ConsumerTag == consumerTag {
@@ -289,12 +602,15 @@ func (q *Queue) removeConsumer(consumerTag string) {
 			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
 		}
 	}
+	q.updateActiveConsumer()
 	var size = len(q.consumers)
 	if size == 0 {
 		q.currentConsumer = 0
 		if q.autoDelete && q.hasHadConsumers {
 			go q.autodeleteTimeout()
 		}
+		// The queue is idle from when its last consumer goes
+		q.Touch()
 	} else {
 		q.currentConsumer = q.currentConsumer % size
 	}
@@ -305,14 +621,56 @@ func (q *Queue) autodeleteTimeout() {
 	// There's technically a race condition here where a new binding could be
 	// added right as we check this, but after a 5 second wait with no activity
 	// I think this is probably safe enough.
-	var now = time.Now()
+	var now = q.clock.Now()
 	q.deleteActive = now
-	time.Sleep(5 * time.Second)
+	q.clock.Sleep(5 * time.Second)
 	if q.deleteActive == now {
 		q.deleteChan <- q
 	}
 }
 
+// The x-expires argument, how long the queue may go unused before it deletes
+// itself, or false if it never expires
+func (q *Queue) Expires() (time.Duration, bool) {
+	var millis, found = q.Arguments.GetInt("x-expires")
+	if !found || millis <= 0 {
+		return 0, false
+	}
+	return time.Duration(millis) * time.Millisecond, true
+}
+
+// Restart the x-expires countdown. Declaring the queue, consuming from it and
+// basic.get all count as using it, and it never expires while it has
+// consumers.
+func (q *Queue) Touch() {
+	var expires, found = q.Expires()
+	if !found {
+		return
+	}
+	q.expiresLock.Lock()
+	defer q.expiresLock.Unlock()
+	atomic.StoreInt64(&q.lastUsed, q.clock.Now().UnixNano())
+	if q.expiresTimer == nil {
+		q.expiresTimer = q.clock.AfterFunc(expires, func() { q.expiresTimeout(expires) })
+	} else {
+		q.expiresTimer.Reset(expires)
+	}
+}
+
+func (q *Queue) expiresTimeout(expires time.Duration) {
+	// A Touch racing the timer firing has already restarted it
+	var unused = q.clock.Now().UnixNano() - atomic.LoadInt64(&q.lastUsed)
+	if unused < int64(expires) {
+		return
+	}
+	q.queueLock.Lock()
+	var closed = q.Closed
+	q.queueLock.Unlock()
+	if !closed && q.ActiveConsumerCount() == 0 {
+		q.deleteChan <- q
+	}
+}
+
 func (q *Queue) cancelConsumers() {
 	q.consumerLock.Lock()
 	defer q.consumerLock.Unlock()
@@ -323,6 +681,7 @@ func (q *Queue) cancelConsumers() {
 		c.Stop()
 	}
 	q.consumers = make([]*consumer.Consumer, 0, 1)
+	q.updateActiveConsumer()
 }
 
 func (q *Queue) AddConsumer(c *consumer.Consumer, exclusive bool) (uint16, error) {
@@ -334,23 +693,232 @@ func (q *Queue) AddConsumer(c *consumer.Consumer, exclusive bool) (uint16, error
 
 	// Add consumer
 	q.consumerLock.Lock()
+	defer q.consumerLock.Unlock()
+	// An exclusive consumer holds the queue until it is cancelled
+	if q.soleConsumer != nil {
+		return 403, fmt.Errorf("Exclusive access denied, queue has an exclusive consumer")
+	}
 	if exclusive {
-		if len(q.consumers) == 0 {
-			q.soleConsumer = c
-		} else {
+		if len(q.consumers) != 0 {
 			return 403, fmt.Errorf("Exclusive access denied, %d consumers active", len(q.consumers))
 		}
+		q.soleConsumer = c
 	}
-	q.consumers = append(q.consumers, c)
+	// Keep consumers ordered by priority, and by age within a priority
+	var i = len(q.consumers)
+	for i > 0 && q.consumers[i-1].Priority() < c.Priority() {
+		i--
+	}
+	q.consumers = append(q.consumers, nil)
+	copy(q.consumers[i+1:], q.consumers[i:])
+	q.consumers[i] = c
 	q.hasHadConsumers = true
-	q.consumerLock.Unlock()
+	q.updateActiveConsumer()
 	return 0, nil
 }
 
+// Queues declared with x-single-active-consumer deliver to one consumer at
+// a time. The others stand by in priority order, then the order they
+// subscribed, and the first of them takes over when the active one goes
+// away.
+func (q *Queue) SingleActiveConsumer() bool {
+	var value = q.Arguments.GetKey("x-single-active-consumer")
+	return value != nil && value.GetVBoolean()
+}
+
+// Durable queues declared with x-force-durable keep every message routed to
+// them on disk, as if it had been published with delivery mode 2
+func (q *Queue) ForcesDurable() bool {
+	var value = q.Arguments.GetKey("x-force-durable")
+	return q.Durable && value != nil && value.GetVBoolean()
+}
+
+func (q *Queue) IsActiveConsumer(c *consumer.Consumer) bool {
+	if !q.SingleActiveConsumer() {
+		return true
+	}
+	q.activeLock.Lock()
+	defer q.activeLock.Unlock()
+	return q.activeConsumer == c
+}
+
+// Make the longest subscribed consumer the active one. The caller holds
+// consumerLock.
+func (q *Queue) updateActiveConsumer() {
+	q.activeLock.Lock()
+	defer q.activeLock.Unlock()
+	var previous = q.activeConsumer
+	q.activeConsumer = nil
+	if len(q.consumers) > 0 {
+		q.activeConsumer = q.consumers[0]
+	}
+	if q.activeConsumer != nil && q.activeConsumer != previous {
+		select {
+		case q.maybeReady <- true:
+		default:
+		}
+	}
+}
+
+// Queues declared with x-dedup-window remember the message ids of that many
+// of the most recent messages enqueued on them and drop publishes of any id
+// they remember. With x-dedup-ttl, in milliseconds, ids are also forgotten
+// once they are that old. A window of 0 means deduplication is off.
+func (q *Queue) DedupWindow() int {
+	var size, found = q.Arguments.GetInt("x-dedup-window")
+	if !found || size < 0 {
+		return 0
+	}
+	return int(size)
+}
+
+// How long ids are remembered for, 0 if only the window size bounds it
+func (q *Queue) DedupTTL() time.Duration {
+	var ttl, found = q.Arguments.GetInt("x-dedup-ttl")
+	if !found || ttl <= 0 {
+		return 0
+	}
+	return time.Duration(ttl) * time.Millisecond
+}
+
+type dedupEntry struct {
+	id   string
+	seen time.Time
+}
+
+// The id deduplication goes by, if the message has one and the queue has
+// a dedup window
+func (q *Queue) DedupId(msg *amqp.Message) (string, bool) {
+	if q.DedupWindow() == 0 || msg.Header == nil || msg.Header.Properties == nil {
+		return "", false
+	}
+	var id = msg.Header.Properties.MessageId
+	if id == nil || len(*id) == 0 {
+		return "", false
+	}
+	return *id, true
+}
+
+// Check whether a message being published has an id the queue remembers.
+// Messages without a message id are never duplicates. The id is only
+// remembered once the message is enqueued, see RecordMessageId, so a publish
+// which is refused or rolled back can be retried.
+func (q *Queue) IsDuplicate(msg *amqp.Message) bool {
+	var id, ok = q.DedupId(msg)
+	if !ok {
+		return false
+	}
+	q.dedupLock.Lock()
+	defer q.dedupLock.Unlock()
+	q.expireDedupNotThreadSafe()
+	var _, seen = q.dedupIds[id]
+	return seen
+}
+
+// Remember the id of a message which was enqueued
+func (q *Queue) RecordMessageId(msg *amqp.Message) {
+	var id, ok = q.DedupId(msg)
+	if !ok {
+		return
+	}
+	q.dedupLock.Lock()
+	defer q.dedupLock.Unlock()
+	if q.dedupIds == nil {
+		q.dedupIds = make(map[string]*list.Element)
+		q.dedupOrder = list.New()
+	}
+	var entry = &dedupEntry{id: id, seen: q.clock.Now()}
+	if elem, seen := q.dedupIds[id]; seen {
+		elem.Value = entry
+		q.dedupOrder.MoveToFront(elem)
+	} else {
+		q.dedupIds[id] = q.dedupOrder.PushFront(entry)
+	}
+	for q.dedupOrder.Len() > q.DedupWindow() {
+		q.removeDedupNotThreadSafe(q.dedupOrder.Back())
+	}
+	q.expireDedupNotThreadSafe()
+}
+
+// Forget the ids older than the dedup ttl. The newest ids are at the front.
+func (q *Queue) expireDedupNotThreadSafe() {
+	var ttl = q.DedupTTL()
+	if ttl == 0 || q.dedupOrder == nil {
+		return
+	}
+	var now = q.clock.Now()
+	for oldest := q.dedupOrder.Back(); oldest != nil; oldest = q.dedupOrder.Back() {
+		if now.Sub(oldest.Value.(*dedupEntry).seen) < ttl {
+			return
+		}
+		q.removeDedupNotThreadSafe(oldest)
+	}
+}
+
+func (q *Queue) removeDedupNotThreadSafe(elem *list.Element) {
+	q.dedupOrder.Remove(elem)
+	delete(q.dedupIds, elem.Value.(*dedupEntry).id)
+}
+
+// The x-queue-type argument, classic if it wasn't given
+func (q *Queue) Type() string {
+	var typ, found = q.Arguments.GetString("x-queue-type")
+	if !found {
+		return QUEUE_TYPE_CLASSIC
+	}
+	return typ
+}
+
+// Lazy queues, declared with x-queue-mode set to lazy, keep the bodies of
+// their messages on disk until they are delivered
+func (q *Queue) Lazy() bool {
+	var mode, _ = q.Arguments.GetString("x-queue-mode")
+	return mode == "lazy"
+}
+
+// The most messages the queue keeps the bodies of in memory, from the
+// x-max-in-memory-length argument or else the server default. Messages
+// published while it is over this are paged out like on a lazy queue, while
+// the ones at the head stay in memory. False if there is no limit.
+func (q *Queue) MaxInMemoryLength() (int64, bool) {
+	var max, found = q.Arguments.GetInt("x-max-in-memory-length")
+	if !found {
+		max = atomic.LoadInt64(&q.maxInMemory)
+	}
+	return max, max > 0
+}
+
+// Set the limit for when the queue has no x-max-in-memory-length argument.
+// 0 means no limit.
+func (q *Queue) SetDefaultMaxInMemoryLength(max int64) {
+	atomic.StoreInt64(&q.maxInMemory, max)
+	q.queueLock.Lock()
+	defer q.queueLock.Unlock()
+	q.updateSpillingNotThreadSafe()
+}
+
+// Tell the message store whether the queue is at its in-memory length, so
+// the next messages for it are paged out
+func (q *Queue) updateSpillingNotThreadSafe() {
+	if q.msgStore == nil || q.Lazy() {
+		return
+	}
+	var max, bounded = q.MaxInMemoryLength()
+	var spilling = bounded && int64(q.queue.Len()) >= max
+	if spilling != q.spilling {
+		q.spilling = spilling
+		q.msgStore.SetQueueSpilling(q.Name, spilling)
+	}
+}
+
 func (q *Queue) Start() {
 	if q.ctx == nil {
 		panic("nil context")
 	}
+	if q.msgStore != nil && q.Lazy() {
+		q.msgStore.SetQueueLazy(q.Name, true)
+	}
+	q.Touch()
 	go func() {
 		select {
 		case q.maybeReady <- true:
@@ -359,7 +927,10 @@ func (q *Queue) Start() {
 		for {
 			select {
 			case <-q.maybeReady:
-				if q.Closed {
+				q.queueLock.Lock()
+				var closed = q.Closed
+				q.queueLock.Unlock()
+				if closed {
 					fmt.Printf("Queue closed!\n")
 					break
 				}
@@ -383,10 +954,29 @@ func (q *Queue) processOne() {
 	if size == 0 {
 		return
 	}
-	for count := 0; count < size; count++ {
-		q.currentConsumer = (q.currentConsumer + 1) % size
-		var c = q.consumers[q.currentConsumer]
-		c.Ping()
+	// Offer the next message to the consumers of the highest priority in
+	// turn, starting after the one which got the last message. Consumers at
+	// their prefetch limit turn it down and the next one is tried, and lower
+	// priorities only get it if every higher one did. A successful delivery
+	// signals maybeReady, so the queue comes back here for the message after.
+	for start := 0; start < size; {
+		var priority = q.consumers[start].Priority()
+		var end = start + 1
+		for end < size && q.consumers[end].Priority() == priority {
+			end++
+		}
+		var offset = 0
+		if q.currentConsumer >= start && q.currentConsumer < end {
+			offset = q.currentConsumer - start + 1
+		}
+		for count := 0; count < end-start; count++ {
+			var index = start + (offset+count)%(end-start)
+			if q.consumers[index].ConsumeOne() {
+				q.currentConsumer = index
+				return
+			}
+		}
+		start = end
 	}
 }
 
@@ -396,11 +986,20 @@ func (q *Queue) GetOneForced() *amqp.QueueMessage {
 	if q.queue.Len() == 0 {
 		return nil
 	}
-	qMsg := q.queue.Remove(q.queue.Front()).(*amqp.QueueMessage)
+	qMsg := q.removeNotThreadSafe(q.queue.Front())
+	q.updateSpillingNotThreadSafe()
+	q.statDeliver.Mark(1)
+	q.touch(&q.lastDeliver)
 	return qMsg
 }
 
 func (q *Queue) GetOne(rhs ...amqp.MessageResourceHolder) (*amqp.QueueMessage, *amqp.Message) {
+	return q.GetOneFiltered(nil, rhs...)
+}
+
+// Like GetOne, but messages accept turns down are left where they are and the
+// first one it accepts is taken instead. A nil accept takes any message.
+func (q *Queue) GetOneFiltered(accept func(*amqp.QueueMessage) bool, rhs ...amqp.MessageResourceHolder) (*amqp.QueueMessage, *amqp.Message) {
 	q.queueLock.Lock()
 	defer q.queueLock.Unlock()
 	// Empty check
@@ -408,13 +1007,24 @@ func (q *Queue) GetOne(rhs ...amqp.MessageResourceHolder) (*amqp.QueueMessage, *
 		return nil, nil
 	}
 
+	var elem = q.queue.Front()
+	for accept != nil && elem != nil && !accept(elem.Value.(*amqp.QueueMessage)) {
+		elem = elem.Next()
+	}
+	if elem == nil {
+		return nil, nil
+	}
+
 	// Get one message. If there is a message try to acquire the resources
 	// from the channel.
-	var qm = q.queue.Front().Value.(*amqp.QueueMessage)
+	var qm = elem.Value.(*amqp.QueueMessage)
 
 	var msg, acquired = q.msgStore.Get(qm, rhs)
 	if acquired {
-		q.queue.Remove(q.queue.Front())
+		q.removeNotThreadSafe(elem)
+		q.updateSpillingNotThreadSafe()
+		q.statDeliver.Mark(1)
+		q.touch(&q.lastDeliver)
 		return qm, msg
 	}
 	return nil, nil
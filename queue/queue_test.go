@@ -1,9 +1,92 @@
 package queue
 
 import (
+	"context"
 	"testing"
+	"time"
+
+	"github.com/karelbilek/amqp-test-server/amqp"
+	"github.com/karelbilek/amqp-test-server/util"
 )
 
 func TestQueueAdd(t *testing.T) {
 
 }
+
+func TestAutodeleteTimeout(t *testing.T) {
+	var deleteChan = make(chan *Queue, 1)
+	var q = NewQueue(context.Background(), "q", false, false, true, amqp.NewTable(), -1, nil, deleteChan)
+	var clock = util.NewFakeClock(time.Unix(0, 0))
+	q.SetClock(clock)
+	q.hasHadConsumers = true
+
+	// The last consumer going starts the timeout
+	q.RemoveConsumer("ctag")
+	clock.BlockUntil(1)
+	clock.Advance(4 * time.Second)
+	select {
+	case <-deleteChan:
+		t.Fatalf("Queue deleted before the autodelete timeout")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	select {
+	case deleted := <-deleteChan:
+		if deleted != q {
+			t.Errorf("Wrong queue deleted")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Queue was not deleted after the autodelete timeout")
+	}
+}
+
+func TestExpiresTimeout(t *testing.T) {
+	var deleteChan = make(chan *Queue, 1)
+	var args = amqp.NewTable()
+	args.SetKey("x-expires", int32(1000))
+	var q = NewQueue(context.Background(), "q", false, false, false, args, -1, nil, deleteChan)
+	var clock = util.NewFakeClock(time.Unix(0, 0))
+	q.SetClock(clock)
+
+	// Each use restarts the one countdown
+	for i := 0; i < 10; i++ {
+		q.Touch()
+		clock.Advance(500 * time.Millisecond)
+	}
+	select {
+	case <-deleteChan:
+		t.Fatalf("Queue expired while in use")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(500 * time.Millisecond)
+	select {
+	case deleted := <-deleteChan:
+		if deleted != q {
+			t.Errorf("Wrong queue deleted")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Queue did not expire")
+	}
+}
+
+func TestPutBackIsNotADelivery(t *testing.T) {
+	var args = amqp.NewTable()
+	args.SetKey("x-delivery-limit", int32(0))
+	var q = NewQueue(context.Background(), "q", false, false, false, args, -1, nil, make(chan *Queue, 1))
+
+	// A message taken for a consumer whose channel closed before delivery
+	// goes back as it was, however often it happens
+	var qm = &amqp.QueueMessage{Id: 1, MsgSize: 1}
+	for i := 0; i < 3; i++ {
+		q.PutBack(qm)
+		if q.Len() != 1 {
+			t.Fatalf("Put back message is not on the queue")
+		}
+		q.queueLock.Lock()
+		q.removeNotThreadSafe(q.queue.Front())
+		q.queueLock.Unlock()
+	}
+	if qm.DeliveryCount != 0 {
+		t.Errorf("Put back message has delivery count %d", qm.DeliveryCount)
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/karelbilek/amqp-test-server/amqp"
+)
+
+// What happens to a channel holding a delivery unacked past the ack timeout
+type AckTimeoutAction uint8
+
+const (
+	// Close the channel with 406, which requeues everything it held
+	ACK_TIMEOUT_CLOSE AckTimeoutAction = iota
+	// Requeue only the late deliveries and leave the channel open
+	ACK_TIMEOUT_REQUEUE
+)
+
+func ParseAckTimeoutAction(name string) (AckTimeoutAction, error) {
+	switch name {
+	case "close":
+		return ACK_TIMEOUT_CLOSE, nil
+	case "requeue":
+		return ACK_TIMEOUT_REQUEUE, nil
+	}
+	return 0, fmt.Errorf("Unknown ack timeout action '%s'", name)
+}
+
+// Set how long a delivery may stay unacked and what to do with channels
+// that hold one longer. 0 disables the check. This applies to connections
+// opened afterwards.
+func (server *Server) SetAckTimeout(timeout time.Duration, action AckTimeoutAction) {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	server.ackTimeout = timeout
+	server.ackTimeoutAction = action
+}
+
+// Periodically look for deliveries which have been waiting on an ack for
+// longer than the connection's ack timeout
+func (channel *Channel) handleAckTimeout() {
+	var timeout = channel.conn.ackTimeout
+	if timeout == 0 {
+		return
+	}
+	go func() {
+		for {
+			select {
+			case <-channel.ctx.Done():
+				return
+			case <-channel.conn.clock.After(timeout / 4):
+			}
+			if state := channel.getState(); state == CH_STATE_CLOSED || state == CH_STATE_CLOSING {
+				return
+			}
+			var late = channel.lateDeliveries(timeout)
+			if len(late) == 0 {
+				continue
+			}
+			if channel.conn.ackTimeoutAction == ACK_TIMEOUT_CLOSE {
+				// Worded like RabbitMQ's, which clients may look for
+				var msg = fmt.Sprintf(
+					"Delivery acknowledgement on channel %d timed out. Timeout value used: %d ms",
+					channel.id,
+					timeout.Milliseconds(),
+				)
+				channel.sendError(amqp.NewSoftError(406, msg, 0, 0))
+				return
+			}
+			for _, tag := range late {
+				// The client may have acked it in the meantime, which is fine
+				channel.nackOne(tag, true, true)
+			}
+		}
+	}()
+}
+
+// The delivery tags which have been unacked for longer than timeout
+func (channel *Channel) lateDeliveries(timeout time.Duration) []uint64 {
+	channel.ackLock.Lock()
+	defer channel.ackLock.Unlock()
+	var late = make([]uint64, 0)
+	for tag, deliveredAt := range channel.deliveredAt {
+		if channel.conn.clock.Now().Sub(deliveredAt) > timeout {
+			late = append(late, tag)
+		}
+	}
+	return late
+}
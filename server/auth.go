@@ -2,13 +2,24 @@ package server
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"fmt"
+	"net"
+
 	"golang.org/x/crypto/bcrypt"
 )
 
 type User struct {
 	name     string
 	password []byte
+	// The virtual hosts the user may open. nil means all of them
+	vhosts map[string]bool
+}
+
+func (user User) canAccess(vhost string) bool {
+	return user.vhosts == nil || user.vhosts[vhost]
 }
 
 func (s *Server) addUsers(userJson map[string]interface{}) {
@@ -20,12 +31,32 @@ func (s *Server) addUsers(userJson map[string]interface{}) {
 		s.users[defaultUserName] = User{name: defaultUserName, password: decoded}
 	}
 	for name, user := range userJson {
-		var encoded = user.(map[string]interface{})["password_bcrypt_base64"].(string)
-		decoded, err := base64.StdEncoding.DecodeString(encoded)
-		if err != nil {
-			panic("Could not base64 decode password for default config file user: " + name)
+		var userConfig = user.(map[string]interface{})
+		// Users who only log in with a client certificate have no password
+		var decoded []byte
+		if encoded, ok := userConfig["password_bcrypt_base64"].(string); ok {
+			var err error
+			decoded, err = base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				panic("Could not base64 decode password for default config file user: " + name)
+			}
+		}
+		if identities, ok := userConfig["certificates"]; ok {
+			for _, identity := range identities.([]interface{}) {
+				if other, found := s.certUsers[identity.(string)]; found {
+					panic(fmt.Sprintf("Certificate identity '%s' is mapped to both %s and %s", identity, other, name))
+				}
+				s.certUsers[identity.(string)] = name
+			}
+		}
+		var vhosts map[string]bool
+		if vhostList, ok := userConfig["vhosts"]; ok {
+			vhosts = make(map[string]bool)
+			for _, vhost := range vhostList.([]interface{}) {
+				vhosts[vhost.(string)] = true
+			}
 		}
-		s.users[name] = User{name: name, password: decoded}
+		s.users[name] = User{name: name, password: decoded, vhosts: vhosts}
 	}
 }
 
@@ -33,21 +64,70 @@ func (s *Server) addUsers(userJson map[string]interface{}) {
 var defaultUserName = "guest"
 var defaultUserPasswordBase64 = "JDJhJDExJENobGk4dG5rY0RGemJhTjhsV21xR3VNNnFZZ1ZqTzUzQWxtbGtyMHRYN3RkUHMuYjF5SUt5"
 
-func (s *Server) authenticate(mechanism string, blob []byte) bool {
+func (s *Server) authenticate(mechanism string, blob []byte) (User, bool) {
 	// Split. SASL PLAIN has three parts
 	parts := bytes.Split(blob, []byte{0})
 	if len(parts) != 3 {
-		return false
+		return User{}, false
 	}
 
 	for name, user := range s.users {
-		if string(parts[1]) != name {
+		if string(parts[1]) != name || len(user.password) == 0 {
 			continue
 		}
 		err := bcrypt.CompareHashAndPassword(user.password, parts[2])
 		if err == nil {
-			return true
+			return user, true
 		}
 	}
-	return false
+	return User{}, false
+}
+
+// SASL EXTERNAL over TLS. The user is the one whose "certificates" list has
+// the common name of the client's certificate, or failing that one of its
+// subject alternative names. The certificate must have been verified, so the
+// listener's tls.Config needs a ClientCAs pool and a ClientAuth which
+// verifies certificates.
+func (s *Server) authenticateCertificate(network net.Conn) (User, bool) {
+	var tlsConn, ok = network.(*tls.Conn)
+	if !ok {
+		return User{}, false
+	}
+	var state = tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return User{}, false
+	}
+	for _, identity := range certificateIdentities(state.PeerCertificates[0]) {
+		if name, found := s.certUsers[identity]; found {
+			return s.users[name], true
+		}
+	}
+	return User{}, false
+}
+
+func certificateIdentities(cert *x509.Certificate) []string {
+	var identities = make([]string, 0)
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	identities = append(identities, cert.DNSNames...)
+	identities = append(identities, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+	return identities
+}
+
+func isTLS(network net.Conn) bool {
+	var _, ok = network.(*tls.Conn)
+	return ok
+}
+
+// The SASL mechanisms offered in connection.start. EXTERNAL is only offered
+// on TLS connections.
+func (conn *AMQPConnection) mechanisms() string {
+	if isTLS(conn.network) && len(conn.server.certUsers) > 0 {
+		return "PLAIN EXTERNAL"
+	}
+	return "PLAIN"
 }
@@ -2,8 +2,8 @@ package server
 
 import (
 	"github.com/karelbilek/amqp-test-server/amqp"
+	"github.com/karelbilek/amqp-test-server/consumer"
 	"github.com/karelbilek/amqp-test-server/stats"
-	"github.com/karelbilek/amqp-test-server/util"
 )
 
 func (channel *Channel) basicRoute(methodFrame amqp.MethodFrame) *amqp.AMQPError {
@@ -30,7 +30,7 @@ func (channel *Channel) basicRoute(methodFrame amqp.MethodFrame) *amqp.AMQPError
 		return channel.basicReject(method)
 	}
 	var classId, methodId = methodFrame.MethodIdentifier()
-	return amqp.NewHardError(540, "Unable to route method frame", classId, methodId)
+	return channel.notImplemented(classId, methodId)
 }
 
 func (channel *Channel) basicQos(method *amqp.BasicQos) *amqp.AMQPError {
@@ -47,6 +47,9 @@ func (channel *Channel) basicRecover(method *amqp.BasicRecover) *amqp.AMQPError
 
 func (channel *Channel) basicNack(method *amqp.BasicNack) *amqp.AMQPError {
 	if method.Multiple {
+		if err := channel.checkMultipleTag(method.DeliveryTag, 120); err != nil {
+			return err
+		}
 		return channel.nackBelow(method.DeliveryTag, method.Requeue, false)
 	}
 	return channel.nackOne(method.DeliveryTag, method.Requeue, false)
@@ -62,14 +65,20 @@ func (channel *Channel) basicConsume(method *amqp.BasicConsume) *amqp.AMQPError
 			method.Queue = channel.lastQueueName
 		}
 	}
-	// TODO: do not directly access channel.conn.server.queues
-	var queue, found = channel.conn.server.queues[method.Queue]
+	if method.Queue == DirectReplyTo {
+		return channel.consumeDirectReply(method)
+	}
+	// TODO: do not directly access channel.vhost.queues
+	var queue, found = channel.vhost.queues[method.Queue]
 	if !found {
 		// Spec doesn't say, but seems like a 404?
 		return amqp.NewSoftError(404, "Queue not found", classId, methodId)
 	}
+	if err := consumer.ValidateArguments(method.Arguments, channel.server.strictMode); err != nil {
+		return amqp.NewSoftError(406, err.Error(), classId, methodId)
+	}
 	if len(method.ConsumerTag) == 0 {
-		method.ConsumerTag = util.RandomId()
+		method.ConsumerTag = channel.conn.ids.NewId()
 	}
 	amqpErr := channel.addConsumer(queue, method)
 	if amqpErr != nil {
@@ -84,7 +93,9 @@ func (channel *Channel) basicConsume(method *amqp.BasicConsume) *amqp.AMQPError
 
 func (channel *Channel) basicCancel(method *amqp.BasicCancel) *amqp.AMQPError {
 
-	if err := channel.removeConsumer(method.ConsumerTag); err != nil {
+	if channel.directReplyAddress != "" && method.ConsumerTag == channel.directReplyTag {
+		channel.cancelDirectReply()
+	} else if err := channel.removeConsumer(method.ConsumerTag); err != nil {
 		var classId, methodId = method.MethodIdentifier()
 		return amqp.NewSoftError(404, "Consumer not found", classId, methodId)
 	}
@@ -98,16 +109,25 @@ func (channel *Channel) basicCancel(method *amqp.BasicCancel) *amqp.AMQPError {
 func (channel *Channel) basicCancelOk(method *amqp.BasicCancelOk) *amqp.AMQPError {
 	// TODO(MAY)
 	var classId, methodId = method.MethodIdentifier()
-	return amqp.NewHardError(540, "Not implemented", classId, methodId)
+	return channel.notImplemented(classId, methodId)
 }
 
 func (channel *Channel) basicPublish(method *amqp.BasicPublish) *amqp.AMQPError {
 	defer stats.RecordHisto(channel.statPublish, stats.Start())
-	var _, found = channel.server.exchanges[method.Exchange]
+	var classId, methodId = method.MethodIdentifier()
+	var exchange, found = channel.vhost.exchanges[method.Exchange]
 	if !found {
-		var classId, methodId = method.MethodIdentifier()
 		return amqp.NewSoftError(404, "Exchange not found", classId, methodId)
 	}
+	// Internal exchanges only receive messages through exchange bindings
+	if exchange.Internal {
+		return amqp.NewSoftError(403, "Cannot publish to internal exchange", classId, methodId)
+	}
+	// Like RabbitMQ, refuse immediate publishes outright rather than
+	// silently treating them as regular ones
+	if method.Immediate {
+		return amqp.NewHardError(540, "Immediate publishing is not supported", classId, methodId)
+	}
 	channel.startPublish(method)
 	return nil
 }
@@ -115,12 +135,13 @@ func (channel *Channel) basicPublish(method *amqp.BasicPublish) *amqp.AMQPError
 func (channel *Channel) basicGet(method *amqp.BasicGet) *amqp.AMQPError {
 	// var classId, methodId = method.MethodIdentifier()
 	// channel.conn.connectionErrorWithMethod(540, "Not implemented", classId, methodId)
-	var queue, found = channel.conn.server.queues[method.Queue]
+	var queue, found = channel.vhost.queues[method.Queue]
 	if !found {
 		// Spec doesn't say, but seems like a 404?
 		var classId, methodId = method.MethodIdentifier()
 		return amqp.NewSoftError(404, "Queue not found", classId, methodId)
 	}
+	queue.Touch()
 	var qm = queue.GetOneForced()
 	if qm == nil {
 		channel.SendMethod(&amqp.BasicGetEmpty{})
@@ -128,7 +149,7 @@ func (channel *Channel) basicGet(method *amqp.BasicGet) *amqp.AMQPError {
 	}
 
 	var rhs = []amqp.MessageResourceHolder{channel}
-	msg, err := channel.server.msgStore.GetAndDecrRef(qm, queue.Name, rhs)
+	msg, err := channel.vhost.msgStore.GetAndDecrRef(qm, queue.Name, rhs)
 	if err != nil {
 		// TODO: return 500 error
 		channel.SendMethod(&amqp.BasicGetEmpty{})
@@ -142,11 +163,15 @@ func (channel *Channel) basicGet(method *amqp.BasicGet) *amqp.AMQPError {
 		RoutingKey:   msg.Key,
 		MessageCount: 1,
 	}, msg)
+	channel.vhost.traceDeliver(queue.Name, msg)
 	return nil
 }
 
 func (channel *Channel) basicAck(method *amqp.BasicAck) *amqp.AMQPError {
 	if method.Multiple {
+		if err := channel.checkMultipleTag(method.DeliveryTag, 80); err != nil {
+			return err
+		}
 		return channel.ackBelow(method.DeliveryTag, false)
 	}
 	return channel.ackOne(method.DeliveryTag, false)
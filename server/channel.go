@@ -3,10 +3,13 @@ package server
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"math"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/karelbilek/amqp-test-server/amqp"
 	"github.com/karelbilek/amqp-test-server/consumer"
@@ -22,14 +25,19 @@ const (
 )
 
 type Channel struct {
-	ctx            context.Context
-	id             uint16
-	server         *Server
-	incoming       chan *amqp.WireFrame
+	ctx      context.Context
+	id       uint16
+	server   *Server
+	vhost    *VirtualHost
+	incoming chan *amqp.WireFrame
+	// Signalled once a channel.close or close-ok frame has been handled
+	closeHandled   chan struct{}
 	outgoing       chan *amqp.WireFrame
 	conn           *AMQPConnection
 	state          uint8
+	stateLock      sync.Mutex
 	currentMessage *amqp.Message
+	currentSize    uint64
 	consumers      map[string]*consumer.Consumer
 	consumerLock   sync.Mutex
 	sendLock       sync.Mutex
@@ -39,6 +47,10 @@ type Channel struct {
 	txLock         sync.Mutex
 	txMessages     []*amqp.TxMessage
 	txAcks         []*amqp.TxAck
+	// Publisher confirms, see confirmMethods.go. Both are only used by the
+	// goroutine handling the channel's frames.
+	confirmMode bool
+	publishTag  uint64
 	// Consumers
 	msgIndex uint64
 	// Delivery Tracking
@@ -46,6 +58,14 @@ type Channel struct {
 	deliveryLock sync.Mutex
 	ackLock      sync.Mutex
 	awaitingAcks map[uint64]amqp.UnackedMessage
+	// The tags in awaitingAcks in delivery order, so multiple acks don't go
+	// through all of them. Acked tags are only dropped once they reach the
+	// front, see trimUnackedTags
+	unackedTags []uint64
+	// When each message in awaitingAcks was delivered, for the ack timeout
+	deliveredAt map[uint64]time.Time
+	// Set by shutdown, after which no more unacked messages are taken
+	acksClosed bool
 	// Channel QOS Limits
 	limitLock     sync.Mutex
 	prefetchSize  uint32
@@ -55,6 +75,14 @@ type Channel struct {
 	// Consumer default QOS limits
 	defaultPrefetchSize  uint32
 	defaultPrefetchCount uint16
+	// Set while consuming direct replies, see directreply.go
+	directReplyAddress string
+	directReplyTag     string
+	// The pool handling the channel's frames, see workerpool.go. nil when
+	// the channel has its own goroutine
+	pool           *workerPool
+	scheduled      atomic.Bool
+	incomingClosed atomic.Bool
 	// Stats
 	statPublish    stats.Histogram
 	statRoute      stats.Histogram
@@ -69,7 +97,9 @@ func NewChannel(ctx context.Context, id uint16, conn *AMQPConnection) *Channel {
 	return &Channel{
 		id:           id,
 		server:       conn.server,
+		vhost:        conn.vhost,
 		incoming:     make(chan *amqp.WireFrame, 100),
+		closeHandled: make(chan struct{}, 1),
 		outgoing:     conn.outgoing,
 		conn:         conn,
 		flow:         true,
@@ -78,6 +108,8 @@ func NewChannel(ctx context.Context, id uint16, conn *AMQPConnection) *Channel {
 		txAcks:       make([]*amqp.TxAck, 0),
 		consumers:    make(map[string]*consumer.Consumer),
 		awaitingAcks: make(map[uint64]amqp.UnackedMessage),
+		deliveredAt:  make(map[uint64]time.Time),
+		pool:         conn.channelPool(id),
 		// Stats
 		statPublish:    stats.MakeHistogram("statPublish"),
 		statRoute:      stats.MakeHistogram("statRoute"),
@@ -91,13 +123,14 @@ func (channel *Channel) commitTx() *amqp.AMQPError {
 	channel.txLock.Lock()
 	defer channel.txLock.Unlock()
 	// messages
-	queueMessagesByQueue, err := channel.server.msgStore.AddTxMessages(channel.txMessages)
+	var txMessages = channel.vhost.dropTxDuplicates(channel.txMessages)
+	queueMessagesByQueue, err := channel.vhost.msgStore.AddTxMessages(txMessages)
 	if err != nil {
 		return amqp.NewSoftError(500, err.Error(), 60, 40)
 	}
 
 	for queueName, qms := range queueMessagesByQueue {
-		queue, found := channel.server.queues[queueName]
+		queue, found := channel.vhost.queues[queueName]
 		// the
 		if !found {
 			continue
@@ -109,10 +142,15 @@ func (channel *Channel) commitTx() *amqp.AMQPError {
 				// it is going away, so worst case if the server dies we have to process
 				// and discard the message on boot.
 				var rhs = []amqp.MessageResourceHolder{channel}
-				channel.server.msgStore.RemoveRef(qm, queueName, rhs)
+				channel.vhost.msgStore.RemoveRef(qm, queueName, rhs)
 			}
 		}
 	}
+	// Ids only count once the message is committed, so a rolled back
+	// publish can be retried
+	for _, txmsg := range txMessages {
+		channel.vhost.recordMessageId(txmsg.QueueName, txmsg.Msg)
+	}
 
 	// Acks
 	// todo: remove acked messages from persistent storage in a single
@@ -158,13 +196,17 @@ func (channel *Channel) recover(requeue bool) {
 		// Requeue. Make sure we update stats
 		for _, unacked := range channel.awaitingAcks {
 			// re-add to queue
-			queue, qFound := channel.server.queues[unacked.QueueName]
+			queue, qFound := channel.vhost.queues[unacked.QueueName]
 			if qFound {
 				queue.Readd(unacked.QueueName, unacked.Msg)
 			}
 			// else: The queue gone. The reference would have been removed
 			//       then so we don't remove it now in an else clause
 
+			if qFound {
+				queue.RemoveUnacked(false)
+			}
+
 			consumer, cFound := channel.consumers[unacked.ConsumerTag]
 			// decr channel active
 			channel.ReleaseResources(unacked.Msg)
@@ -175,16 +217,29 @@ func (channel *Channel) recover(requeue bool) {
 		}
 		// Clear awaiting acks
 		channel.awaitingAcks = make(map[uint64]amqp.UnackedMessage)
+		channel.unackedTags = nil
+		channel.deliveredAt = make(map[uint64]time.Time)
 	} else {
 		// Redeliver. Don't need to mess with stats.
 		// We do this in a short-lived goroutine since this could end up
-		// blocking on sending to the network inside the consumer
+		// blocking on sending to the network inside the consumer. It works
+		// on a copy, since acks keep changing awaitingAcks meanwhile.
+		channel.ackLock.Lock()
+		var redeliver = make(map[uint64]amqp.UnackedMessage, len(channel.awaitingAcks))
+		for tag, unacked := range channel.awaitingAcks {
+			redeliver[tag] = unacked
+		}
+		channel.ackLock.Unlock()
+		var consumers = make(map[string]*consumer.Consumer, len(channel.consumers))
+		for consumerTag, consumer := range channel.consumers {
+			consumers[consumerTag] = consumer
+		}
 		go func() {
-			for tag, unacked := range channel.awaitingAcks {
-				consumer, cFound := channel.consumers[unacked.ConsumerTag]
+			for tag, unacked := range redeliver {
+				consumer, cFound := consumers[unacked.ConsumerTag]
 				if cFound {
 					// Consumer exists, try to deliver again
-					channel.server.msgStore.IncrDeliveryCount(unacked.QueueName, unacked.Msg)
+					channel.vhost.msgStore.IncrDeliveryCount(unacked.QueueName, unacked.Msg)
 					consumer.Redeliver(tag, unacked.Msg)
 				} else {
 					// no consumer, drop message
@@ -192,7 +247,7 @@ func (channel *Channel) recover(requeue bool) {
 						channel,
 						consumer,
 					}
-					channel.server.msgStore.RemoveRef(unacked.Msg, unacked.QueueName, rhs)
+					channel.vhost.msgStore.RemoveRef(unacked.Msg, unacked.QueueName, rhs)
 				}
 
 			}
@@ -224,28 +279,92 @@ func (channel *Channel) ackBelow(tag uint64, commitTx bool) *amqp.AMQPError {
 	}
 	channel.ackLock.Lock()
 	defer channel.ackLock.Unlock()
-	for k, unacked := range channel.awaitingAcks {
-		if k <= tag || tag == 0 {
-			consumer, cFound := channel.consumers[unacked.ConsumerTag]
-			// Initialize resource holders array
-			var rhs = []amqp.MessageResourceHolder{channel}
-			if cFound {
-				rhs = append(rhs, consumer)
-			}
-			err := channel.server.msgStore.RemoveRef(unacked.Msg, unacked.QueueName, rhs)
-			// TODO: if this was an error do I still delete the ack we're waiting for?
-			// The resources probably haven't been released.
-			if err != nil {
-				return amqp.NewSoftError(500, err.Error(), 60, 80)
-			}
-			delete(channel.awaitingAcks, k)
+	var freed = make(map[*consumer.Consumer]bool)
+	defer pingConsumers(freed)
+	for _, k := range channel.unackedUpTo(tag) {
+		var unacked = channel.awaitingAcks[k]
+		consumer, cFound := channel.consumers[unacked.ConsumerTag]
+		// Initialize resource holders array
+		var rhs = []amqp.MessageResourceHolder{channel}
+		if cFound {
+			rhs = append(rhs, consumer)
+		}
+		err := channel.vhost.msgStore.RemoveRef(unacked.Msg, unacked.QueueName, rhs)
+		// TODO: if this was an error do I still delete the ack we're waiting for?
+		// The resources probably haven't been released.
+		if err != nil {
+			return amqp.NewSoftError(500, err.Error(), 60, 80)
+		}
+		channel.forgetUnacked(k, true)
 
-			if cFound {
-				consumer.Ping()
-			}
+		if cFound {
+			freed[consumer] = true
 		}
 	}
-	// TODO: should this be an error if nothing was actually deleted and tag != 0?
+	return nil
+}
+
+// The tags waiting on an ack up to and including tag, oldest first. 0 means
+// all of them. The caller must hold ackLock.
+func (channel *Channel) unackedUpTo(tag uint64) []uint64 {
+	var tags = make([]uint64, 0)
+	for _, k := range channel.unackedTags {
+		if tag != 0 && k > tag {
+			break
+		}
+		if _, found := channel.awaitingAcks[k]; found {
+			tags = append(tags, k)
+		}
+	}
+	return tags
+}
+
+// Drop the tags at the front of unackedTags which were acked. Each tag is
+// only dropped once, so a batch of multiple acks doesn't cost more than the
+// messages it acks. Tags acked behind an older unacked message stay until
+// there are twice as many tags as unacked messages. The caller must hold
+// ackLock.
+func (channel *Channel) trimUnackedTags() {
+	var start = 0
+	for start < len(channel.unackedTags) {
+		if _, found := channel.awaitingAcks[channel.unackedTags[start]]; found {
+			break
+		}
+		start += 1
+	}
+	channel.unackedTags = channel.unackedTags[start:]
+	if len(channel.unackedTags) <= 2*len(channel.awaitingAcks)+16 {
+		return
+	}
+	var tags = make([]uint64, 0, len(channel.awaitingAcks))
+	for _, k := range channel.unackedTags {
+		if _, found := channel.awaitingAcks[k]; found {
+			tags = append(tags, k)
+		}
+	}
+	channel.unackedTags = tags
+}
+
+// Let consumers which had messages acked or nacked take more
+func pingConsumers(consumers map[*consumer.Consumer]bool) {
+	for consumer := range consumers {
+		consumer.Ping()
+	}
+}
+
+// An ack or nack with multiple set must name a delivery still waiting on an
+// ack, except that 0 means all of them. Tags are never reused on a channel,
+// so this also catches tags which were already acked.
+func (channel *Channel) checkMultipleTag(tag uint64, methodId uint16) *amqp.AMQPError {
+	if tag == 0 {
+		return nil
+	}
+	channel.ackLock.Lock()
+	defer channel.ackLock.Unlock()
+	if _, found := channel.awaitingAcks[tag]; !found {
+		var msg = fmt.Sprintf("Precondition Failed: Delivery Tag not found: %d", tag)
+		return amqp.NewSoftError(406, msg, 60, methodId)
+	}
 	return nil
 }
 
@@ -274,13 +393,13 @@ func (channel *Channel) ackOne(tag uint64, commitTx bool) *amqp.AMQPError {
 	if cFound {
 		rhs = append(rhs, consumer)
 	}
-	err := channel.server.msgStore.RemoveRef(unacked.Msg, unacked.QueueName, rhs)
+	err := channel.vhost.msgStore.RemoveRef(unacked.Msg, unacked.QueueName, rhs)
 	// TODO: if this is an error, do I still delete the tag? the resources
 	// probably haven't been freed
 	if err != nil {
 		return amqp.NewSoftError(500, err.Error(), 60, 80)
 	}
-	delete(channel.awaitingAcks, tag)
+	channel.forgetUnacked(tag, true)
 
 	if cFound {
 		consumer.Ping()
@@ -301,44 +420,43 @@ func (channel *Channel) nackBelow(tag uint64, requeue bool, commitTx bool) *amqp
 	}
 
 	// Non-transaction mode
-	var count = 0
-	for k, unacked := range channel.awaitingAcks {
-		if k <= tag || tag == 0 {
-			count += 1
-			// Init
-			consumer, cFound := channel.consumers[unacked.ConsumerTag]
-			queue, qFound := channel.server.queues[unacked.QueueName]
+	var freed = make(map[*consumer.Consumer]bool)
+	defer pingConsumers(freed)
+	for _, k := range channel.unackedUpTo(tag) {
+		var unacked = channel.awaitingAcks[k]
+		// Init
+		consumer, cFound := channel.consumers[unacked.ConsumerTag]
+		queue, qFound := channel.vhost.queues[unacked.QueueName]
+
+		// Initialize resource holders array
+		var rhs = []amqp.MessageResourceHolder{channel}
+		if cFound {
+			rhs = append(rhs, consumer)
+		}
 
-			// Initialize resource holders array
-			var rhs = []amqp.MessageResourceHolder{channel}
-			if cFound {
-				rhs = append(rhs, consumer)
+		// requeue and release the approriate resources
+		if requeue && qFound {
+			// If we're requeueing we release the resources but don't remove the
+			// reference.
+			queue.Readd(unacked.QueueName, unacked.Msg)
+			for _, rh := range rhs {
+				rh.ReleaseResources(unacked.Msg)
 			}
-
-			// requeue and release the approriate resources
-			if requeue && qFound {
-				// If we're requeueing we release the resources but don't remove the
-				// reference.
-				queue.Readd(unacked.QueueName, unacked.Msg)
-				for _, rh := range rhs {
-					rh.ReleaseResources(unacked.Msg)
-				}
-			} else {
-				// If we aren't re-adding, remove the ref and all associated
-				// resources
-				err := channel.server.msgStore.RemoveRef(unacked.Msg, unacked.QueueName, rhs)
-				if err != nil {
-					return amqp.NewSoftError(500, err.Error(), 60, 120)
-				}
+		} else {
+			// If we aren't re-adding, remove the ref and all associated
+			// resources
+			err := channel.vhost.msgStore.RemoveRef(unacked.Msg, unacked.QueueName, rhs)
+			if err != nil {
+				return amqp.NewSoftError(500, err.Error(), 60, 120)
 			}
+		}
 
-			// Remove this unacked message from the ones
-			// we're waiting for acks on and ping the consumer
-			// since there might be a message available now
-			delete(channel.awaitingAcks, k)
-			if cFound {
-				consumer.Ping()
-			}
+		// Remove this unacked message from the ones
+		// we're waiting for acks on and ping the consumer
+		// afterwards since there might be a message available now
+		channel.forgetUnacked(k, false)
+		if cFound {
+			freed[consumer] = true
 		}
 	}
 	return nil
@@ -362,7 +480,7 @@ func (channel *Channel) nackOne(tag uint64, requeue bool, commitTx bool) *amqp.A
 	// Non-transaction mode
 	// Init
 	consumer, cFound := channel.consumers[unacked.ConsumerTag]
-	queue, qFound := channel.server.queues[unacked.QueueName]
+	queue, qFound := channel.vhost.queues[unacked.QueueName]
 
 	// Initialize resource holders array
 	var rhs = []amqp.MessageResourceHolder{channel}
@@ -381,7 +499,7 @@ func (channel *Channel) nackOne(tag uint64, requeue bool, commitTx bool) *amqp.A
 	} else {
 		// If we aren't re-adding, remove the ref and all associated
 		// resources
-		err := channel.server.msgStore.RemoveRef(unacked.Msg, unacked.QueueName, rhs)
+		err := channel.vhost.msgStore.RemoveRef(unacked.Msg, unacked.QueueName, rhs)
 		if err != nil {
 			return amqp.NewSoftError(500, err.Error(), 60, 120)
 		}
@@ -390,7 +508,7 @@ func (channel *Channel) nackOne(tag uint64, requeue bool, commitTx bool) *amqp.A
 	// Remove this unacked message from the ones
 	// we're waiting for acks on and ping the consumer
 	// since there might be a message available now
-	delete(channel.awaitingAcks, tag)
+	channel.forgetUnacked(tag, false)
 	if cFound {
 		consumer.Ping()
 	}
@@ -402,19 +520,53 @@ func (channel *Channel) FlowActive() bool {
 	return channel.flow
 }
 
-func (channel *Channel) AddUnackedMessage(consumerTag string, msg *amqp.QueueMessage, queueName string) uint64 {
-	var tag = channel.nextDeliveryTag()
-	var unacked = amqp.NewUnackedMessage(consumerTag, msg, queueName)
+// Called when a queue is deleted out from under one of this channel's
+// consumers. Clients that don't advertise consumer_cancel_notify don't expect
+// an unsolicited basic.cancel, so their channel is closed instead.
+func (channel *Channel) ConsumerCancelled(consumerTag string, queueName string) {
+	if channel.conn.clientCapability("consumer_cancel_notify") {
+		channel.SendMethod(&amqp.BasicCancel{
+			ConsumerTag: consumerTag,
+			NoWait:      true,
+		})
+		return
+	}
+	channel.sendError(amqp.NewSoftError(404, fmt.Sprintf("Queue '%s' deleted, consumer '%s' cancelled", queueName, consumerTag), 0, 0))
+}
+
+func (channel *Channel) AddUnackedMessage(consumerTag string, msg *amqp.QueueMessage, queueName string) (uint64, bool) {
 	channel.ackLock.Lock()
 	defer channel.ackLock.Unlock()
+	if channel.acksClosed {
+		return 0, false
+	}
+	var tag = channel.nextDeliveryTag()
+	var unacked = amqp.NewUnackedMessage(consumerTag, msg, queueName)
 
 	_, found := channel.awaitingAcks[tag]
 	if found {
-		panic(fmt.Sprintf("Already found tag: %s", tag))
+		panic(fmt.Sprintf("Already found tag: %d", tag))
 	}
 	channel.awaitingAcks[tag] = *unacked
+	channel.unackedTags = append(channel.unackedTags, tag)
+	channel.deliveredAt[tag] = channel.conn.clock.Now()
 	// fmt.Printf("Adding tag: %d\n", tag)
-	return tag
+	return tag, true
+}
+
+// Stop waiting on an ack for tag and update the stats of the queue the
+// message came from. The caller must hold ackLock.
+func (channel *Channel) forgetUnacked(tag uint64, acked bool) {
+	var unacked, found = channel.awaitingAcks[tag]
+	if !found {
+		return
+	}
+	delete(channel.awaitingAcks, tag)
+	delete(channel.deliveredAt, tag)
+	channel.trimUnackedTags()
+	if queue, qFound := channel.vhost.queues[unacked.QueueName]; qFound {
+		queue.RemoveUnacked(acked)
+	}
 }
 
 func (channel *Channel) addConsumer(q *queue.Queue, method *amqp.BasicConsume) *amqp.AMQPError {
@@ -422,7 +574,7 @@ func (channel *Channel) addConsumer(q *queue.Queue, method *amqp.BasicConsume) *
 	// Create consumer
 	var consumer = consumer.NewConsumer(
 		channel.ctx,
-		channel.server.msgStore,
+		channel.vhost.msgStore,
 		method.Arguments,
 		channel,
 		method.ConsumerTag,
@@ -438,24 +590,27 @@ func (channel *Channel) addConsumer(q *queue.Queue, method *amqp.BasicConsume) *
 
 	channel.consumerLock.Lock()
 	defer channel.consumerLock.Unlock()
-	// Make sure the doesn't exist on this channel
+	// Tags only have to be unique within the channel, so a client which
+	// reconnects can reuse its tags on the new channel
 	_, found := channel.consumers[consumer.ConsumerTag]
 	if found {
-		return amqp.NewHardError(
-			530,
+		return amqp.NewSoftError(
+			403,
 			fmt.Sprintf("Consumer tag already exists: %s", consumer.ConsumerTag),
 			classId,
 			methodId,
 		)
 	}
 
-	// Add the consumer to the queue, then channel
+	// Add the consumer to the channel, then queue. The queue may deliver to
+	// it straight away, and a delivery dropped by an interceptor is acked
+	// with the channel's consumer.
+	channel.consumers[consumer.ConsumerTag] = consumer
 	code, err := q.AddConsumer(consumer, method.Exclusive)
 	if err != nil {
-		return amqp.NewSoftError(code, err.Error(), classId, methodId)
+		delete(channel.consumers, consumer.ConsumerTag)
+		return amqp.NewError(code, err.Error(), classId, methodId)
 	}
-
-	channel.consumers[consumer.ConsumerTag] = consumer
 	consumer.Start()
 	return nil
 }
@@ -470,7 +625,7 @@ func (channel *Channel) ReleaseResources(qm *amqp.QueueMessage) {
 func (channel *Channel) AcquireResources(qm *amqp.QueueMessage) bool {
 	channel.limitLock.Lock()
 	defer channel.limitLock.Unlock()
-	var sizeOk = channel.prefetchSize == 0 || channel.activeSize < channel.prefetchSize
+	var sizeOk = consumer.PrefetchSizeOk(channel.prefetchSize, channel.activeSize, channel.activeCount, qm.MsgSize)
 	var countOk = channel.prefetchCount == 0 || channel.activeCount < channel.prefetchCount
 	// If we're OK on size and count, acquire the resources
 	if sizeOk && countOk {
@@ -491,12 +646,37 @@ func (channel *Channel) setPrefetch(count uint16, size uint32, global bool) {
 	}
 }
 
+// The channel moves from INIT to OPEN on channel.open. Sending channel.close
+// moves it to CLOSING, and it is CLOSED once the client sends close-ok (or
+// its own channel.close) or the connection goes away. While CLOSING only
+// close methods are acted on; every other frame is discarded.
+func (channel *Channel) getState() uint8 {
+	channel.stateLock.Lock()
+	defer channel.stateLock.Unlock()
+	return channel.state
+}
+
 func (channel *Channel) setStateOpen() {
+	channel.stateLock.Lock()
+	defer channel.stateLock.Unlock()
 	channel.state = CH_STATE_OPEN
 }
 
+// Move to CLOSING. Reports false if the channel is already closing or
+// closed, in which case the caller must not send another channel.close.
+func (channel *Channel) startClosing() bool {
+	channel.stateLock.Lock()
+	defer channel.stateLock.Unlock()
+	if channel.state == CH_STATE_CLOSING || channel.state == CH_STATE_CLOSED {
+		return false
+	}
+	channel.state = CH_STATE_CLOSING
+	return true
+}
+
 func (channel *Channel) startPublish(method *amqp.BasicPublish) error {
 	channel.currentMessage = amqp.NewMessage(method, channel.conn.id)
+	channel.currentSize = 0
 	return nil
 }
 
@@ -510,50 +690,93 @@ func (channel *Channel) nextDeliveryTag() uint64 {
 
 func (channel *Channel) start() {
 	if channel.id == 0 {
-		channel.state = CH_STATE_OPEN
+		channel.setStateOpen()
 		go channel.startConnection()
 	} else {
 		go channel.startChannel()
+		channel.handleAckTimeout()
+	}
+	// Pooled channels are handled on a worker once frames arrive
+	if channel.pool != nil {
+		return
 	}
 
 	// Receive method frames from the client and route them
 	go func() {
 		for {
-			if channel.state == CH_STATE_CLOSED {
+			if channel.getState() == CH_STATE_CLOSED {
 				break
 			}
 			var frame *amqp.WireFrame
+			var open bool
 			select {
-			case frame = <-channel.incoming:
+			case frame, open = <-channel.incoming:
 			case <-channel.ctx.Done():
 				return
 			}
-			var amqpErr *amqp.AMQPError = nil
-			switch {
-			case frame.FrameType == uint8(amqp.FrameMethod):
-				amqpErr = channel.routeMethod(frame)
-			case frame.FrameType == uint8(amqp.FrameHeader):
-				if channel.state != CH_STATE_CLOSING {
-					amqpErr = channel.handleContentHeader(frame)
-				}
-			case frame.FrameType == uint8(amqp.FrameBody):
-				if channel.state != CH_STATE_CLOSING {
-					amqpErr = channel.handleContentBody(frame)
-				}
-			default:
-				amqpErr = amqp.NewHardError(500, "Unknown frame type", 0, 0)
-			}
-			if amqpErr != nil {
-				channel.sendError(amqpErr)
+			// The connection is gone
+			if !open {
+				channel.shutdown()
+				return
 			}
+			channel.handleFrame(frame)
 		}
 	}()
 }
 
+func (channel *Channel) handleFrame(frame *amqp.WireFrame) {
+	// Body frames end up in the message being published, which outlives the
+	// handling, so the frame is only looked at before it is handled
+	var closing = isChannelClose(frame)
+	var amqpErr *amqp.AMQPError = nil
+	switch {
+	case frame.FrameType == uint8(amqp.FrameMethod):
+		amqpErr = channel.routeMethod(frame)
+	case frame.FrameType == uint8(amqp.FrameHeader):
+		if channel.getState() != CH_STATE_CLOSING {
+			amqpErr = channel.handleContentHeader(frame)
+		} else {
+			// Content that was cut off by the close is never published
+			channel.currentMessage = nil
+		}
+	case frame.FrameType == uint8(amqp.FrameBody):
+		if channel.getState() != CH_STATE_CLOSING {
+			amqpErr = channel.handleContentBody(frame)
+		} else {
+			channel.currentMessage = nil
+		}
+	default:
+		amqpErr = amqp.NewHardError(500, "Unknown frame type", 0, 0)
+	}
+	if amqpErr != nil {
+		channel.sendError(amqpErr)
+	}
+	if closing {
+		channel.closeHandled <- struct{}{}
+	}
+}
+
+// Whether the frame is a channel.close or close-ok for a channel other than
+// 0. The connection waits for those to be handled before reading on, since
+// the client may reopen the channel number straight after.
+func isChannelClose(frame *amqp.WireFrame) bool {
+	if frame.Channel == 0 || frame.FrameType != uint8(amqp.FrameMethod) || len(frame.Payload) < 4 {
+		return false
+	}
+	var classId = binary.BigEndian.Uint16(frame.Payload)
+	var methodId = binary.BigEndian.Uint16(frame.Payload[2:])
+	return classId == amqp.ClassIdChannel &&
+		(methodId == amqp.MethodIdChannelClose || methodId == amqp.MethodIdChannelCloseOk)
+}
+
 func (channel *Channel) sendError(amqpErr *amqp.AMQPError) {
 	if amqpErr.Soft {
+		// Only the first error is reported, the client can't tell apart
+		// errors raised after it was told the channel is closing
+		if !channel.startClosing() {
+			return
+		}
 		fmt.Println("Sending channel error:", amqpErr.Msg)
-		channel.state = CH_STATE_CLOSING
 		channel.SendMethod(&amqp.ChannelClose{
 			ReplyCode: amqpErr.Code,
 			ReplyText: amqpErr.Msg,
@@ -570,27 +793,45 @@ func (channel *Channel) startChannel() {
 }
 
 func (channel *Channel) close(code uint16, reason string, classId uint16, methodId uint16) {
+	if !channel.startClosing() {
+		return
+	}
 	channel.SendMethod(&amqp.ChannelClose{
 		ReplyCode: code,
 		ReplyText: reason,
 		ClassId:   classId,
 		MethodId:  methodId,
 	})
-	channel.state = CH_STATE_CLOSING
 }
 
 func (channel *Channel) shutdown() {
+	channel.stateLock.Lock()
 	if channel.state == CH_STATE_CLOSED {
+		channel.stateLock.Unlock()
 		fmt.Printf("Shutdown already finished on %d\n", channel.id)
 		return
 	}
+	var wasOpen = channel.state != CH_STATE_INIT
 	channel.state = CH_STATE_CLOSED
+	channel.stateLock.Unlock()
 	// unregister this channel
 	channel.conn.deregisterChannel(channel.id)
+	if wasOpen && channel.id != 0 {
+		channel.vhost.emit("channel.close", map[string]interface{}{
+			"connection": channel.conn.id,
+			"channel":    channel.id,
+		})
+	}
 	// remove any consumers associated with this channel
 	for _, consumer := range channel.consumers {
 		channel.removeConsumer(consumer.ConsumerTag)
 	}
+	channel.cancelDirectReply()
+	// Deliveries racing with the shutdown either get in before this and are
+	// requeued below, or are refused and put back by their consumer
+	channel.ackLock.Lock()
+	channel.acksClosed = true
+	channel.ackLock.Unlock()
 	// Any unacked messages should be re-added
 	// for tag, unacked := range channel.awaitingAcks {
 	// TODO(MUST): If we want at-most-once delivery we can't re-add these
@@ -607,6 +848,9 @@ func (channel *Channel) removeConsumer(consumerTag string) error {
 		return errors.New("Consumer not found")
 	}
 	consumer.Stop()
+	if q, qFound := channel.vhost.queues[consumer.QueueName()]; qFound {
+		q.RemoveConsumer(consumerTag)
+	}
 	delete(channel.consumers, consumerTag)
 	return nil
 }
@@ -617,11 +861,28 @@ func (channel *Channel) SendMethod(method amqp.MethodFrame) {
 	// fmt.Printf("Sending method: %s\n", method.MethodName())
 	var buf = bytes.NewBuffer([]byte{})
 	method.Write(buf)
-	channel.outgoing <- &amqp.WireFrame{FrameType: uint8(amqp.FrameMethod), Channel: channel.id, Payload: buf.Bytes()}
+	channel.send(&amqp.WireFrame{FrameType: uint8(amqp.FrameMethod), Channel: channel.id, Payload: buf.Bytes()})
+}
+
+// Queue a frame for the connection to write. Once the connection is torn
+// down nothing writes them any more, and frames are dropped instead of
+// blocking the sender, which may be a consumer delivering as the channel
+// closes.
+func (channel *Channel) send(frame *amqp.WireFrame) bool {
+	select {
+	case channel.outgoing <- frame:
+		return true
+	case <-channel.conn.done:
+		return false
+	}
 }
 
 // Send a method frame out to the client
 func (channel *Channel) SendContent(method amqp.MethodFrame, message *amqp.Message) {
+	message, ok := channel.interceptDeliver(method, message)
+	if !ok {
+		return
+	}
 	var start = stats.Start()
 	channel.sendLock.Lock()
 	defer channel.sendLock.Unlock()
@@ -631,7 +892,7 @@ func (channel *Channel) SendContent(method amqp.MethodFrame, message *amqp.Messa
 	amqp.WriteShort(buf, message.Header.ContentWeight)
 	amqp.WriteLonglong(buf, message.Header.ContentBodySize)
 	var propBuf = bytes.NewBuffer(make([]byte, 0, 20))
-	flags, err := message.Header.Properties.WriteProps(propBuf)
+	flags, err := message.Header.Properties.WriteProps(propBuf, channel.server.strictMode)
 	if err != nil {
 		panic("Error writing header!")
 	}
@@ -642,61 +903,112 @@ func (channel *Channel) SendContent(method amqp.MethodFrame, message *amqp.Messa
 	// Send method
 	channel.SendMethod(method)
 	// Send header
-	channel.outgoing <- &amqp.WireFrame{FrameType: uint8(amqp.FrameHeader), Channel: channel.id, Payload: buf.Bytes()}
-	// Send body
+	if !channel.send(&amqp.WireFrame{FrameType: uint8(amqp.FrameHeader), Channel: channel.id, Payload: buf.Bytes()}) {
+		return
+	}
+	// Send body. The frames are shared by every delivery of the message, so
+	// each gets its own with this channel's id.
 	for _, b := range message.Payload {
-		b.Channel = channel.id
-		channel.outgoing <- b
+		if !channel.send(&amqp.WireFrame{FrameType: b.FrameType, Channel: channel.id, Payload: b.Payload}) {
+			return
+		}
 	}
 	stats.RecordHisto(channel.statSendChan, start)
 }
 
 func (channel *Channel) handleContentHeader(frame *amqp.WireFrame) *amqp.AMQPError {
 	if channel.currentMessage == nil {
-		return amqp.NewSoftError(500, "Unexpected content header frame!", 0, 0)
+		return amqp.NewHardError(505, "Unexpected content header frame!", 0, 0)
 	}
 	if channel.currentMessage.Header != nil {
-		return amqp.NewSoftError(500, "Unexpected content header frame! Already saw header", 0, 0)
+		return amqp.NewHardError(505, "Unexpected content header frame! Already saw header", 0, 0)
 	}
 	var headerFrame = &amqp.ContentHeaderFrame{}
 	var err = headerFrame.Read(bytes.NewReader(frame.Payload), channel.server.strictMode)
 	if err != nil {
 		return amqp.NewHardError(500, "Error parsing header frame: "+err.Error(), 0, 0)
 	}
+	// The user-id property may only name the user who authenticated
+	var userId = headerFrame.Properties.UserId
+	if userId != nil && *userId != channel.conn.user.name {
+		channel.currentMessage = nil
+		var msg = fmt.Sprintf("user_id property set to '%s' but authenticated user was '%s'", *userId, channel.conn.user.name)
+		return amqp.NewSoftError(406, msg, amqp.ClassIdBasic, amqp.MethodIdBasicPublish)
+	}
+	// Refuse oversized messages before buffering any of the body
+	var maxSize = channel.conn.maxMessageSize
+	if maxSize != 0 && headerFrame.ContentBodySize > maxSize {
+		channel.currentMessage = nil
+		var msg = fmt.Sprintf("message size %d is larger than the max size %d", headerFrame.ContentBodySize, maxSize)
+		return amqp.NewSoftError(406, msg, amqp.ClassIdBasic, amqp.MethodIdBasicPublish)
+	}
+	if channel.vhost.byteLimitReached(headerFrame.ContentBodySize) {
+		channel.currentMessage = nil
+		return amqp.NewSoftError(403, "Byte limit reached for virtual host", amqp.ClassIdBasic, amqp.MethodIdBasicPublish)
+	}
+	if channel.conn.timestampMessages && headerFrame.Properties.Timestamp == nil {
+		var now = uint64(channel.conn.clock.Now().Unix())
+		headerFrame.Properties.Timestamp = &now
+	}
+	if amqpErr := channel.setDirectReplyTo(headerFrame); amqpErr != nil {
+		channel.currentMessage = nil
+		return amqpErr
+	}
 	channel.currentMessage.Header = headerFrame
+	// An empty body has no body frames at all
+	if headerFrame.ContentBodySize == 0 {
+		return channel.publishCurrentMessage()
+	}
 	return nil
 }
 
 func (channel *Channel) handleContentBody(frame *amqp.WireFrame) *amqp.AMQPError {
 	if channel.currentMessage == nil {
-		return amqp.NewSoftError(500, "Unexpected content body frame. No method content-having method called yet!", 0, 0)
+		return amqp.NewHardError(505, "Unexpected content body frame. No method content-having method called yet!", 0, 0)
 	}
 	if channel.currentMessage.Header == nil {
-		return amqp.NewSoftError(500, "Unexpected content body frame! No header yet", 0, 0)
+		return amqp.NewHardError(505, "Unexpected content body frame! No header yet", 0, 0)
 	}
 	channel.currentMessage.Payload = append(channel.currentMessage.Payload, frame)
-	// TODO: store this on message
-	var size = uint64(0)
-	for _, body := range channel.currentMessage.Payload {
-		size += uint64(len(body.Payload))
+	channel.currentSize += uint64(len(frame.Payload))
+	if channel.currentSize > channel.currentMessage.Header.ContentBodySize {
+		channel.currentMessage = nil
+		return amqp.NewHardError(505, "Content body exceeds the size declared in the header", 0, 0)
 	}
-	if size < channel.currentMessage.Header.ContentBodySize {
+	if channel.currentSize < channel.currentMessage.Header.ContentBodySize {
 		return nil
 	}
+	return channel.publishCurrentMessage()
+}
 
+func (channel *Channel) publishCurrentMessage() *amqp.AMQPError {
 	// We have the whole contents, let's publish!
 	defer stats.RecordHisto(channel.statRoute, stats.Start())
-	var server = channel.server
-	var message = channel.currentMessage
+	var vhost = channel.vhost
+	var confirmTag = channel.nextPublishTag()
+	message, ok := channel.interceptPublish(channel.currentMessage)
+	if !ok {
+		channel.currentMessage = nil
+		// Dropped messages are confirmed like unroutable ones
+		channel.confirmPublish(confirmTag, nil, 0)
+		return nil
+	}
+	channel.currentMessage = message
 
-	exchange, _ := server.exchanges[message.Method.Exchange]
+	exchange, _ := vhost.exchanges[message.Method.Exchange]
 
-	if channel.txMode {
+	if isDirectReply(message) {
+		channel.publishDirectReply(message)
+		channel.confirmPublish(confirmTag, message, 0)
+	} else if channel.txMode {
 		// TxMode, add the messages to a list
-		queues, err := exchange.QueuesForPublish(channel.currentMessage)
-		if err != nil {
-			return err
+		queues := vhost.queuesForPublish(exchange, channel.currentMessage)
+		vhost.dropDuplicates(queues, channel.currentMessage)
+		if amqpErr := vhost.checkFull(queues); amqpErr != nil {
+			channel.currentMessage = nil
+			return amqpErr
 		}
+		vhost.forceDurable(queues, channel.currentMessage)
 
 		channel.txLock.Lock()
 		for queueName, _ := range queues {
@@ -706,14 +1018,22 @@ func (channel *Channel) handleContentBody(frame *amqp.WireFrame) *amqp.AMQPError
 		channel.txLock.Unlock()
 	} else {
 		// Normal mode, publish directly
-		returnMethod, amqpErr := server.publish(exchange, channel.currentMessage)
+		var flushGen = vhost.msgStore.FlushGeneration()
+		returnMethod, amqpErr := vhost.publish(exchange, channel.currentMessage)
 		if amqpErr != nil {
 			channel.currentMessage = nil
+			// With confirms the publisher is told with a nack instead of
+			// losing the channel
+			if confirmTag != 0 {
+				channel.SendMethod(&amqp.BasicNack{DeliveryTag: confirmTag})
+				return nil
+			}
 			return amqpErr
 		}
 		if returnMethod != nil {
 			channel.SendContent(returnMethod, channel.currentMessage)
 		}
+		channel.confirmPublish(confirmTag, message, flushGen)
 	}
 
 	channel.currentMessage = nil
@@ -722,7 +1042,14 @@ func (channel *Channel) handleContentBody(frame *amqp.WireFrame) *amqp.AMQPError
 
 func (channel *Channel) routeMethod(frame *amqp.WireFrame) *amqp.AMQPError {
 	var methodReader = bytes.NewReader(frame.Payload)
-	var methodFrame, err = amqp.ReadMethod(methodReader, channel.server.strictMode)
+	var readMethod = amqp.ReadMethod
+	if len(frame.Payload) >= 2 && binary.BigEndian.Uint16(frame.Payload) == amqp.ClassIdAccess {
+		readMethod = amqp.ReadAccessMethod
+	}
+	var methodFrame, err = readMethod(methodReader, channel.server.strictMode)
+	if unknown, ok := err.(*amqp.UnknownMethodError); ok {
+		return channel.notImplemented(unknown.ClassId, unknown.MethodId)
+	}
 	if err != nil {
 		return amqp.NewHardError(500, err.Error(), 0, 0)
 	}
@@ -731,12 +1058,30 @@ func (channel *Channel) routeMethod(frame *amqp.WireFrame) *amqp.AMQPError {
 	// If the method isn't closing related and we're closing, ignore the frames
 	var closeChannel = classId == amqp.ClassIdChannel && (methodId == amqp.MethodIdChannelClose || methodId == amqp.MethodIdChannelCloseOk)
 	var closeConnection = classId == amqp.ClassIdConnection && (methodId == amqp.MethodIdConnectionClose || methodId == amqp.MethodIdConnectionCloseOk)
-	if channel.state == CH_STATE_CLOSING && !(closeChannel || closeConnection) {
+	var state = channel.getState()
+	if state == CH_STATE_CLOSING && !(closeChannel || closeConnection) {
 		return nil
 	}
 
+	// Once a content-carrying method is received, only its header and body
+	// frames may follow until the content is complete
+	if channel.currentMessage != nil && state != CH_STATE_CLOSING {
+		channel.currentMessage = nil
+		return amqp.NewHardError(505, "Expected content frame, got a method frame", classId, methodId)
+	}
+
+	// Connection methods only go on channel 0, and the methods of the
+	// channel classes only on the others
+	if channel.id == 0 && isChannelClass(classId) {
+		var msg = fmt.Sprintf("Class %d methods can't be sent on channel 0", classId)
+		return amqp.NewHardError(503, msg, classId, methodId)
+	}
+	if channel.id != 0 && classId == amqp.ClassIdConnection {
+		return amqp.NewHardError(503, "Connection methods must be sent on channel 0", classId, methodId)
+	}
+
 	// Non-open method on an INIT-state channel is an error
-	if channel.state == CH_STATE_INIT && (classId != 20 || methodId != 10) {
+	if state == CH_STATE_INIT && (classId != 20 || methodId != 10) {
 		return amqp.NewHardError(
 			503,
 			"Non-Channel.Open method called on unopened channel",
@@ -751,16 +1096,41 @@ func (channel *Channel) routeMethod(frame *amqp.WireFrame) *amqp.AMQPError {
 		return channel.connectionRoute(channel.conn, methodFrame)
 	case classId == 20:
 		return channel.channelRoute(methodFrame)
+	case classId == 30:
+		return channel.accessRoute(methodFrame)
 	case classId == 40:
 		return channel.exchangeRoute(methodFrame)
 	case classId == 50:
 		return channel.queueRoute(methodFrame)
 	case classId == 60:
 		return channel.basicRoute(methodFrame)
+	case classId == 85:
+		return channel.confirmRoute(methodFrame)
 	case classId == 90:
 		return channel.txRoute(methodFrame)
 	default:
-		return amqp.NewHardError(540, "Not implemented", classId, methodId)
+		return channel.notImplemented(classId, methodId)
 	}
-	return nil
+}
+
+// The error for a method the server doesn't handle. It only closes the
+// channel when the method belongs to a class which works on a channel, so
+// anything on channel 0, in the connection class or in a class the protocol
+// doesn't have closes the connection.
+func (channel *Channel) notImplemented(classId uint16, methodId uint16) *amqp.AMQPError {
+	var msg = fmt.Sprintf("Not implemented: class %d, method %d", classId, methodId)
+	if channel.id != 0 && isChannelClass(classId) {
+		return amqp.NewSoftError(540, msg, classId, methodId)
+	}
+	return amqp.NewHardError(540, msg, classId, methodId)
+}
+
+// Whether the class's methods work on a channel other than 0
+func isChannelClass(classId uint16) bool {
+	switch classId {
+	case amqp.ClassIdChannel, amqp.ClassIdAccess, amqp.ClassIdExchange, amqp.ClassIdQueue,
+		amqp.ClassIdBasic, amqp.ClassIdConfirm, amqp.ClassIdTx:
+		return true
+	}
+	return false
 }
@@ -20,16 +20,20 @@ func (channel *Channel) channelRoute(methodFrame amqp.MethodFrame) *amqp.AMQPErr
 		//   return channel.channelOpenOk(method)
 	}
 	var classId, methodId = methodFrame.MethodIdentifier()
-	return amqp.NewHardError(540, "Unable to route method frame", classId, methodId)
+	return channel.notImplemented(classId, methodId)
 }
 
 func (channel *Channel) channelOpen(method *amqp.ChannelOpen) *amqp.AMQPError {
-	if channel.state == CH_STATE_OPEN {
+	if channel.getState() == CH_STATE_OPEN {
 		var classId, methodId = method.MethodIdentifier()
 		return amqp.NewHardError(504, "Channel already open", classId, methodId)
 	}
 	channel.SendMethod(&amqp.ChannelOpenOk{})
 	channel.setStateOpen()
+	channel.vhost.emit("channel.open", map[string]interface{}{
+		"connection": channel.conn.id,
+		"channel":    channel.id,
+	})
 	return nil
 }
 
@@ -41,7 +45,7 @@ func (channel *Channel) channelFlow(method *amqp.ChannelFlow) *amqp.AMQPError {
 
 func (channel *Channel) channelFlowOk(method *amqp.ChannelFlowOk) *amqp.AMQPError {
 	var classId, methodId = method.MethodIdentifier()
-	return amqp.NewHardError(540, "Not implemented", classId, methodId)
+	return channel.notImplemented(classId, methodId)
 }
 
 func (channel *Channel) channelClose(method *amqp.ChannelClose) *amqp.AMQPError {
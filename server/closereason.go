@@ -0,0 +1,66 @@
+package server
+
+import (
+	"github.com/karelbilek/amqp-test-server/amqp"
+)
+
+// Why a connection closed. It is in the log line written when the connection
+// is torn down and in the connection.close event.
+type CloseReason string
+
+const (
+	// The client sent connection.close
+	CLOSE_CLIENT CloseReason = "client_close"
+	// The client broke the protocol, or the server closed the connection
+	// with a connection error other than the ones below
+	CLOSE_PROTOCOL_ERROR CloseReason = "protocol_error"
+	// A frame the server couldn't take, like one over frame-max
+	CLOSE_FRAME_ERROR CloseReason = "frame_error"
+	// The client went quiet with heartbeats on, or didn't answer probes
+	CLOSE_HEARTBEAT_TIMEOUT CloseReason = "heartbeat_timeout"
+	// The client went quiet with heartbeats off
+	CLOSE_IDLE_TIMEOUT    CloseReason = "idle_timeout"
+	CLOSE_AUTH_FAILURE    CloseReason = "auth_failure"
+	CLOSE_NETWORK_ERROR   CloseReason = "network_error"
+	CLOSE_SERVER_SHUTDOWN CloseReason = "server_shutdown"
+	// Closed by an operator, see CloseConnection
+	CLOSE_FORCED CloseReason = "forced"
+)
+
+// Record why the connection is closing. Only the first reason counts, so the
+// close-ok or close timeout following a connection.close from the server
+// keeps the reason the close was sent for.
+func (conn *AMQPConnection) setCloseReason(reason CloseReason) {
+	conn.closeReason.CompareAndSwap(nil, reason)
+}
+
+// Why the connection closed, or "" while it is open
+func (conn *AMQPConnection) getCloseReason() CloseReason {
+	var reason, _ = conn.closeReason.Load().(CloseReason)
+	return reason
+}
+
+// The reason for a connection error the server closes the connection with
+func errorCloseReason(amqpErr *amqp.AMQPError) CloseReason {
+	switch amqpErr.Code {
+	case 501:
+		return CLOSE_FRAME_ERROR
+	case 320:
+		return CLOSE_FORCED
+	}
+	return CLOSE_PROTOCOL_ERROR
+}
+
+// The reason for the network failing a read. The read deadline is two
+// heartbeats, or the idle timeout without heartbeats, see readTimeout.
+func (conn *AMQPConnection) readCloseReason(err error) CloseReason {
+	if err != errReadTimeout {
+		return CLOSE_NETWORK_ERROR
+	}
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.receiveHeartbeatInterval > 0 {
+		return CLOSE_HEARTBEAT_TIMEOUT
+	}
+	return CLOSE_IDLE_TIMEOUT
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"github.com/karelbilek/amqp-test-server/amqp"
+)
+
+func (channel *Channel) confirmRoute(methodFrame amqp.MethodFrame) *amqp.AMQPError {
+	switch method := methodFrame.(type) {
+	case *amqp.ConfirmSelect:
+		return channel.confirmSelect(method)
+	}
+	var classId, methodId = methodFrame.MethodIdentifier()
+	return channel.notImplemented(classId, methodId)
+}
+
+func (channel *Channel) confirmSelect(method *amqp.ConfirmSelect) *amqp.AMQPError {
+	if channel.txMode {
+		var classId, methodId = method.MethodIdentifier()
+		return amqp.NewSoftError(406, "Channel is in transaction mode", classId, methodId)
+	}
+	channel.confirmMode = true
+	if !method.Nowait {
+		channel.SendMethod(&amqp.ConfirmSelectOk{})
+	}
+	return nil
+}
+
+// The delivery tag of the publish being handled, counting the publishes
+// since confirm.select. 0 when the channel isn't in confirm mode.
+func (channel *Channel) nextPublishTag() uint64 {
+	if !channel.confirmMode {
+		return 0
+	}
+	channel.publishTag += 1
+	return channel.publishTag
+}
+
+// Confirm a publish once the server has taken responsibility for it. That
+// is once it was routed, or for a persistent message once it is on disk.
+// A persistent message is waited on in another goroutine, so the channel
+// handles more publishes meanwhile and confirms may go out of order. If the
+// message store fails to write it, the publish is nacked instead so the
+// publisher knows to send it again.
+func (channel *Channel) confirmPublish(tag uint64, msg *amqp.Message, flushGen uint64) {
+	if tag == 0 {
+		return
+	}
+	var store = channel.vhost.msgStore
+	if !isPersistent(msg) || store.InMemory() {
+		channel.SendMethod(&amqp.BasicAck{DeliveryTag: tag})
+		return
+	}
+	go func() {
+		var err = store.WaitFlushed(flushGen)
+		if channel.getState() == CH_STATE_CLOSED {
+			return
+		}
+		if err != nil {
+			channel.SendMethod(&amqp.BasicNack{DeliveryTag: tag})
+			return
+		}
+		channel.SendMethod(&amqp.BasicAck{DeliveryTag: tag})
+	}()
+}
+
+func isPersistent(msg *amqp.Message) bool {
+	if msg == nil || msg.Header == nil || msg.Header.Properties == nil {
+		return false
+	}
+	var mode = msg.Header.Properties.DeliveryMode
+	return mode != nil && *mode == 2
+}
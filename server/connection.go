@@ -5,8 +5,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/karelbilek/amqp-test-server/amqp"
@@ -29,6 +31,11 @@ type ConnectStatus struct {
 	closed   bool
 }
 
+// The heartbeat interval the server proposes in connection.tune unless
+// SetHeartbeatInterval changes it. The client may lower it or disable
+// heartbeats entirely in connection.tune-ok.
+var defaultHeartbeatInterval = 10 * time.Second
+
 type AMQPConnection struct {
 	ctx                      context.Context
 	id                       int64
@@ -38,64 +45,156 @@ type AMQPConnection struct {
 	connectStatus            ConnectStatus
 	server                   *Server
 	network                  net.Conn
+	reader                   *retryReader // network, see readretry.go
 	lock                     sync.Mutex
 	ttl                      time.Time
 	sendHeartbeatInterval    time.Duration
 	receiveHeartbeatInterval time.Duration
 	maxChannels              uint16
 	maxFrameSize             uint32
-	clientProperties         *amqp.Table
+	maxMessageSize           uint64
+	timestampMessages        bool
+	rateLimiter              *rateLimiter
+	// Whether the connection starts with a PROXY protocol header, and the
+	// client address it named
+	proxyProtocol    bool
+	proxiedAddr      net.Addr
+	idleTimeout      time.Duration
+	closeTimeout     time.Duration
+	probeInterval    time.Duration
+	probeFailures    int
+	writeRetries     int
+	writeBackoff     time.Duration
+	ackTimeout       time.Duration
+	ackTimeoutAction AckTimeoutAction
+	clock            util.Clock
+	ids              util.IdGenerator
+	lastActivity     time.Time
+	clientProperties *amqp.Table
+	user             User
+	// Selected in connection.open. Channels can only be opened after that
+	vhost *VirtualHost
+	// Closed once teardown has released everything the connection held
+	done chan struct{}
+	// Handles the frames of the connection's channels, see workerpool.go.
+	// nil when each channel has its own goroutine
+	pool *workerPool
+	// Why the connection closed, see closereason.go
+	closeReason atomic.Value
 	// stats
 	statOutBlocked stats.Histogram
 	statOutNetwork stats.Histogram
 	statInBlocked  stats.Histogram
 	statInNetwork  stats.Histogram
+	// Time spent waiting on the rate limit
+	statInThrottled stats.Histogram
 }
 
 func (conn *AMQPConnection) MarshalJSON() ([]byte, error) {
-	return json.Marshal(map[string]interface{}{
+	return json.Marshal(conn.describe())
+}
+
+func (conn *AMQPConnection) describe() map[string]interface{} {
+	return map[string]interface{}{
 		"id":               conn.id,
-		"address":          fmt.Sprintf("%s", conn.network.RemoteAddr()),
+		"address":          conn.address(),
 		"clientProperties": conn.clientProperties.Table,
 		"channelCount":     len(conn.channels),
-	})
+	}
 }
 
 func NewAMQPConnection(ctx context.Context, server *Server, network net.Conn) *AMQPConnection {
-	return &AMQPConnection{
+	var reader = &retryReader{reader: network, clock: server.clock}
+	var conn = &AMQPConnection{
 		// If outgoing has a buffer the server performs better. I'm not adding one
 		// in until I fully understand why that is
 		id:                       util.NextId(),
 		network:                  network,
+		reader:                   reader,
 		channels:                 make(map[uint16]*Channel),
 		outgoing:                 make(chan *amqp.WireFrame, 100),
 		connectStatus:            ConnectStatus{},
 		server:                   server,
-		receiveHeartbeatInterval: 10 * time.Second,
-		maxChannels:              4096,
-		maxFrameSize:             65536,
+		receiveHeartbeatInterval: server.heartbeatInterval,
+		maxChannels:              server.maxChannels,
+		maxFrameSize:             server.maxFrameSize,
+		maxMessageSize:           server.maxMessageSize,
+		timestampMessages:        server.timestampMessages,
+		rateLimiter:              newRateLimiter(server.rateLimit, server.clock),
+		proxyProtocol:            server.proxyProtocol && !isWebSocket(network) && !isTLS(network),
+		idleTimeout:              server.idleTimeout,
+		closeTimeout:             server.closeTimeout,
+		probeInterval:            server.probeInterval,
+		probeFailures:            server.probeFailures,
+		writeRetries:             server.writeRetries,
+		writeBackoff:             server.writeBackoff,
+		ackTimeout:               server.ackTimeout,
+		ackTimeoutAction:         server.ackTimeoutAction,
+		clock:                    server.clock,
+		ids:                      server.ids,
+		lastActivity:             server.clock.Now(),
+		done:                     make(chan struct{}),
+		pool:                     server.currentChannelPool(),
 		// stats
-		statOutBlocked: stats.MakeHistogram("Connection.Out.Blocked"),
-		statOutNetwork: stats.MakeHistogram("Connection.Out.Network"),
-		statInBlocked:  stats.MakeHistogram("Connection.In.Blocked"),
-		statInNetwork:  stats.MakeHistogram("Connection.In.Network"),
-		ctx:            ctx,
+		statOutBlocked:  stats.MakeLinkedHistogram("Connection.Out.Blocked"),
+		statOutNetwork:  stats.MakeLinkedHistogram("Connection.Out.Network"),
+		statInBlocked:   stats.MakeLinkedHistogram("Connection.In.Blocked"),
+		statInNetwork:   stats.MakeLinkedHistogram("Connection.In.Network"),
+		statInThrottled: stats.MakeLinkedHistogram("Connection.In.Throttled"),
+		ctx:             ctx,
 	}
+	reader.timeout = conn.readTimeout
+	return conn
+}
+
+// How long the client may send nothing at all before the connection is taken
+// to be gone, which is what a half-open connection looks like. With
+// heartbeats it is two heartbeat intervals, as the spec has it. Until
+// connection.tune-ok that is the interval the server proposed, which bounds
+// the handshake too, leaving out the time the server takes to check the
+// credentials. Without heartbeats it is the idle timeout. 0 means no
+// limit, leaving it to TCP keepalive and probing. Any octet counts, unlike
+// the heartbeat check which only sees whole frames. A read already waiting
+// keeps the window it started with.
+func (conn *AMQPConnection) readTimeout() time.Duration {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.receiveHeartbeatInterval > 0 {
+		return conn.receiveHeartbeatInterval * 2
+	}
+	return conn.idleTimeout
 }
 
 func (conn *AMQPConnection) openConnection() {
+	defer conn.teardown()
 	// Negotiate Protocol
 	buf := make([]byte, 8)
-	_, err := conn.network.Read(buf)
+	_, err := io.ReadFull(conn.reader, buf)
 	if err != nil {
-		conn.hardClose()
+		conn.hardClose(conn.readCloseReason(err))
 		return
 	}
+	// A balancer's PROXY header comes before the protocol header
+	if conn.proxyProtocol {
+		addr, err := readProxyHeader(conn.reader, buf)
+		if err != nil {
+			fmt.Println("Error reading PROXY protocol header: " + err.Error())
+			conn.hardClose(CLOSE_PROTOCOL_ERROR)
+			return
+		}
+		conn.lock.Lock()
+		conn.proxiedAddr = addr
+		conn.lock.Unlock()
+		if _, err = io.ReadFull(conn.reader, buf); err != nil {
+			conn.hardClose(conn.readCloseReason(err))
+			return
+		}
+	}
 
 	var supported = []byte{'A', 'M', 'Q', 'P', 0, 0, 9, 1}
 	if bytes.Compare(buf, supported) != 0 {
 		conn.network.Write(supported)
-		conn.hardClose()
+		conn.hardClose(CLOSE_PROTOCOL_ERROR)
 		return
 	}
 
@@ -103,6 +202,7 @@ func (conn *AMQPConnection) openConnection() {
 	conn.channels[0] = NewChannel(conn.ctx, 0, conn)
 	conn.channels[0].start()
 	conn.handleOutgoing()
+	conn.handleProbe()
 	conn.handleIncoming()
 }
 
@@ -116,25 +216,117 @@ func (conn *AMQPConnection) deregisterChannel(id uint16) {
 	delete(conn.channels, id)
 }
 
-func (conn *AMQPConnection) hardClose() {
+func (conn *AMQPConnection) hardClose(reason CloseReason) {
+	conn.setCloseReason(reason)
+	// Closing the network stops the reader, which then runs teardown. Doing
+	// the cleanup here would race with the channels still handling frames.
 	conn.network.Close()
-	// FIXME data races
-	// conn.connectStatus.closed = true
-	// conn.server.deregisterConnection(conn.id)
-	// conn.server.deleteQueuesForConn(conn.id)
-	// for _, channel := range conn.channels {
-	// 	channel.shutdown()
-	// }
+}
+
+// Close the network connection once every frame queued so far has been
+// written. Used after connection.close-ok so the client gets to see it, so
+// the connection is recorded as closed by the client.
+func (conn *AMQPConnection) closeAfterFlush() {
+	conn.outgoing <- nil
+}
+
+// Release everything the connection holds once the network is gone. Each
+// channel shuts itself down when it sees its incoming frames end, and exclusive
+// queues owned by the connection are deleted.
+func (conn *AMQPConnection) teardown() {
+	// The reader only stops without a reason when the server shuts down
+	if conn.ctx.Err() != nil {
+		conn.setCloseReason(CLOSE_SERVER_SHUTDOWN)
+	} else {
+		conn.setCloseReason(CLOSE_NETWORK_ERROR)
+	}
+	fmt.Printf("Connection %d closed: %s\n", conn.id, conn.getCloseReason())
+	conn.lock.Lock()
+	conn.connectStatus.closed = true
+	var channels = make([]*Channel, 0, len(conn.channels))
+	for _, channel := range conn.channels {
+		channels = append(channels, channel)
+	}
+	conn.lock.Unlock()
+	// Frames are only sent to channels from the reader, which has stopped
+	for _, channel := range channels {
+		channel.closeIncoming()
+	}
+	if conn.vhost != nil {
+		conn.vhost.deleteQueuesForConn(conn.id)
+	}
+	conn.server.deregisterConnection(conn)
+	if conn.connectStatus.openOk {
+		conn.runDisconnectHooks()
+	}
+	close(conn.done)
+}
+
+// Whether teardown has run. The connection's goroutines check this while
+// teardown may be setting it.
+func (conn *AMQPConnection) isClosed() bool {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.connectStatus.closed
+}
+
+// Whether the client advertised the named capability in its client
+// properties on connection.start-ok
+func (conn *AMQPConnection) clientCapability(name string) bool {
+	var capabilities, found = conn.clientProperties.GetTable("capabilities")
+	if !found {
+		return false
+	}
+	var enabled, _ = capabilities.GetBool(name)
+	return enabled
 }
 
 func (conn *AMQPConnection) setMaxChannels(max uint16) {
 	conn.maxChannels = max
 }
 
+// The reader checks incoming frames against this, so it changes under the
+// lock
 func (conn *AMQPConnection) setMaxFrameSize(max uint32) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
 	conn.maxFrameSize = max
 }
 
+// Negotiate one of the connection.tune limits. 0 means no limit on either
+// side, so the other side's value wins. A client asking for more than the
+// server allows is refused.
+func negotiateLimit(server uint32, client uint32) (uint32, bool) {
+	if server == 0 {
+		return client, true
+	}
+	if client == 0 {
+		return server, true
+	}
+	return client, client <= server
+}
+
+// Take the lower of the server's proposal and the client's value. A client
+// value of 0 disables heartbeats, a server value of 0 means the server has no
+// preference and the client's value is used.
+func negotiateHeartbeat(server time.Duration, client time.Duration) time.Duration {
+	if client == 0 || server == 0 {
+		return client
+	}
+	if client < server {
+		return client
+	}
+	return server
+}
+
+func (conn *AMQPConnection) setHeartbeatInterval(interval time.Duration) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.sendHeartbeatInterval = interval
+	conn.receiveHeartbeatInterval = interval
+	conn.ttl = conn.clock.Now().Add(interval * 2)
+}
+
 func (conn *AMQPConnection) startSendHeartbeat(interval time.Duration) {
 	conn.sendHeartbeatInterval = interval
 	conn.handleSendHeartbeat()
@@ -143,13 +335,13 @@ func (conn *AMQPConnection) startSendHeartbeat(interval time.Duration) {
 func (conn *AMQPConnection) handleSendHeartbeat() {
 	go func() {
 		for {
-			if conn.connectStatus.closed {
+			if conn.isClosed() {
 				break
 			}
 			select {
 			case <-conn.ctx.Done():
 				return
-			case <-time.After(conn.sendHeartbeatInterval / 2):
+			case <-conn.clock.After(conn.sendHeartbeatInterval / 2):
 			}
 			conn.outgoing <- &amqp.WireFrame{FrameType: 8, Channel: 0, Payload: make([]byte, 0)}
 		}
@@ -159,24 +351,69 @@ func (conn *AMQPConnection) handleSendHeartbeat() {
 func (conn *AMQPConnection) handleClientHeartbeatTimeout() {
 	// TODO(MUST): The spec is that any octet is a heartbeat substitute. Right
 	// now this is only looking at frames, so a long send could cause a timeout
-	// TODO(MUST): if the client isn't heartbeating how do we know when it's
-	// gone?
 	go func() {
 		for {
-			if conn.connectStatus.closed {
+			if conn.isClosed() {
 				break
 			}
 			select {
 			case <-conn.ctx.Done():
 				return
-			case <-time.After(conn.receiveHeartbeatInterval / 2):
+			case <-conn.clock.After(conn.receiveHeartbeatInterval / 2):
 			}
 			// If now is higher than TTL we need to time the client out
 			conn.lock.Lock()
-			if conn.ttl.Before(time.Now()) {
-				conn.hardClose()
+			if conn.ttl.Before(conn.clock.Now()) {
+				conn.hardClose(CLOSE_HEARTBEAT_TIMEOUT)
+			}
+			conn.lock.Unlock()
+		}
+	}()
+}
+
+// Close the connection if the client sends nothing at all, heartbeats
+// included, for the idle timeout. Unlike the heartbeat timeout this also
+// catches clients which negotiated heartbeats off and went away. It starts
+// once connection.open-ok is sent, so time the server spends on the
+// handshake, like checking the password, doesn't count against the client.
+func (conn *AMQPConnection) handleIdleTimeout() {
+	if conn.idleTimeout == 0 {
+		return
+	}
+	go func() {
+		for {
+			if conn.isClosed() {
+				break
 			}
+			select {
+			case <-conn.ctx.Done():
+				return
+			case <-conn.clock.After(conn.idleTimeout / 4):
+			}
+			conn.lock.Lock()
+			var idle = conn.clock.Now().Sub(conn.lastActivity)
 			conn.lock.Unlock()
+			if idle > conn.idleTimeout {
+				fmt.Println("Closing idle connection")
+				conn.hardClose(CLOSE_IDLE_TIMEOUT)
+				return
+			}
+		}
+	}()
+}
+
+// Close the socket if the client doesn't answer connection.close in time,
+// so a client which ignores it doesn't keep the connection open
+func (conn *AMQPConnection) handleCloseTimeout() {
+	if conn.closeTimeout == 0 {
+		return
+	}
+	go func() {
+		select {
+		case <-conn.done:
+		case <-conn.clock.After(conn.closeTimeout):
+			fmt.Println("No connection.close-ok in time, closing the connection")
+			conn.hardClose(CLOSE_PROTOCOL_ERROR)
 		}
 	}()
 }
@@ -187,7 +424,7 @@ func (conn *AMQPConnection) handleOutgoing() {
 	// interval is known.
 	go func() {
 		for {
-			if conn.connectStatus.closed {
+			if conn.isClosed() {
 				break
 			}
 			var start = stats.Start()
@@ -197,14 +434,21 @@ func (conn *AMQPConnection) handleOutgoing() {
 			case <-conn.ctx.Done():
 				return
 			}
+			if frame == nil {
+				conn.hardClose(CLOSE_CLIENT)
+				return
+			}
 			stats.RecordHisto(conn.statOutBlocked, start)
 
 			// fmt.Printf("Sending outgoing message. type: %d\n", frame.FrameType)
-			// TODO(MUST): Hard close on irrecoverable errors, retry on recoverable
-			// ones some number of times.
 			start = stats.Start()
-			amqp.WriteFrame(conn.network, frame)
+			var err = writeWithRetry(conn.network, amqp.EncodeFrame(frame), conn.writeRetries, conn.writeBackoff, conn.clock)
 			stats.RecordHisto(conn.statOutNetwork, start)
+			if err != nil {
+				fmt.Println("Error writing frame:", err.Error())
+				conn.hardClose(CLOSE_NETWORK_ERROR)
+				return
+			}
 			// for wire protocol debugging:
 			// for _, b := range frame.Payload {
 			// 	fmt.Printf("%d,", b)
@@ -216,6 +460,10 @@ func (conn *AMQPConnection) handleOutgoing() {
 
 func (conn *AMQPConnection) connectionErrorWithMethod(amqpErr *amqp.AMQPError) {
 	fmt.Println("Sending connection error:", amqpErr.Msg)
+	conn.setCloseReason(errorCloseReason(amqpErr))
+	if !conn.connectStatus.closing {
+		conn.handleCloseTimeout()
+	}
 	conn.connectStatus.closing = true
 	conn.channels[0].SendMethod(&amqp.ConnectionClose{
 		ReplyCode: amqpErr.Code,
@@ -228,21 +476,31 @@ func (conn *AMQPConnection) connectionErrorWithMethod(amqpErr *amqp.AMQPError) {
 func (conn *AMQPConnection) handleIncoming() {
 	for {
 		// If the connection is done, we stop handling frames
-		if conn.connectStatus.closed {
+		if conn.isClosed() {
 			break
 		}
-		// Read from the network
-		// TODO(MUST): Add a timeout to the read, esp. if there is no heartbeat
-		// TODO(MUST): Hard close on unrecoverable errors, retry (with backoff?)
-		// for recoverable ones
+		// Read from the network. The reader gives up once the client has
+		// been silent for readTimeout
 		var start = stats.Start()
-		frame, err := amqp.ReadFrame(conn.network)
+		frame, err := amqp.ReadFrame(conn.reader)
 		if err != nil {
 			fmt.Println("Error reading frame: " + err.Error())
-			conn.hardClose()
+			conn.hardClose(conn.readCloseReason(err))
 			break
 		}
 		stats.RecordHisto(conn.statInNetwork, start)
+		conn.lock.Lock()
+		conn.lastActivity = conn.clock.Now()
+		var maxFrameSize = conn.maxFrameSize
+		conn.lock.Unlock()
+		// The frame size includes the 7 byte header and the end octet
+		if maxFrameSize != 0 && len(frame.Payload)+8 > int(maxFrameSize) {
+			conn.connectionErrorWithMethod(amqp.NewHardError(501, "Frame exceeds the negotiated frame-max", 0, 0))
+			continue
+		}
+		if !conn.throttle(frame) {
+			break
+		}
 		conn.handleFrame(frame)
 	}
 }
@@ -252,7 +510,7 @@ func (conn *AMQPConnection) handleFrame(frame *amqp.WireFrame) {
 	// Upkeep. Remove things which have expired, etc
 	conn.cleanUp()
 	conn.lock.Lock()
-	conn.ttl = time.Now().Add(conn.receiveHeartbeatInterval * 2)
+	conn.ttl = conn.clock.Now().Add(conn.receiveHeartbeatInterval * 2)
 	conn.lock.Unlock()
 
 	switch {
@@ -261,22 +519,39 @@ func (conn *AMQPConnection) handleFrame(frame *amqp.WireFrame) {
 		return
 	}
 
+	// Once the server has sent connection.close only close and close-ok are
+	// of interest, and those come on channel 0
+	if conn.connectStatus.closing && frame.Channel != 0 {
+		return
+	}
+
 	if !conn.connectStatus.open && frame.Channel != 0 {
 		fmt.Println("Non-0 channel for unopened connection")
-		conn.hardClose()
+		conn.hardClose(CLOSE_PROTOCOL_ERROR)
 		return
 	}
 	conn.lock.Lock()
 	var channel, ok = conn.channels[frame.Channel]
-	// TODO(MUST): Check that the channel number if in the valid range
+	if !ok && conn.maxChannels != 0 && frame.Channel > conn.maxChannels {
+		conn.lock.Unlock()
+		conn.connectionErrorWithMethod(amqp.NewHardError(530, "Channel number exceeds the negotiated channel-max", 0, 0))
+		return
+	}
 	if !ok {
 		channel = NewChannel(conn.ctx, frame.Channel, conn)
 		conn.channels[frame.Channel] = channel
 		conn.channels[frame.Channel].start()
 	}
 	conn.lock.Unlock()
-	// Dispatch
+	// Dispatch. The channel owns the frame from here on
+	var closing = isChannelClose(frame)
 	start := stats.Start()
-	channel.incoming <- frame
+	channel.dispatch(frame)
 	stats.RecordHisto(conn.statInBlocked, start)
+	if closing {
+		select {
+		case <-channel.closeHandled:
+		case <-conn.ctx.Done():
+		}
+	}
 }
@@ -28,36 +28,64 @@ func (channel *Channel) connectionRoute(conn *AMQPConnection, methodFrame amqp.M
 		return channel.connectionUnblocked(conn, method)
 	}
 	var classId, methodId = methodFrame.MethodIdentifier()
-	return amqp.NewHardError(540, "Unable to route method frame", classId, methodId)
+	return channel.notImplemented(classId, methodId)
 }
 
 func (channel *Channel) connectionOpen(conn *AMQPConnection, method *amqp.ConnectionOpen) *amqp.AMQPError {
-	// TODO(MAY): Add support for virtual hosts. Check for access to the
-	// selected one
+	var classId, methodId = method.MethodIdentifier()
+	var vhost, found = conn.server.virtualHost(method.VirtualHost)
+	if !found {
+		return amqp.NewHardError(404, "Virtual host not found: "+method.VirtualHost, classId, methodId)
+	}
+	if !conn.user.canAccess(vhost.name) {
+		return amqp.NewHardError(530, "Access to virtual host refused: "+method.VirtualHost, classId, methodId)
+	}
+	if conn.server.connectionLimitReached(vhost) {
+		return amqp.NewHardError(530, "Connection limit reached for virtual host: "+method.VirtualHost, classId, methodId)
+	}
+	conn.lock.Lock()
+	conn.vhost = vhost
+	conn.lock.Unlock()
 	conn.connectStatus.open = true
 	channel.SendMethod(&amqp.ConnectionOpenOk{Reserved1: ""})
 	conn.connectStatus.openOk = true
+	conn.handleIdleTimeout()
+	vhost.emit("connection.open", map[string]interface{}{
+		"connection": conn.id,
+		"address":    conn.address(),
+	})
+	conn.runConnectHooks()
 	return nil
 }
 
 func (channel *Channel) connectionTuneOk(conn *AMQPConnection, method *amqp.ConnectionTuneOk) *amqp.AMQPError {
 	conn.connectStatus.tuneOk = true
-	if method.ChannelMax > conn.maxChannels || method.FrameMax > conn.maxFrameSize {
-		conn.hardClose()
+	var maxChannels, channelsOk = negotiateLimit(uint32(conn.maxChannels), uint32(method.ChannelMax))
+	var maxFrameSize, frameSizeOk = negotiateLimit(conn.maxFrameSize, method.FrameMax)
+	// Peers must accept frames of at least frame-min-size, so a smaller
+	// frame-max is as bad as one above the server's
+	if maxFrameSize != 0 && maxFrameSize < uint32(amqp.FrameMinSize) {
+		frameSizeOk = false
+	}
+	if !channelsOk || !frameSizeOk {
+		conn.hardClose(CLOSE_PROTOCOL_ERROR)
 		return nil
 	}
 
-	conn.setMaxChannels(method.ChannelMax)
-	conn.setMaxFrameSize(method.FrameMax)
-
-	if method.Heartbeat > 0 {
-		// Start sending heartbeats to the client
-		conn.startSendHeartbeat(time.Duration(method.Heartbeat) * time.Second)
+	conn.setMaxChannels(uint16(maxChannels))
+	conn.setMaxFrameSize(maxFrameSize)
+
+	var interval = negotiateHeartbeat(
+		conn.receiveHeartbeatInterval,
+		time.Duration(method.Heartbeat)*time.Second,
+	)
+	conn.setHeartbeatInterval(interval)
+	if interval > 0 {
+		// Start sending heartbeats to the client and listening for the
+		// client's heartbeats
+		conn.startSendHeartbeat(interval)
+		conn.handleClientHeartbeatTimeout()
 	}
-	// Start listening for heartbeats from the client.
-	// We always ask for them since we want to shut down
-	// connections not in use
-	conn.handleClientHeartbeatTimeout()
 	return nil
 }
 
@@ -65,12 +93,24 @@ func (channel *Channel) connectionStartOk(conn *AMQPConnection, method *amqp.Con
 	// TODO(SHOULD): record product/version/platform/copyright/information
 	// TODO(MUST): assert mechanism, response, locale are not null
 	conn.connectStatus.startOk = true
-
-	if method.Mechanism != "PLAIN" {
-		conn.hardClose()
+	// The client can't answer before it hears back, and checking its
+	// credentials may be slow
+	conn.reader.pauseDeadline()
+	defer conn.reader.restartDeadline()
+
+	var user User
+	var ok bool
+	switch method.Mechanism {
+	case "PLAIN":
+		user, ok = conn.server.authenticate(method.Mechanism, method.Response)
+	case "EXTERNAL":
+		user, ok = conn.server.authenticateCertificate(conn.network)
+	default:
+		conn.hardClose(CLOSE_AUTH_FAILURE)
+		return nil
 	}
-
-	if !conn.server.authenticate(method.Mechanism, method.Response) {
+	if !ok {
+		conn.setCloseReason(CLOSE_AUTH_FAILURE)
 		var classId, methodId = method.MethodIdentifier()
 		return &amqp.AMQPError{
 			Code:   530,
@@ -81,6 +121,7 @@ func (channel *Channel) connectionStartOk(conn *AMQPConnection, method *amqp.Con
 		}
 	}
 
+	conn.user = user
 	conn.clientProperties = method.ClientProperties
 	// TODO(MUST): add support these being enforced at the connection level.
 	channel.SendMethod(&amqp.ConnectionTune{
@@ -98,8 +139,9 @@ func (channel *Channel) connectionStartOk(conn *AMQPConnection, method *amqp.Con
 func (channel *Channel) startConnection() *amqp.AMQPError {
 	// TODO(SHOULD): add fields: host, product, version, platform, copyright, information
 	var capabilities = amqp.NewTable()
-	capabilities.SetKey("publisher_confirms", false)
+	capabilities.SetKey("publisher_confirms", true)
 	capabilities.SetKey("basic.nack", true)
+	capabilities.SetKey("consumer_cancel_notify", true)
 	var serverProps = amqp.NewTable()
 	// TODO: the java rabbitmq client I'm using for load testing doesn't like these string
 	//       fields even though the go/python clients do. If they are set as longstr (bytes)
@@ -125,24 +167,27 @@ func (channel *Channel) startConnection() *amqp.AMQPError {
 	// Locales              []byte   `protobuf:"bytes,5,opt,name=locales" json:"locales,omitempty"`
 	channel.SendMethod(&amqp.ConnectionStart{VersionMajor: 0,
 		VersionMinor: 9, ServerProperties: serverProps,
-		Mechanisms: []byte("PLAIN"), Locales: []byte("en_US")})
+		Mechanisms: []byte(channel.conn.mechanisms()), Locales: []byte("en_US")})
 	return nil
 }
 
+// The client may close at any point, including in the middle of the
+// handshake before connection.open-ok, and gets close-ok either way
 func (channel *Channel) connectionClose(conn *AMQPConnection, method *amqp.ConnectionClose) *amqp.AMQPError {
+	conn.setCloseReason(CLOSE_CLIENT)
 	channel.SendMethod(&amqp.ConnectionCloseOk{})
-	conn.hardClose()
+	conn.closeAfterFlush()
 	return nil
 }
 
 func (channel *Channel) connectionCloseOk(conn *AMQPConnection, method *amqp.ConnectionCloseOk) *amqp.AMQPError {
-	conn.hardClose()
+	conn.hardClose(CLOSE_PROTOCOL_ERROR)
 	return nil
 }
 
 func (channel *Channel) connectionSecureOk(conn *AMQPConnection, method *amqp.ConnectionSecureOk) *amqp.AMQPError {
 	// TODO(MAY): If other security mechanisms are in place, handle this
-	conn.hardClose()
+	conn.hardClose(CLOSE_PROTOCOL_ERROR)
 	return nil
 }
 
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/karelbilek/amqp-test-server/amqp"
+	"github.com/karelbilek/amqp-test-server/stats"
+)
+
+// Summaries of the connection's own network and blocking times, in
+// nanoseconds
+func (conn *AMQPConnection) Stats() map[string]stats.HistogramSummary {
+	return map[string]stats.HistogramSummary{
+		"outBlocked":  stats.Summarize(conn.statOutBlocked),
+		"outNetwork":  stats.Summarize(conn.statOutNetwork),
+		"inBlocked":   stats.Summarize(conn.statInBlocked),
+		"inNetwork":   stats.Summarize(conn.statInNetwork),
+		"inThrottled": stats.Summarize(conn.statInThrottled),
+	}
+}
+
+// ConnectionHandler describes the connection whose id ends the request path,
+// like /api/connections/123, along with its stats. DELETE closes it instead,
+// see CloseConnection.
+func (server *Server) ConnectionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var id, err = strconv.ParseInt(path.Base(r.URL.Path), 10, 64)
+		if err != nil {
+			http.Error(w, "Bad connection id", http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			if !server.CloseConnection(id, "Closed via the admin API") {
+				http.Error(w, "Connection not found", http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		server.serverLock.Lock()
+		var conn, found = server.conns[id]
+		server.serverLock.Unlock()
+		if !found {
+			http.Error(w, "Connection not found", http.StatusNotFound)
+			return
+		}
+		var details = conn.describe()
+		details["stats"] = conn.Stats()
+		b, err := json.MarshalIndent(details, "", "    ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+}
+
+// Close a connection the way an operator would, with a connection.close with
+// code 320. The connection is torn down once the client answers with
+// close-ok, or after the close timeout if it doesn't. Reports false if there
+// is no connection with that id.
+func (server *Server) CloseConnection(id int64, reason string) bool {
+	server.serverLock.Lock()
+	var conn, found = server.conns[id]
+	server.serverLock.Unlock()
+	if !found {
+		return false
+	}
+	conn.connectionErrorWithMethod(amqp.NewHardError(320, "CONNECTION_FORCED - "+reason, 0, 0))
+	return true
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/karelbilek/amqp-test-server/amqp"
+	"github.com/karelbilek/amqp-test-server/queue"
+)
+
+// Publish a message a queue gave up on to the queue's x-dead-letter-exchange,
+// with its x-dead-letter-routing-key or else the key the message was
+// published with. Without a dead letter exchange the message is dropped.
+func (vhost *VirtualHost) deadLetter(q *queue.Queue, qm *amqp.QueueMessage, reason string) {
+	var exchangeName, hasExchange = q.Arguments.GetString("x-dead-letter-exchange")
+	if !hasExchange {
+		return
+	}
+	vhost.lock.Lock()
+	var ex, found = vhost.exchanges[exchangeName]
+	vhost.lock.Unlock()
+	if !found {
+		return
+	}
+	msg, found := vhost.msgStore.GetNoChecks(qm.Id)
+	if !found {
+		return
+	}
+	var key = msg.Key
+	if deadLetterKey, found := q.Arguments.GetString("x-dead-letter-routing-key"); found {
+		key = deadLetterKey
+	}
+	var dead = amqp.NewMessage(&amqp.BasicPublish{
+		Exchange:   exchangeName,
+		RoutingKey: key,
+	}, -1)
+	dead.Header = deadLetterHeader(msg, q.Name, reason)
+	dead.Payload = msg.Payload
+	if _, amqpErr := vhost.publish(ex, dead); amqpErr != nil {
+		fmt.Println("Error dead lettering message:", amqpErr.Msg)
+	}
+}
+
+// Copy the content header of a dead lettered message, recording where it
+// was first dead lettered like RabbitMQ's x-first-death headers
+func deadLetterHeader(msg *amqp.Message, queueName string, reason string) *amqp.ContentHeaderFrame {
+	var header = *msg.Header
+	var props = amqp.BasicContentHeaderProperties{}
+	if header.Properties != nil {
+		props = *header.Properties
+	}
+	var headers = amqp.NewTable()
+	if props.Headers != nil {
+		headers.Table = append(headers.Table, props.Headers.Table...)
+	}
+	if headers.GetKey("x-first-death-queue") == nil {
+		headers.SetKey("x-first-death-queue", []byte(queueName))
+		headers.SetKey("x-first-death-reason", []byte(reason))
+		headers.SetKey("x-first-death-exchange", []byte(msg.Exchange))
+	}
+	props.Headers = headers
+	header.Properties = &props
+	header.PropertyFlags |= amqp.MaskHeaders
+	return &header
+}
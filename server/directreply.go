@@ -0,0 +1,109 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/karelbilek/amqp-test-server/amqp"
+)
+
+// The pseudo-queue for RabbitMQ style direct reply-to. A channel consumes
+// from it, with no-ack, and publishes requests with this as the reply-to.
+// The server gives each of those requests the channel's own reply address,
+// and a reply published to that address on the default exchange goes
+// straight to the consumer, without a queue in between.
+const DirectReplyTo = "amq.rabbitmq.reply-to"
+
+// Reply addresses are the pseudo-queue name, a dot and a random id
+const directReplyPrefix = DirectReplyTo + "."
+
+type directReplyConsumer struct {
+	channel     *Channel
+	consumerTag string
+}
+
+func (channel *Channel) consumeDirectReply(method *amqp.BasicConsume) *amqp.AMQPError {
+	var classId, methodId = method.MethodIdentifier()
+	if !method.NoAck {
+		return amqp.NewSoftError(406, "Direct reply-to consumers must use no-ack", classId, methodId)
+	}
+	if channel.directReplyAddress != "" {
+		return amqp.NewSoftError(406, "Channel is already consuming direct replies", classId, methodId)
+	}
+	if len(method.ConsumerTag) == 0 {
+		method.ConsumerTag = channel.conn.ids.NewId()
+	}
+	channel.consumerLock.Lock()
+	_, found := channel.consumers[method.ConsumerTag]
+	channel.consumerLock.Unlock()
+	if found {
+		var msg = fmt.Sprintf("Consumer tag already exists: %s", method.ConsumerTag)
+		return amqp.NewSoftError(403, msg, classId, methodId)
+	}
+	channel.directReplyAddress = directReplyPrefix + channel.conn.ids.NewId()
+	channel.directReplyTag = method.ConsumerTag
+	channel.vhost.lock.Lock()
+	channel.vhost.directReplies[channel.directReplyAddress] = directReplyConsumer{
+		channel:     channel,
+		consumerTag: method.ConsumerTag,
+	}
+	channel.vhost.lock.Unlock()
+	if !method.NoWait {
+		channel.SendMethod(&amqp.BasicConsumeOk{ConsumerTag: method.ConsumerTag})
+	}
+	return nil
+}
+
+// Stop consuming direct replies. Replies sent to the old address after this
+// are dropped, or returned if they were mandatory.
+func (channel *Channel) cancelDirectReply() {
+	if channel.directReplyAddress == "" {
+		return
+	}
+	channel.vhost.lock.Lock()
+	delete(channel.vhost.directReplies, channel.directReplyAddress)
+	channel.vhost.lock.Unlock()
+	channel.directReplyAddress = ""
+	channel.directReplyTag = ""
+}
+
+// Give a request published with the pseudo-queue as its reply-to the
+// channel's reply address instead
+func (channel *Channel) setDirectReplyTo(header *amqp.ContentHeaderFrame) *amqp.AMQPError {
+	var replyTo = header.Properties.ReplyTo
+	if replyTo == nil || *replyTo != DirectReplyTo {
+		return nil
+	}
+	if channel.directReplyAddress == "" {
+		return amqp.NewSoftError(406, "Direct reply-to consumer does not exist", amqp.ClassIdBasic, amqp.MethodIdBasicPublish)
+	}
+	var address = channel.directReplyAddress
+	header.Properties.ReplyTo = &address
+	return nil
+}
+
+func isDirectReply(msg *amqp.Message) bool {
+	return msg.Exchange == "" && strings.HasPrefix(msg.Key, directReplyPrefix)
+}
+
+// Deliver a reply straight to the consumer of its address. Direct replies
+// aren't stored, so they also skip transactions and are sent on straight
+// away.
+func (channel *Channel) publishDirectReply(msg *amqp.Message) {
+	var vhost = channel.vhost
+	vhost.lock.Lock()
+	var target, found = vhost.directReplies[msg.Key]
+	vhost.lock.Unlock()
+	if !found {
+		if msg.Method.Mandatory {
+			channel.SendContent(vhost.returnMessage(msg, 313, "No direct reply-to consumer"), msg)
+		}
+		return
+	}
+	target.channel.SendContent(&amqp.BasicDeliver{
+		ConsumerTag: target.consumerTag,
+		DeliveryTag: target.channel.nextDeliveryTag(),
+		Exchange:    msg.Exchange,
+		RoutingKey:  msg.Key,
+	}, msg)
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/karelbilek/amqp-test-server/binding"
+	"github.com/karelbilek/amqp-test-server/util"
+)
+
+// How many events a subscriber may fall behind by. Events which don't fit
+// are dropped for that subscriber rather than holding up the broker.
+const eventBufferSize = 256
+
+// A change to the broker's state, like a queue being declared or a
+// connection closing. Type is named after the AMQP method where there is
+// one, like queue.declare or exchange.bind.
+type Event struct {
+	Type string
+	Time time.Time
+	// What the event is about, like the queue name or connection id
+	Data map[string]interface{}
+}
+
+func (event *Event) MarshalJSON() ([]byte, error) {
+	var fields = map[string]interface{}{
+		"type": event.Type,
+		"time": event.Time,
+	}
+	for key, value := range event.Data {
+		fields[key] = value
+	}
+	return json.Marshal(fields)
+}
+
+type eventBus struct {
+	lock        sync.Mutex
+	subscribers map[chan *Event]bool
+	// The server's clock, so events line up with the rest of the broker
+	// under a fake clock
+	clock util.Clock
+}
+
+func newEventBus(clock util.Clock) *eventBus {
+	return &eventBus{subscribers: make(map[chan *Event]bool), clock: clock}
+}
+
+func (bus *eventBus) setClock(clock util.Clock) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	bus.clock = clock
+}
+
+func (bus *eventBus) subscribe() chan *Event {
+	var ch = make(chan *Event, eventBufferSize)
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	bus.subscribers[ch] = true
+	return ch
+}
+
+func (bus *eventBus) unsubscribe(ch chan *Event) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	delete(bus.subscribers, ch)
+}
+
+func (bus *eventBus) emit(eventType string, data map[string]interface{}) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	if len(bus.subscribers) == 0 {
+		return
+	}
+	var event = &Event{Type: eventType, Time: bus.clock.Now(), Data: data}
+	for ch := range bus.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Receive broker events until the returned function is called
+func (server *Server) SubscribeEvents() (<-chan *Event, func()) {
+	var ch = server.events.subscribe()
+	return ch, func() { server.events.unsubscribe(ch) }
+}
+
+func (vhost *VirtualHost) emit(eventType string, data map[string]interface{}) {
+	data["vhost"] = vhost.name
+	vhost.events.emit(eventType, data)
+}
+
+func (channel *Channel) emitBinding(eventType string, b *binding.Binding) {
+	var data = map[string]interface{}{
+		"connection":  channel.conn.id,
+		"exchange":    b.ExchangeName,
+		"routingKey":  b.Key,
+		"destination": b.QueueName,
+	}
+	channel.vhost.emit(eventType, data)
+}
+
+// EventsHandler streams broker events as Server-Sent Events, each one a
+// JSON object with the event type and time alongside its details
+func (server *Server) EventsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var flusher, ok = w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+		events, unsubscribe := server.SubscribeEvents()
+		defer unsubscribe()
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		for {
+			select {
+			case event := <-events:
+				var b, err = json.Marshal(event)
+				if err != nil {
+					fmt.Println("Error serializing event:", err.Error())
+					continue
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, b)
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
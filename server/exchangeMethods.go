@@ -3,8 +3,8 @@ package server
 import (
 	_ "fmt"
 	"github.com/karelbilek/amqp-test-server/amqp"
+	"github.com/karelbilek/amqp-test-server/binding"
 	"github.com/karelbilek/amqp-test-server/exchange"
-	"strings"
 )
 
 func (channel *Channel) exchangeRoute(methodFrame amqp.MethodFrame) *amqp.AMQPError {
@@ -19,7 +19,7 @@ func (channel *Channel) exchangeRoute(methodFrame amqp.MethodFrame) *amqp.AMQPEr
 		return channel.exchangeDelete(method)
 	}
 	var classId, methodId = methodFrame.MethodIdentifier()
-	return amqp.NewHardError(540, "Not implemented", classId, methodId)
+	return channel.notImplemented(classId, methodId)
 }
 
 func (channel *Channel) exchangeDeclare(method *amqp.ExchangeDeclare) *amqp.AMQPError {
@@ -38,58 +38,69 @@ func (channel *Channel) exchangeDeclare(method *amqp.ExchangeDeclare) *amqp.AMQP
 		return amqp.NewSoftError(406, err.Error(), classId, methodId)
 	}
 
-	// Declare!
-	var ex, amqpErr = exchange.NewFromMethod(method, false, channel.server.exchangeDeleter)
-	if amqpErr != nil {
-		return amqpErr
+	// A passive declare only checks that the exchange exists. The other
+	// fields, including the type, are ignored
+	if method.Passive {
+		if _, found := channel.vhost.exchanges[method.Exchange]; !found {
+			return amqp.NewSoftError(404, "Exchange does not exist", classId, methodId)
+		}
+		if !method.NoWait {
+			channel.SendMethod(&amqp.ExchangeDeclareOk{})
+		}
+		return nil
 	}
+
+	// Declare!
 	tp, err := exchange.ExchangeNameToType(method.Type)
-	if err != nil || tp == exchange.EX_TYPE_HEADERS {
-		return amqp.NewHardError(503, err.Error(), classId, methodId)
-	}
-	existing, hasKey := channel.server.exchanges[ex.Name]
-	if !hasKey && method.Passive {
-		return amqp.NewSoftError(404, "Exchange does not exist", classId, methodId)
+	if err != nil {
+		return amqp.NewHardError(503, "Bad exchange type", classId, methodId)
 	}
+	// Redeclaring an existing exchange is checked against the method, so
+	// the common idempotent declare doesn't build a new exchange
+	existing, hasKey := channel.vhost.exchanges[method.Exchange]
 	if hasKey {
-		// if diskLoad {
-		// 	panic(fmt.Sprintf("Can't disk load a key that exists: %s", ex.Name))
-		// }
-		if existing.ExType != ex.ExType {
+		if existing.ExType != tp {
 			return amqp.NewHardError(530, "Cannot redeclare an exchange with a different type", classId, methodId)
 		}
-		if existing.EquivalentExchanges(ex) {
+		if existing.EquivalentDeclare(method) {
 			if !method.NoWait {
 				channel.SendMethod(&amqp.ExchangeDeclareOk{})
 			}
 			return nil
 		}
-		// Not equivalent, error in passive mode
-		if method.Passive {
-			return amqp.NewSoftError(406, "Exchange with this name already exists", classId, methodId)
-		}
+		// Not equivalent. Redeclaring must not replace the existing exchange
+		return amqp.NewSoftError(406, "Exchange exists and is not equivalent to existing", classId, methodId)
 	}
-	if method.Passive {
-		if !method.NoWait {
-			channel.SendMethod(&amqp.ExchangeDeclareOk{})
-		}
-		return nil
+	var ex, amqpErr = exchange.NewFromMethod(method, false, channel.vhost.exchangeDeleter)
+	if amqpErr != nil {
+		return amqpErr
 	}
 
 	// outside of passive mode you can't create an exchange starting with
 	// amq.
-	if strings.HasPrefix(method.Exchange, "amq.") {
+	if amqp.IsReservedName(method.Exchange) {
 		return amqp.NewSoftError(403, "Exchange names starting with 'amq.' are reserved", classId, methodId)
 	}
-
-	err = channel.server.addExchange(ex)
-	if err != nil {
-		return amqp.NewSoftError(500, err.Error(), classId, methodId)
+	err = channel.vhost.addExchange(ex)
+	if err == errExchangeLimit {
+		return amqp.NewSoftError(403, err.Error(), classId, methodId)
 	}
-	err = ex.Persist(channel.server.db)
 	if err != nil {
 		return amqp.NewSoftError(500, err.Error(), classId, methodId)
 	}
+	// Persist durable exchanges so they are redeclared on boot
+	if ex.Durable {
+		err = ex.Persist(channel.vhost.db)
+		if err != nil {
+			return amqp.NewSoftError(500, err.Error(), classId, methodId)
+		}
+	}
+	channel.vhost.emit("exchange.declare", map[string]interface{}{
+		"connection": channel.conn.id,
+		"name":       ex.Name,
+		"type":       method.Type,
+		"durable":    ex.Durable,
+	})
 	if !method.NoWait {
 		channel.SendMethod(&amqp.ExchangeDeclareOk{})
 	}
@@ -98,9 +109,9 @@ func (channel *Channel) exchangeDeclare(method *amqp.ExchangeDeclare) *amqp.AMQP
 
 func (channel *Channel) exchangeDelete(method *amqp.ExchangeDelete) *amqp.AMQPError {
 	var classId, methodId = method.MethodIdentifier()
-	var errCode, err = channel.server.deleteExchange(method)
+	var errCode, err = channel.vhost.deleteExchange(method)
 	if err != nil {
-		return amqp.NewSoftError(errCode, err.Error(), classId, methodId)
+		return amqp.NewError(errCode, err.Error(), classId, methodId)
 	}
 	if !method.NoWait {
 		channel.SendMethod(&amqp.ExchangeDeleteOk{})
@@ -110,15 +121,83 @@ func (channel *Channel) exchangeDelete(method *amqp.ExchangeDelete) *amqp.AMQPEr
 
 func (channel *Channel) exchangeBind(method *amqp.ExchangeBind) *amqp.AMQPError {
 	var classId, methodId = method.MethodIdentifier()
-	return amqp.NewHardError(540, "Not implemented", classId, methodId)
-	// if !method.NoWait {
-	// 	channel.SendMethod(&amqp.ExchangeBindOk{})
-	// }
+	var source, foundSource = channel.vhost.exchanges[method.Source]
+	if !foundSource {
+		return amqp.NewSoftError(404, "Source exchange not found", classId, methodId)
+	}
+	var dest, foundDest = channel.vhost.exchanges[method.Destination]
+	if !foundDest {
+		return amqp.NewSoftError(404, "Destination exchange not found", classId, methodId)
+	}
+	if source.IsHeaders() {
+		if err := binding.CheckHeadersMatch(method.Arguments); err != nil {
+			return amqp.NewSoftError(406, err.Error(), classId, methodId)
+		}
+	}
+
+	// Create binding
+	b, err := binding.NewExchangeBinding(method.Destination, method.Source, method.RoutingKey, method.Arguments, source.IsTopic())
+	if err != nil {
+		return amqp.NewSoftError(500, err.Error(), classId, methodId)
+	}
+	if source.IsHeaders() {
+		b.SetHeaders()
+	}
+
+	// Add binding
+	err = source.AddBinding(b, channel.conn.id)
+	if err != nil {
+		return amqp.NewSoftError(500, err.Error(), classId, methodId)
+	}
+
+	// Persist durable bindings
+	if source.Durable && dest.Durable {
+		var err = b.Persist(channel.vhost.db)
+		if err != nil {
+			return amqp.NewSoftError(500, err.Error(), classId, methodId)
+		}
+	}
+	channel.emitBinding("exchange.bind", b)
+
+	if !method.NoWait {
+		channel.SendMethod(&amqp.ExchangeBindOk{})
+	}
+	return nil
 }
+
 func (channel *Channel) exchangeUnbind(method *amqp.ExchangeUnbind) *amqp.AMQPError {
 	var classId, methodId = method.MethodIdentifier()
-	return amqp.NewHardError(540, "Not implemented", classId, methodId)
-	// if !method.NoWait {
-	// 	channel.SendMethod(&amqp.ExchangeUnbindOk{})
-	// }
+	var source, foundSource = channel.vhost.exchanges[method.Source]
+	if !foundSource {
+		return amqp.NewSoftError(404, "Source exchange not found", classId, methodId)
+	}
+	var dest, foundDest = channel.vhost.exchanges[method.Destination]
+	if !foundDest {
+		return amqp.NewSoftError(404, "Destination exchange not found", classId, methodId)
+	}
+
+	b, err := binding.NewExchangeBinding(method.Destination, method.Source, method.RoutingKey, method.Arguments, source.IsTopic())
+	if err != nil {
+		return amqp.NewSoftError(500, err.Error(), classId, methodId)
+	}
+	if source.IsHeaders() {
+		b.SetHeaders()
+	}
+
+	if source.Durable && dest.Durable {
+		if err := b.Depersist(channel.vhost.db); err != nil {
+			return amqp.NewSoftError(500, "Could not de-persist binding!", classId, methodId)
+		}
+	}
+
+	// A binding which doesn't exist is silently ignored
+	if err := source.RemoveBinding(b); err != nil {
+		return amqp.NewSoftError(500, err.Error(), classId, methodId)
+	}
+	channel.emitBinding("exchange.unbind", b)
+
+	if !method.NoWait {
+		channel.SendMethod(&amqp.ExchangeUnbindOk{})
+	}
+	return nil
 }
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Stop accepting connections and close the open ones. Listeners passed to
+// Serve are closed, so Serve returns, and Health reports the server as
+// shutting down from here on.
+func (server *Server) Shutdown() {
+	server.serverLock.Lock()
+	server.shuttingDown = true
+	var listeners = make([]net.Listener, 0, len(server.listeners))
+	for ln := range server.listeners {
+		listeners = append(listeners, ln)
+	}
+	var conns = make([]*AMQPConnection, 0, len(server.conns))
+	for _, conn := range server.conns {
+		conns = append(conns, conn)
+	}
+	server.serverLock.Unlock()
+
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	for _, conn := range conns {
+		conn.hardClose(CLOSE_SERVER_SHUTDOWN)
+	}
+}
+
+// Why the server can't take traffic, or nil if it can. It is unhealthy once
+// Shutdown starts, when a Serve accept loop failed, and when a message store
+// is closed or failed its last write.
+func (server *Server) Health() error {
+	server.serverLock.Lock()
+	var shuttingDown = server.shuttingDown
+	var acceptErr = server.acceptErr
+	var vhosts = make([]*VirtualHost, 0, len(server.vhosts))
+	for _, vhost := range server.vhosts {
+		vhosts = append(vhosts, vhost)
+	}
+	server.serverLock.Unlock()
+
+	if shuttingDown {
+		return errors.New("Server is shutting down")
+	}
+	if acceptErr != nil {
+		return fmt.Errorf("Accepting connections failed: %s", acceptErr.Error())
+	}
+	for _, vhost := range vhosts {
+		if err := vhost.msgStore.Health(); err != nil {
+			return fmt.Errorf("Message store for virtual host '%s': %s", vhost.name, err.Error())
+		}
+	}
+	return nil
+}
+
+// HealthHandler answers 200 while the server is healthy and 503 with the
+// reason otherwise, for load balancer and orchestrator probes
+func (server *Server) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := server.Health(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+}
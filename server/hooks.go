@@ -0,0 +1,60 @@
+package server
+
+// Called once a connection is open, after connection.open-ok is sent
+type ConnectHook func(conn *AMQPConnection)
+
+// Called with the id of an open connection once it is torn down
+type DisconnectHook func(id int64)
+
+// Hooks run in their own goroutine, so a slow hook doesn't hold up the
+// connection, and nothing orders them against each other or against the
+// connection's later frames. A disconnect hook may even run before the
+// connect hooks of the same connection have finished.
+func (server *Server) OnConnect(hook ConnectHook) {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	server.connectHooks = append(server.connectHooks, hook)
+}
+
+// Connections which never got as far as connection.open-ok don't run the
+// disconnect hooks
+func (server *Server) OnDisconnect(hook DisconnectHook) {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	server.disconnectHooks = append(server.disconnectHooks, hook)
+}
+
+// Like the interceptors, the hooks are only ever appended to
+func (server *Server) getHooks() ([]ConnectHook, []DisconnectHook) {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	return server.connectHooks, server.disconnectHooks
+}
+
+func (conn *AMQPConnection) runConnectHooks() {
+	var hooks, _ = conn.server.getHooks()
+	for _, hook := range hooks {
+		go hook(conn)
+	}
+}
+
+func (conn *AMQPConnection) runDisconnectHooks() {
+	var _, hooks = conn.server.getHooks()
+	for _, hook := range hooks {
+		go hook(conn.id)
+	}
+}
+
+func (conn *AMQPConnection) Id() int64 {
+	return conn.id
+}
+
+// The name of the virtual host the connection opened
+func (conn *AMQPConnection) VirtualHost() string {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.vhost == nil {
+		return ""
+	}
+	return conn.vhost.name
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"github.com/gogo/protobuf/proto"
+	"github.com/karelbilek/amqp-test-server/amqp"
+)
+
+// Where a message passing through an interceptor was published or is being
+// delivered
+type InterceptContext struct {
+	VirtualHost  string
+	ConnectionId int64
+	Channel      uint16
+	// For deliveries to a consumer. Empty for publishes and basic.get
+	ConsumerTag string
+}
+
+// Called with every published message before it is routed to queues. It
+// returns the message to route, which may be msg itself after changing it,
+// and false to drop the message instead. The exchange and routing key can't
+// be changed, the message is routed with the ones it was published with.
+type PublishInterceptor func(ctx *InterceptContext, msg *amqp.Message) (*amqp.Message, bool)
+
+// Called with every message sent to a consumer or basic.get, like
+// PublishInterceptor. msg is the message the queue stored, which other queues
+// may share, so an interceptor which changes it returns a changed copy made
+// with CopyMessage instead. A dropped message counts as acked.
+type DeliverInterceptor func(ctx *InterceptContext, msg *amqp.Message) (*amqp.Message, bool)
+
+// Interceptors run in the order they were added. A message body changed by
+// one needs its header's ContentBodySize updated too.
+func (server *Server) AddPublishInterceptor(interceptor PublishInterceptor) {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	server.publishInterceptors = append(server.publishInterceptors, interceptor)
+}
+
+func (server *Server) AddDeliverInterceptor(interceptor DeliverInterceptor) {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	server.deliverInterceptors = append(server.deliverInterceptors, interceptor)
+}
+
+// The interceptors are only ever appended to, so a copy of the slice can be
+// used without the lock
+func (server *Server) getInterceptors() ([]PublishInterceptor, []DeliverInterceptor) {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	return server.publishInterceptors, server.deliverInterceptors
+}
+
+func (channel *Channel) interceptContext(consumerTag string) *InterceptContext {
+	return &InterceptContext{
+		VirtualHost:  channel.vhost.name,
+		ConnectionId: channel.conn.id,
+		Channel:      channel.id,
+		ConsumerTag:  consumerTag,
+	}
+}
+
+func (channel *Channel) interceptPublish(msg *amqp.Message) (*amqp.Message, bool) {
+	var interceptors, _ = channel.server.getInterceptors()
+	if len(interceptors) == 0 {
+		return msg, true
+	}
+	var ctx = channel.interceptContext("")
+	for _, interceptor := range interceptors {
+		var keep bool
+		if msg, keep = interceptor(ctx, msg); !keep {
+			return nil, false
+		}
+	}
+	return msg, true
+}
+
+// Run the deliver interceptors for a basic.deliver or basic.get-ok. When one
+// drops the message it is acked, and basic.get is answered with get-empty.
+func (channel *Channel) interceptDeliver(method amqp.MethodFrame, msg *amqp.Message) (*amqp.Message, bool) {
+	var _, interceptors = channel.server.getInterceptors()
+	if len(interceptors) == 0 {
+		return msg, true
+	}
+	var tag uint64
+	var consumerTag string
+	switch m := method.(type) {
+	case *amqp.BasicDeliver:
+		tag, consumerTag = m.DeliveryTag, m.ConsumerTag
+	case *amqp.BasicGetOk:
+		tag = m.DeliveryTag
+	default:
+		return msg, true
+	}
+	var ctx = channel.interceptContext(consumerTag)
+	for _, interceptor := range interceptors {
+		var keep bool
+		if msg, keep = interceptor(ctx, msg); !keep {
+			if channel.awaitsAck(tag) {
+				channel.ackOne(tag, true)
+			}
+			if _, isGet := method.(*amqp.BasicGetOk); isGet {
+				channel.SendMethod(&amqp.BasicGetEmpty{})
+			}
+			return nil, false
+		}
+	}
+	return msg, true
+}
+
+// Deliveries to no-ack consumers, basic.get and direct replies are never
+// waited on for an ack
+func (channel *Channel) awaitsAck(tag uint64) bool {
+	channel.ackLock.Lock()
+	defer channel.ackLock.Unlock()
+	var _, found = channel.awaitingAcks[tag]
+	return found
+}
+
+// A deep copy for a deliver interceptor to change, going through the encoding
+// the message store uses, since proto.Clone doesn't handle the cast types in
+// the message
+func CopyMessage(msg *amqp.Message) (*amqp.Message, error) {
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	var copied = &amqp.Message{}
+	if err = proto.Unmarshal(b, copied); err != nil {
+		return nil, err
+	}
+	return copied, nil
+}
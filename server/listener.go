@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Default TCP keepalive period for accepted connections
+const DefaultKeepAlive = 15 * time.Second
+
+// Set whether the listener is created with SO_REUSEADDR so that a restarted
+// server can bind while old connections are still in TIME_WAIT
+func (server *Server) SetReuseAddr(reuse bool) {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	server.reuseAddr = reuse
+}
+
+// Set the accept backlog of listeners created by Listen. 0 keeps the
+// system default.
+func (server *Server) SetAcceptBacklog(backlog int) {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	server.acceptBacklog = backlog
+}
+
+// Set the TCP keepalive period of accepted connections. 0 disables
+// keepalive.
+func (server *Server) SetKeepAlive(period time.Duration) {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	server.keepAlive = period
+}
+
+// Set whether Nagle's algorithm is disabled on accepted connections
+func (server *Server) SetNoDelay(noDelay bool) {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	server.noDelay = noDelay
+}
+
+// Listen creates a TCP listener on address using the server's listener
+// options. Pass it to Serve to accept connections.
+func (server *Server) Listen(address string) (net.Listener, error) {
+	server.serverLock.Lock()
+	var reuseAddr = server.reuseAddr
+	var backlog = server.acceptBacklog
+	server.serverLock.Unlock()
+
+	var lc = net.ListenConfig{
+		// Accepted connections are tuned in tuneConn instead
+		KeepAlive: -1,
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = setReuseAddr(fd, reuseAddr)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if backlog > 0 {
+		if err = setBacklog(ln, backlog); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// ListenUnix creates a listener on a Unix domain socket at path, for local
+// clients. A socket left behind at path by a server which didn't shut down
+// cleanly is replaced, any other file there is an error. Pass it to Serve
+// like a TCP listener. The socket file is removed when the listener closes.
+func (server *Server) ListenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// ListenTLS creates a TCP listener like Listen whose connections are served
+// over TLS with config. Clients presenting a certificate verified against
+// config.ClientCAs may log in with SASL EXTERNAL, see auth.go. Connections
+// are tuned before the TLS handshake, and the PROXY protocol isn't read on
+// them.
+func (server *Server) ListenTLS(address string, config *tls.Config) (net.Listener, error) {
+	ln, err := server.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	return &tlsListener{Listener: ln, server: server, config: config}, nil
+}
+
+type tlsListener struct {
+	net.Listener
+	server *Server
+	config *tls.Config
+}
+
+func (ln *tlsListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if err = ln.server.tuneConn(conn); err != nil {
+			fmt.Println("Error tuning connection:", err.Error())
+			conn.Close()
+			continue
+		}
+		return tls.Server(conn, ln.config), nil
+	}
+}
+
+// Serve accepts connections from ln until it fails or the server shuts
+// down, tuning each one before handing it to OpenConnection
+func (server *Server) Serve(ln net.Listener) error {
+	server.serverLock.Lock()
+	if server.shuttingDown {
+		server.serverLock.Unlock()
+		ln.Close()
+		return errors.New("Server is shutting down")
+	}
+	server.listeners[ln] = true
+	server.serverLock.Unlock()
+	defer func() {
+		server.serverLock.Lock()
+		delete(server.listeners, ln)
+		server.serverLock.Unlock()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			// Closing the listener is how Shutdown stops the loop
+			server.serverLock.Lock()
+			if !server.shuttingDown {
+				server.acceptErr = err
+			}
+			server.serverLock.Unlock()
+			return err
+		}
+		if err = server.tuneConn(conn); err != nil {
+			fmt.Println("Error tuning connection:", err.Error())
+			conn.Close()
+			continue
+		}
+		go server.OpenConnection(conn)
+	}
+}
+
+// The subset of *net.TCPConn used to tune accepted connections
+type tunableConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+	SetNoDelay(noDelay bool) error
+}
+
+func (server *Server) tuneConn(conn net.Conn) error {
+	tcpConn, ok := conn.(tunableConn)
+	if !ok {
+		return nil
+	}
+	server.serverLock.Lock()
+	var keepAlive = server.keepAlive
+	var noDelay = server.noDelay
+	server.serverLock.Unlock()
+
+	if err := tcpConn.SetNoDelay(noDelay); err != nil {
+		return err
+	}
+	if keepAlive <= 0 {
+		return tcpConn.SetKeepAlive(false)
+	}
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return tcpConn.SetKeepAlivePeriod(keepAlive)
+}
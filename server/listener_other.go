@@ -0,0 +1,17 @@
+//go:build !unix
+
+package server
+
+import (
+	"net"
+)
+
+// Socket options are only tuned on unix systems
+
+func setReuseAddr(fd uintptr, reuse bool) error {
+	return nil
+}
+
+func setBacklog(ln net.Listener, backlog int) error {
+	return nil
+}
@@ -0,0 +1,37 @@
+//go:build unix
+
+package server
+
+import (
+	"net"
+	"syscall"
+)
+
+func setReuseAddr(fd uintptr, reuse bool) error {
+	var value = 0
+	if reuse {
+		value = 1
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, value)
+}
+
+// Go always listens with the system maximum backlog. Calling listen again
+// on the bound socket replaces it with the configured one.
+func setBacklog(ln net.Listener, backlog int) error {
+	tcpLn, ok := ln.(*net.TCPListener)
+	if !ok {
+		return nil
+	}
+	rawConn, err := tcpLn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var listenErr error
+	err = rawConn.Control(func(fd uintptr) {
+		listenErr = syscall.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return listenErr
+}
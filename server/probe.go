@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/karelbilek/amqp-test-server/amqp"
+)
+
+// Default number of unanswered probes after which a connection is closed
+const DefaultProbeFailures = 3
+
+// Set how often quiet connections are probed. A connection which sends
+// nothing for interval is sent a heartbeat frame, and it is closed once
+// failures probes in a row go by without anything arriving from the client.
+// This is stricter than the heartbeat timeout, which only applies when the
+// client negotiated heartbeats, so clients which turned heartbeats off and
+// stay quiet for that long are closed too. 0 disables probing, which is the
+// default. This applies to connections opened afterwards.
+func (server *Server) SetProbe(interval time.Duration, failures int) {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	if failures <= 0 {
+		failures = DefaultProbeFailures
+	}
+	server.probeInterval = interval
+	server.probeFailures = failures
+}
+
+func (conn *AMQPConnection) handleProbe() {
+	if conn.probeInterval == 0 {
+		return
+	}
+	go func() {
+		var unanswered = 0
+		var probeSent time.Time
+		for {
+			select {
+			case <-conn.done:
+				return
+			case <-conn.ctx.Done():
+				return
+			case <-conn.clock.After(conn.probeInterval):
+			}
+			conn.lock.Lock()
+			var lastActivity = conn.lastActivity
+			conn.lock.Unlock()
+			// Anything arriving after a probe counts as the answer
+			if unanswered > 0 && lastActivity.After(probeSent) {
+				unanswered = 0
+			}
+			if unanswered == 0 && conn.clock.Now().Sub(lastActivity) < conn.probeInterval {
+				continue
+			}
+			// The previous probe, if there was one, got nothing back
+			if unanswered >= conn.probeFailures {
+				fmt.Printf("Closing connection %d after %d unanswered probes\n", conn.id, unanswered)
+				conn.hardClose(CLOSE_HEARTBEAT_TIMEOUT)
+				return
+			}
+			unanswered += 1
+			probeSent = conn.clock.Now()
+			// A peer which stopped reading can leave the writer stuck, which
+			// counts against it like no reply
+			select {
+			case conn.outgoing <- &amqp.WireFrame{FrameType: 8, Channel: 0, Payload: make([]byte, 0)}:
+			default:
+			}
+		}
+	}()
+}
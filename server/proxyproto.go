@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The PROXY protocol lets a TCP load balancer tell the server who the
+// client really is, in a header sent before anything else on the
+// connection. See https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+
+var proxyV1Prefix = []byte("PROXY ")
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// A v1 header is at most 107 bytes including the CRLF
+const proxyV1MaxLength = 107
+
+// Set whether TCP connections must start with a PROXY protocol v1 or v2
+// header. Connections without one are closed, so only enable this behind a
+// balancer which sends it. WebSocket connections are never expected to send
+// one. This applies to connections opened afterwards.
+func (server *Server) SetProxyProtocol(enabled bool) {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	server.proxyProtocol = enabled
+}
+
+// Read a PROXY protocol header. start holds the first bytes already read
+// from the connection, at least 8. The returned address is nil if the
+// header doesn't name a client, like v1 UNKNOWN or a v2 LOCAL command.
+func readProxyHeader(reader io.Reader, start []byte) (net.Addr, error) {
+	switch {
+	case bytes.HasPrefix(start, proxyV1Prefix):
+		return readProxyV1(reader, start)
+	case bytes.HasPrefix(proxyV2Signature, start):
+		return readProxyV2(reader, start)
+	}
+	return nil, errors.New("Missing PROXY protocol header")
+}
+
+func readProxyV1(reader io.Reader, start []byte) (net.Addr, error) {
+	// Byte by byte, so nothing past the header is consumed
+	var line = append([]byte{}, start...)
+	var b = make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, errors.New("PROXY v1 header too long")
+		}
+		if _, err := io.ReadFull(reader, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	var fields = strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("Malformed PROXY v1 header: %q", line)
+	}
+	var ip = net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("Malformed PROXY v1 address: %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(reader io.Reader, start []byte) (net.Addr, error) {
+	// The rest of the signature, version and command, family and length
+	var header = make([]byte, len(proxyV2Signature)+4)
+	copy(header, start)
+	if _, err := io.ReadFull(reader, header[len(start):]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(proxyV2Signature)], proxyV2Signature) {
+		return nil, errors.New("Malformed PROXY v2 signature")
+	}
+	var versionCommand = header[12]
+	var family = header[13]
+	var length = binary.BigEndian.Uint16(header[14:])
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("Unsupported PROXY protocol version %d", versionCommand>>4)
+	}
+	var addresses = make([]byte, length)
+	if _, err := io.ReadFull(reader, addresses); err != nil {
+		return nil, err
+	}
+	// LOCAL connections are the balancer's own, like health checks
+	if versionCommand&0xf == 0 {
+		return nil, nil
+	}
+	switch family >> 4 {
+	case 1:
+		if len(addresses) < 12 {
+			return nil, errors.New("Short PROXY v2 IPv4 address block")
+		}
+		var port = binary.BigEndian.Uint16(addresses[8:])
+		return &net.TCPAddr{IP: net.IP(addresses[0:4]), Port: int(port)}, nil
+	case 2:
+		if len(addresses) < 36 {
+			return nil, errors.New("Short PROXY v2 IPv6 address block")
+		}
+		var port = binary.BigEndian.Uint16(addresses[32:])
+		return &net.TCPAddr{IP: net.IP(addresses[0:16]), Port: int(port)}, nil
+	}
+	// Unix sockets and unspecified families carry no usable address
+	return nil, nil
+}
+
+// The client's address, as reported by the PROXY protocol header if there
+// was one
+func (conn *AMQPConnection) remoteAddr() net.Addr {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.proxiedAddr != nil {
+		return conn.proxiedAddr
+	}
+	return conn.network.RemoteAddr()
+}
+
+// The remote address for connection listings and events. Clients of a Unix
+// socket are usually unnamed, so those show the socket they connected to.
+func (conn *AMQPConnection) address() string {
+	var addr = conn.remoteAddr()
+	if unixAddr, ok := addr.(*net.UnixAddr); ok && (unixAddr.Name == "" || unixAddr.Name == "@") {
+		if local, ok := conn.network.LocalAddr().(*net.UnixAddr); ok {
+			return "unix:" + local.Name
+		}
+		return "unix"
+	}
+	return fmt.Sprintf("%s", addr)
+}
@@ -6,7 +6,6 @@ import (
 	"github.com/karelbilek/amqp-test-server/amqp"
 	"github.com/karelbilek/amqp-test-server/binding"
 	"github.com/karelbilek/amqp-test-server/queue"
-	"github.com/karelbilek/amqp-test-server/util"
 )
 
 func (channel *Channel) queueRoute(methodFrame amqp.MethodFrame) *amqp.AMQPError {
@@ -23,14 +22,14 @@ func (channel *Channel) queueRoute(methodFrame amqp.MethodFrame) *amqp.AMQPError
 		return channel.queueUnbind(method)
 	}
 	var classId, methodId = methodFrame.MethodIdentifier()
-	return amqp.NewHardError(540, "Not implemented", classId, methodId)
+	return channel.notImplemented(classId, methodId)
 }
 
 func (channel *Channel) queueDeclare(method *amqp.QueueDeclare) *amqp.AMQPError {
 	var classId, methodId = method.MethodIdentifier()
 	// No name means generate a name
 	if len(method.Queue) == 0 {
-		method.Queue = util.RandomId()
+		method.Queue = channel.conn.ids.NewId()
 	}
 
 	// Check the name format
@@ -41,12 +40,18 @@ func (channel *Channel) queueDeclare(method *amqp.QueueDeclare) *amqp.AMQPError
 
 	// If this is a passive request, do the appropriate checks and return
 	if method.Passive {
-		queue, found := channel.conn.server.queues[method.Queue]
+		queue, found := channel.vhost.queues[method.Queue]
 		if found {
+			if queue.ConnId != -1 && queue.ConnId != channel.conn.id {
+				return amqp.NewSoftError(405, "Queue is locked to another connection", classId, methodId)
+			}
+			queue.Touch()
 			if !method.NoWait {
-				var qsize = uint32(queue.Len())
-				var csize = queue.ActiveConsumerCount()
-				channel.SendMethod(&amqp.QueueDeclareOk{Queue: method.Queue, MessageCount: qsize, ConsumerCount: csize})
+				channel.SendMethod(&amqp.QueueDeclareOk{
+					Queue:         method.Queue,
+					MessageCount:  queue.Len(),
+					ConsumerCount: queue.ActiveConsumerCount(),
+				})
 			}
 			channel.lastQueueName = method.Queue
 			return nil
@@ -54,47 +59,80 @@ func (channel *Channel) queueDeclare(method *amqp.QueueDeclare) *amqp.AMQPError
 		return amqp.NewSoftError(404, "Queue not found", classId, methodId)
 	}
 
-	// Create the new queue
-	var connId = channel.conn.id
-	if !method.Exclusive {
-		connId = -1
+	// Like exchanges, queues named amq.* are reserved for the server
+	if amqp.IsReservedName(method.Queue) {
+		return amqp.NewSoftError(403, "Queue names starting with 'amq.' are reserved", classId, methodId)
 	}
-	var queue = queue.NewQueue(
-		channel.ctx,
-		method.Queue,
-		method.Durable,
-		method.Exclusive,
-		method.AutoDelete,
-		method.Arguments,
-		connId,
-		channel.server.msgStore,
-		channel.server.queueDeleter,
-	)
 
-	// If the new queue exists already, ensure the settings are the same. If it
-	// doesn't, add it and optionally persist it
-	existing, hasKey := channel.server.queues[queue.Name]
+	switch typ, _ := method.Arguments.GetString("x-queue-type"); typ {
+	case "", queue.QUEUE_TYPE_CLASSIC:
+	case "quorum", "stream":
+		var msg = fmt.Sprintf("Queue type '%s' is not implemented", typ)
+		return amqp.NewHardError(540, msg, classId, methodId)
+	default:
+		var msg = fmt.Sprintf("Unknown queue type '%s'", typ)
+		return amqp.NewSoftError(406, msg, classId, methodId)
+	}
+
+	// An existing queue is checked against the method, so the common
+	// idempotent declare doesn't build a new queue
+	var q, hasKey = channel.vhost.queues[method.Queue]
 	if hasKey {
-		if existing.ConnId != -1 && existing.ConnId != channel.conn.id {
+		if q.ConnId != -1 && q.ConnId != channel.conn.id {
 			return amqp.NewSoftError(405, "Queue is locked to another connection", classId, methodId)
 		}
-		if !existing.EquivalentQueues(queue) {
+		if !q.EquivalentDeclare(method) {
 			return amqp.NewSoftError(406, "Queue exists and is not equivalent to existing", classId, methodId)
 		}
+		q.Touch()
 	} else {
-		err = channel.server.addQueue(queue)
+		// Refused declares don't build a queue only to throw it away
+		if channel.vhost.queueLimitReached() {
+			return amqp.NewSoftError(403, errQueueLimit.Error(), classId, methodId)
+		}
+		// Create the new queue
+		var connId = channel.conn.id
+		if !method.Exclusive {
+			connId = -1
+		}
+		q = queue.NewQueue(
+			channel.ctx,
+			method.Queue,
+			method.Durable,
+			method.Exclusive,
+			method.AutoDelete,
+			method.Arguments,
+			connId,
+			channel.vhost.msgStore,
+			channel.vhost.queueDeleter,
+		)
+		err = channel.vhost.addQueue(q)
+		if err == errQueueLimit {
+			return amqp.NewSoftError(403, err.Error(), classId, methodId)
+		}
 		if err != nil { // pragma: nocover
 			return amqp.NewSoftError(500, "Error creating queue", classId, methodId)
 		}
 		// Persist
-		if queue.Durable {
-			queue.Persist(channel.server.db)
+		if q.Durable {
+			q.Persist(channel.vhost.db)
 		}
+		channel.vhost.emit("queue.declare", map[string]interface{}{
+			"connection": channel.conn.id,
+			"name":       q.Name,
+			"durable":    q.Durable,
+			"exclusive":  method.Exclusive,
+			"autoDelete": method.AutoDelete,
+		})
 	}
 
 	channel.lastQueueName = method.Queue
 	if !method.NoWait {
-		channel.SendMethod(&amqp.QueueDeclareOk{Queue: queue.Name, MessageCount: uint32(0), ConsumerCount: uint32(0)})
+		channel.SendMethod(&amqp.QueueDeclareOk{
+			Queue:         q.Name,
+			MessageCount:  q.Len(),
+			ConsumerCount: q.ActiveConsumerCount(),
+		})
 	}
 	return nil
 }
@@ -111,13 +149,13 @@ func (channel *Channel) queueBind(method *amqp.QueueBind) *amqp.AMQPError {
 	}
 
 	// Check exchange
-	var exchange, foundExchange = channel.server.exchanges[method.Exchange]
+	var exchange, foundExchange = channel.vhost.exchanges[method.Exchange]
 	if !foundExchange {
 		return amqp.NewSoftError(404, "Exchange not found", classId, methodId)
 	}
 
 	// Check queue
-	var queue, foundQueue = channel.server.queues[method.Queue]
+	var queue, foundQueue = channel.vhost.queues[method.Queue]
 	if !foundQueue || queue.Closed {
 		return amqp.NewSoftError(404, fmt.Sprintf("Queue not found: %s", method.Queue), classId, methodId)
 	}
@@ -125,12 +163,20 @@ func (channel *Channel) queueBind(method *amqp.QueueBind) *amqp.AMQPError {
 	if queue.ConnId != -1 && queue.ConnId != channel.conn.id {
 		return amqp.NewSoftError(405, fmt.Sprintf("Queue is locked to another connection"), classId, methodId)
 	}
+	if exchange.IsHeaders() {
+		if err := binding.CheckHeadersMatch(method.Arguments); err != nil {
+			return amqp.NewSoftError(406, err.Error(), classId, methodId)
+		}
+	}
 
 	// Create binding
 	b, err := binding.NewBinding(method.Queue, method.Exchange, method.RoutingKey, method.Arguments, exchange.IsTopic())
 	if err != nil {
 		return amqp.NewSoftError(500, err.Error(), classId, methodId)
 	}
+	if exchange.IsHeaders() {
+		b.SetHeaders()
+	}
 
 	// Add binding
 	err = exchange.AddBinding(b, channel.conn.id)
@@ -140,11 +186,12 @@ func (channel *Channel) queueBind(method *amqp.QueueBind) *amqp.AMQPError {
 
 	// Persist durable bindings
 	if exchange.Durable && queue.Durable {
-		var err = b.Persist(channel.server.db)
+		var err = b.Persist(channel.vhost.db)
 		if err != nil {
 			return amqp.NewSoftError(500, err.Error(), classId, methodId)
 		}
 	}
+	channel.emitBinding("queue.bind", b)
 
 	if !method.NoWait {
 		channel.SendMethod(&amqp.QueueBindOk{})
@@ -165,7 +212,7 @@ func (channel *Channel) queuePurge(method *amqp.QueuePurge) *amqp.AMQPError {
 		}
 	}
 
-	var queue, foundQueue = channel.server.queues[method.Queue]
+	var queue, foundQueue = channel.vhost.queues[method.Queue]
 	if !foundQueue {
 		return amqp.NewSoftError(404, "Queue not found", classId, methodId)
 	}
@@ -194,9 +241,9 @@ func (channel *Channel) queueDelete(method *amqp.QueueDelete) *amqp.AMQPError {
 		}
 	}
 
-	numPurged, errCode, err := channel.server.deleteQueue(method, channel.conn.id)
+	numPurged, errCode, err := channel.vhost.deleteQueue(method, channel.conn.id)
 	if err != nil {
-		return amqp.NewSoftError(errCode, err.Error(), classId, methodId)
+		return amqp.NewError(errCode, err.Error(), classId, methodId)
 	}
 
 	if !method.NoWait {
@@ -217,7 +264,7 @@ func (channel *Channel) queueUnbind(method *amqp.QueueUnbind) *amqp.AMQPError {
 		}
 	}
 
-	var queue, foundQueue = channel.server.queues[method.Queue]
+	var queue, foundQueue = channel.vhost.queues[method.Queue]
 	if !foundQueue {
 		return amqp.NewSoftError(404, "Queue not found", classId, methodId)
 	}
@@ -227,7 +274,7 @@ func (channel *Channel) queueUnbind(method *amqp.QueueUnbind) *amqp.AMQPError {
 	}
 
 	// Check exchange
-	var exchange, foundExchange = channel.server.exchanges[method.Exchange]
+	var exchange, foundExchange = channel.vhost.exchanges[method.Exchange]
 	if !foundExchange {
 		return amqp.NewSoftError(404, "Exchange not found", classId, methodId)
 	}
@@ -243,9 +290,12 @@ func (channel *Channel) queueUnbind(method *amqp.QueueUnbind) *amqp.AMQPError {
 	if err != nil {
 		return amqp.NewSoftError(500, err.Error(), classId, methodId)
 	}
+	if exchange.IsHeaders() {
+		binding.SetHeaders()
+	}
 
 	if queue.Durable && exchange.Durable {
-		err := binding.Depersist(channel.server.db)
+		err := binding.Depersist(channel.vhost.db)
 		if err != nil {
 			return amqp.NewSoftError(500, "Could not de-persist binding!", classId, methodId)
 		}
@@ -254,6 +304,7 @@ func (channel *Channel) queueUnbind(method *amqp.QueueUnbind) *amqp.AMQPError {
 	if err := exchange.RemoveBinding(binding); err != nil {
 		return amqp.NewSoftError(500, err.Error(), classId, methodId)
 	}
+	channel.emitBinding("queue.unbind", binding)
 	channel.SendMethod(&amqp.QueueUnbindOk{})
 	return nil
 }
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/karelbilek/amqp-test-server/consumer"
+)
+
+// Messages in a dump unless the request gives a limit
+const defaultDumpLimit = 10
+
+// Body bytes shown for each message in a dump
+const dumpPreviewBytes = 256
+
+// QueueHandler dumps the messages at the front of a queue without consuming
+// them, for requests like /api/queues/q1/dump?limit=20&vhost=/. The vhost
+// defaults to /, and names with a slash need it escaped as %2F.
+func (server *Server) QueueHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var escaped = r.URL.EscapedPath()
+		if !strings.HasSuffix(escaped, "/dump") {
+			http.NotFound(w, r)
+			return
+		}
+		name, err := url.PathUnescape(path.Base(strings.TrimSuffix(escaped, "/dump")))
+		if err != nil {
+			http.Error(w, "Bad queue name", http.StatusBadRequest)
+			return
+		}
+		var limit = defaultDumpLimit
+		if param := r.URL.Query().Get("limit"); param != "" {
+			limit, err = strconv.Atoi(param)
+			if err != nil || limit < 0 {
+				http.Error(w, "Bad limit", http.StatusBadRequest)
+				return
+			}
+		}
+		var vhostName = r.URL.Query().Get("vhost")
+		if vhostName == "" {
+			vhostName = DefaultVirtualHost
+		}
+		vhost, found := server.virtualHost(vhostName)
+		if !found {
+			http.Error(w, "Virtual host not found", http.StatusNotFound)
+			return
+		}
+		dump, found := vhost.dumpQueue(name, limit)
+		if !found {
+			http.Error(w, "Queue not found", http.StatusNotFound)
+			return
+		}
+		b, err := json.MarshalIndent(dump, "", "    ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+}
+
+func (vhost *VirtualHost) dumpQueue(name string, limit int) ([]map[string]interface{}, bool) {
+	vhost.lock.Lock()
+	var q, found = vhost.queues[name]
+	vhost.lock.Unlock()
+	if !found {
+		return nil, false
+	}
+	var dump = make([]map[string]interface{}, 0)
+	for _, qm := range q.Peek(limit) {
+		// Delivered and acked since the peek
+		msg, found := vhost.msgStore.GetNoChecks(qm.Id)
+		if !found {
+			continue
+		}
+		var preview = make([]byte, 0, dumpPreviewBytes)
+		for _, frame := range msg.Payload {
+			var room = dumpPreviewBytes - len(preview)
+			if room <= 0 {
+				break
+			}
+			if len(frame.Payload) > room {
+				preview = append(preview, frame.Payload[:room]...)
+			} else {
+				preview = append(preview, frame.Payload...)
+			}
+		}
+		var item = consumer.MessageData(msg)
+		item["id"] = qm.Id
+		item["delivery_count"] = qm.DeliveryCount
+		item["body_size"] = qm.MsgSize
+		item["body_preview"] = string(preview)
+		item["truncated"] = uint32(len(preview)) < qm.MsgSize
+		dump = append(dump, item)
+	}
+	return dump, true
+}
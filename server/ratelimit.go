@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/karelbilek/amqp-test-server/amqp"
+	"github.com/karelbilek/amqp-test-server/util"
+)
+
+// How fast a connection's incoming frames are handled. Frames over the limit
+// are not dropped, the connection just stops reading until it is back under
+// it, which pushes back on the client through TCP. 0 means no limit.
+type RateLimit struct {
+	// basic.publish frames per second
+	MessagesPerSecond uint32
+	// Frame payload bytes per second, whatever the frame type
+	BytesPerSecond uint64
+}
+
+// A token bucket per limit, each holding up to a second's worth
+type rateLimiter struct {
+	lock     sync.Mutex
+	limit    RateLimit
+	messages float64
+	bytes    float64
+	last     time.Time
+	clock    util.Clock
+}
+
+func newRateLimiter(limit RateLimit, clock util.Clock) *rateLimiter {
+	var rl = &rateLimiter{clock: clock}
+	rl.setLimit(limit)
+	return rl
+}
+
+func (rl *rateLimiter) setLimit(limit RateLimit) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	rl.limit = limit
+	rl.messages = float64(limit.MessagesPerSecond)
+	rl.bytes = float64(limit.BytesPerSecond)
+	rl.last = rl.clock.Now()
+}
+
+func (rl *rateLimiter) getLimit() RateLimit {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	return rl.limit
+}
+
+// Take the frame's tokens and say how long to wait before handling it
+func (rl *rateLimiter) reserve(frame *amqp.WireFrame) time.Duration {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	var now = rl.clock.Now()
+	var elapsed = now.Sub(rl.last).Seconds()
+	rl.last = now
+	var wait float64
+	if rl.limit.MessagesPerSecond != 0 {
+		var rate = float64(rl.limit.MessagesPerSecond)
+		rl.messages = math.Min(rate, rl.messages+elapsed*rate)
+		if isPublish(frame) {
+			rl.messages -= 1
+		}
+		wait = math.Max(wait, -rl.messages/rate)
+	}
+	if rl.limit.BytesPerSecond != 0 {
+		var rate = float64(rl.limit.BytesPerSecond)
+		rl.bytes = math.Min(rate, rl.bytes+elapsed*rate) - float64(len(frame.Payload))
+		wait = math.Max(wait, -rl.bytes/rate)
+	}
+	return time.Duration(wait * float64(time.Second))
+}
+
+func isPublish(frame *amqp.WireFrame) bool {
+	return frame.FrameType == uint8(amqp.FrameMethod) &&
+		len(frame.Payload) >= 4 &&
+		binary.BigEndian.Uint16(frame.Payload) == amqp.ClassIdBasic &&
+		binary.BigEndian.Uint16(frame.Payload[2:]) == amqp.MethodIdBasicPublish
+}
+
+// Set the rate limit for connections opened afterwards
+func (server *Server) SetRateLimit(limit RateLimit) {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	server.rateLimit = limit
+}
+
+// Replace the rate limit of one open connection. Reports false if there is
+// no connection with that id.
+func (server *Server) SetConnectionRateLimit(connId int64, limit RateLimit) bool {
+	server.serverLock.Lock()
+	var conn, found = server.conns[connId]
+	server.serverLock.Unlock()
+	if !found {
+		return false
+	}
+	conn.rateLimiter.setLimit(limit)
+	return true
+}
+
+// Wait until the frame fits within the connection's rate limit. Reports
+// false if the connection went away in the meantime.
+func (conn *AMQPConnection) throttle(frame *amqp.WireFrame) bool {
+	var wait = conn.rateLimiter.reserve(frame)
+	if wait <= 0 {
+		return true
+	}
+	defer conn.statInThrottled.Update(int64(wait))
+	select {
+	case <-conn.clock.After(wait):
+		return true
+	case <-conn.ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/karelbilek/amqp-test-server/util"
+)
+
+// Backoff between reads which failed with a temporary error, doubling up to
+// the max
+const (
+	readRetryBackoff    = 10 * time.Millisecond
+	maxReadRetryBackoff = time.Second
+)
+
+// Reads from the network, retrying temporary errors so a frame read never
+// sees them. Bytes read up to the error are kept, so nothing from the
+// stream is lost. A timeout from a deadline set elsewhere only means no data
+// came yet and is retried after a backoff. If timeout gives a window, each
+// read sets a deadline that far ahead, and the read fails with
+// errReadTimeout once it passes with nothing arriving, so not even a
+// half-open connection blocks the reader for longer than that. EOF and other
+// errors are passed on and close the connection.
+type retryReader struct {
+	reader  io.Reader
+	clock   util.Clock
+	timeout func() time.Duration
+	// The deadline set on the reader, zero if there is none. It is moved by
+	// the reader and by pauseDeadline and restartDeadline.
+	lock     sync.Mutex
+	deadline time.Time
+	paused   bool
+}
+
+var errReadTimeout = errors.New("Nothing received from the client in time")
+
+// Implemented by network connections
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+func (r *retryReader) Read(buf []byte) (int, error) {
+	var backoff = readRetryBackoff
+	r.setDeadline(false)
+	for {
+		n, err := r.reader.Read(buf)
+		if err == nil || !(isTemporary(err) || isTimeout(err)) {
+			return n, err
+		}
+		// Hand on what did arrive. The next read runs into the error again if
+		// it persists
+		if n > 0 {
+			return n, nil
+		}
+		if isTimeout(err) {
+			if r.deadlinePassed() {
+				return 0, errReadTimeout
+			}
+			// Someone else's deadline ran out. Put ours back, or none, so
+			// the reads don't keep running into it
+			r.setDeadline(true)
+		}
+		r.clock.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxReadRetryBackoff {
+			backoff = maxReadRetryBackoff
+		}
+	}
+}
+
+// Stop the deadline while the server works on something the client has to
+// wait for, like checking its credentials, which can take a while
+func (r *retryReader) pauseDeadline() {
+	var deadliner, ok = r.reader.(readDeadliner)
+	if !ok || r.timeout == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.paused = true
+	deadliner.SetReadDeadline(time.Time{})
+	r.deadline = time.Time{}
+}
+
+// Start the current window again from now, after pauseDeadline
+func (r *retryReader) restartDeadline() {
+	r.lock.Lock()
+	r.paused = false
+	r.lock.Unlock()
+	r.setDeadline(false)
+}
+
+// Move the read deadline to the end of the current window. Without a window
+// the deadline is cleared if this reader set one, or if clear is given.
+func (r *retryReader) setDeadline(clear bool) {
+	var deadliner, ok = r.reader.(readDeadliner)
+	if !ok || r.timeout == nil {
+		return
+	}
+	var timeout = r.timeout()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.paused {
+		return
+	}
+	if timeout <= 0 {
+		if clear || !r.deadline.IsZero() {
+			deadliner.SetReadDeadline(time.Time{})
+			r.deadline = time.Time{}
+		}
+		return
+	}
+	var deadline = time.Now().Add(timeout)
+	if deadliner.SetReadDeadline(deadline) != nil {
+		r.deadline = time.Time{}
+		return
+	}
+	r.deadline = deadline
+}
+
+// Deadlines are on the real clock whatever clock the server uses
+func (r *retryReader) deadlinePassed() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return !r.deadline.IsZero() && !time.Now().Before(r.deadline)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// The settings which can be changed on a running server with Reload
+type Config struct {
+	// Proposed to new connections in connection.tune. 0 disables heartbeats
+	HeartbeatInterval time.Duration
+	// Limit on each new connection's incoming frames
+	RateLimit RateLimit
+	// Connections over this many are refused. 0 means no limit
+	MaxConnections int
+	// Limits of the virtual hosts listed. Others keep the limits they have.
+	VirtualHostLimits map[string]VirtualHostLimits
+}
+
+// Apply cfg without a restart. Open connections keep what they negotiated
+// and the rate limit they had, and only connections opened afterwards get
+// the new heartbeat interval and rate limit. A lowered MaxConnections
+// doesn't close connections either, it only refuses new ones until enough
+// have gone away. If a virtual host in VirtualHostLimits doesn't exist
+// nothing is changed.
+func (server *Server) Reload(cfg Config) error {
+	var vhosts = make(map[*VirtualHost]VirtualHostLimits, len(cfg.VirtualHostLimits))
+	for name, limits := range cfg.VirtualHostLimits {
+		vhost, found := server.virtualHost(name)
+		if !found {
+			return fmt.Errorf("Virtual host not found: '%s'", name)
+		}
+		vhosts[vhost] = limits
+	}
+	server.serverLock.Lock()
+	server.heartbeatInterval = cfg.HeartbeatInterval
+	server.rateLimit = cfg.RateLimit
+	server.maxConnections = cfg.MaxConnections
+	server.serverLock.Unlock()
+	for vhost, limits := range vhosts {
+		vhost.lock.Lock()
+		vhost.limits = limits
+		vhost.lock.Unlock()
+	}
+	return nil
+}
@@ -3,422 +3,463 @@ package server
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net"
+	"net/url"
 	"sync"
+	"time"
 
 	"github.com/karelbilek/amqp-test-server/amqp"
 	"github.com/karelbilek/amqp-test-server/binding"
 	"github.com/karelbilek/amqp-test-server/exchange"
 	"github.com/karelbilek/amqp-test-server/msgstore"
-	"github.com/karelbilek/amqp-test-server/queue"
-	bolt "go.etcd.io/bbolt"
+	"github.com/karelbilek/amqp-test-server/util"
 )
 
 type Server struct {
-	exchanges       map[string]*exchange.Exchange
-	queues          map[string]*queue.Queue
-	bindings        []*binding.Binding
-	idLock          sync.Mutex
-	conns           map[int64]*AMQPConnection
-	db              *bolt.DB
-	serverLock      sync.Mutex
-	msgStore        *msgstore.MessageStore
-	exchangeDeleter chan *exchange.Exchange
-	queueDeleter    chan *queue.Queue
-	users           map[string]User
-	strictMode      bool
-	ctx             context.Context
+	vhosts       map[string]*VirtualHost
+	conns        map[int64]*AMQPConnection
+	serverLock   sync.Mutex
+	users        map[string]User
+	strictMode   bool
+	ctx          context.Context
+	dbPath       string
+	msgStorePath string
+	// Whether virtual hosts keep their messages in memory only, see
+	// NewMemoryServer
+	memoryStore bool
+	// User names by client certificate identity, see auth.go
+	certUsers map[string]string
+	// Limits advertised in connection.tune. 0 means no limit
+	maxChannels  uint16
+	maxFrameSize uint32
+	// Largest message body a client may publish. 0 means no limit
+	maxMessageSize uint64
+	// Whether publishes without a timestamp property are given one
+	timestampMessages bool
+	// Default x-max-in-memory-length for queues. 0 means no limit
+	maxInMemoryLength int64
+	// Limit on each connection's incoming frames, see ratelimit.go
+	rateLimit RateLimit
+	// Heartbeat interval proposed in connection.tune. 0 disables heartbeats
+	heartbeatInterval time.Duration
+	// Connections over this many are refused. 0 means no limit
+	maxConnections int
+	// Whether TCP connections start with a PROXY protocol header
+	proxyProtocol bool
+	// Connections which send nothing for this long are closed. 0 disables
+	idleTimeout time.Duration
+	// How long to wait on close-ok after sending connection.close. 0 disables
+	closeTimeout time.Duration
+	// Probing of quiet connections, see probe.go. 0 disables
+	probeInterval time.Duration
+	probeFailures int
+	// Retrying of failed network writes, see writeretry.go
+	writeRetries int
+	writeBackoff time.Duration
+	// Deliveries unacked for this long trigger ackTimeoutAction. 0 disables
+	ackTimeout       time.Duration
+	ackTimeoutAction AckTimeoutAction
+	// When message stores write durable changes to disk, see msgstore
+	flushPolicy   msgstore.FlushPolicy
+	flushInterval time.Duration
+	// How message stores compress bodies on disk, see msgstore
+	compression          msgstore.Compression
+	compressionThreshold uint32
+	// Listener and accepted socket tuning, see listener.go
+	reuseAddr     bool
+	acceptBacklog int
+	keepAlive     time.Duration
+	noDelay       bool
+	// Listeners in Serve, closed by Shutdown. See health.go
+	listeners    map[net.Listener]bool
+	acceptErr    error
+	shuttingDown bool
+	// Subscribers to broker events, see events.go
+	events *eventBus
+	// Goroutines handling channel frames, see workerpool.go. No pool is used
+	// while channelWorkers is 0
+	channelPool    *workerPool
+	channelWorkers int
+	// Hooks on published and delivered messages, see interceptors.go
+	publishInterceptors []PublishInterceptor
+	deliverInterceptors []DeliverInterceptor
+	// Hooks on opened and closed connections, see hooks.go
+	connectHooks    []ConnectHook
+	disconnectHooks []DisconnectHook
+	// Where timeouts get the time from, see SetClock
+	clock util.Clock
+	// Where generated names come from, see SetIdGenerator
+	ids util.IdGenerator
 }
 
+// Server-wide defaults for the connection.tune limits
+const (
+	DefaultMaxChannels  uint16 = 4096
+	DefaultMaxFrameSize uint32 = 65536
+)
+
+// Default for how long a connection may stay silent, whether or not
+// heartbeats were negotiated
+const DefaultIdleTimeout = 10 * time.Minute
+
+// Default for how long the client has to answer the server's
+// connection.close
+const DefaultCloseTimeout = 10 * time.Second
+
 func (server *Server) MarshalJSON() ([]byte, error) {
 	conns := make(map[string]*AMQPConnection)
 	for id, value := range server.conns {
 		conns[fmt.Sprintf("%d", id)] = value
 	}
+	// The default virtual host is also reported at the top level, which is
+	// where the admin page looks for it
+	var vhost = server.vhosts[DefaultVirtualHost]
 	return json.Marshal(map[string]interface{}{
-		"exchanges":     server.exchanges,
-		"queues":        server.queues,
+		"exchanges":     vhost.exchanges,
+		"queues":        vhost.queues,
 		"connections":   conns,
-		"msgCount":      server.msgStore.MessageCount(),
-		"msgIndexCount": server.msgStore.IndexCount(),
+		"msgCount":      vhost.msgStore.MessageCount(),
+		"msgIndexCount": vhost.msgStore.IndexCount(),
+		"msgPagedCount": vhost.msgStore.PagedCount(),
+		"virtualHosts":  server.vhosts,
 	})
 }
 
 func NewServer(ctx context.Context, dbPath string, msgStorePath string, userJson map[string]interface{}, strictMode bool) *Server {
-	db, err := bolt.Open(dbPath, 0600, nil)
-	if err != nil {
-		panic(err.Error())
+	return newServer(ctx, dbPath, msgStorePath, false, userJson, strictMode)
+}
 
-	}
-	msgStore, err := msgstore.NewMessageStore(ctx, msgStorePath)
-	msgStore.Start()
-	if err != nil {
-		panic("Could not create message store!")
-	}
+// Create a server whose message stores never touch disk, so no message
+// database file is created. Durable messages are kept in memory like
+// transient ones and don't survive a restart.
+func NewMemoryServer(ctx context.Context, dbPath string, userJson map[string]interface{}, strictMode bool) *Server {
+	return newServer(ctx, dbPath, "", true, userJson, strictMode)
+}
 
+func newServer(ctx context.Context, dbPath string, msgStorePath string, memoryStore bool, userJson map[string]interface{}, strictMode bool) *Server {
 	var server = &Server{
-		exchanges:       make(map[string]*exchange.Exchange),
-		queues:          make(map[string]*queue.Queue),
-		bindings:        make([]*binding.Binding, 0),
-		conns:           make(map[int64]*AMQPConnection),
-		db:              db,
-		msgStore:        msgStore,
-		exchangeDeleter: make(chan *exchange.Exchange),
-		queueDeleter:    make(chan *queue.Queue),
-		users:           make(map[string]User),
-		strictMode:      strictMode,
-		ctx:             ctx,
-	}
-
-	server.init(ctx)
+		vhosts:            make(map[string]*VirtualHost),
+		conns:             make(map[int64]*AMQPConnection),
+		listeners:         make(map[net.Listener]bool),
+		events:            newEventBus(util.RealClock),
+		clock:             util.RealClock,
+		ids:               util.RandomIds,
+		users:             make(map[string]User),
+		certUsers:         make(map[string]string),
+		strictMode:        strictMode,
+		ctx:               ctx,
+		dbPath:            dbPath,
+		msgStorePath:      msgStorePath,
+		memoryStore:       memoryStore,
+		maxChannels:       DefaultMaxChannels,
+		maxFrameSize:      DefaultMaxFrameSize,
+		idleTimeout:       DefaultIdleTimeout,
+		heartbeatInterval: defaultHeartbeatInterval,
+		closeTimeout:      DefaultCloseTimeout,
+		probeFailures:     DefaultProbeFailures,
+		writeRetries:      DefaultWriteRetries,
+		writeBackoff:      DefaultWriteBackoff,
+		flushPolicy:       msgstore.FLUSH_INTERVAL,
+		flushInterval:     msgstore.DefaultFlushInterval,
+		reuseAddr:         true,
+		keepAlive:         DefaultKeepAlive,
+		noDelay:           true,
+	}
+
+	var msgStore = server.newMessageStore(ctx, msgStorePath)
+	server.vhosts[DefaultVirtualHost] = newVirtualHost(ctx, DefaultVirtualHost, dbPath, msgStore, server.events, server.clock)
 	server.addUsers(userJson)
+	server.registerStoreGauges()
 	return server
 }
 
-func (server *Server) init(ctx context.Context) {
-	server.msgStore.LoadMessages() //this must be before initQueues
-	server.initExchanges()
-	server.initQueues(ctx)
-	server.initBindings() // this must be after init{Exchanges,Queues}
-	go server.exchangeDeleteMonitor()
-	go server.queueDeleteMonitor()
+// Add a virtual host. Its database files are kept next to the default
+// virtual host's, with the escaped vhost name appended.
+func (server *Server) AddVirtualHost(name string) error {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	if _, found := server.vhosts[name]; found {
+		return fmt.Errorf("Virtual host already exists: '%s'", name)
+	}
+	var suffix = "." + url.PathEscape(name)
+	var msgStore = server.newMessageStore(server.ctx, server.msgStorePath+suffix)
+	var vhost = newVirtualHost(server.ctx, name, server.dbPath+suffix, msgStore, server.events, server.clock)
+	if err := vhost.msgStore.SetFlushPolicy(server.flushPolicy, server.flushInterval); err != nil {
+		return err
+	}
+	vhost.msgStore.SetCompression(server.compression, server.compressionThreshold)
+	vhost.setMaxInMemoryLength(server.maxInMemoryLength)
+	server.vhosts[name] = vhost
+	return nil
 }
 
-func (server *Server) exchangeDeleteMonitor() {
-	for {
-		select {
-		case e := <-server.exchangeDeleter:
-			var dele = &amqp.ExchangeDelete{
-
-				Exchange: e.Name,
-				NoWait:   true,
-			}
-			server.deleteExchange(dele)
-		case <-server.ctx.Done():
-			return
-		}
+// The message store of a new virtual host, kept at path unless the server
+// keeps messages in memory only
+func (server *Server) newMessageStore(ctx context.Context, path string) *msgstore.MessageStore {
+	if server.memoryStore {
+		return msgstore.NewMemoryMessageStore(ctx)
+	}
+	msgStore, err := msgstore.NewMessageStore(ctx, path)
+	if err != nil {
+		panic("Could not create message store!")
 	}
+	return msgStore
 }
 
-func (server *Server) queueDeleteMonitor() {
-	for {
-		select {
-		case q := <-server.queueDeleter:
-			var delq = &amqp.QueueDelete{
-				Queue:  q.Name,
-				NoWait: true,
-			}
-			server.deleteQueue(delq, -1)
-		case <-server.ctx.Done():
-			return
-		}
-	}
+// Bindings lists every binding in the default virtual host. Like the rest
+// of the admin API this only covers the default virtual host.
+func (server *Server) Bindings() []*binding.Binding {
+	vhost, _ := server.virtualHost(DefaultVirtualHost)
+	return vhost.allBindings()
 }
 
-func (server *Server) initBindings() {
-	// Load bindings
-	bindings, err := binding.LoadAllBindings(server.db)
-	if err != nil {
-		panic("Couldn't load bindings!")
-	}
-	for _, b := range bindings {
-		// Get Exchange
-		var exchange, foundExchange = server.exchanges[b.ExchangeName]
-		if !foundExchange {
-			panic("Couldn't bind non-existant exchange " + b.ExchangeName)
-		}
-		// Add Binding
-		err = exchange.AddBinding(b, -1)
-		if err != nil {
-			panic(err.Error())
-		}
-	}
+// Exchanges lists the exchanges in the default virtual host ordered by name
+func (server *Server) Exchanges() []*exchange.Exchange {
+	vhost, _ := server.virtualHost(DefaultVirtualHost)
+	return vhost.sortedExchanges()
 }
 
-func (server *Server) initQueues(ctx context.Context) {
-	// Load queues
-	queues, err := queue.LoadAllQueues(ctx, server.db, server.msgStore, server.queueDeleter)
-	if err != nil {
-		panic("Couldn't load queues!")
-	}
-	for _, queue := range queues {
-		err = server.addQueue(queue)
-		if err != nil {
-			panic("Couldn't load queues!")
+// BindingsForQueue lists the bindings to the named queue in the default
+// virtual host
+func (server *Server) BindingsForQueue(name string) []*binding.Binding {
+	var ret = make([]*binding.Binding, 0)
+	for _, b := range server.Bindings() {
+		if !b.ToExchange && b.QueueName == name {
+			ret = append(ret, b)
 		}
 	}
-	// Load queue data
-	for _, queue := range server.queues {
-		queue.LoadFromMsgStore(server.msgStore)
-	}
+	return ret
 }
 
-func (server *Server) initExchanges() {
-	// LOAD FROM PERSISTENT STORAGE
-	exchanges, err := exchange.LoadAllExchanges(server.db, server.exchangeDeleter)
-	if err != nil {
-		panic("Couldn't load exchanges!")
-	}
-	for _, ex := range exchanges {
-		err = server.addExchange(ex)
-		if err != nil {
-			panic("Couldn't load queues!")
-		}
-	}
-	if err != nil {
-		panic("FAILED TO LOAD EXCHANGES: " + err.Error())
+// BindingsForExchange lists the bindings from the named exchange in the
+// default virtual host. It reports false if there is no such exchange.
+func (server *Server) BindingsForExchange(name string) ([]*binding.Binding, bool) {
+	vhost, _ := server.virtualHost(DefaultVirtualHost)
+	vhost.lock.Lock()
+	var exchange, found = vhost.exchanges[name]
+	vhost.lock.Unlock()
+	if !found {
+		return nil, false
 	}
-
-	// DECLARE MISSING SYSEM EXCHANGES
-	server.genDefaultExchange("", exchange.EX_TYPE_DIRECT)
-	server.genDefaultExchange("amq.direct", exchange.EX_TYPE_DIRECT)
-	server.genDefaultExchange("amq.fanout", exchange.EX_TYPE_FANOUT)
-	server.genDefaultExchange("amq.topic", exchange.EX_TYPE_TOPIC)
+	return exchange.Bindings(), true
 }
 
-func (server *Server) genDefaultExchange(name string, typ uint8) {
-	_, hasKey := server.exchanges[name]
-	if !hasKey {
-		var ex = exchange.NewExchange(
-			name,
-			exchange.EX_TYPE_TOPIC,
-			true,
-			false,
-			false,
-			amqp.NewTable(),
-			true,
-			server.exchangeDeleter,
-		)
-		// Persist
-		ex.Persist(server.db)
-		err := server.addExchange(ex)
-		if err != nil {
-			panic(err.Error())
-		}
+func (server *Server) virtualHost(name string) (*VirtualHost, bool) {
+	if len(name) == 0 && !server.strictMode {
+		name = DefaultVirtualHost
 	}
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	var vhost, found = server.vhosts[name]
+	return vhost, found
 }
 
-func (server *Server) addExchange(ex *exchange.Exchange) error {
+// Set the highest channel number new connections may use. 0 removes the
+// server-imposed limit.
+func (server *Server) SetMaxChannels(max uint16) {
 	server.serverLock.Lock()
 	defer server.serverLock.Unlock()
-	server.exchanges[ex.Name] = ex
-	return nil
+	server.maxChannels = max
 }
 
-func (server *Server) addQueue(q *queue.Queue) error {
+// Set the largest frame new connections may send. 0 removes the
+// server-imposed limit. Values below the spec's frame-min-size are raised
+// to it, since no client could connect otherwise.
+func (server *Server) SetMaxFrameSize(max uint32) {
 	server.serverLock.Lock()
 	defer server.serverLock.Unlock()
-	server.queues[q.Name] = q
-	var defaultExchange = server.exchanges[""]
-	var defaultBinding, err = binding.NewBinding(q.Name, "", q.Name, amqp.NewTable(), false)
-	if err != nil {
-		return err
+	if max != 0 && max < uint32(amqp.FrameMinSize) {
+		max = uint32(amqp.FrameMinSize)
 	}
-	defaultExchange.AddBinding(defaultBinding, q.ConnId)
-	q.Start()
-	return nil
+	server.maxFrameSize = max
 }
 
-func (server *Server) deleteQueuesForConn(connId int64) {
+// Set the largest message body new connections may publish. Larger
+// publishes close the channel with 406. 0 removes the limit.
+func (server *Server) SetMaxMessageSize(max uint64) {
 	server.serverLock.Lock()
-	var queues = make([]*queue.Queue, 0)
-	for _, queue := range server.queues {
-		if queue.ConnId == connId {
-			queues = append(queues, queue)
-		}
-	}
-	server.serverLock.Unlock()
-	for _, queue := range queues {
-		var method = &amqp.QueueDelete{
-			Queue: queue.Name,
-		}
-		server.deleteQueue(method, connId)
-	}
+	defer server.serverLock.Unlock()
+	server.maxMessageSize = max
 }
 
-func (server *Server) deleteQueue(method *amqp.QueueDelete, connId int64) (uint32, uint16, error) {
+// Set whether the timestamp property of messages published without one is
+// set to the time the server received them, in seconds like the property
+// itself. Messages which have a timestamp keep it. This applies to
+// connections opened afterwards.
+func (server *Server) SetTimestampMessages(enabled bool) {
 	server.serverLock.Lock()
 	defer server.serverLock.Unlock()
-	// Validate
-	var queue, foundQueue = server.queues[method.Queue]
-	if !foundQueue {
-		return 0, 404, errors.New("Queue not found")
-	}
-
-	if queue.ConnId != -1 && queue.ConnId != connId {
-		return 0, 405, fmt.Errorf("Queue is locked to another connection")
-	}
-
-	// Close to stop anything from changing
-	queue.Close()
-	// Delete for storage
-	bindings := server.bindingsForQueue(queue.Name)
-	server.removeBindingsForQueue(method.Queue)
-	server.depersistQueue(queue, bindings)
+	server.timestampMessages = enabled
+}
 
-	// Cleanup
-	numPurged, err := queue.Delete(method.IfUnused, method.IfEmpty)
-	delete(server.queues, method.Queue)
-	if err != nil {
-		return 0, 406, err
+// Set how many messages queues keep in memory before the bodies of further
+// ones are paged out to the message store, for queues declared without
+// x-max-in-memory-length. This applies to existing queues too. 0 removes the
+// limit.
+func (server *Server) SetMaxInMemoryLength(max int64) {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	server.maxInMemoryLength = max
+	for _, vhost := range server.vhosts {
+		vhost.setMaxInMemoryLength(max)
 	}
-	return numPurged, 0, nil
+}
 
+// Set the heartbeat interval the server proposes to connections opened
+// afterwards. Clients may lower it. 0 disables heartbeats unless the client
+// asks for them.
+func (server *Server) SetHeartbeatInterval(interval time.Duration) {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	server.heartbeatInterval = interval
 }
 
-func (server *Server) depersistQueue(queue *queue.Queue, bindings []*binding.Binding) error {
-	return server.db.Update(func(tx *bolt.Tx) error {
-		for _, binding := range bindings {
-			if err := binding.DepersistBoltTx(tx); err != nil {
-				return err
-			}
-		}
-		return queue.DepersistBoltTx(tx)
-	})
+// Set how many connections may be open at once. Further ones are closed as
+// soon as they are accepted. Connections already open over a lowered limit
+// stay open. 0 removes the limit.
+func (server *Server) SetMaxConnections(max int) {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	server.maxConnections = max
 }
 
-func (server *Server) bindingsForQueue(queueName string) []*binding.Binding {
-	ret := make([]*binding.Binding, 0)
-	for _, exchange := range server.exchanges {
-		ret = append(ret, exchange.BindingsForQueue(queueName)...)
-	}
-	return ret
+// Set how long an open connection may go without sending any frame before
+// it is closed. This applies even when heartbeats are disabled. 0 disables
+// it.
+func (server *Server) SetIdleTimeout(timeout time.Duration) {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	server.idleTimeout = timeout
 }
 
-func (server *Server) removeBindingsForQueue(queueName string) {
-	for _, exchange := range server.exchanges {
-		exchange.RemoveBindingsForQueue(queueName)
-	}
+// Set how long a client has to answer connection.close with close-ok once
+// the server sent it, for instance on a connection error. The socket is
+// closed after that either way. 0 waits forever, leaving it to the idle
+// timeout. This applies to connections opened afterwards.
+func (server *Server) SetCloseTimeout(timeout time.Duration) {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	server.closeTimeout = timeout
 }
 
-func (server *Server) deleteExchange(method *amqp.ExchangeDelete) (uint16, error) {
+// Set the clock used for timeouts: heartbeats, idle and ack timeouts,
+// probing, and exchange and queue autodelete and expiry. Tests pass a
+// util.FakeClock to trigger these without waiting. It applies to existing
+// exchanges and queues and to connections opened afterwards, so it should be
+// set before any traffic.
+func (server *Server) SetClock(clock util.Clock) {
 	server.serverLock.Lock()
 	defer server.serverLock.Unlock()
-	exchange, found := server.exchanges[method.Exchange]
-	if !found {
-		return 404, fmt.Errorf("Exchange not found: '%s'", method.Exchange)
+	server.clock = clock
+	server.events.setClock(clock)
+	for _, vhost := range server.vhosts {
+		vhost.setClock(clock)
 	}
-	if exchange.System {
-		return 530, fmt.Errorf("Cannot delete system exchange: '%s'", method.Exchange)
-	}
-	exchange.Close()
-	exchange.Depersist(server.db)
-	// Note: we don't need to delete the bindings from the queues they are
-	// associated with because they are stored on the exchange.
-	delete(server.exchanges, method.Exchange)
-	return 0, nil
 }
 
-func (server *Server) OpenConnection(network net.Conn) {
-	c := NewAMQPConnection(server.ctx, server, network)
+// Set how names are generated for server-named queues, consumers without a
+// tag and direct reply-to addresses, for connections opened afterwards.
+// Generated names must be unique within the server.
+func (server *Server) SetIdGenerator(ids util.IdGenerator) {
 	server.serverLock.Lock()
-	server.conns[c.id] = c
-	server.serverLock.Unlock()
-	c.openConnection()
+	defer server.serverLock.Unlock()
+	server.ids = ids
 }
 
-func (server *Server) returnMessage(msg *amqp.Message, code uint16, text string) *amqp.BasicReturn {
-	return &amqp.BasicReturn{
-		Exchange:   msg.Method.Exchange,
-		RoutingKey: msg.Method.RoutingKey,
-		ReplyCode:  code,
-		ReplyText:  text,
+// Set when the message stores of all virtual hosts, including ones added
+// later, write durable changes to disk. Under FLUSH_EVERY_WRITE a persistent
+// publish is on disk before the server handles the next frame on that
+// channel. interval 0 keeps the current interval.
+func (server *Server) SetFlushPolicy(policy msgstore.FlushPolicy, interval time.Duration) error {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	server.flushPolicy = policy
+	if interval > 0 {
+		server.flushInterval = interval
 	}
-}
-
-func (server *Server) publish(exchange *exchange.Exchange, msg *amqp.Message) (*amqp.BasicReturn, *amqp.AMQPError) {
-	// Concurrency note: Since there is no lock we can, technically, have messages
-	// published after the exchange has been closed. These couldn't be on the same
-	// channel as the close is happening on, so that seems justifiable.
-	if exchange.Closed {
-		if msg.Method.Mandatory || msg.Method.Immediate {
-			var rm = server.returnMessage(msg, 313, "Exchange closed, cannot route to queues or consumers")
-			return rm, nil
+	for _, vhost := range server.vhosts {
+		if err := vhost.msgStore.SetFlushPolicy(policy, interval); err != nil {
+			return err
 		}
-		return nil, nil
-	}
-	queues, amqpErr := exchange.QueuesForPublish(msg)
-	if amqpErr != nil {
-		return nil, amqpErr
 	}
+	return nil
+}
 
-	if len(queues) == 0 {
-		// If we got here the message was unroutable.
-		if msg.Method.Mandatory || msg.Method.Immediate {
-			var rm = server.returnMessage(msg, 313, "No queues available")
-			return rm, nil
-		}
+// Set how the message stores of all virtual hosts, including ones added
+// later, compress message bodies of at least threshold bytes when writing
+// them to disk. 0 keeps the current threshold. Messages already on disk stay
+// as they are and can be read either way.
+func (server *Server) SetCompression(codec msgstore.Compression, threshold uint32) {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	server.compression = codec
+	if threshold > 0 {
+		server.compressionThreshold = threshold
 	}
-
-	var queueNames = make([]string, 0, len(queues))
-	for k, _ := range queues {
-		queueNames = append(queueNames, k)
+	for _, vhost := range server.vhosts {
+		vhost.msgStore.SetCompression(codec, threshold)
 	}
+}
 
-	// Immediate messages
-	if msg.Method.Immediate {
-		var consumed = false
-		// Add message to message store
-		queueMessagesByQueue, err := server.msgStore.AddMessage(msg, queueNames)
-		if err != nil {
-			return nil, amqp.NewSoftError(500, err.Error(), 60, 40)
-		}
-		// Try to immediately consumed it
-		for queueName, _ := range queues {
-			qms := queueMessagesByQueue[queueName]
-			for _, qm := range qms {
-				queue, found := server.queues[queueName]
-				if !found {
-					// The queue must have been deleted since the queuesForPublish call
-					continue
-				}
-				var oneConsumed = queue.ConsumeImmediate(qm)
-				var rhs = make([]amqp.MessageResourceHolder, 0)
-				if !oneConsumed {
-					server.msgStore.RemoveRef(qm, queueName, rhs)
-				}
-				consumed = oneConsumed || consumed
-			}
-		}
-		if !consumed {
-			var rm = server.returnMessage(msg, 313, "No consumers available for immediate message")
-			return rm, nil
-		}
-		return nil, nil
+func (server *Server) OpenConnection(network net.Conn) {
+	server.serverLock.Lock()
+	if server.shuttingDown {
+		server.serverLock.Unlock()
+		network.Close()
+		return
 	}
-
-	// Add the message to the message store along with the queues we're about to add it to
-	queueMessagesByQueue, err := server.msgStore.AddMessage(msg, queueNames)
-	if err != nil {
-		return nil, amqp.NewSoftError(500, err.Error(), 60, 40)
+	if server.maxConnections != 0 && len(server.conns) >= server.maxConnections {
+		server.serverLock.Unlock()
+		fmt.Println("Refusing connection, the connection limit was reached")
+		network.Close()
+		return
 	}
+	c := NewAMQPConnection(server.ctx, server, network)
+	server.conns[c.id] = c
+	server.serverLock.Unlock()
+	c.openConnection()
+}
 
-	for queueName, _ := range queues {
-		qms := queueMessagesByQueue[queueName]
-		for _, qm := range qms {
-			queue, found := server.queues[queueName]
-			if !found || !queue.Add(qm) {
-				// If we couldn't add it means the queue is closed and we should
-				// remove the ref from the message store. The queue being closed means
-				// it is going away, so worst case if the server dies we have to process
-				// and discard the message on boot.
-				var rhs = make([]amqp.MessageResourceHolder, 0)
-				server.msgStore.RemoveRef(qm, queueName, rhs)
-			}
-		}
-	}
-	return nil, nil
+// The connection.close event says why the connection closed, see
+// closereason.go
+func (server *Server) deregisterConnection(conn *AMQPConnection) {
+	server.serverLock.Lock()
+	delete(server.conns, conn.id)
+	server.serverLock.Unlock()
+	server.events.emit("connection.close", map[string]interface{}{
+		"connection": conn.id,
+		"address":    conn.address(),
+		"reason":     string(conn.getCloseReason()),
+	})
 }
 
-// Close closes all open connections
+// Close closes all open connections, flushes the message stores and closes
+// the database files of every virtual host
 func (server *Server) Close() error {
+	server.serverLock.Lock()
+	var conns = make([]*AMQPConnection, 0, len(server.conns))
 	for _, conn := range server.conns {
-		conn.hardClose()
+		conns = append(conns, conn)
+	}
+	server.serverLock.Unlock()
+	// Wait for each connection to release its queues before the databases
+	// are closed underneath them
+	for _, conn := range conns {
+		conn.hardClose(CLOSE_SERVER_SHUTDOWN)
+		<-conn.done
 	}
 	server.serverLock.Lock()
 	defer server.serverLock.Unlock()
+	// The workers stop once they have shut down the closed channels
+	if server.channelPool != nil {
+		server.channelPool.resize(0)
+	}
 	server.conns = make(map[int64]*AMQPConnection)
+	for _, vhost := range server.vhosts {
+		if err := vhost.close(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
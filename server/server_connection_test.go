@@ -0,0 +1,1728 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/karelbilek/amqp-test-server/amqp"
+	"github.com/karelbilek/amqp-test-server/util"
+	amqpclient "github.com/streadway/amqp"
+)
+
+func TestHeartbeatNegotiation(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.rawConnect()
+	defer conn.Close()
+
+	tune := rawHandshake(t, conn, &amqp.ConnectionTuneOk{
+		ChannelMax: 100,
+		FrameMax:   65536,
+		Heartbeat:  2,
+	})
+	if tune.Heartbeat != uint16(defaultHeartbeatInterval/time.Second) {
+		t.Fatalf("Server proposed wrong heartbeat: %d", tune.Heartbeat)
+	}
+
+	// The lower client value wins and heartbeats go out every interval/2
+	var last = time.Now()
+	for i := 0; i < 3; i++ {
+		frame, err := amqp.ReadFrame(conn)
+		if err != nil {
+			t.Fatalf("Error reading frame: %s", err.Error())
+		}
+		if frame.FrameType != uint8(amqp.FrameHeartbeat) {
+			t.Fatalf("Expected heartbeat frame, got frame type %d", frame.FrameType)
+		}
+		var now = time.Now()
+		var gap = now.Sub(last)
+		if gap < 500*time.Millisecond || gap > 1500*time.Millisecond {
+			t.Fatalf("Heartbeat arrived after %s, expected about 1s", gap)
+		}
+		last = now
+	}
+	var serverConn = tc.connFromServer()
+	serverConn.lock.Lock()
+	defer serverConn.lock.Unlock()
+	if serverConn.sendHeartbeatInterval != 2*time.Second {
+		t.Errorf("Wrong send interval: %s", serverConn.sendHeartbeatInterval)
+	}
+	if serverConn.receiveHeartbeatInterval != 2*time.Second {
+		t.Errorf("Wrong receive interval: %s", serverConn.receiveHeartbeatInterval)
+	}
+}
+
+func TestHeartbeatDisabled(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.rawConnect()
+	defer conn.Close()
+
+	rawHandshake(t, conn, &amqp.ConnectionTuneOk{
+		ChannelMax: 100,
+		FrameMax:   65536,
+		Heartbeat:  0,
+	})
+
+	conn.SetReadDeadline(time.Now().Add(1500 * time.Millisecond))
+	frame, err := amqp.ReadFrame(conn)
+	if err == nil {
+		t.Fatalf("Got frame type %d with heartbeats disabled", frame.FrameType)
+	}
+	var serverConn = tc.connFromServer()
+	serverConn.lock.Lock()
+	defer serverConn.lock.Unlock()
+	if serverConn.sendHeartbeatInterval != 0 || serverConn.receiveHeartbeatInterval != 0 {
+		t.Errorf("Heartbeats not disabled")
+	}
+}
+
+func TestChannelMax(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	tc.s.SetMaxChannels(2)
+	conn := tc.rawConnect()
+	defer conn.Close()
+
+	// The client accepts whatever the server proposes
+	tune := rawHandshake(t, conn, &amqp.ConnectionTuneOk{FrameMax: 65536})
+	if tune.ChannelMax != 2 {
+		t.Fatalf("Server proposed wrong channel-max: %d", tune.ChannelMax)
+	}
+	rawSendMethod(conn, 0, &amqp.ConnectionOpen{VirtualHost: "/"})
+	rawReadMethod(t, conn)
+
+	rawSendMethod(conn, 2, &amqp.ChannelOpen{})
+	if _, ok := rawReadMethod(t, conn).(*amqp.ChannelOpenOk); !ok {
+		t.Fatalf("Expected channel.open-ok")
+	}
+	rawSendMethod(conn, 3, &amqp.ChannelOpen{})
+	closeMethod, ok := rawReadMethod(t, conn).(*amqp.ConnectionClose)
+	if !ok {
+		t.Fatalf("Expected connection.close")
+	}
+	if closeMethod.ReplyCode != 530 {
+		t.Errorf("Wrong reply code: %d", closeMethod.ReplyCode)
+	}
+}
+
+func TestTuneNegotiation(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	tc.s.SetMaxChannels(10)
+	tc.s.SetMaxFrameSize(8192)
+	conn := tc.rawConnect()
+	defer conn.Close()
+
+	tune := rawHandshake(t, conn, &amqp.ConnectionTuneOk{
+		ChannelMax: 5,
+		FrameMax:   4096,
+		Heartbeat:  3,
+	})
+	if tune.ChannelMax != 10 || tune.FrameMax != 8192 {
+		t.Errorf("Server proposed wrong limits: %d channels, %d bytes", tune.ChannelMax, tune.FrameMax)
+	}
+	if tune.Heartbeat != uint16(defaultHeartbeatInterval/time.Second) {
+		t.Errorf("Server proposed wrong heartbeat: %d", tune.Heartbeat)
+	}
+	// Wait for the server to have handled tune-ok
+	rawSendMethod(conn, 0, &amqp.ConnectionOpen{VirtualHost: "/"})
+	rawReadMethod(t, conn)
+
+	var serverConn = tc.connFromServer()
+	serverConn.lock.Lock()
+	defer serverConn.lock.Unlock()
+	if serverConn.maxChannels != 5 || serverConn.maxFrameSize != 4096 {
+		t.Errorf("Wrong negotiated limits: %d channels, %d bytes", serverConn.maxChannels, serverConn.maxFrameSize)
+	}
+	if serverConn.receiveHeartbeatInterval != 3*time.Second {
+		t.Errorf("Wrong negotiated heartbeat: %s", serverConn.receiveHeartbeatInterval)
+	}
+}
+
+func TestFrameMaxBelowMinimum(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.rawConnect()
+	defer conn.Close()
+
+	rawHandshake(t, conn, &amqp.ConnectionTuneOk{ChannelMax: 100, FrameMax: 1024})
+	// The connection is closed without a connection.close
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := amqp.ReadFrame(conn)
+	if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Connection with frame-max below frame-min-size was not closed")
+	}
+}
+
+func TestNegotiateLimit(t *testing.T) {
+	var cases = []struct {
+		server, client, expected uint32
+		ok                       bool
+	}{
+		{4096, 100, 100, true},
+		{4096, 0, 4096, true},
+		{0, 100, 100, true},
+		{0, 0, 0, true},
+		{100, 4096, 4096, false},
+	}
+	for _, c := range cases {
+		var value, ok = negotiateLimit(c.server, c.client)
+		if value != c.expected || ok != c.ok {
+			t.Errorf("negotiateLimit(%d, %d) = %d, %v", c.server, c.client, value, ok)
+		}
+	}
+}
+
+func TestVirtualHosts(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	if err := tc.s.AddVirtualHost("test"); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	conn, err := tc.dial("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	ch, _, _ := channelHelper(tc, conn)
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	if _, found := tc.s.vhosts["test"].queues["q1"]; !found {
+		t.Errorf("Queue was not declared in the selected virtual host")
+	}
+	if _, found := tc.vhost().queues["q1"]; found {
+		t.Errorf("Queue leaked into the default virtual host")
+	}
+	if len(tc.s.vhosts["test"].exchanges) != 5 {
+		t.Errorf("Wrong number of exchanges: %d", len(tc.s.vhosts["test"].exchanges))
+	}
+}
+
+func TestVirtualHostRejected(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	tc.s.AddVirtualHost("private")
+	var guest = tc.s.users["guest"]
+	guest.vhosts = map[string]bool{DefaultVirtualHost: true}
+	tc.s.users["guest"] = guest
+
+	var expectClose = func(vhost string, code uint16) {
+		conn := tc.rawConnect()
+		defer conn.Close()
+		rawHandshake(t, conn, &amqp.ConnectionTuneOk{FrameMax: 65536})
+		rawSendMethod(conn, 0, &amqp.ConnectionOpen{VirtualHost: vhost})
+		closeMethod, ok := rawReadMethod(t, conn).(*amqp.ConnectionClose)
+		if !ok {
+			t.Fatalf("Expected connection.close opening %s", vhost)
+		}
+		if closeMethod.ReplyCode != code {
+			t.Errorf("Wrong reply code opening %s: %d", vhost, closeMethod.ReplyCode)
+		}
+	}
+	expectClose("missing", 404)
+	expectClose("private", 530)
+}
+
+func TestVirtualHostLimits(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	tc.s.AddVirtualHost("limited")
+	if err := tc.s.SetVirtualHostLimits("limited", VirtualHostLimits{MaxQueues: 2, MaxConnections: 1}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := tc.s.SetVirtualHostLimits("missing", VirtualHostLimits{}); err == nil {
+		t.Errorf("Set limits on a virtual host which doesn't exist")
+	}
+
+	conn, err := tc.dial("limited")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatalf("Failed to open channel")
+	}
+	for _, name := range []string{"q1", "q2"} {
+		if _, err := ch.QueueDeclare(name, false, false, false, false, NO_ARGS); err != nil {
+			t.Fatalf("Failed to declare queue %s: %s", name, err.Error())
+		}
+	}
+	// Redeclaring doesn't add a queue, so it's still allowed
+	if _, err := ch.QueueDeclare("q1", false, false, false, false, NO_ARGS); err != nil {
+		t.Fatalf("Failed to redeclare queue: %s", err.Error())
+	}
+	_, err = ch.QueueDeclare("q3", false, false, false, false, NO_ARGS)
+	if amqpErr, ok := err.(*amqpclient.Error); !ok || amqpErr.Code != 403 {
+		t.Errorf("Expected 403 for the third queue, got %v", err)
+	}
+	if _, found := tc.s.vhosts["limited"].queues["q3"]; found {
+		t.Errorf("Queue over the limit was declared")
+	}
+
+	// The default virtual host isn't limited
+	defaultCh, _, _ := channelHelper(tc, tc.connect())
+	for _, name := range []string{"q1", "q2", "q3"} {
+		if _, err := defaultCh.QueueDeclare(name, false, false, false, false, NO_ARGS); err != nil {
+			t.Errorf("Failed to declare queue %s in the default virtual host: %s", name, err.Error())
+		}
+	}
+
+	if _, err := tc.dial("limited"); err == nil {
+		t.Errorf("Second connection to the virtual host was allowed")
+	}
+}
+
+// Channels declaring at the same time can't take the virtual host past its
+// limits between them
+func TestVirtualHostLimitsConcurrentDeclare(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	tc.s.AddVirtualHost("limited")
+	tc.s.SetVirtualHostLimits("limited", VirtualHostLimits{MaxQueues: 1, MaxExchanges: 1})
+	conn, err := tc.dial("limited")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Each declare that fails closes its channel, so queues and exchanges
+	// get a channel each
+	const count = 8
+	var channels = make([]*amqpclient.Channel, 2*count)
+	for i := range channels {
+		if channels[i], err = conn.Channel(); err != nil {
+			t.Fatalf("Failed to open channel")
+		}
+	}
+	var done = make(chan bool)
+	for i := 0; i < count; i++ {
+		go func(i int) {
+			var name = fmt.Sprintf("q%d", i)
+			channels[2*i].QueueDeclare(name, false, false, false, false, NO_ARGS)
+			done <- true
+		}(i)
+		go func(i int) {
+			var name = fmt.Sprintf("x%d", i)
+			channels[2*i+1].ExchangeDeclare(name, "direct", false, false, false, false, NO_ARGS)
+			done <- true
+		}(i)
+	}
+	for range channels {
+		<-done
+	}
+	var vhost = tc.s.vhosts["limited"]
+	if len(vhost.queues) != 1 {
+		t.Errorf("Expected 1 queue, declared %d", len(vhost.queues))
+	}
+	var declared = 0
+	for _, ex := range vhost.exchanges {
+		if !ex.System {
+			declared += 1
+		}
+	}
+	if declared != 1 {
+		t.Errorf("Expected 1 exchange, declared %d", declared)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	tc.s.SetIdleTimeout(time.Second)
+	conn := tc.rawConnect()
+	defer conn.Close()
+
+	// The handshake doesn't count, however long the server takes over it
+	rawOpenChannel(t, conn)
+	var start = time.Now()
+	conn.SetReadDeadline(start.Add(5 * time.Second))
+	for {
+		// Nothing should arrive on this connection before it is closed
+		_, err := amqp.ReadFrame(conn)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			t.Fatalf("Idle connection was not closed")
+		}
+		if err != nil {
+			break
+		}
+	}
+	if time.Since(start) < 900*time.Millisecond {
+		t.Errorf("Connection closed before the idle timeout")
+	}
+}
+
+// A client which goes away without the server hearing of it stops sending
+// anything. The server's clock is stopped, so only the read deadline can
+// close these.
+func TestHalfOpenConnection(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	tc.s.SetClock(util.NewFakeClock(time.Unix(1700000000, 0)))
+	tc.s.SetHeartbeatInterval(time.Second)
+	tc.s.SetIdleTimeout(500 * time.Millisecond)
+
+	var closedWithin = func(conn net.Conn, min time.Duration, max time.Duration) {
+		var start = time.Now()
+		conn.SetReadDeadline(start.Add(max + time.Second))
+		for {
+			_, err := amqp.ReadFrame(conn)
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				t.Fatalf("Half-open connection was not closed")
+			}
+			if err != nil {
+				break
+			}
+		}
+		var elapsed = time.Since(start)
+		if elapsed < min || elapsed > max {
+			t.Errorf("Connection closed after %s, expected %s to %s", elapsed, min, max)
+		}
+	}
+
+	// Gone during the handshake, bounded by the proposed heartbeat
+	conn := tc.rawConnect()
+	defer conn.Close()
+	if _, ok := rawReadMethod(t, conn).(*amqp.ConnectionStart); !ok {
+		t.Fatalf("Expected connection.start")
+	}
+	closedWithin(conn, 1500*time.Millisecond, 3*time.Second)
+
+	// Gone after negotiating heartbeats, two intervals
+	conn = tc.rawConnect()
+	defer conn.Close()
+	rawHandshake(t, conn, &amqp.ConnectionTuneOk{FrameMax: 65536, Heartbeat: 1})
+	closedWithin(conn, 1500*time.Millisecond, 3*time.Second)
+
+	// Without heartbeats it is the idle timeout. The read already waiting
+	// when tune-ok arrives keeps the window it started with, so this waits
+	// for the next one.
+	conn = tc.rawConnect()
+	defer conn.Close()
+	rawHandshake(t, conn, &amqp.ConnectionTuneOk{FrameMax: 65536})
+	rawSendMethod(conn, 0, &amqp.ConnectionOpen{VirtualHost: "/"})
+	if _, ok := rawReadMethod(t, conn).(*amqp.ConnectionOpenOk); !ok {
+		t.Fatalf("Expected connection.open-ok")
+	}
+	closedWithin(conn, 400*time.Millisecond, 1500*time.Millisecond)
+}
+
+func TestAccessRequest(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.rawConnect()
+	defer conn.Close()
+	rawOpenChannel(t, conn)
+
+	rawSendMethod(conn, 1, &amqp.AccessRequest{Realm: "/data", Active: true, ReadAccess: true})
+	frame, err := amqp.ReadFrame(conn)
+	if err != nil {
+		t.Fatalf("Error reading frame: %s", err.Error())
+	}
+	method, err := amqp.ReadAccessMethod(bytes.NewReader(frame.Payload), false)
+	if err != nil {
+		t.Fatalf("Error reading method: %s", err.Error())
+	}
+	requestOk, ok := method.(*amqp.AccessRequestOk)
+	if !ok {
+		t.Fatalf("Expected access.request-ok, got %s", method.MethodName())
+	}
+	if requestOk.Ticket == 0 {
+		t.Errorf("Expected a non-zero ticket")
+	}
+
+	// The channel is still usable afterwards
+	rawSendMethod(conn, 1, &amqp.ExchangeDeclare{Exchange: "ex", Type: "direct", Arguments: amqp.NewTable()})
+	if _, ok := rawReadMethod(t, conn).(*amqp.ExchangeDeclareOk); !ok {
+		t.Errorf("Expected exchange.declare-ok")
+	}
+}
+
+// tuningConn records the socket options set on an accepted connection
+type tuningConn struct {
+	net.Conn
+	noDelay   bool
+	keepAlive bool
+	period    time.Duration
+}
+
+func (conn *tuningConn) SetNoDelay(noDelay bool) error {
+	conn.noDelay = noDelay
+	return nil
+}
+
+func (conn *tuningConn) SetKeepAlive(keepAlive bool) error {
+	conn.keepAlive = keepAlive
+	return nil
+}
+
+func (conn *tuningConn) SetKeepAlivePeriod(period time.Duration) error {
+	conn.period = period
+	return nil
+}
+
+// oneConnListener hands out a single connection, then fails
+type oneConnListener struct {
+	net.Listener
+	conn net.Conn
+}
+
+func (ln *oneConnListener) Accept() (net.Conn, error) {
+	if ln.conn == nil {
+		return nil, errors.New("listener closed")
+	}
+	var conn = ln.conn
+	ln.conn = nil
+	return conn, nil
+}
+
+func TestAcceptedConnTuning(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	tc.s.SetKeepAlive(30 * time.Second)
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	var conn = &tuningConn{Conn: serverSide}
+
+	if err := tc.s.Serve(&oneConnListener{conn: conn}); err == nil {
+		t.Fatalf("Serve returned without an accept error")
+	}
+	if !conn.noDelay {
+		t.Errorf("NoDelay was not set on the accepted connection")
+	}
+	if !conn.keepAlive || conn.period != 30*time.Second {
+		t.Errorf("Wrong keepalive: %v %s", conn.keepAlive, conn.period)
+	}
+}
+
+func TestListen(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	tc.s.SetAcceptBacklog(16)
+	ln, err := tc.s.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err.Error())
+	}
+	defer ln.Close()
+	go tc.s.Serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err.Error())
+	}
+	defer conn.Close()
+	amqp.WriteProtocolHeader(conn)
+	if _, ok := rawReadMethod(t, conn).(*amqp.ConnectionStart); !ok {
+		t.Errorf("Expected connection.start")
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	var path = filepath.Join(t.TempDir(), "dispatchd.sock")
+	ln, err := tc.s.ListenUnix(path)
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err.Error())
+	}
+	defer ln.Close()
+	go tc.s.Serve(ln)
+
+	conn, err := amqpclient.DialConfig("amqp://localhost/", amqpclient.Config{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err.Error())
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = ch.QueueDeclare("q", false, false, false, false, NO_ARGS); err != nil {
+		t.Fatalf("Failed to declare a queue: %s", err.Error())
+	}
+	if tc.vhost().queues["q"] == nil {
+		t.Errorf("Queue wasn't declared")
+	}
+	var info = tc.connFromServer().describe()
+	if info["address"] != "unix:"+path {
+		t.Errorf("Bad address for a unix socket connection: %v", info["address"])
+	}
+}
+
+func TestClientConnectionClose(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.rawConnect()
+	defer conn.Close()
+	rawOpenChannel(t, conn)
+	rawSendMethod(conn, 1, &amqp.QueueDeclare{Queue: "q1", Exclusive: true, Arguments: amqp.NewTable()})
+	if _, ok := rawReadMethod(t, conn).(*amqp.QueueDeclareOk); !ok {
+		t.Fatalf("Expected queue.declare-ok")
+	}
+
+	rawSendMethod(conn, 0, &amqp.ConnectionClose{ReplyCode: 200, ReplyText: "bye"})
+	if _, ok := rawReadMethod(t, conn).(*amqp.ConnectionCloseOk); !ok {
+		t.Fatalf("Expected connection.close-ok")
+	}
+	// The server then closes the network connection
+	if _, err := amqp.ReadFrame(conn); err == nil {
+		t.Fatalf("Connection still open after close-ok")
+	}
+
+	// Exclusive queues go away with the connection
+	var deadline = time.Now().Add(time.Second)
+	for {
+		tc.s.serverLock.Lock()
+		var connCount = len(tc.s.conns)
+		tc.s.serverLock.Unlock()
+		tc.vhost().lock.Lock()
+		_, queueFound := tc.vhost().queues["q1"]
+		tc.vhost().lock.Unlock()
+		if connCount == 0 && !queueFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Connection was not torn down. conns: %d, queue found: %v", connCount, queueFound)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestChannelErrorIsolated(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch1, _, errChan := channelHelper(tc, conn)
+	ch2, _, _ := channelHelper(tc, conn)
+
+	// Passive declare of a missing queue is a channel exception
+	ch1.QueueDeclarePassive("missing", false, false, false, true, NO_ARGS)
+	resp := <-errChan
+	if resp.Code != 404 {
+		t.Errorf("Wrong response code: %d", resp.Code)
+	}
+
+	// The other channel on the same connection is unaffected
+	if _, err := ch2.QueueDeclare("q1", false, false, false, false, NO_ARGS); err != nil {
+		t.Fatalf("Second channel was closed by the first channel's error: %s", err.Error())
+	}
+	if _, ok := tc.vhost().queues["q1"]; !ok {
+		t.Errorf("Queue was not declared")
+	}
+}
+
+func TestResourceErrorsCloseOnlyTheChannel(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	connErrs := conn.NotifyClose(make(chan *amqpclient.Error, 1))
+	ch2, _, _ := channelHelper(tc, conn)
+	ch2.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	ch2.Consume("q1", "exclusive", false, true, false, false, NO_ARGS)
+
+	var expectChannelError = func(code uint16, action func(ch *amqpclient.Channel)) {
+		ch1, _, errChan := channelHelper(tc, conn)
+		// The client only returns once the close has been notified
+		go action(ch1)
+		resp := <-errChan
+		if resp.Code != int(code) {
+			t.Errorf("Wrong response code: %d, expected %d", resp.Code, code)
+		}
+		if _, err := ch2.QueueDeclare("q1", false, false, false, false, NO_ARGS); err != nil {
+			t.Fatalf("Error %d closed the other channel: %s", code, err.Error())
+		}
+	}
+	expectChannelError(403, func(ch *amqpclient.Channel) {
+		ch.ExchangeDelete("amq.direct", false, false)
+	})
+	expectChannelError(403, func(ch *amqpclient.Channel) {
+		ch.Consume("q1", "other", false, false, false, false, NO_ARGS)
+	})
+	expectChannelError(404, func(ch *amqpclient.Channel) {
+		ch.QueueDelete("missing", false, false, false)
+	})
+	select {
+	case err := <-connErrs:
+		t.Errorf("Connection was closed: %v", err)
+	default:
+	}
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	var httpServer = httptest.NewServer(tc.s.WebSocketHandler())
+	defer httpServer.Close()
+
+	var dialer = websocket.Dialer{Subprotocols: []string{WebSocketSubprotocol}}
+	var url = "ws" + strings.TrimPrefix(httpServer.URL, "http")
+	ws, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err.Error())
+	}
+	var conn = newWSConn(ws)
+	defer conn.Close()
+	if ws.Subprotocol() != WebSocketSubprotocol {
+		t.Errorf("Wrong sub-protocol: %s", ws.Subprotocol())
+	}
+
+	amqp.WriteProtocolHeader(conn)
+	rawOpenChannel(t, conn)
+	rawSendMethod(conn, 1, &amqp.QueueDeclare{Queue: "q1", Arguments: amqp.NewTable()})
+	if _, ok := rawReadMethod(t, conn).(*amqp.QueueDeclareOk); !ok {
+		t.Fatalf("Expected queue.declare-ok")
+	}
+	if _, ok := tc.vhost().queues["q1"]; !ok {
+		t.Errorf("Queue was not declared")
+	}
+}
+
+func TestWebSocketSubprotocolRequired(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	var httpServer = httptest.NewServer(tc.s.WebSocketHandler())
+	defer httpServer.Close()
+
+	var url = "ws" + strings.TrimPrefix(httpServer.URL, "http")
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		t.Fatalf("Connected without the amqp sub-protocol")
+	}
+	if resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a 400 response")
+	}
+}
+
+func TestServerChannelCloseHandshake(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.rawConnect()
+	defer conn.Close()
+
+	rawOpenChannel(t, conn)
+	rawSendMethod(conn, 1, &amqp.QueueDeclare{Queue: "q1", Arguments: amqp.NewTable()})
+	if _, ok := rawReadMethod(t, conn).(*amqp.QueueDeclareOk); !ok {
+		t.Fatalf("Expected queue.declare-ok")
+	}
+	rawSendMethod(conn, 1, &amqp.QueueDeclare{Queue: "missing", Passive: true, Arguments: amqp.NewTable()})
+	chClose, ok := rawReadMethod(t, conn).(*amqp.ChannelClose)
+	if !ok || chClose.ReplyCode != 404 {
+		t.Fatalf("Expected channel.close with 404")
+	}
+
+	// Frames the client sent before it saw the close are discarded, even
+	// ones which would fail again
+	rawSendMethod(conn, 1, &amqp.QueueDeclare{Queue: "missing", Passive: true, Arguments: amqp.NewTable()})
+	rawSendMethod(conn, 1, &amqp.BasicPublish{RoutingKey: "q1"})
+	rawSendHeader(conn, 1, 4)
+	rawSendBody(conn, 1, []byte("late"))
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if frame, err := amqp.ReadFrame(conn); err == nil {
+		t.Fatalf("Got frame type %d on a closing channel", frame.FrameType)
+	}
+	conn.SetReadDeadline(time.Time{})
+	if tc.vhost().queues["q1"].Len() != 0 {
+		t.Fatalf("Publish on a closing channel was routed")
+	}
+
+	// close-ok finishes the teardown and frees the channel number
+	rawSendMethod(conn, 1, &amqp.ChannelCloseOk{})
+	rawSendMethod(conn, 1, &amqp.ChannelOpen{})
+	if _, ok := rawReadMethod(t, conn).(*amqp.ChannelOpenOk); !ok {
+		t.Fatalf("Expected channel.open-ok after close-ok")
+	}
+	rawSendMethod(conn, 1, &amqp.QueueDeclare{Queue: "q1", Passive: true, Arguments: amqp.NewTable()})
+	if _, ok := rawReadMethod(t, conn).(*amqp.QueueDeclareOk); !ok {
+		t.Fatalf("Reopened channel is not usable")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	var clock = util.NewFakeClock(time.Unix(1700000000, 0))
+	tc.s.SetClock(clock)
+	tc.s.SetRateLimit(RateLimit{MessagesPerSecond: 100})
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	tc.wait(ch)
+
+	var q = tc.vhost().queues["q1"]
+	var waitForLen = func(length uint32) {
+		var deadline = time.Now().Add(5 * time.Second)
+		for q.Len() < length {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %d messages, have %d", length, q.Len())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	// The connection stops reading when it is over the limit, which blocks
+	// the client's writes
+	var publish = func(count int) {
+		go func() {
+			for i := 0; i < count; i++ {
+				ch.Publish("", "q1", false, false, TEST_TRANSIENT_MSG)
+			}
+		}()
+	}
+
+	// A second's worth goes through at once, and the rest waits for the
+	// clock
+	publish(200)
+	waitForLen(100)
+	time.Sleep(50 * time.Millisecond)
+	if q.Len() != 100 {
+		t.Fatalf("%d publishes went through at 100/s", q.Len())
+	}
+	// The waiting frame may not have started its wait yet, so the clock goes
+	// forward in steps until the rest is through
+	var deadline = time.Now().Add(5 * time.Second)
+	for q.Len() < 200 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Throttled publishes never arrived, have %d", q.Len())
+		}
+		clock.Advance(100 * time.Millisecond)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Lifting the limit on the open connection applies straight away
+	if !tc.s.SetConnectionRateLimit(tc.connFromServer().id, RateLimit{}) {
+		t.Fatalf("Connection not found")
+	}
+	publish(200)
+	waitForLen(400)
+}
+
+func TestProxyProtocol(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	tc.s.SetProxyProtocol(true)
+
+	internal, external := net.Pipe()
+	go tc.s.OpenConnection(internal)
+	external.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 5672\r\n"))
+	if err := amqp.WriteProtocolHeader(external); err != nil {
+		t.Fatalf(err.Error())
+	}
+	rawOpenChannel(t, external)
+	var conn = tc.connFromServer()
+	if addr := conn.remoteAddr().String(); addr != "192.0.2.1:56324" {
+		t.Errorf("Wrong client address: %s", addr)
+	}
+	js, err := conn.MarshalJSON()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !strings.Contains(string(js), `"address":"192.0.2.1:56324"`) {
+		t.Errorf("Proxied address missing from %s", js)
+	}
+	external.Close()
+
+	// Without the header the connection is refused
+	var plain = tc.rawConnect()
+	defer plain.Close()
+	plain.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := plain.Read(make([]byte, 8)); err != io.EOF {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	ln, err := tc.s.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var served = make(chan error, 1)
+	go func() { served <- tc.s.Serve(ln) }()
+	var health = httptest.NewServer(tc.s.HealthHandler())
+	defer health.Close()
+
+	var status = func() int {
+		resp, err := http.Get(health.URL)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := status(); code != http.StatusOK {
+		t.Fatalf("Healthy server answered %d", code)
+	}
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer client.Close()
+	amqp.WriteProtocolHeader(client)
+	rawReadMethod(t, client)
+
+	tc.s.Shutdown()
+	if code := status(); code != http.StatusServiceUnavailable {
+		t.Errorf("Server shutting down answered %d", code)
+	}
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Serve kept accepting after Shutdown")
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected Shutdown to close the connection, got %v", err)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	var clock = util.NewFakeClock(time.Unix(1700000000, 0))
+	tc.s.SetClock(clock)
+	var stream = httptest.NewServer(tc.s.EventsHandler())
+	defer stream.Close()
+	resp, err := http.Get(stream.URL)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Wrong content type: %s", resp.Header.Get("Content-Type"))
+	}
+	var lines = make(chan string, 100)
+	go func() {
+		var scanner = bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	// The data of the next event of the given type
+	var next = func(eventType string) map[string]interface{} {
+		var timeout = time.After(2 * time.Second)
+		for {
+			select {
+			case line := <-lines:
+				if line != "event: "+eventType {
+					continue
+				}
+				var data = strings.TrimPrefix(<-lines, "data: ")
+				var event map[string]interface{}
+				if err := json.Unmarshal([]byte(data), &event); err != nil {
+					t.Fatalf("Bad event data %q: %s", data, err.Error())
+				}
+				return event
+			case <-timeout:
+				t.Fatalf("No %s event", eventType)
+			}
+		}
+	}
+
+	conn := tc.connect()
+	if event := next("connection.open"); event["vhost"] != "/" {
+		t.Errorf("Wrong connection.open event: %v", event)
+	}
+	ch, _, _ := channelHelper(tc, conn)
+	next("channel.open")
+	ch.QueueDeclare("q1", true, false, false, false, NO_ARGS)
+	var event = next("queue.declare")
+	if event["name"] != "q1" || event["durable"] != true || event["time"] == nil {
+		t.Errorf("Wrong queue.declare event: %v", event)
+	}
+	var stamp, _ = event["time"].(string)
+	if at, _ := time.Parse(time.RFC3339Nano, stamp); !at.Equal(clock.Now()) {
+		t.Errorf("Event time %v isn't from the server's clock", event["time"])
+	}
+	ch.QueueBind("q1", "rk", "amq.direct", false, NO_ARGS)
+	if event := next("queue.bind"); event["exchange"] != "amq.direct" || event["destination"] != "q1" {
+		t.Errorf("Wrong queue.bind event: %v", event)
+	}
+	ch.QueueDelete("q1", false, false, false)
+	if event := next("queue.delete"); event["name"] != "q1" {
+		t.Errorf("Wrong queue.delete event: %v", event)
+	}
+	ch.Close()
+	next("channel.close")
+	conn.Close()
+	if event := next("connection.close"); event["reason"] != "client_close" {
+		t.Errorf("Wrong connection.close event: %v", event)
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	events, unsubscribe := tc.s.SubscribeEvents()
+	defer unsubscribe()
+	conn := tc.rawConnect()
+	defer conn.Close()
+	rawOpenChannel(t, conn)
+
+	// A frame over the negotiated frame-max of 65536
+	amqp.WriteFrame(conn, &amqp.WireFrame{
+		FrameType: uint8(amqp.FrameBody),
+		Channel:   1,
+		Payload:   make([]byte, 70000),
+	})
+	if connClose, ok := rawReadMethod(t, conn).(*amqp.ConnectionClose); !ok || connClose.ReplyCode != 501 {
+		t.Fatalf("Expected connection.close with 501")
+	}
+	rawSendMethod(conn, 0, &amqp.ConnectionCloseOk{})
+
+	var timeout = time.After(2 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.Type != "connection.close" {
+				continue
+			}
+			if event.Data["reason"] != "frame_error" {
+				t.Errorf("Connection closed with reason %v", event.Data["reason"])
+			}
+			return
+		case <-timeout:
+			t.Fatalf("No connection.close event")
+		}
+	}
+}
+
+func TestProbeClosesDeadPeer(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	tc.s.SetProbe(100*time.Millisecond, 2)
+	var openConns = func() int {
+		tc.s.serverLock.Lock()
+		defer tc.s.serverLock.Unlock()
+		return len(tc.s.conns)
+	}
+
+	// A peer which answers every probe stays connected. Probing starts with
+	// the protocol header, so neither peer goes through the handshake, which
+	// can take longer than the probes under load.
+	alive := tc.rawConnect()
+	defer alive.Close()
+	go func() {
+		for {
+			frame, err := amqp.ReadFrame(alive)
+			if err != nil {
+				return
+			}
+			if frame.FrameType == uint8(amqp.FrameHeartbeat) {
+				amqp.WriteFrame(alive, &amqp.WireFrame{FrameType: uint8(amqp.FrameHeartbeat), Payload: []byte{}})
+			}
+		}
+	}()
+	time.Sleep(600 * time.Millisecond)
+	if openConns() != 1 {
+		t.Fatalf("Connection answering probes was closed")
+	}
+
+	// A peer which stops reading and writing is closed after the probes
+	dead := tc.rawConnect()
+	defer dead.Close()
+	var deadline = time.Now().Add(2 * time.Second)
+	for openConns() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Dead peer was not closed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if openConns() != 1 {
+		t.Fatalf("Expected the answering connection to stay open")
+	}
+}
+
+func TestConnectionStatsHandler(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	tc.wait(ch)
+	var api = httptest.NewServer(tc.s.ConnectionHandler())
+	defer api.Close()
+
+	var get = func(id string) *http.Response {
+		resp, err := http.Get(api.URL + "/api/connections/" + id)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		return resp
+	}
+	var resp = get(fmt.Sprintf("%d", tc.connFromServer().id))
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Connection stats answered %d", resp.StatusCode)
+	}
+	var details struct {
+		Stats map[string]struct {
+			Count int64
+			Mean  float64
+			P95   float64
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&details); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, name := range []string{"outBlocked", "outNetwork", "inBlocked", "inNetwork"} {
+		var summary, found = details.Stats[name]
+		if !found {
+			t.Errorf("Missing %s stats", name)
+		} else if summary.Count == 0 {
+			t.Errorf("No %s samples recorded", name)
+		}
+	}
+
+	var missing = get("12345")
+	missing.Body.Close()
+	if missing.StatusCode != http.StatusNotFound {
+		t.Errorf("Unknown connection answered %d", missing.StatusCode)
+	}
+}
+
+func TestCloseConnectionHandler(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.rawConnect()
+	defer conn.Close()
+	rawOpenChannel(t, conn)
+	var api = httptest.NewServer(tc.s.ConnectionHandler())
+	defer api.Close()
+
+	var remove = func(id string) int {
+		req, err := http.NewRequest(http.MethodDelete, api.URL+"/api/connections/"+id, nil)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := remove("12345"); code != http.StatusNotFound {
+		t.Errorf("Closing a missing connection answered %d", code)
+	}
+	if code := remove(fmt.Sprintf("%d", tc.connFromServer().id)); code != http.StatusNoContent {
+		t.Fatalf("Closing the connection answered %d", code)
+	}
+	closeMethod, ok := rawReadMethod(t, conn).(*amqp.ConnectionClose)
+	if !ok {
+		t.Fatalf("Expected connection.close")
+	}
+	if closeMethod.ReplyCode != 320 {
+		t.Errorf("Expected 320, got %d", closeMethod.ReplyCode)
+	}
+	rawSendMethod(conn, 0, &amqp.ConnectionCloseOk{})
+
+	var deadline = time.Now().Add(2 * time.Second)
+	for {
+		tc.s.serverLock.Lock()
+		var count = len(tc.s.conns)
+		tc.s.serverLock.Unlock()
+		if count == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Closed connection was not deregistered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientCloseDuringHandshake(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+
+	var expectCloseOk = func(conn net.Conn) {
+		rawSendMethod(conn, 0, &amqp.ConnectionClose{ReplyCode: 200, ReplyText: "bye"})
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, ok := rawReadMethod(t, conn).(*amqp.ConnectionCloseOk); !ok {
+			t.Fatalf("Expected connection.close-ok")
+		}
+		if _, err := amqp.ReadFrame(conn); err == nil {
+			t.Errorf("Connection stayed open after close-ok")
+		}
+	}
+
+	// Right after connection.start
+	conn := tc.rawConnect()
+	defer conn.Close()
+	if _, ok := rawReadMethod(t, conn).(*amqp.ConnectionStart); !ok {
+		t.Fatalf("Expected connection.start")
+	}
+	expectCloseOk(conn)
+
+	// After tune-ok, before connection.open
+	conn2 := tc.rawConnect()
+	defer conn2.Close()
+	rawHandshake(t, conn2, &amqp.ConnectionTuneOk{FrameMax: 65536})
+	expectCloseOk(conn2)
+}
+
+func TestUnknownMethod(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.rawConnect()
+	defer conn.Close()
+	rawOpenChannel(t, conn)
+
+	var sendBogus = func(channel uint16, classId uint16, methodId uint16) {
+		var buf = bytes.NewBuffer([]byte{})
+		amqp.WriteShort(buf, classId)
+		amqp.WriteShort(buf, methodId)
+		amqp.WriteFrame(conn, &amqp.WireFrame{
+			FrameType: uint8(amqp.FrameMethod),
+			Channel:   channel,
+			Payload:   buf.Bytes(),
+		})
+	}
+
+	// An unknown method in a channel class only closes the channel
+	sendBogus(1, amqp.ClassIdBasic, 999)
+	chClose, ok := rawReadMethod(t, conn).(*amqp.ChannelClose)
+	if !ok || chClose.ReplyCode != 540 || chClose.ClassId != amqp.ClassIdBasic || chClose.MethodId != 999 {
+		t.Fatalf("Expected channel.close with 540 for basic method 999, got %v", chClose)
+	}
+	rawSendMethod(conn, 1, &amqp.ChannelCloseOk{})
+	rawSendMethod(conn, 1, &amqp.ChannelOpen{})
+	if _, ok := rawReadMethod(t, conn).(*amqp.ChannelOpenOk); !ok {
+		t.Fatalf("Connection is not usable after the unknown method")
+	}
+
+	// A class the protocol doesn't have closes the connection
+	sendBogus(1, 999, 10)
+	connClose, ok := rawReadMethod(t, conn).(*amqp.ConnectionClose)
+	if !ok || connClose.ReplyCode != 540 || connClose.ClassId != 999 || connClose.MethodId != 10 {
+		t.Fatalf("Expected connection.close with 540 for class 999, got %v", connClose)
+	}
+}
+
+func TestMethodOnWrongChannel(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+
+	// A channel method on channel 0
+	conn := tc.rawConnect()
+	defer conn.Close()
+	rawOpenChannel(t, conn)
+	rawSendMethod(conn, 0, &amqp.QueueDeclare{Queue: "q1", Arguments: amqp.NewTable()})
+	connClose, ok := rawReadMethod(t, conn).(*amqp.ConnectionClose)
+	if !ok || connClose.ReplyCode != 503 || connClose.ClassId != amqp.ClassIdQueue {
+		t.Fatalf("Expected connection.close with 503 for queue.declare on channel 0, got %v", connClose)
+	}
+	if tc.vhost().queues["q1"] != nil {
+		t.Errorf("Queue declared on channel 0")
+	}
+
+	// A connection method on a channel other than 0
+	conn2 := tc.rawConnect()
+	defer conn2.Close()
+	rawOpenChannel(t, conn2)
+	rawSendMethod(conn2, 1, &amqp.ConnectionTuneOk{ChannelMax: 10, FrameMax: 65536})
+	connClose, ok = rawReadMethod(t, conn2).(*amqp.ConnectionClose)
+	if !ok || connClose.ReplyCode != 503 || connClose.ClassId != amqp.ClassIdConnection {
+		t.Fatalf("Expected connection.close with 503 for connection.tune-ok on channel 1, got %v", connClose)
+	}
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary failure" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// Fails the first failures writes, the first of them after writing a byte
+type flakyWriter struct {
+	failures int
+	err      error
+	written  bytes.Buffer
+}
+
+func (w *flakyWriter) Write(data []byte) (int, error) {
+	if w.failures > 0 {
+		w.failures -= 1
+		if w.written.Len() == 0 {
+			w.written.Write(data[:1])
+			return 1, w.err
+		}
+		return 0, w.err
+	}
+	return w.written.Write(data)
+}
+
+func TestWriteRetry(t *testing.T) {
+	var frame = []byte("frame")
+	var w = &flakyWriter{failures: 2, err: temporaryError{}}
+	if err := writeWithRetry(w, frame, 3, time.Millisecond, util.RealClock); err != nil {
+		t.Fatalf("Write failed after two temporary errors: %s", err.Error())
+	}
+	if w.written.String() != "frame" {
+		t.Errorf("Retrying wrote %q", w.written.String())
+	}
+
+	w = &flakyWriter{failures: 2, err: temporaryError{}}
+	if err := writeWithRetry(w, frame, 1, time.Millisecond, util.RealClock); err == nil {
+		t.Errorf("Write succeeded with too few retries")
+	}
+
+	// Permanent errors aren't retried
+	w = &flakyWriter{failures: 1, err: io.ErrClosedPipe}
+	if err := writeWithRetry(w, frame, 3, time.Millisecond, util.RealClock); err != io.ErrClosedPipe {
+		t.Errorf("Expected the permanent error, got %v", err)
+	}
+	if w.failures != 0 || w.written.Len() != 1 {
+		t.Errorf("Permanent error was retried")
+	}
+}
+
+// Returns each of its results in turn, then EOF
+type scriptedReader struct {
+	results []scriptedRead
+}
+
+type scriptedRead struct {
+	data []byte
+	err  error
+}
+
+func (r *scriptedReader) Read(buf []byte) (int, error) {
+	if len(r.results) == 0 {
+		return 0, io.EOF
+	}
+	var next = &r.results[0]
+	var n = copy(buf, next.data)
+	next.data = next.data[n:]
+	if len(next.data) > 0 {
+		// The rest comes with the next read
+		return n, nil
+	}
+	r.results = r.results[1:]
+	return n, next.err
+}
+
+func TestReadRetry(t *testing.T) {
+	var encoded = amqp.EncodeFrame(&amqp.WireFrame{FrameType: uint8(amqp.FrameHeartbeat)})
+	var reader = &retryReader{
+		reader: &scriptedReader{results: []scriptedRead{
+			{err: temporaryError{}},
+			{data: encoded[:3], err: temporaryError{}},
+			// A read deadline passing, which isn't a reason to close
+			{err: os.ErrDeadlineExceeded},
+			{data: encoded[3:]},
+		}},
+		clock: util.RealClock,
+	}
+	frame, err := amqp.ReadFrame(reader)
+	if err != nil {
+		t.Fatalf("Temporary errors failed the read: %s", err.Error())
+	}
+	if frame.FrameType != uint8(amqp.FrameHeartbeat) {
+		t.Errorf("Read frame type %d", frame.FrameType)
+	}
+	// EOF still ends the connection
+	if _, err := amqp.ReadFrame(reader); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	tc.s.SetCloseTimeout(100 * time.Millisecond)
+	conn := tc.rawConnect()
+	defer conn.Close()
+	rawOpenChannel(t, conn)
+
+	// Channel numbers over channel-max are a connection error
+	rawSendMethod(conn, 101, &amqp.ChannelOpen{})
+	if connClose, ok := rawReadMethod(t, conn).(*amqp.ConnectionClose); !ok || connClose.ReplyCode != 530 {
+		t.Fatalf("Expected connection.close with 530")
+	}
+	// Never send close-ok, the server gives up waiting and closes the socket
+	var start = time.Now()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, err := amqp.ReadFrame(conn); err != nil {
+			if err != io.EOF {
+				t.Fatalf("Socket wasn't closed after the close timeout: %s", err.Error())
+			}
+			break
+		}
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("Socket was closed without waiting for close-ok")
+	}
+}
+
+func TestReload(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	first := tc.connect()
+	second := tc.connect()
+
+	// Nothing changes if a virtual host isn't found
+	var err = tc.s.Reload(Config{
+		MaxConnections:    1,
+		VirtualHostLimits: map[string]VirtualHostLimits{"missing": {}},
+	})
+	if err == nil {
+		t.Errorf("Reloaded limits for a virtual host which doesn't exist")
+	}
+	if extra, err := tc.dial("/"); err != nil {
+		t.Fatalf("Connection refused after a failed reload: %s", err.Error())
+	} else {
+		extra.Close()
+	}
+
+	err = tc.s.Reload(Config{
+		HeartbeatInterval: 3 * time.Second,
+		MaxConnections:    1,
+		VirtualHostLimits: map[string]VirtualHostLimits{"/": {MaxQueues: 1}},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := tc.dial("/"); err == nil {
+		t.Errorf("Connection over the reloaded limit was allowed")
+	}
+	// The connections over the new limit stay open
+	for _, conn := range []*amqpclient.Connection{first, second} {
+		ch, err := conn.Channel()
+		if err != nil {
+			t.Fatalf("Existing connection stopped working: %s", err.Error())
+		}
+		ch.Close()
+	}
+	tc.s.serverLock.Lock()
+	for _, conn := range tc.s.conns {
+		if conn.receiveHeartbeatInterval != defaultHeartbeatInterval {
+			t.Errorf("Existing connection's heartbeat changed to %s", conn.receiveHeartbeatInterval)
+		}
+	}
+	tc.s.serverLock.Unlock()
+
+	// Once there's room again new connections get the new settings
+	first.Close()
+	second.Close()
+	var deadline = time.Now().Add(2 * time.Second)
+	for {
+		tc.s.serverLock.Lock()
+		var count = len(tc.s.conns)
+		tc.s.serverLock.Unlock()
+		if count == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Closed connections were not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	raw := tc.rawConnect()
+	defer raw.Close()
+	tune := rawHandshake(t, raw, &amqp.ConnectionTuneOk{ChannelMax: 100, FrameMax: 65536})
+	if tune.Heartbeat != 3 {
+		t.Errorf("New connection was proposed heartbeat %d", tune.Heartbeat)
+	}
+	if tc.vhost().getLimits().MaxQueues != 1 {
+		t.Errorf("Virtual host limits were not reloaded")
+	}
+}
+
+func TestChannelWorkers(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	tc.s.SetChannelWorkers(2)
+	conn := tc.connect()
+
+	// More channels than workers, each with its own traffic
+	const channels = 20
+	var deliveries = make([]<-chan amqpclient.Delivery, channels)
+	for i := 0; i < channels; i++ {
+		ch, err := conn.Channel()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		var name = fmt.Sprintf("q%d", i)
+		ch.QueueDeclare(name, false, false, false, false, NO_ARGS)
+		for j := 0; j < 10; j++ {
+			ch.Publish("", name, false, false, TEST_TRANSIENT_MSG)
+		}
+		d, err := ch.Consume(name, "", false, false, false, false, NO_ARGS)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		deliveries[i] = d
+	}
+	if tc.connFromServer().channels[1].pool == nil {
+		t.Fatalf("Channel isn't using the worker pool")
+	}
+	for i, d := range deliveries {
+		for j := 0; j < 10; j++ {
+			select {
+			case msg := <-d:
+				msg.Ack(false)
+			case <-time.After(2 * time.Second):
+				t.Fatalf("Channel %d only got %d messages", i, j)
+			}
+		}
+	}
+
+	// Channel errors and reopening work the same
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, _, err = ch.Get("missing", false)
+	if amqpErr, ok := err.(*amqpclient.Error); !ok || amqpErr.Code != 404 {
+		t.Errorf("Expected 404 for a missing queue, got %v", err)
+	}
+	ch, err = conn.Channel()
+	if err != nil {
+		t.Fatalf("Failed to reopen a channel: %s", err.Error())
+	}
+	tc.wait(ch)
+	conn.Close()
+
+	// Each channel shuts down on a worker
+	var deadline = time.Now().Add(2 * time.Second)
+	for tc.vhost().queues["q0"].ActiveConsumerCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Consumers of the closed connection were not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if tc.vhost().queues["q0"].UnackedCount() != 0 {
+		t.Errorf("Acks on pooled channels were lost")
+	}
+}
+
+// Goroutines and publish throughput with 10k open channels, with and without
+// the channel worker pool
+func BenchmarkChannelWorkers(b *testing.B) {
+	for _, workers := range []int{0, 64} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			benchmarkChannels(b, workers, 10, 1000)
+		})
+	}
+}
+
+func benchmarkChannels(b *testing.B, workers int, conns int, channelsPerConn int) {
+	tc := &testClient{serverDb: dbPath(), msgDb: dbPath()}
+	tc.s = NewServer(context.Background(), tc.serverDb, tc.msgDb, nil, false)
+	defer tc.cleanup()
+	defer tc.s.Close()
+	tc.s.SetChannelWorkers(workers)
+
+	var channels = make([]*amqpclient.Channel, 0, conns*channelsPerConn)
+	for i := 0; i < conns; i++ {
+		conn := tc.connect()
+		for j := 0; j < channelsPerConn; j++ {
+			ch, err := conn.Channel()
+			if err != nil {
+				b.Fatalf(err.Error())
+			}
+			channels = append(channels, ch)
+		}
+	}
+	channels[0].QueueDeclare("bench", false, false, false, false, NO_ARGS)
+	var goroutines = runtime.NumGoroutine()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		channels[i%len(channels)].Publish("", "bench", false, false, TEST_TRANSIENT_MSG)
+	}
+	for tc.vhost().queues["bench"].Len() < uint32(b.N) {
+		time.Sleep(time.Millisecond)
+	}
+	b.StopTimer()
+	// Reported after ResetTimer, which drops metrics
+	b.ReportMetric(float64(goroutines), "goroutines")
+}
+
+func TestConnectionHooks(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	var connected = make(chan *AMQPConnection, 1)
+	var disconnected = make(chan int64, 1)
+	tc.s.OnConnect(func(conn *AMQPConnection) { connected <- conn })
+	tc.s.OnDisconnect(func(id int64) { disconnected <- id })
+
+	conn := tc.connect()
+	var opened *AMQPConnection
+	select {
+	case opened = <-connected:
+	case <-time.After(time.Second):
+		t.Fatalf("Connect hook didn't run")
+	}
+	if opened.Id() != tc.connFromServer().id || opened.VirtualHost() != DefaultVirtualHost {
+		t.Errorf("Connect hook got the wrong connection")
+	}
+
+	conn.Close()
+	select {
+	case id := <-disconnected:
+		if id != opened.Id() {
+			t.Errorf("Disconnect hook got id %d, expected %d", id, opened.Id())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Disconnect hook didn't run")
+	}
+}
+
+// Client certificates for TestCertificateLogin, signed by a CA made for the
+// test
+type testCertificates struct {
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	pool   *x509.CertPool
+	serial int64
+}
+
+func newTestCertificates(t *testing.T) *testCertificates {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var template = &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pool = x509.NewCertPool()
+	pool.AddCert(caCert)
+	return &testCertificates{caCert: caCert, caKey: key, pool: pool, serial: 1}
+}
+
+func (certs *testCertificates) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs.serial += 1
+	var template = &x509.Certificate{
+		SerialNumber: big.NewInt(certs.serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, certs.caCert, &key.PublicKey, certs.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+type externalAuth struct{}
+
+func (auth *externalAuth) Mechanism() string { return "EXTERNAL" }
+func (auth *externalAuth) Response() string  { return "" }
+
+func TestCertificateLogin(t *testing.T) {
+	var certs = newTestCertificates(t)
+	var users = map[string]interface{}{
+		"svc-a": map[string]interface{}{
+			"vhosts":       []interface{}{"/tenant-a"},
+			"certificates": []interface{}{"svc-a"},
+		},
+		"svc-b": map[string]interface{}{
+			"vhosts":       []interface{}{"/tenant-b"},
+			"certificates": []interface{}{"svc-b"},
+		},
+	}
+	tc := &testClient{t: t, serverDb: dbPath(), msgDb: dbPath()}
+	tc.s = NewServer(context.Background(), tc.serverDb, tc.msgDb, users, false)
+	defer tc.cleanup()
+	tc.s.AddVirtualHost("/tenant-a")
+	tc.s.AddVirtualHost("/tenant-b")
+
+	var serverConfig = &tls.Config{
+		Certificates: []tls.Certificate{certs.issue(t, "localhost", x509.ExtKeyUsageServerAuth)},
+		ClientCAs:    certs.pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+	var dial = func(cert *tls.Certificate, vhost string) error {
+		internal, external := net.Pipe()
+		go tc.s.OpenConnection(tls.Server(internal, serverConfig))
+		var clientConfig = &tls.Config{RootCAs: certs.pool, ServerName: "localhost"}
+		if cert != nil {
+			clientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		conn, err := amqpclient.DialConfig("amqp://localhost:1234", amqpclient.Config{
+			SASL:  []amqpclient.Authentication{&externalAuth{}},
+			Vhost: vhost,
+			Dial: func(network, addr string) (net.Conn, error) {
+				return tls.Client(external, clientConfig), nil
+			},
+		})
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	var svcA = certs.issue(t, "svc-a", x509.ExtKeyUsageClientAuth)
+	var svcB = certs.issue(t, "svc-b", x509.ExtKeyUsageClientAuth)
+	if err := dial(&svcA, "/tenant-a"); err != nil {
+		t.Errorf("svc-a couldn't open /tenant-a: %v", err)
+	}
+	if err := dial(&svcA, "/tenant-b"); err == nil {
+		t.Errorf("svc-a was allowed to open /tenant-b")
+	}
+	if err := dial(&svcB, "/tenant-b"); err != nil {
+		t.Errorf("svc-b couldn't open /tenant-b: %v", err)
+	}
+	if err := dial(&svcB, "/tenant-a"); err == nil {
+		t.Errorf("svc-b was allowed to open /tenant-a")
+	}
+
+	// A certificate the server doesn't know and no certificate at all
+	var unknown = certs.issue(t, "svc-c", x509.ExtKeyUsageClientAuth)
+	if err := dial(&unknown, "/tenant-a"); err == nil {
+		t.Errorf("Unmapped certificate was allowed to log in")
+	}
+	if err := dial(nil, "/tenant-a"); err == nil {
+		t.Errorf("Client without a certificate was allowed to log in")
+	}
+}
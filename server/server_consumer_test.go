@@ -1,8 +1,13 @@
 package server
 
 import (
-	"github.com/karelbilek/amqp-test-server/util"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/karelbilek/amqp-test-server/amqp"
+	"github.com/karelbilek/amqp-test-server/util"
+	amqpclient "github.com/streadway/amqp"
 )
 
 func TestAckNackOne(t *testing.T) {
@@ -57,7 +62,7 @@ func TestAckNackOne(t *testing.T) {
 	msg1.Nack(false, false)
 	msg2.Nack(false, true)
 	tc.wait(ch)
-	if tc.s.queues["q1"].Len() != 1 {
+	if tc.vhost().queues["q1"].Len() != 1 {
 		t.Fatalf("Should have 1 message in queue")
 	}
 
@@ -117,7 +122,7 @@ func TestAckNackMany(t *testing.T) {
 	ch.Cancel(consumerId, false)
 	msg2.Nack(true, false)
 	tc.wait(ch)
-	if tc.s.queues["q1"].Len() != 0 {
+	if tc.vhost().queues["q1"].Len() != 0 {
 		t.Fatalf("Should have 0 message in queue")
 	}
 
@@ -136,7 +141,7 @@ func TestAckNackMany(t *testing.T) {
 	ch.Cancel(consumerId, false)
 	msg2.Nack(true, true)
 	tc.wait(ch)
-	if tc.s.queues["q1"].Len() != 2 {
+	if tc.vhost().queues["q1"].Len() != 2 {
 		t.Fatalf("Should have 2 message in queue")
 	}
 }
@@ -183,9 +188,9 @@ func TestRecover(t *testing.T) {
 	ch.Cancel(cTag, false)
 	ch.Recover(true)
 	tc.wait(ch)
-	msgCount := tc.s.queues["q1"].Len()
+	msgCount := tc.vhost().queues["q1"].Len()
 	if msgCount != 2 {
-		t.Fatalf("Should have 2 message in queue. Found", msgCount)
+		t.Fatalf("Should have 2 message in queue. Found %d", msgCount)
 	}
 }
 
@@ -212,3 +217,835 @@ func TestGet(t *testing.T) {
 		t.Fatalf("wrong message response in get")
 	}
 }
+
+func TestFairDispatch(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	ch.QueueBind("q1", "abc", "amq.direct", false, NO_ARGS)
+	deliveries1, err := ch.Consume("q1", "TestFairDispatch-1", false, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume")
+	}
+	deliveries2, err := ch.Consume("q1", "TestFairDispatch-2", false, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume")
+	}
+
+	for i := 0; i < 6; i++ {
+		ch.Publish("amq.direct", "abc", false, false, TEST_TRANSIENT_MSG)
+	}
+	var counts = make(map[string]int)
+	for i := 0; i < 6; i++ {
+		select {
+		case msg := <-deliveries1:
+			counts[msg.ConsumerTag] += 1
+		case msg := <-deliveries2:
+			counts[msg.ConsumerTag] += 1
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Only got %d of 6 messages", i)
+		}
+	}
+	if counts["TestFairDispatch-1"] < 2 || counts["TestFairDispatch-2"] < 2 {
+		t.Errorf("Uneven split between consumers: %v", counts)
+	}
+}
+
+func TestExclusiveConsumer(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+
+	var expectRefused = func(exclusive bool) {
+		other, _, errChan := channelHelper(tc, conn)
+		go other.Consume("q1", "", false, exclusive, false, false, NO_ARGS)
+		resp := <-errChan
+		if resp.Code != 403 {
+			t.Errorf("Wrong response code: %d", resp.Code)
+		}
+	}
+
+	// Exclusive only works on a queue without consumers
+	if _, err := ch.Consume("q1", "shared", false, false, false, false, NO_ARGS); err != nil {
+		t.Fatalf("Failed to consume")
+	}
+	expectRefused(true)
+	ch.Cancel("shared", false)
+
+	// While the exclusive consumer is active nobody else can consume
+	if _, err := ch.Consume("q1", "exclusive", false, true, false, false, NO_ARGS); err != nil {
+		t.Fatalf("Failed to consume exclusively")
+	}
+	expectRefused(false)
+	expectRefused(true)
+
+	// Once it leaves the queue is open again
+	ch.Cancel("exclusive", false)
+	if _, err := ch.Consume("q1", "after", false, false, false, false, NO_ARGS); err != nil {
+		t.Fatalf("Failed to consume after the exclusive consumer left")
+	}
+}
+
+func TestNoLocal(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	ch.QueueBind("q1", "abc", "amq.direct", false, NO_ARGS)
+
+	deliveries, err := ch.Consume("q1", "TestNoLocal-1", false, false, true, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume")
+	}
+	// Published on the consuming connection, so it is not delivered back
+	ch.Publish("amq.direct", "abc", false, false, TEST_TRANSIENT_MSG)
+	// Published on another connection. The local message must not block it
+	otherConn := tc.connect()
+	otherCh, _, _ := channelHelper(tc, otherConn)
+	otherCh.Publish("amq.direct", "abc", false, false, amqpclient.Publishing{Body: []byte("remote")})
+
+	select {
+	case msg := <-deliveries:
+		if string(msg.Body) != "remote" {
+			t.Errorf("Local message was delivered to a no-local consumer")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Remote message was not delivered")
+	}
+	tc.wait(ch)
+	select {
+	case <-deliveries:
+		t.Errorf("Local message was delivered to a no-local consumer")
+	default:
+	}
+	if tc.vhost().queues["q1"].Len() != 1 {
+		t.Errorf("Local message should stay on the queue")
+	}
+}
+
+func TestSingleActiveConsumer(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	var args = amqpclient.Table{"x-single-active-consumer": true}
+	ch.QueueDeclare("q1", false, false, false, false, args)
+	ch.QueueBind("q1", "abc", "amq.direct", false, NO_ARGS)
+	deliveries1, err := ch.Consume("q1", "TestSingleActiveConsumer-1", true, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume")
+	}
+	deliveries2, err := ch.Consume("q1", "TestSingleActiveConsumer-2", true, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume")
+	}
+
+	var receive = func(expected string) {
+		select {
+		case msg := <-deliveries1:
+			if msg.ConsumerTag != expected {
+				t.Errorf("Message went to %s, expected %s", msg.ConsumerTag, expected)
+			}
+		case msg := <-deliveries2:
+			if msg.ConsumerTag != expected {
+				t.Errorf("Message went to %s, expected %s", msg.ConsumerTag, expected)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Message was not delivered")
+		}
+	}
+
+	// Only the first consumer gets messages while it is subscribed
+	for i := 0; i < 4; i++ {
+		ch.Publish("amq.direct", "abc", false, false, TEST_TRANSIENT_MSG)
+	}
+	for i := 0; i < 4; i++ {
+		receive("TestSingleActiveConsumer-1")
+	}
+
+	// The standby consumer takes over once it leaves
+	if err := ch.Cancel("TestSingleActiveConsumer-1", false); err != nil {
+		t.Fatalf("Failed to cancel")
+	}
+	// The client closes the delivery channel of a cancelled consumer
+	deliveries1 = nil
+	for i := 0; i < 2; i++ {
+		ch.Publish("amq.direct", "abc", false, false, TEST_TRANSIENT_MSG)
+	}
+	for i := 0; i < 2; i++ {
+		receive("TestSingleActiveConsumer-2")
+	}
+}
+
+func TestAckTimeoutClose(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	tc.s.SetAckTimeout(100*time.Millisecond, ACK_TIMEOUT_CLOSE)
+	conn := tc.connect()
+	ch, _, errChan := channelHelper(tc, conn)
+
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	ch.QueueBind("q1", "abc", "amq.direct", false, NO_ARGS)
+	ch.Qos(2, 0, false)
+	deliveries, err := ch.Consume("q1", "c1", false, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume")
+	}
+	ch.Publish("amq.direct", "abc", false, false, TEST_TRANSIENT_MSG)
+	ch.Publish("amq.direct", "abc", false, false, TEST_TRANSIENT_MSG)
+	<-deliveries
+	<-deliveries
+
+	// Never ack, so the channel is closed and the messages requeued
+	select {
+	case resp := <-errChan:
+		if resp.Code != 406 {
+			t.Fatalf("Wrong ack timeout error code: %d", resp.Code)
+		}
+		if !strings.HasSuffix(resp.Reason, "Timeout value used: 100 ms") {
+			t.Errorf("Ack timeout reason doesn't give the timeout: %s", resp.Reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Channel was not closed after the ack timeout")
+	}
+	ch2, _, _ := channelHelper(tc, conn)
+	tc.wait(ch2)
+	if tc.vhost().queues["q1"].Len() != 2 {
+		t.Fatalf("Unacked messages were not requeued")
+	}
+}
+
+func TestAckTimeoutRequeue(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	tc.s.SetAckTimeout(100*time.Millisecond, ACK_TIMEOUT_REQUEUE)
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	ch.QueueBind("q1", "abc", "amq.direct", false, NO_ARGS)
+	ch.Qos(1, 0, false)
+	deliveries, err := ch.Consume("q1", "c1", false, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume")
+	}
+	ch.Publish("amq.direct", "abc", false, false, TEST_TRANSIENT_MSG)
+	var first = <-deliveries
+
+	// The late delivery is requeued and sent again, on the same channel
+	select {
+	case d := <-deliveries:
+		if !d.Redelivered || d.DeliveryTag == first.DeliveryTag {
+			t.Fatalf("Expected a redelivery with a new tag")
+		}
+		d.Ack(false)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Message was not requeued after the ack timeout")
+	}
+	tc.wait(ch)
+	if tc.vhost().queues["q1"].Len() != 0 {
+		t.Fatalf("Message was left on the queue")
+	}
+}
+
+func TestConsumerPriority(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	chLow, _, _ := channelHelper(tc, conn)
+	chHigh, _, _ := channelHelper(tc, conn)
+
+	chLow.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	chLow.QueueBind("q1", "abc", "amq.direct", false, NO_ARGS)
+	chLow.Qos(2, 0, false)
+	chHigh.Qos(2, 0, false)
+	// The low priority consumer subscribes first and still waits its turn
+	low, err := chLow.Consume("q1", "low", false, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume")
+	}
+	high, err := chHigh.Consume("q1", "high", false, false, false, false, amqpclient.Table{"x-priority": int32(5)})
+	if err != nil {
+		t.Fatalf("Failed to consume")
+	}
+
+	for i := 0; i < 2; i++ {
+		chLow.Publish("amq.direct", "abc", false, false, TEST_TRANSIENT_MSG)
+		select {
+		case <-high:
+		case <-low:
+			t.Fatalf("Low priority consumer got a message before the high priority one was full")
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Message was not delivered")
+		}
+	}
+
+	// Once the high priority consumer is at its prefetch limit the low
+	// priority one gets messages
+	chLow.Publish("amq.direct", "abc", false, false, TEST_TRANSIENT_MSG)
+	select {
+	case d := <-low:
+		d.Ack(false)
+	case <-high:
+		t.Fatalf("High priority consumer went over its prefetch limit")
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Message was not delivered to the low priority consumer")
+	}
+}
+
+func TestCancelNotifyOnQueueDelete(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	// The client advertises consumer_cancel_notify, so the channel stays
+	// open and only the consumer goes away
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	var cancels = ch.NotifyCancel(make(chan string, 1))
+	if _, err := ch.Consume("q1", "TestCancelNotify-1", true, false, false, false, NO_ARGS); err != nil {
+		t.Fatalf("Failed to consume")
+	}
+	ch2, _, _ := channelHelper(tc, conn)
+	if _, err := ch2.QueueDelete("q1", false, false, false); err != nil {
+		t.Fatalf("Failed to delete queue: %s", err.Error())
+	}
+	select {
+	case tag := <-cancels:
+		if tag != "TestCancelNotify-1" {
+			t.Fatalf("Cancelled the wrong consumer: %s", tag)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("No basic.cancel received")
+	}
+	if _, err := ch.QueueDeclare("q2", false, false, false, false, NO_ARGS); err != nil {
+		t.Fatalf("Channel closed after cancel notification: %s", err.Error())
+	}
+}
+
+func TestCancelWithoutNotifyCapability(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.rawConnect()
+	defer conn.Close()
+
+	// rawOpenChannel sends no client capabilities
+	rawOpenChannel(t, conn)
+	rawSendMethod(conn, 1, &amqp.QueueDeclare{Queue: "q1", Arguments: amqp.NewTable()})
+	if _, ok := rawReadMethod(t, conn).(*amqp.QueueDeclareOk); !ok {
+		t.Fatalf("Expected queue.declare-ok")
+	}
+	rawSendMethod(conn, 1, &amqp.BasicConsume{Queue: "q1", ConsumerTag: "raw", Arguments: amqp.NewTable()})
+	if _, ok := rawReadMethod(t, conn).(*amqp.BasicConsumeOk); !ok {
+		t.Fatalf("Expected basic.consume-ok")
+	}
+
+	ch, _, _ := channelHelper(tc, tc.connect())
+	if _, err := ch.QueueDelete("q1", false, false, false); err != nil {
+		t.Fatalf("Failed to delete queue: %s", err.Error())
+	}
+	chClose, ok := rawReadMethod(t, conn).(*amqp.ChannelClose)
+	if !ok {
+		t.Fatalf("Expected channel.close instead of basic.cancel")
+	}
+	if chClose.ReplyCode != 404 {
+		t.Fatalf("Wrong reply code: %d", chClose.ReplyCode)
+	}
+}
+
+func TestRequeueOrder(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	var publish = func() {
+		for _, body := range []string{"1", "2", "3"} {
+			ch.Publish("", "q1", false, false, amqpclient.Publishing{Body: []byte(body)})
+		}
+	}
+	ch.Qos(1, 0, false)
+	deliveries, err := ch.Consume("q1", "c1", false, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume")
+	}
+	var next = func() amqpclient.Delivery {
+		select {
+		case d := <-deliveries:
+			return d
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for a delivery")
+		}
+		return amqpclient.Delivery{}
+	}
+	var expectOrder = func(what string, ds []amqpclient.Delivery) {
+		for i, d := range ds {
+			if string(d.Body) != []string{"1", "2", "3"}[i] {
+				t.Fatalf("%s: delivery %d was message %s", what, i+1, d.Body)
+			}
+		}
+	}
+
+	// Nacking the head puts it back ahead of the rest
+	publish()
+	next().Nack(false, true)
+	var ordered = make([]amqpclient.Delivery, 0, 3)
+	for i := 0; i < 3; i++ {
+		var d = next()
+		ordered = append(ordered, d)
+		d.Ack(false)
+	}
+	expectOrder("nack", ordered)
+	if !ordered[0].Redelivered || ordered[1].Redelivered {
+		t.Errorf("Wrong redelivered flags")
+	}
+
+	// Requeueing several at once keeps them in order too
+	ch.Cancel("c1", false)
+	ch.Qos(3, 0, false)
+	deliveries, err = ch.Consume("q1", "c2", false, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume")
+	}
+	publish()
+	ordered = []amqpclient.Delivery{next(), next(), next()}
+	expectOrder("first delivery", ordered)
+	ordered[2].Nack(true, true)
+	ordered = []amqpclient.Delivery{next(), next(), next()}
+	expectOrder("multiple nack", ordered)
+	ch.Recover(true)
+	ordered = []amqpclient.Delivery{next(), next(), next()}
+	expectOrder("recover", ordered)
+}
+
+func TestConsumeArguments(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+
+	// Arguments are kept on the consumer, and unknown ones are ignored
+	var args = amqpclient.Table{"x-priority": int32(7), "x-unknown": "value"}
+	if _, err := ch.Consume("q1", "c1", false, false, false, false, args); err != nil {
+		t.Fatalf("Failed to consume: %s", err.Error())
+	}
+	tc.wait(ch)
+	var c = tc.connFromServer().channels[1].consumers["c1"]
+	if c.Priority() != 7 {
+		t.Errorf("Wrong consumer priority: %d", c.Priority())
+	}
+	if value, _ := c.Arguments().GetString("x-unknown"); value != "value" {
+		t.Errorf("Consumer arguments were not kept")
+	}
+
+	var expectError = func(conn *amqpclient.Connection, args amqpclient.Table) {
+		badCh, err := conn.Channel()
+		if err != nil {
+			t.Fatalf("Failed to open channel")
+		}
+		_, err = badCh.Consume("q1", "", false, false, false, false, args)
+		if amqpErr, ok := err.(*amqpclient.Error); !ok || amqpErr.Code != 406 {
+			t.Errorf("Expected 406 for arguments %v, got %v", args, err)
+		}
+	}
+	expectError(conn, amqpclient.Table{"x-priority": "high"})
+
+	// Strict mode is set before any connection reads it
+	strict := newTestClient(t)
+	defer strict.cleanup()
+	strict.s.strictMode = true
+	strictConn := strict.connect()
+	strictCh, _, _ := channelHelper(strict, strictConn)
+	strictCh.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	expectError(strictConn, amqpclient.Table{"x-unknown": "value"})
+}
+
+func TestDuplicateConsumerTag(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatalf("Failed to open channel")
+	}
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	ch.QueueBind("q1", "abc", "amq.direct", false, NO_ARGS)
+	deliveries, err := ch.Consume("q1", "ctag", false, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume")
+	}
+	ch.Publish("amq.direct", "abc", false, false, TEST_TRANSIENT_MSG)
+	select {
+	case d := <-deliveries:
+		d.Ack(false)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("First consumer got nothing")
+	}
+
+	_, err = ch.Consume("q1", "ctag", false, false, false, false, NO_ARGS)
+	if amqpErr, ok := err.(*amqpclient.Error); !ok || amqpErr.Code != 403 {
+		t.Fatalf("Expected 403 for a duplicate consumer tag, got %v", err)
+	}
+	// Refusing closes the channel, which takes the first consumer with it
+	select {
+	case _, ok := <-deliveries:
+		if ok {
+			t.Errorf("Unexpected delivery")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("First consumer was not closed with its channel")
+	}
+
+	// Another channel on the same connection may use the tag
+	ch2, _, _ := channelHelper(tc, conn)
+	deliveries, err = ch2.Consume("q1", "ctag", false, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Tag was not usable on a new channel: %s", err.Error())
+	}
+	ch2.Publish("amq.direct", "abc", false, false, TEST_TRANSIENT_MSG)
+	select {
+	case <-deliveries:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Consumer on the new channel got nothing")
+	}
+}
+
+func TestDeliveryTags(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatalf("Failed to open channel")
+	}
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	ch.QueueBind("q1", "abc", "amq.direct", false, NO_ARGS)
+	deliveries, err := ch.Consume("q1", "c1", false, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume")
+	}
+	for i := 0; i < 3; i++ {
+		ch.Publish("amq.direct", "abc", false, false, amqpclient.Publishing{Body: []byte{byte(i)}})
+	}
+
+	// Tags start at 1 and each one refers to its own message
+	var received = make([]amqpclient.Delivery, 0, 3)
+	for i := 0; i < 3; i++ {
+		select {
+		case d := <-deliveries:
+			if d.DeliveryTag != uint64(i+1) || d.Body[0] != byte(i) {
+				t.Fatalf("Delivery %d had tag %d and body %d", i, d.DeliveryTag, d.Body[0])
+			}
+			received = append(received, d)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Message %d was not delivered", i)
+		}
+	}
+	received[1].Ack(false)
+	received[0].Reject(true)
+	select {
+	case d := <-deliveries:
+		if d.DeliveryTag != 4 || d.Body[0] != 0 || !d.Redelivered {
+			t.Fatalf("Requeued message came back with tag %d and body %d", d.DeliveryTag, d.Body[0])
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Rejected message was not redelivered")
+	}
+	ch.Close()
+
+	var expectClose = func(ack func(ch *amqpclient.Channel) error) {
+		ch, err := conn.Channel()
+		if err != nil {
+			t.Fatalf("Failed to open channel")
+		}
+		var closed = ch.NotifyClose(make(chan *amqpclient.Error, 1))
+		ack(ch)
+		select {
+		case amqpErr := <-closed:
+			if amqpErr == nil || amqpErr.Code != 406 {
+				t.Errorf("Expected 406 for a bad ack, got %v", amqpErr)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("Channel stayed open after a bad ack")
+		}
+	}
+	expectClose(func(ch *amqpclient.Channel) error { return ch.Ack(99, false) })
+	expectClose(func(ch *amqpclient.Channel) error { return ch.Ack(99, true) })
+	expectClose(func(ch *amqpclient.Channel) error { return ch.Nack(99, true, true) })
+}
+
+func TestPrefetchSize(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	ch.QueueBind("q1", "abc", "amq.direct", false, NO_ARGS)
+	// Room for the 10 and 20 byte messages, but not the 5 byte one after them
+	ch.Qos(0, 32, false)
+	for _, size := range []int{10, 20, 5, 100} {
+		ch.Publish("amq.direct", "abc", false, false, amqpclient.Publishing{Body: make([]byte, size)})
+	}
+	tc.wait(ch)
+	deliveries, err := ch.Consume("q1", "c1", false, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume")
+	}
+	var expectDelivery = func(size int) amqpclient.Delivery {
+		select {
+		case d := <-deliveries:
+			if len(d.Body) != size {
+				t.Fatalf("Expected a %d byte message, got %d bytes", size, len(d.Body))
+			}
+			return d
+		case <-time.After(2 * time.Second):
+			t.Fatalf("The %d byte message was not delivered", size)
+		}
+		return amqpclient.Delivery{}
+	}
+	var expectNoDelivery = func() {
+		select {
+		case d := <-deliveries:
+			t.Fatalf("A %d byte message was delivered over the prefetch size", len(d.Body))
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	var first = expectDelivery(10)
+	var second = expectDelivery(20)
+	expectNoDelivery()
+
+	// Acking the first frees enough for the next one
+	first.Ack(false)
+	var third = expectDelivery(5)
+	expectNoDelivery()
+
+	// A message bigger than the window still goes once nothing is unacked
+	second.Ack(false)
+	expectNoDelivery()
+	third.Ack(false)
+	expectDelivery(100)
+}
+
+func TestAckMultipleBatch(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	const count = 1000
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	ch.Qos(count, 0, false)
+	for i := 0; i < count+1; i++ {
+		ch.Publish("", "q1", false, false, TEST_TRANSIENT_MSG)
+	}
+	tc.wait(ch)
+	deliveries, err := ch.Consume("q1", "c1", false, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume")
+	}
+	var last amqpclient.Delivery
+	for i := 0; i < count; i++ {
+		select {
+		case last = <-deliveries:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Only %d messages were delivered", i)
+		}
+	}
+	// The prefetch limit holds back the last message
+	select {
+	case <-deliveries:
+		t.Fatalf("Message delivered over the prefetch limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	last.Ack(true)
+	var extra amqpclient.Delivery
+	select {
+	case extra = <-deliveries:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Acking didn't release the prefetch limit")
+	}
+	if extra.DeliveryTag != count+1 {
+		t.Errorf("Expected delivery tag %d, got %d", count+1, extra.DeliveryTag)
+	}
+	var channel = tc.connFromServer().channels[1]
+	channel.ackLock.Lock()
+	var unacked, tags = len(channel.awaitingAcks), len(channel.unackedTags)
+	channel.ackLock.Unlock()
+	if unacked != 1 || tags != 1 {
+		t.Errorf("Expected only the last delivery unacked, got %d unacked and %d tags", unacked, tags)
+	}
+	if tc.vhost().queues["q1"].UnackedCount() != 1 {
+		t.Errorf("Queue has %d unacked messages", tc.vhost().queues["q1"].UnackedCount())
+	}
+	if tc.vhost().msgStore.MessageCount() != 1 {
+		t.Errorf("Acked messages are still in the message store: %d", tc.vhost().msgStore.MessageCount())
+	}
+}
+
+func TestNoAckConsume(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	const count = 10
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	// No-ack deliveries aren't held back by the channel's prefetch limit
+	ch.Qos(1, 0, true)
+	for i := 0; i < count; i++ {
+		ch.Publish("", "q1", false, false, TEST_TRANSIENT_MSG)
+	}
+	tc.wait(ch)
+	deliveries, err := ch.Consume("q1", "c1", true, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume")
+	}
+	for i := 0; i < count; i++ {
+		select {
+		case <-deliveries:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Only %d messages were delivered", i)
+		}
+	}
+	tc.wait(ch)
+
+	var q = tc.vhost().queues["q1"]
+	if q.Len() != 0 || q.UnackedCount() != 0 {
+		t.Errorf("Queue has %d ready and %d unacked messages", q.Len(), q.UnackedCount())
+	}
+	var channel = tc.connFromServer().channels[1]
+	channel.ackLock.Lock()
+	var unacked = len(channel.awaitingAcks)
+	channel.ackLock.Unlock()
+	channel.limitLock.Lock()
+	var activeCount, activeSize = channel.activeCount, channel.activeSize
+	channel.limitLock.Unlock()
+	if unacked != 0 || activeCount != 0 || activeSize != 0 {
+		t.Errorf("Channel has %d unacked and %d (%d bytes) active messages", unacked, activeCount, activeSize)
+	}
+	if tc.vhost().msgStore.MessageCount() != 0 {
+		t.Errorf("Delivered messages are still in the message store: %d", tc.vhost().msgStore.MessageCount())
+	}
+}
+
+// Worth running with -race, since deliveries race with the channel shutdown
+func TestDeliveryToClosedConnection(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	const count = 200
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	for i := 0; i < count; i++ {
+		ch.Publish("", "q1", false, false, TEST_TRANSIENT_MSG)
+	}
+	tc.wait(ch)
+
+	// The consumer stops reading part way through the deliveries and then
+	// goes away, leaving deliveries blocked on the connection
+	raw := tc.rawConnect()
+	rawOpenChannel(t, raw)
+	rawSendMethod(raw, 1, &amqp.BasicConsume{Queue: "q1", ConsumerTag: "c1", Arguments: amqp.NewTable()})
+	if _, ok := rawReadMethod(t, raw).(*amqp.BasicConsumeOk); !ok {
+		t.Fatalf("Expected basic.consume-ok")
+	}
+	if _, ok := rawReadMethod(t, raw).(*amqp.BasicDeliver); !ok {
+		t.Fatalf("Expected basic.deliver")
+	}
+	raw.Close()
+
+	var q = tc.vhost().queues["q1"]
+	var deadline = time.Now().Add(2 * time.Second)
+	for (q.Len() != count || q.UnackedCount() != 0) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if q.Len() != count || q.UnackedCount() != 0 {
+		t.Errorf("Queue has %d ready and %d unacked messages, expected %d ready", q.Len(), q.UnackedCount(), count)
+	}
+}
+
+func TestIdGenerator(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	tc.s.SetIdGenerator(util.NewSequentialIds("id-"))
+	// The client library makes up its own consumer tags
+	conn := tc.rawConnect()
+	defer conn.Close()
+	rawOpenChannel(t, conn)
+
+	rawSendMethod(conn, 1, &amqp.QueueDeclare{Arguments: amqp.NewTable()})
+	declareOk, ok := rawReadMethod(t, conn).(*amqp.QueueDeclareOk)
+	if !ok || declareOk.Queue != "id-1" {
+		t.Fatalf("Expected the generated queue name id-1, got %v", declareOk)
+	}
+	rawSendMethod(conn, 1, &amqp.BasicConsume{Queue: declareOk.Queue, Arguments: amqp.NewTable()})
+	consumeOk, ok := rawReadMethod(t, conn).(*amqp.BasicConsumeOk)
+	if !ok || consumeOk.ConsumerTag != "id-2" {
+		t.Fatalf("Expected the generated consumer tag id-2, got %v", consumeOk)
+	}
+}
+
+func TestConsumerFilter(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	eu, err := ch.Consume("q1", "eu", false, false, false, false, amqpclient.Table{"x-filter-jmespath": "headers.region == 'eu'"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	us, err := ch.Consume("q1", "us", false, false, false, false, amqpclient.Table{"x-filter-jmespath": "headers.region == 'us'"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, region := range []string{"eu", "us", "eu", "asia", "us", "eu"} {
+		ch.Publish("", "q1", false, false, amqpclient.Publishing{
+			Headers: amqpclient.Table{"region": region},
+			Body:    []byte(region),
+		})
+	}
+	var expect = func(deliveries <-chan amqpclient.Delivery, region string, count int) {
+		for i := 0; i < count; i++ {
+			select {
+			case d := <-deliveries:
+				if string(d.Body) != region {
+					t.Errorf("Consumer for %s got a message for %s", region, d.Body)
+				}
+				d.Ack(false)
+			case <-time.After(2 * time.Second):
+				t.Fatalf("Consumer for %s only got %d messages", region, i)
+			}
+		}
+	}
+	expect(eu, "eu", 3)
+	expect(us, "us", 2)
+	tc.wait(ch)
+	// Nobody takes the message for the other region
+	if tc.vhost().queues["q1"].Len() != 1 {
+		t.Errorf("Expected the unmatched message to stay in the queue")
+	}
+
+	// Bad filters are refused
+	ch2, err := conn.Channel()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, err = ch2.Consume("q1", "bad", false, false, false, false, amqpclient.Table{"x-filter-jmespath": "headers.region =="})
+	if amqpErr, ok := err.(*amqpclient.Error); !ok || amqpErr.Code != 406 {
+		t.Errorf("Expected 406 for a bad filter, got %v", err)
+	}
+}
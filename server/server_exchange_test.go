@@ -1,7 +1,15 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/karelbilek/amqp-test-server/amqp"
+	"github.com/karelbilek/amqp-test-server/exchange"
+	amqpclient "github.com/streadway/amqp"
 )
 
 func TestExchangeMethods(t *testing.T) {
@@ -13,19 +21,667 @@ func TestExchangeMethods(t *testing.T) {
 	channel.ExchangeDeclare("ex-1", "topic", false, false, false, false, NO_ARGS)
 
 	// Create exchange
-	if len(tc.s.exchanges) != 5 {
-		t.Errorf("Wrong number of exchanges: %d", len(tc.s.exchanges))
+	if len(tc.vhost().exchanges) != 6 {
+		t.Errorf("Wrong number of exchanges: %d", len(tc.vhost().exchanges))
 	}
 
 	// Create Queue
 	channel.QueueDeclare("q-1", false, false, false, false, NO_ARGS)
-	if len(tc.s.queues) != 1 {
-		t.Errorf("Wrong number of queues: %d", len(tc.s.queues))
+	if len(tc.vhost().queues) != 1 {
+		t.Errorf("Wrong number of queues: %d", len(tc.vhost().queues))
 	}
 
 	// Delete exchange
 	channel.ExchangeDelete("ex-1", false, false)
-	if len(tc.s.exchanges) != 4 {
-		t.Errorf("Wrong number of exchanges: %d", len(tc.s.exchanges))
+	if len(tc.vhost().exchanges) != 5 {
+		t.Errorf("Wrong number of exchanges: %d", len(tc.vhost().exchanges))
+	}
+}
+
+func TestDurableExchangeRestart(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	ch.ExchangeDeclare("ex-durable", "topic", true, false, false, false, NO_ARGS)
+	ch.ExchangeDeclare("ex-transient", "topic", false, false, false, false, NO_ARGS)
+	ch.QueueDeclare("q1", true, false, false, false, NO_ARGS)
+	ch.QueueBind("q1", "a.*", "ex-durable", false, NO_ARGS)
+
+	tc.restart()
+	ex, found := tc.vhost().exchanges["ex-durable"]
+	if !found {
+		t.Fatalf("Durable exchange did not survive restart")
+	}
+	if !ex.Durable || !ex.IsTopic() {
+		t.Fatalf("Durable exchange lost its properties")
+	}
+	if len(ex.BindingsForQueue("q1")) != 1 {
+		t.Fatalf("Binding did not survive restart")
+	}
+	if _, found := tc.vhost().exchanges["ex-transient"]; found {
+		t.Fatalf("Transient exchange survived restart")
+	}
+
+	// Redeclaring with different properties is refused
+	conn = tc.connect()
+	ch, _, errChan := channelHelper(tc, conn)
+	ch.ExchangeDeclare("ex-durable", "topic", false, false, false, true, NO_ARGS)
+	resp := <-errChan
+	if resp.Code != 406 {
+		t.Errorf("Wrong response code: %d", resp.Code)
+	}
+	if !tc.vhost().exchanges["ex-durable"].Durable {
+		t.Errorf("Non-equivalent redeclare replaced the exchange")
+	}
+}
+
+func TestExchangePassive(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, errChan := channelHelper(tc, conn)
+
+	ch.ExchangeDeclare("ex-1", "topic", false, false, false, false, NO_ARGS)
+	// The type and flags are ignored for a passive declare
+	if err := ch.ExchangeDeclarePassive("ex-1", "direct", true, false, false, false, NO_ARGS); err != nil {
+		t.Fatalf("Passive declare of existing exchange failed: %s", err.Error())
+	}
+	if len(tc.vhost().exchanges) != 6 {
+		t.Fatalf("Passive declare changed the exchanges")
+	}
+
+	ch.ExchangeDeclarePassive("does.not.exist", "topic", false, false, false, true, NO_ARGS)
+	resp := <-errChan
+	if resp.Code != 404 {
+		t.Errorf("Wrong response code: %d", resp.Code)
+	}
+	if _, found := tc.vhost().exchanges["does.not.exist"]; found {
+		t.Errorf("Passive declare created an exchange")
+	}
+}
+
+func TestExchangeBind(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	ch.ExchangeDeclare("ex-dest", "fanout", false, false, false, false, NO_ARGS)
+	ch.ExchangeDeclare("ex-src", "direct", false, false, false, false, NO_ARGS)
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	ch.QueueBind("q1", "", "ex-dest", false, NO_ARGS)
+	if err := ch.ExchangeBind("ex-dest", "rk", "ex-src", false, NO_ARGS); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// A binding back to the source must not make routing loop forever
+	if err := ch.ExchangeBind("ex-src", "", "ex-dest", false, NO_ARGS); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Only the matching key is routed through the exchange binding
+	ch.Publish("ex-src", "rk", false, false, TEST_TRANSIENT_MSG)
+	ch.Publish("ex-src", "other", false, false, TEST_TRANSIENT_MSG)
+	tc.wait(ch)
+	if tc.vhost().queues["q1"].Len() != 1 {
+		t.Fatalf("Wrong number of routed messages: %d", tc.vhost().queues["q1"].Len())
+	}
+}
+
+func TestInternalExchange(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, errChan := channelHelper(tc, conn)
+
+	ch.ExchangeDeclare("ex-internal", "fanout", false, false, true, false, NO_ARGS)
+	ch.ExchangeDeclare("ex-src", "direct", false, false, false, false, NO_ARGS)
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	ch.QueueBind("q1", "", "ex-internal", false, NO_ARGS)
+	if err := ch.ExchangeBind("ex-internal", "rk", "ex-src", false, NO_ARGS); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// A binding back to the source must not make routing loop forever
+	if err := ch.ExchangeBind("ex-src", "", "ex-internal", false, NO_ARGS); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Routed through the exchange binding
+	ch.Publish("ex-src", "rk", false, false, TEST_TRANSIENT_MSG)
+	ch.Publish("ex-src", "other", false, false, TEST_TRANSIENT_MSG)
+	tc.wait(ch)
+	if tc.vhost().queues["q1"].Len() != 1 {
+		t.Fatalf("Wrong number of routed messages: %d", tc.vhost().queues["q1"].Len())
+	}
+
+	// Direct publishes are refused
+	ch.Publish("ex-internal", "", false, false, TEST_TRANSIENT_MSG)
+	resp := <-errChan
+	if resp.Code != 403 {
+		t.Errorf("Wrong response code: %d", resp.Code)
+	}
+	if tc.vhost().queues["q1"].Len() != 1 {
+		t.Errorf("Direct publish to internal exchange was routed")
+	}
+}
+
+func TestExchangeDeleteIfUnused(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, errChan := channelHelper(tc, conn)
+
+	ch.ExchangeDeclare("ex-1", "direct", true, false, false, false, NO_ARGS)
+	ch.ExchangeDeclare("ex-2", "direct", true, false, false, false, NO_ARGS)
+	ch.QueueDeclare("q1", true, false, false, false, NO_ARGS)
+	ch.QueueBind("q1", "rk", "ex-1", false, NO_ARGS)
+	ch.QueueBind("q1", "rk", "ex-2", false, NO_ARGS)
+
+	// Bound exchanges are refused
+	go ch.ExchangeDelete("ex-1", true, false)
+	if resp := <-errChan; resp.Code != 406 {
+		t.Errorf("Wrong response code deleting a used exchange: %d", resp.Code)
+	}
+	if _, found := tc.vhost().exchanges["ex-1"]; !found {
+		t.Fatalf("Used exchange was deleted")
+	}
+
+	// Once unbound they can go
+	ch, _, _ = channelHelper(tc, conn)
+	ch.QueueUnbind("q1", "rk", "ex-1", NO_ARGS)
+	if err := ch.ExchangeDelete("ex-1", true, false); err != nil {
+		t.Fatalf("Failed to delete an unused exchange: %s", err.Error())
+	}
+
+	// Without if-unused the bindings go with the exchange
+	if err := ch.ExchangeDelete("ex-2", false, false); err != nil {
+		t.Fatalf("Failed to delete a used exchange: %s", err.Error())
+	}
+	for _, b := range tc.s.BindingsForQueue("q1") {
+		if b.ExchangeName != "" {
+			t.Errorf("Binding from %s left after delete", b.ExchangeName)
+		}
+	}
+	tc.restart()
+	for _, name := range []string{"ex-1", "ex-2"} {
+		if _, found := tc.vhost().exchanges[name]; found {
+			t.Errorf("Deleted exchange %s came back after restart", name)
+		}
+	}
+	if len(tc.s.BindingsForQueue("q1")) != 1 {
+		t.Errorf("Deleted bindings came back after restart")
+	}
+}
+
+func TestBindingListing(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	ch.ExchangeDeclare("ex-1", "direct", false, false, false, false, NO_ARGS)
+	ch.ExchangeDeclare("ex-2", "fanout", false, false, false, false, NO_ARGS)
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	ch.QueueDeclare("q2", false, false, false, false, NO_ARGS)
+	ch.QueueBind("q1", "a", "ex-1", false, NO_ARGS)
+	ch.QueueBind("q1", "b", "ex-1", false, NO_ARGS)
+	ch.QueueBind("q2", "", "ex-2", false, NO_ARGS)
+	if err := ch.ExchangeBind("ex-2", "c", "ex-1", false, NO_ARGS); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	fromEx1, found := tc.s.BindingsForExchange("ex-1")
+	if !found {
+		t.Fatalf("Exchange not found")
+	}
+	if len(fromEx1) != 3 {
+		t.Errorf("Wrong number of bindings from ex-1: %d", len(fromEx1))
+	}
+	if _, found := tc.s.BindingsForExchange("missing"); found {
+		t.Errorf("Found bindings for a missing exchange")
+	}
+
+	// Two explicit bindings plus the default exchange's
+	toQ1 := tc.s.BindingsForQueue("q1")
+	if len(toQ1) != 3 {
+		t.Fatalf("Wrong number of bindings to q1: %d", len(toQ1))
+	}
+	var fromEx1ToQ1 = 0
+	for _, b := range toQ1 {
+		if b.ExchangeName == "ex-1" {
+			fromEx1ToQ1++
+		}
+	}
+	if fromEx1ToQ1 != 2 {
+		t.Errorf("Wrong number of ex-1 bindings to q1: %d", fromEx1ToQ1)
+	}
+
+	var all = tc.s.Bindings()
+	var found2 = 0
+	for _, b := range all {
+		if (b.QueueName == "q2" && b.ExchangeName == "ex-2") || (b.ToExchange && b.QueueName == "ex-2") {
+			found2++
+		}
+	}
+	if found2 != 2 {
+		t.Errorf("Server listing is missing bindings: %d", found2)
+	}
+	if _, err := json.Marshal(all); err != nil {
+		t.Errorf("Could not serialize bindings: %s", err.Error())
+	}
+
+	// The listing holds copies
+	toQ1[0].Key = "changed"
+	for _, b := range tc.s.BindingsForQueue("q1") {
+		if b.Key == "changed" {
+			t.Errorf("Listing returned the exchange's own binding")
+		}
+	}
+}
+
+func TestExchangeUnbind(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	ch.ExchangeDeclare("ex-src", "direct", false, false, false, false, NO_ARGS)
+	ch.ExchangeDeclare("ex-dest", "fanout", false, false, false, false, NO_ARGS)
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	ch.QueueBind("q1", "", "ex-dest", false, NO_ARGS)
+	if err := ch.ExchangeBind("ex-dest", "rk", "ex-src", false, NO_ARGS); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if err := ch.ExchangeUnbind("ex-dest", "rk", "ex-src", false, NO_ARGS); err != nil {
+		t.Fatalf("Failed to unbind: %s", err.Error())
+	}
+	if len(tc.vhost().exchanges["ex-src"].BindingsForExchange("ex-dest")) != 0 {
+		t.Errorf("Binding still present after unbind")
+	}
+	ch.Publish("ex-src", "rk", false, false, TEST_TRANSIENT_MSG)
+	tc.wait(ch)
+	if tc.vhost().queues["q1"].Len() != 0 {
+		t.Errorf("Message routed through a removed binding")
+	}
+
+	// Unbinding again is a no-op, not an error
+	if err := ch.ExchangeUnbind("ex-dest", "rk", "ex-src", false, NO_ARGS); err != nil {
+		t.Errorf("Unbinding a missing binding failed: %s", err.Error())
+	}
+}
+
+func TestBindingArgumentsIgnored(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	var countBindings = func(exchange string) int {
+		var count = 0
+		for _, b := range tc.s.BindingsForQueue("q1") {
+			if b.ExchangeName == exchange {
+				count++
+			}
+		}
+		return count
+	}
+	ch.QueueDeclare("q1", true, false, false, false, NO_ARGS)
+	ch.QueueBind("q1", "rk", "amq.direct", false, amqpclient.Table{"a": "1"})
+	ch.QueueBind("q1", "rk", "amq.direct", false, amqpclient.Table{"a": "2"})
+	ch.QueueBind("q1", "", "amq.fanout", false, NO_ARGS)
+	ch.QueueBind("q1", "", "amq.fanout", false, amqpclient.Table{"a": "1"})
+	if count := countBindings("amq.direct"); count != 1 {
+		t.Errorf("Direct bindings differing in arguments weren't merged: %d", count)
+	}
+	if count := countBindings("amq.fanout"); count != 1 {
+		t.Errorf("Fanout bindings differing in arguments weren't merged: %d", count)
+	}
+	ch.Publish("amq.direct", "rk", false, false, TEST_TRANSIENT_MSG)
+	tc.wait(ch)
+	if tc.vhost().queues["q1"].Len() != 1 {
+		t.Errorf("Merged binding routed %d messages", tc.vhost().queues["q1"].Len())
+	}
+
+	// Unbinding with other arguments removes the binding from disk too
+	if err := ch.QueueUnbind("q1", "rk", "amq.direct", amqpclient.Table{"a": "3"}); err != nil {
+		t.Fatalf(err.Error())
 	}
+	if count := countBindings("amq.direct"); count != 0 {
+		t.Errorf("Binding left after unbind: %d", count)
+	}
+	tc.restart()
+	if count := countBindings("amq.direct"); count != 0 {
+		t.Errorf("Unbound binding came back after restart: %d", count)
+	}
+	if count := countBindings("amq.fanout"); count != 1 {
+		t.Errorf("Wrong number of fanout bindings after restart: %d", count)
+	}
+}
+
+func TestUnbindMissingBinding(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	// Durable on both ends, so the unbind also goes to the database
+	ch.QueueDeclare("q1", true, false, false, false, NO_ARGS)
+	if err := ch.QueueUnbind("q1", "never.bound", "amq.direct", NO_ARGS); err != nil {
+		t.Fatalf("Unbinding a missing binding failed: %s", err.Error())
+	}
+	if _, err := ch.QueueDeclarePassive("q1", true, false, false, false, NO_ARGS); err != nil {
+		t.Errorf("Channel closed after no-op unbind: %s", err.Error())
+	}
+}
+
+func TestDefaultExchange(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	// No explicit binding, and a name which isn't a valid topic key
+	ch.QueueDeclare("my-queue", false, false, false, false, NO_ARGS)
+	ch.QueueDeclare("other", false, false, false, false, NO_ARGS)
+	deliveries, err := ch.Consume("my-queue", "", true, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume")
+	}
+	ch.Publish("", "my-queue", false, false, TEST_TRANSIENT_MSG)
+	select {
+	case d := <-deliveries:
+		if string(d.Body) != string(TEST_TRANSIENT_MSG.Body) || d.RoutingKey != "my-queue" {
+			t.Fatalf("Wrong delivery through the default exchange")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Message published to the default exchange was not delivered")
+	}
+	tc.wait(ch)
+	if tc.vhost().queues["other"].Len() != 0 {
+		t.Fatalf("Default exchange routed to a queue with another name")
+	}
+}
+
+func TestSystemExchangeTypes(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	var expected = map[string]uint8{
+		"":           exchange.EX_TYPE_DIRECT,
+		"amq.direct": exchange.EX_TYPE_DIRECT,
+		"amq.fanout": exchange.EX_TYPE_FANOUT,
+		"amq.topic":  exchange.EX_TYPE_TOPIC,
+		"amq.match":  exchange.EX_TYPE_HEADERS,
+	}
+	for name, typ := range expected {
+		if tc.vhost().exchanges[name].ExType != typ {
+			t.Errorf("Wrong type for system exchange '%s'", name)
+		}
+	}
+
+	// Ones persisted with the wrong type by older versions are fixed on boot
+	var ex = tc.vhost().exchanges["amq.fanout"]
+	ex.ExType = exchange.EX_TYPE_TOPIC
+	ex.Persist(tc.vhost().db)
+	tc.restart()
+	if tc.vhost().exchanges["amq.fanout"].ExType != exchange.EX_TYPE_FANOUT {
+		t.Errorf("System exchange type was not fixed on restart")
+	}
+}
+
+func TestReservedNames(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+
+	var declares = map[string]func(ch *amqpclient.Channel){
+		"exchange": func(ch *amqpclient.Channel) {
+			ch.ExchangeDeclare("amq.custom", "direct", false, false, false, false, NO_ARGS)
+		},
+		"queue": func(ch *amqpclient.Channel) {
+			ch.QueueDeclare("amq.custom", false, false, false, false, NO_ARGS)
+		},
+	}
+	for kind, declare := range declares {
+		ch, _, errChan := channelHelper(tc, conn)
+		go declare(ch)
+		resp := <-errChan
+		if resp.Code != 403 {
+			t.Errorf("Wrong response code declaring a reserved %s name: %d", kind, resp.Code)
+		}
+	}
+	if _, found := tc.vhost().exchanges["amq.custom"]; found {
+		t.Errorf("Reserved exchange name was declared")
+	}
+	if _, found := tc.vhost().queues["amq.custom"]; found {
+		t.Errorf("Reserved queue name was declared")
+	}
+
+	// The system exchanges can still be redeclared and used
+	ch, _, _ := channelHelper(tc, conn)
+	if err := ch.ExchangeDeclare("amq.direct", "direct", true, false, false, false, NO_ARGS); err != nil {
+		t.Fatalf("Failed to redeclare a system exchange: %s", err.Error())
+	}
+	if err := ch.ExchangeDeclarePassive("amq.topic", "topic", true, false, false, false, NO_ARGS); err != nil {
+		t.Fatalf("Failed to passively declare a system exchange: %s", err.Error())
+	}
+}
+
+func TestNameLength(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	// The longest name a short string can hold is allowed
+	var name = strings.Repeat("q", amqp.MaxNameLength)
+	if _, err := ch.QueueDeclare(name, false, false, false, false, NO_ARGS); err != nil {
+		t.Fatalf("Failed to declare a %d byte queue name: %s", len(name), err.Error())
+	}
+	if err := ch.ExchangeDeclare(name, "direct", false, false, false, false, NO_ARGS); err != nil {
+		t.Fatalf("Failed to declare a %d byte exchange name: %s", len(name), err.Error())
+	}
+}
+
+func TestDefaultExchanges(t *testing.T) {
+	var names = func(s *Server) []string {
+		var ret = make([]string, 0)
+		for _, ex := range s.Exchanges() {
+			ret = append(ret, ex.Name)
+		}
+		return ret
+	}
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	var got = strings.Join(names(tc.s), ",")
+	if got != ",amq.direct,amq.fanout,amq.match,amq.topic" {
+		t.Errorf("Wrong default exchanges: %s", got)
+	}
+
+	// The listing is ordered by name, whatever order they were declared in
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+	for _, name := range []string{"zeta", "alpha", "mid"} {
+		ch.ExchangeDeclare(name, "direct", false, false, false, false, NO_ARGS)
+	}
+	tc.wait(ch)
+	got = strings.Join(names(tc.s), ",")
+	if got != ",alpha,amq.direct,amq.fanout,amq.match,amq.topic,mid,zeta" {
+		t.Errorf("Exchanges not ordered by name: %s", got)
+	}
+
+	// Servers can be created with fewer system exchanges
+	var saved = SystemExchanges
+	SystemExchanges = []SystemExchange{{"amq.topic", exchange.EX_TYPE_TOPIC}}
+	defer func() { SystemExchanges = saved }()
+	tc2 := newTestClient(t)
+	defer tc2.cleanup()
+	got = strings.Join(names(tc2.s), ",")
+	if got != ",amq.topic" {
+		t.Errorf("Wrong exchanges with a custom set: %s", got)
+	}
+}
+
+func TestHeadersExchange(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	ch.ExchangeDeclare("h", "headers", false, false, false, false, NO_ARGS)
+	ch.QueueDeclare("q-any", false, false, false, false, NO_ARGS)
+	ch.QueueDeclare("q-any-with-x", false, false, false, false, NO_ARGS)
+	ch.QueueBind("q-any", "", "h", false, amqpclient.Table{"x-match": "any", "x-tenant": "a"})
+	ch.QueueBind("q-any-with-x", "", "h", false, amqpclient.Table{"x-match": "any-with-x", "x-tenant": "a"})
+	ch.Publish("h", "", false, false, amqpclient.Publishing{
+		Headers: amqpclient.Table{"x-tenant": "a"},
+		Body:    []byte("dispatchd"),
+	})
+	tc.wait(ch)
+	if tc.vhost().queues["q-any"].Len() != 0 {
+		t.Errorf("any matched on an x- header")
+	}
+	if tc.vhost().queues["q-any-with-x"].Len() != 1 {
+		t.Errorf("any-with-x didn't match on an x- header")
+	}
+
+	// Bad x-match values are refused
+	ch2, err := conn.Channel()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = ch2.QueueBind("q-any", "", "h", false, amqpclient.Table{"x-match": "some"})
+	if amqpErr, ok := err.(*amqpclient.Error); !ok || amqpErr.Code != 406 {
+		t.Errorf("Expected 406 for a bad x-match, got %v", err)
+	}
+}
+
+func TestHeadersBindingArguments(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	var tenantA = amqpclient.Table{"x-match": "all", "tenant": "a", "region": "eu"}
+	var tenantB = amqpclient.Table{"x-match": "any", "tenant": "b"}
+	ch.ExchangeDeclare("h", "headers", false, false, false, false, NO_ARGS)
+	ch.QueueDeclare("q", false, false, false, false, NO_ARGS)
+	ch.QueueBind("q", "", "h", false, tenantA)
+	ch.QueueBind("q", "", "h", false, tenantB)
+	// The same arguments again are the same binding
+	ch.QueueBind("q", "", "h", false, tenantA)
+	tc.wait(ch)
+	if count := tc.vhost().exchanges["h"].BindingCount(); count != 2 {
+		t.Fatalf("Expected 2 bindings, got %d", count)
+	}
+	var publish = func(tenant string) {
+		ch.Publish("h", "", false, false, amqpclient.Publishing{
+			Headers: amqpclient.Table{"tenant": tenant, "region": "eu"},
+			Body:    []byte("dispatchd"),
+		})
+	}
+	publish("a")
+	publish("b")
+	tc.wait(ch)
+	if tc.vhost().queues["q"].Len() != 2 {
+		t.Fatalf("Both bindings should have routed, got %d", tc.vhost().queues["q"].Len())
+	}
+
+	// Unbinding one leaves the other in place
+	if err := ch.QueueUnbind("q", "", "h", tenantA); err != nil {
+		t.Fatalf(err.Error())
+	}
+	ch.QueuePurge("q", false)
+	publish("a")
+	publish("b")
+	tc.wait(ch)
+	if tc.vhost().queues["q"].Len() != 1 {
+		t.Fatalf("Only the tenant b binding should be left, got %d", tc.vhost().queues["q"].Len())
+	}
+}
+
+func TestContentTypeFilter(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	ch.ExchangeDeclare("json", "topic", false, false, false, false, amqpclient.Table{"x-content-type-filter": "application/json"})
+	ch.QueueDeclare("q", false, false, false, false, NO_ARGS)
+	ch.QueueBind("q", "#", "json", false, NO_ARGS)
+	for _, contentType := range []string{"application/json", "application/x-protobuf", "", "application/json"} {
+		ch.Publish("json", "key", false, false, amqpclient.Publishing{
+			ContentType: contentType,
+			Body:        []byte("dispatchd"),
+		})
+	}
+	tc.wait(ch)
+	if tc.vhost().queues["q"].Len() != 2 {
+		t.Errorf("Expected only the 2 json messages to route, got %d", tc.vhost().queues["q"].Len())
+	}
+}
+
+func TestRedeclare(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	var args = amqpclient.Table{"alternate-exchange": "ae"}
+	var exchanges = len(tc.vhost().exchanges)
+	for i := 0; i < 1000; i++ {
+		if err := ch.ExchangeDeclare("ex", "topic", true, false, false, false, args); err != nil {
+			t.Fatalf("Redeclare %d failed: %s", i, err.Error())
+		}
+		if _, err := ch.QueueDeclare("q", true, false, false, false, args); err != nil {
+			t.Fatalf("Redeclare %d failed: %s", i, err.Error())
+		}
+	}
+	if len(tc.vhost().exchanges) != exchanges+1 || len(tc.vhost().queues) != 1 {
+		t.Errorf("Redeclaring created new entities")
+	}
+
+	// Declares which aren't equivalent still fail
+	ch2, err := conn.Channel()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = ch2.ExchangeDeclare("ex", "topic", false, false, false, false, args)
+	if amqpErr, ok := err.(*amqpclient.Error); !ok || amqpErr.Code != 406 {
+		t.Errorf("Expected 406 redeclaring a non-equivalent exchange, got %v", err)
+	}
+	ch3, err := conn.Channel()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, err = ch3.QueueDeclare("q", true, false, false, false, NO_ARGS)
+	if amqpErr, ok := err.(*amqpclient.Error); !ok || amqpErr.Code != 406 {
+		t.Errorf("Expected 406 redeclaring a non-equivalent queue, got %v", err)
+	}
+}
+
+func BenchmarkRedeclare(b *testing.B) {
+	tc := &testClient{serverDb: dbPath(), msgDb: dbPath()}
+	tc.s = NewServer(context.Background(), tc.serverDb, tc.msgDb, nil, false)
+	defer tc.cleanup()
+	defer tc.s.Close()
+	conn := tc.connect()
+	ch, err := conn.Channel()
+	if err != nil {
+		b.Fatalf(err.Error())
+	}
+	ch.ExchangeDeclare("ex", "topic", false, false, false, false, NO_ARGS)
+	ch.QueueDeclare("q", false, false, false, false, NO_ARGS)
+
+	b.Run("exchange", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			ch.ExchangeDeclare("ex", "topic", false, false, false, false, NO_ARGS)
+		}
+	})
+	b.Run("queue", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			ch.QueueDeclare("q", false, false, false, false, NO_ARGS)
+		}
+	})
 }
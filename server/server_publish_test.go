@@ -1,31 +1,115 @@
 package server
 
 import (
-	"github.com/karelbilek/amqp-test-server/util"
+	"bytes"
+	"context"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/karelbilek/amqp-test-server/amqp"
+	"github.com/karelbilek/amqp-test-server/msgstore"
+	"github.com/karelbilek/amqp-test-server/util"
+	amqpclient "github.com/streadway/amqp"
 )
 
-func TestImmediateFail(t *testing.T) {
+func TestImmediateRejected(t *testing.T) {
 	tc := newTestClient(t)
 	defer tc.cleanup()
 	conn := tc.connect()
-	ch, retChan, _ := channelHelper(tc, conn)
+	connErrs := conn.NotifyClose(make(chan *amqpclient.Error, 1))
+	ch, _, _ := channelHelper(tc, conn)
 
 	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
 	ch.QueueBind("q1", "abc", "amq.direct", false, NO_ARGS)
+	_, err := ch.Consume("q1", util.RandomId(), false, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume")
+	}
+	// Rejected even though a consumer is ready
 	ch.Publish("amq.direct", "abc", false, true, TEST_TRANSIENT_MSG)
 
+	resp := <-connErrs
+	if resp == nil || resp.Code != 540 {
+		t.Fatalf("Expected a 540 connection error, got %v", resp)
+	}
+}
+
+// Immediate publishes are refused on the wire, but the delivery path is
+// still there for messages the server publishes itself
+func TestImmediateConsumerFilter(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	deliveries, err := ch.Consume("q1", "eu", true, false, false, false, amqpclient.Table{"x-filter-jmespath": "headers.region == 'eu'"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var publish = func(region string) *amqp.BasicReturn {
+		var headers = amqp.NewTable()
+		headers.SetKey("region", region)
+		var msg = amqp.NewMessage(&amqp.BasicPublish{
+			Exchange:   "",
+			RoutingKey: "q1",
+			Immediate:  true,
+		}, -1)
+		msg.Header = &amqp.ContentHeaderFrame{
+			ContentClass:    60,
+			ContentBodySize: uint64(len(region)),
+			PropertyFlags:   amqp.MaskHeaders,
+			Properties:      &amqp.BasicContentHeaderProperties{Headers: headers},
+		}
+		msg.Payload = append(msg.Payload, &amqp.WireFrame{
+			FrameType: uint8(amqp.FrameBody),
+			Payload:   []byte(region),
+		})
+		var ret, amqpErr = tc.vhost().publish(tc.vhost().exchanges[""], msg)
+		if amqpErr != nil {
+			t.Fatalf(amqpErr.Msg)
+		}
+		return ret
+	}
+	if ret := publish("us"); ret == nil || ret.ReplyCode != 313 {
+		t.Fatalf("Expected the filtered out message to be returned, got %v", ret)
+	}
+	if ret := publish("eu"); ret != nil {
+		t.Fatalf("Expected the matching message to be delivered, got %v", ret)
+	}
+	select {
+	case d := <-deliveries:
+		if string(d.Body) != "eu" {
+			t.Errorf("The consumer got a message for %s", d.Body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("No delivery")
+	}
+}
+
+func TestMandatory(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, retChan, _ := channelHelper(tc, conn)
+
+	ch.Publish("amq.direct", "abc", true, false, TEST_TRANSIENT_MSG)
+
 	ret := <-retChan
 
 	if ret.ReplyCode != 313 {
-		t.Fatalf("Wrong reply code with Immediate return")
+		t.Fatalf("Wrong reply code with Mandatory return")
 	}
 	if string(ret.Body) != string(TEST_TRANSIENT_MSG.Body) {
 		t.Fatalf("Did not get same payload back in BasicReturn")
 	}
 }
 
-func TestImmediate(t *testing.T) {
+func TestTracing(t *testing.T) {
 	tc := newTestClient(t)
 	defer tc.cleanup()
 	conn := tc.connect()
@@ -33,29 +117,665 @@ func TestImmediate(t *testing.T) {
 
 	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
 	ch.QueueBind("q1", "abc", "amq.direct", false, NO_ARGS)
+	// Nothing is traced until tracing is enabled
+	ch.Publish("amq.direct", "abc", false, false, TEST_TRANSIENT_MSG)
+	tc.wait(ch)
+	ch.Get("q1", true)
 
-	deliveries, err := ch.Consume("q1", util.RandomId(), false, false, false, false, NO_ARGS)
-	if err != nil {
-		t.Fatalf("Failed to consume")
+	if err := tc.s.SetTracing(DefaultVirtualHost, true); err != nil {
+		t.Fatalf(err.Error())
 	}
-	ch.Publish("amq.direct", "abc", false, true, TEST_TRANSIENT_MSG)
+	ch.QueueDeclare("trace", false, false, false, false, NO_ARGS)
+	ch.QueueBind("trace", "#", TRACE_EXCHANGE, false, NO_ARGS)
+	if tc.vhost().queues["trace"].Len() != 0 {
+		t.Fatalf("Traced a message before tracing was enabled")
+	}
+
+	msg := TEST_TRANSIENT_MSG
+	msg.Headers = amqpclient.Table{"origin": "test"}
+	ch.Publish("amq.direct", "abc", false, false, msg)
+	tc.wait(ch)
+	if _, ok, _ := ch.Get("q1", true); !ok {
+		t.Fatalf("Message was not routed to q1")
+	}
+	tc.wait(ch)
+
+	var expected = []string{"publish.amq.direct", "deliver.q1"}
+	for _, key := range expected {
+		trace, ok, err := ch.Get("trace", true)
+		if err != nil || !ok {
+			t.Fatalf("Missing trace message %s", key)
+		}
+		if trace.RoutingKey != key {
+			t.Fatalf("Wrong trace routing key: %s, expected %s", trace.RoutingKey, key)
+		}
+		if string(trace.Body) != string(TEST_TRANSIENT_MSG.Body) {
+			t.Fatalf("Trace message has the wrong body")
+		}
+		if trace.Headers["origin"] != "test" || trace.Headers["exchange_name"] != "amq.direct" {
+			t.Fatalf("Trace message has the wrong headers: %v", trace.Headers)
+		}
+	}
+
+	// Delivering trace messages doesn't trace them again
+	tc.wait(ch)
+	if tc.vhost().queues["trace"].Len() != 0 {
+		t.Fatalf("Trace messages were traced")
+	}
+
+	tc.s.SetTracing(DefaultVirtualHost, false)
+	ch.Publish("amq.direct", "abc", false, false, msg)
+	ch.Get("q1", true)
+	tc.wait(ch)
+	if tc.vhost().queues["trace"].Len() != 0 {
+		t.Fatalf("Traced a message after tracing was disabled")
+	}
+}
+
+func expectUnexpectedFrame(t *testing.T, conn net.Conn) {
+	closeMethod, ok := rawReadMethod(t, conn).(*amqp.ConnectionClose)
+	if !ok {
+		t.Fatalf("Expected connection.close")
+	}
+	if closeMethod.ReplyCode != 505 {
+		t.Errorf("Wrong reply code: %d", closeMethod.ReplyCode)
+	}
+}
+
+func TestContentBodyReassembly(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.rawConnect()
+	defer conn.Close()
+	rawOpenChannel(t, conn)
+
+	rawSendMethod(conn, 1, &amqp.QueueDeclare{Queue: "q1", Arguments: amqp.NewTable()})
+	rawReadMethod(t, conn)
+	rawSendMethod(conn, 1, &amqp.QueueBind{Queue: "q1", Exchange: "amq.direct", RoutingKey: "q1", Arguments: amqp.NewTable()})
+	rawReadMethod(t, conn)
+
+	// A body split across frames, and an empty body with no frames at all
+	rawSendMethod(conn, 1, &amqp.BasicPublish{Exchange: "amq.direct", RoutingKey: "q1"})
+	rawSendHeader(conn, 1, 6)
+	rawSendBody(conn, 1, []byte("abc"))
+	rawSendBody(conn, 1, []byte("def"))
+	rawSendMethod(conn, 1, &amqp.BasicPublish{Exchange: "amq.direct", RoutingKey: "q1"})
+	rawSendHeader(conn, 1, 0)
+	rawSendMethod(conn, 1, &amqp.QueueDeclare{Queue: "q1", Passive: true, Arguments: amqp.NewTable()})
+	declareOk, ok := rawReadMethod(t, conn).(*amqp.QueueDeclareOk)
+	if !ok {
+		t.Fatalf("Expected queue.declare-ok")
+	}
+	if declareOk.MessageCount != 2 {
+		t.Errorf("Wrong message count: %d", declareOk.MessageCount)
+	}
+}
+
+func TestContentBodyTruncated(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.rawConnect()
+	defer conn.Close()
+	rawOpenChannel(t, conn)
+
+	rawSendMethod(conn, 1, &amqp.BasicPublish{RoutingKey: "q1"})
+	rawSendHeader(conn, 1, 10)
+	rawSendBody(conn, 1, []byte("abc"))
+	// The next publish starts before the first body is complete
+	rawSendMethod(conn, 1, &amqp.BasicPublish{RoutingKey: "q1"})
+	expectUnexpectedFrame(t, conn)
+}
+
+func TestContentBodyOversized(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.rawConnect()
+	defer conn.Close()
+	rawOpenChannel(t, conn)
+
+	rawSendMethod(conn, 1, &amqp.BasicPublish{RoutingKey: "q1"})
+	rawSendHeader(conn, 1, 4)
+	rawSendBody(conn, 1, []byte("abcdefgh"))
+	expectUnexpectedFrame(t, conn)
+}
+
+func TestContentInterleavedMethod(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.rawConnect()
+	defer conn.Close()
+	rawOpenChannel(t, conn)
+
+	rawSendMethod(conn, 1, &amqp.BasicPublish{RoutingKey: "q1"})
+	rawSendMethod(conn, 1, &amqp.QueueDeclare{Queue: "q1", Arguments: amqp.NewTable()})
+	expectUnexpectedFrame(t, conn)
+}
+
+func TestMemoryMessageStore(t *testing.T) {
+	serverDb := dbPath()
+	tc := &testClient{
+		t:        t,
+		s:        NewMemoryServer(context.Background(), serverDb, nil, false),
+		serverDb: serverDb,
+	}
+	defer tc.cleanup()
+	if err := tc.s.AddVirtualHost("other"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if files, _ := filepath.Glob(serverDb + "*"); len(files) != 2 {
+		t.Fatalf("Expected only the server databases, got %v", files)
+	}
+	if !tc.vhost().msgStore.InMemory() {
+		t.Fatalf("Message store isn't in memory")
+	}
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	ch.QueueDeclare("q1", true, false, false, false, NO_ARGS)
+	ch.QueueBind("q1", "abc", "amq.direct", false, NO_ARGS)
+	ch.Publish("amq.direct", "abc", false, false, amqpclient.Publishing{
+		DeliveryMode: amqpclient.Persistent,
+		Body:         []byte("dispatchd"),
+	})
+	tc.wait(ch)
+	msg, ok, err := ch.Get("q1", true)
+	if err != nil || !ok || string(msg.Body) != "dispatchd" {
+		t.Fatalf("Failed to get a durable message from an in-memory store")
+	}
+	tc.wait(ch)
+	if tc.vhost().msgStore.MessageCount() != 0 {
+		t.Errorf("Message was not removed from the in-memory store")
+	}
+}
+
+func TestBasicPropertiesRoundTrip(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	ch.QueueDeclare("q1", true, false, false, false, NO_ARGS)
+	ch.QueueBind("q1", "abc", "amq.direct", false, NO_ARGS)
+	var sent = amqpclient.Publishing{
+		Headers: amqpclient.Table{
+			"bool":    true,
+			"int16":   int16(-2),
+			"int32":   int32(-3),
+			"int64":   int64(-4),
+			"float32": float32(5.5),
+			"float64": float64(-6.5),
+			"decimal": amqpclient.Decimal{Scale: 2, Value: 700},
+			"string":  "eight",
+			"bytes":   []byte{9, 10},
+			"time":    time.Unix(1234567890, 0),
+			"array":   []interface{}{"eleven", int32(12)},
+			"table":   amqpclient.Table{"inner": "thirteen"},
+			"void":    nil,
+		},
+		ContentType:     "text/plain",
+		ContentEncoding: "utf-8",
+		DeliveryMode:    amqpclient.Persistent,
+		Priority:        3,
+		CorrelationId:   "correlation",
+		ReplyTo:         "reply.to",
+		Expiration:      "60000",
+		MessageId:       "message",
+		Timestamp:       time.Unix(1234567890, 0),
+		Type:            "type",
+		UserId:          "guest",
+		AppId:           "app",
+		Body:            []byte("dispatchd"),
+	}
+	ch.Publish("amq.direct", "abc", false, false, sent)
+	tc.wait(ch)
+	// Go through the message store on disk as well
+	tc.restart()
+	conn = tc.connect()
+	ch, _, _ = channelHelper(tc, conn)
+
+	got, ok, err := ch.Get("q1", true)
+	if err != nil || !ok {
+		t.Fatalf("Failed to get the message back: %v", err)
+	}
+	if !reflect.DeepEqual(sent.Headers, got.Headers) {
+		t.Errorf("Headers changed.\nsent: %v\ngot:  %v", sent.Headers, got.Headers)
+	}
+	var check = func(name string, sent interface{}, got interface{}) {
+		if !reflect.DeepEqual(sent, got) {
+			t.Errorf("%s changed. sent: %v, got: %v", name, sent, got)
+		}
+	}
+	check("ContentType", sent.ContentType, got.ContentType)
+	check("ContentEncoding", sent.ContentEncoding, got.ContentEncoding)
+	check("DeliveryMode", sent.DeliveryMode, got.DeliveryMode)
+	check("Priority", sent.Priority, got.Priority)
+	check("CorrelationId", sent.CorrelationId, got.CorrelationId)
+	check("ReplyTo", sent.ReplyTo, got.ReplyTo)
+	check("Expiration", sent.Expiration, got.Expiration)
+	check("MessageId", sent.MessageId, got.MessageId)
+	check("Timestamp", sent.Timestamp.Unix(), got.Timestamp.Unix())
+	check("Type", sent.Type, got.Type)
+	check("UserId", sent.UserId, got.UserId)
+	check("AppId", sent.AppId, got.AppId)
+	check("Body", sent.Body, got.Body)
+}
+
+func TestClusterIdRoundTrip(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.rawConnect()
+	defer conn.Close()
+	rawOpenChannel(t, conn)
+
+	rawSendMethod(conn, 1, &amqp.QueueDeclare{Queue: "q1", Arguments: amqp.NewTable()})
+	rawReadMethod(t, conn)
+
+	// cluster-id is the last property, which exercises the whole bitmask
+	var clusterId = "cluster"
+	rawSendMethod(conn, 1, &amqp.BasicPublish{Exchange: "", RoutingKey: "q1"})
+	rawSendHeaderProps(conn, 1, 0, &amqp.BasicContentHeaderProperties{Reserved: &clusterId})
+
+	rawSendMethod(conn, 1, &amqp.BasicGet{Queue: "q1", NoAck: true})
+	if _, ok := rawReadMethod(t, conn).(*amqp.BasicGetOk); !ok {
+		t.Fatalf("Expected basic.get-ok")
+	}
+	frame, err := amqp.ReadFrame(conn)
+	if err != nil || frame.FrameType != uint8(amqp.FrameHeader) {
+		t.Fatalf("Expected a content header")
+	}
+	var header = &amqp.ContentHeaderFrame{}
+	if err = header.Read(bytes.NewReader(frame.Payload), false); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if header.PropertyFlags != amqp.MaskReserved || header.Properties.Reserved == nil || *header.Properties.Reserved != clusterId {
+		t.Errorf("cluster-id did not survive: %v", header.Properties)
+	}
+}
+
+func TestUserIdValidation(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, errChan := channelHelper(tc, conn)
+
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	// The test client authenticates as the default guest user
+	ch.Publish("", "q1", false, false, amqpclient.Publishing{UserId: "guest", Body: []byte("dispatchd")})
+	tc.wait(ch)
+	if tc.vhost().queues["q1"].Len() != 1 {
+		t.Fatalf("Publish with the authenticated user-id was not routed")
+	}
+
+	ch.Publish("", "q1", false, false, amqpclient.Publishing{UserId: "someone-else", Body: []byte("dispatchd")})
+	resp := <-errChan
+	if resp.Code != 406 {
+		t.Errorf("Wrong response code: %d", resp.Code)
+	}
+	if tc.vhost().queues["q1"].Len() != 1 {
+		t.Errorf("Publish with a mismatched user-id was routed")
+	}
+}
+
+func TestFlushPolicy(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	if err := tc.s.SetFlushPolicy(msgstore.FLUSH_EVERY_WRITE, 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := tc.s.AddVirtualHost("test"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for name, vhost := range tc.s.vhosts {
+		if vhost.msgStore.FlushPolicy() != msgstore.FLUSH_EVERY_WRITE {
+			t.Errorf("Flush policy not applied to virtual host '%s'", name)
+		}
+	}
+
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+	ch.QueueDeclare("q1", true, false, false, false, NO_ARGS)
+	ch.Publish("", "q1", false, false, amqpclient.Publishing{DeliveryMode: amqpclient.Persistent, Body: []byte("dispatchd")})
+	tc.wait(ch)
+	tc.restart()
+	if tc.vhost().queues["q1"].Len() != 1 {
+		t.Errorf("Persistent message didn't survive a restart")
+	}
+}
+
+func TestStoreGaugeSnapshot(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+	var clock = util.NewFakeClock(time.Unix(1700000000, 0))
+	var snapshot = &storeStatsSnapshot{server: tc.s, clock: clock}
+
+	ch.QueueDeclare("q1", true, false, false, false, NO_ARGS)
+	var publish = func() {
+		ch.Publish("", "q1", false, false, amqpclient.Publishing{
+			DeliveryMode: amqpclient.Persistent,
+			Body:         []byte("dispatchd"),
+		})
+		tc.wait(ch)
+	}
+	publish()
+	var before = snapshot.get().LiveEntries
+	// Reads within the max age share the one count
+	publish()
+	if live := snapshot.get().LiveEntries; live != before {
+		t.Fatalf("Snapshot was taken again before it got old: %d, then %d", before, live)
+	}
+	clock.Advance(storeGaugeMaxAge)
+	if live := snapshot.get().LiveEntries; live != before+1 {
+		t.Fatalf("Expected %d live entries once the snapshot was old, got %d", before+1, live)
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	var before = tc.s.Stats()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	ch.QueueDeclare("q2", false, false, false, false, NO_ARGS)
+	ch.QueueBind("q1", "", "amq.fanout", false, NO_ARGS)
+	ch.QueueBind("q2", "", "amq.fanout", false, NO_ARGS)
+	for i := 0; i < 3; i++ {
+		ch.Publish("amq.fanout", "", false, false, TEST_TRANSIENT_MSG)
+	}
+	tc.wait(ch)
+	ch.Qos(1, 0, false)
+	deliveries, _ := ch.Consume("q2", "c1", false, false, false, false, NO_ARGS)
 	<-deliveries
+	tc.wait(ch)
+
+	var s = tc.s.Stats()
+	if s.Connections != 1 || s.Channels != 1 || s.VirtualHosts != 1 {
+		t.Errorf("Wrong connection totals: %+v", s)
+	}
+	// tc.wait declares queues of its own, and every queue is bound to the
+	// default exchange
+	if s.Queues != len(tc.vhost().queues) || s.Exchanges != before.Exchanges || s.Bindings != before.Bindings+s.Queues+2 {
+		t.Errorf("Wrong object totals: %+v", s)
+	}
+	if s.MessagesReady != 5 || s.MessagesUnacked != 1 {
+		t.Errorf("Wrong message totals: %+v", s)
+	}
+	if s.ReadyBytes != 5*uint64(len(TEST_TRANSIENT_MSG.Body)) {
+		t.Errorf("Wrong byte total: %d", s.ReadyBytes)
+	}
 }
 
-func TestMandatory(t *testing.T) {
+func TestMaxMessageSize(t *testing.T) {
 	tc := newTestClient(t)
 	defer tc.cleanup()
+	tc.s.SetMaxMessageSize(64 * 1024)
 	conn := tc.connect()
-	ch, retChan, _ := channelHelper(tc, conn)
+	ch, _, errChan := channelHelper(tc, conn)
 
-	ch.Publish("amq.direct", "abc", false, true, TEST_TRANSIENT_MSG)
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	ch.Publish("", "q1", false, false, amqpclient.Publishing{Body: make([]byte, 64*1024)})
+	tc.wait(ch)
+	if tc.vhost().queues["q1"].Len() != 1 {
+		t.Fatalf("Message within the max size was not routed")
+	}
 
-	ret := <-retChan
+	// Spans several body frames, none of which may end up in a message
+	ch.Publish("", "q1", false, false, amqpclient.Publishing{Body: make([]byte, 200*1024)})
+	resp := <-errChan
+	if resp.Code != 406 {
+		t.Errorf("Wrong response code: %d", resp.Code)
+	}
+	ch2, _, _ := channelHelper(tc, conn)
+	tc.wait(ch2)
+	if tc.vhost().queues["q1"].Len() != 1 {
+		t.Errorf("Oversized message was routed")
+	}
+}
 
-	if ret.ReplyCode != 313 {
-		t.Fatalf("Wrong reply code with Mandatory return")
+func TestDirectReplyTo(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	serverCh, _, _ := channelHelper(tc, tc.connect())
+	clientCh, _, _ := channelHelper(tc, tc.connect())
+
+	serverCh.QueueDeclare("rpc", false, false, false, false, NO_ARGS)
+	requests, err := serverCh.Consume("rpc", "server", true, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume requests")
 	}
-	if string(ret.Body) != string(TEST_TRANSIENT_MSG.Body) {
-		t.Fatalf("Did not get same payload back in BasicReturn")
+	replies, err := clientCh.Consume(DirectReplyTo, "client", true, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume direct replies: %s", err.Error())
+	}
+	clientCh.Publish("", "rpc", false, false, amqpclient.Publishing{
+		Body:    []byte("ping"),
+		ReplyTo: DirectReplyTo,
+	})
+
+	var request amqpclient.Delivery
+	select {
+	case request = <-requests:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Request was not delivered")
+	}
+	if !strings.HasPrefix(request.ReplyTo, DirectReplyTo+".") {
+		t.Fatalf("Request reply-to wasn't given a reply address: %s", request.ReplyTo)
+	}
+	serverCh.Publish("", request.ReplyTo, false, false, amqpclient.Publishing{Body: []byte("pong")})
+	select {
+	case reply := <-replies:
+		if string(reply.Body) != "pong" || reply.ConsumerTag != "client" {
+			t.Fatalf("Got reply %q for consumer %s", reply.Body, reply.ConsumerTag)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Reply was not delivered")
+	}
+	if len(tc.vhost().queues) != 1 {
+		t.Errorf("Direct reply-to declared a queue")
+	}
+
+	// The pseudo-queue only works for channels consuming from it
+	ch, err := tc.connect().Channel()
+	if err != nil {
+		t.Fatalf("Failed to open channel")
+	}
+	ch.Publish("", "rpc", false, false, amqpclient.Publishing{ReplyTo: DirectReplyTo})
+	if _, err := ch.QueueDeclare("rpc", false, false, false, false, NO_ARGS); err == nil {
+		t.Errorf("Publishing with direct reply-to without consuming was allowed")
+	} else if amqpErr, ok := err.(*amqpclient.Error); !ok || amqpErr.Code != 406 {
+		t.Errorf("Expected 406, got %v", err)
+	}
+}
+
+func TestTimestampMessages(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	var clock = util.NewFakeClock(time.Unix(1700000000, 0))
+	tc.s.SetClock(clock)
+	tc.s.SetTimestampMessages(true)
+	ch, _, _ := channelHelper(tc, tc.connect())
+
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	deliveries, err := ch.Consume("q1", "c1", true, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume")
+	}
+	ch.Publish("", "q1", false, false, amqpclient.Publishing{Body: []byte("a"), ContentType: "text/plain"})
+	// A timestamp the publisher set is kept
+	ch.Publish("", "q1", false, false, amqpclient.Publishing{Body: []byte("b"), Timestamp: time.Unix(1600000000, 0)})
+	for _, expected := range []int64{1700000000, 1600000000} {
+		select {
+		case d := <-deliveries:
+			if d.Timestamp.Unix() != expected {
+				t.Errorf("Message %s has timestamp %d, expected %d", d.Body, d.Timestamp.Unix(), expected)
+			}
+			if string(d.Body) == "a" && d.ContentType != "text/plain" {
+				t.Errorf("Other properties were lost: %q", d.ContentType)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Message was not delivered")
+		}
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	var setHeader = func(msg *amqp.Message, key string, value string) {
+		var props = msg.Header.Properties
+		if props.Headers == nil {
+			props.Headers = amqp.NewTable()
+		}
+		props.Headers.SetKey(key, value)
+	}
+	tc.s.AddPublishInterceptor(func(ctx *InterceptContext, msg *amqp.Message) (*amqp.Message, bool) {
+		if msg.Key == "drop" {
+			return nil, false
+		}
+		setHeader(msg, "x-published-in", ctx.VirtualHost)
+		return msg, true
+	})
+	tc.s.AddDeliverInterceptor(func(ctx *InterceptContext, msg *amqp.Message) (*amqp.Message, bool) {
+		copied, err := CopyMessage(msg)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		setHeader(copied, "x-delivered-to", ctx.ConsumerTag)
+		return copied, true
+	})
+	ch, _, _ := channelHelper(tc, tc.connect())
+
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	ch.QueueDeclare("drop", false, false, false, false, NO_ARGS)
+	ch.Publish("", "drop", false, false, TEST_TRANSIENT_MSG)
+	ch.Publish("", "q1", false, false, TEST_TRANSIENT_MSG)
+	tc.wait(ch)
+	if tc.vhost().queues["drop"].Len() != 0 {
+		t.Errorf("Dropped message was routed")
+	}
+
+	deliveries, err := ch.Consume("q1", "c1", true, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume")
+	}
+	select {
+	case d := <-deliveries:
+		if d.Headers["x-published-in"] != DefaultVirtualHost || d.Headers["x-delivered-to"] != "c1" {
+			t.Errorf("Interceptors didn't set the headers: %v", d.Headers)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Message was not delivered")
+	}
+}
+
+func TestDeliverInterceptorDrop(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	tc.s.AddDeliverInterceptor(func(ctx *InterceptContext, msg *amqp.Message) (*amqp.Message, bool) {
+		return msg, string(msg.Payload[0].Payload) != "drop"
+	})
+	ch, _, errChan := channelHelper(tc, tc.connect())
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	var publish = func(bodies ...string) {
+		for _, body := range bodies {
+			ch.Publish("", "q1", false, false, amqpclient.Publishing{Body: []byte(body)})
+		}
+		tc.wait(ch)
+	}
+
+	// basic.get answers a dropped message with get-empty
+	publish("drop")
+	if _, ok, err := ch.Get("q1", true); ok || err != nil {
+		t.Fatalf("Dropped message was got: %v", err)
+	}
+
+	// Dropped deliveries to an acking consumer are acked for it, and no-ack
+	// consumers have nothing to ack
+	for _, noAck := range []bool{false, true} {
+		publish("drop", "keep")
+		deliveries, err := ch.Consume("q1", "c1", noAck, false, false, false, NO_ARGS)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		select {
+		case d := <-deliveries:
+			if string(d.Body) != "keep" {
+				t.Fatalf("Dropped message was delivered")
+			}
+			if !noAck {
+				d.Ack(false)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Message was not delivered")
+		}
+		ch.Cancel("c1", false)
+		tc.wait(ch)
+	}
+	var q = tc.vhost().queues["q1"]
+	if q.Len() != 0 || q.UnackedCount() != 0 {
+		t.Errorf("Queue has %d ready and %d unacked messages", q.Len(), q.UnackedCount())
+	}
+	select {
+	case err := <-errChan:
+		t.Errorf("Channel closed: %v", err)
+	default:
+	}
+}
+
+func TestPublisherConfirms(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	tc.s.SetFlushPolicy(msgstore.FLUSH_INTERVAL, 10*time.Millisecond)
+	conn := tc.connect()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err = ch.Confirm(false); err != nil {
+		t.Fatalf(err.Error())
+	}
+	var confirms = ch.NotifyPublish(make(chan amqpclient.Confirmation, 10))
+	ch.QueueDeclare("q1", true, false, false, false, NO_ARGS)
+	ch.QueueDeclare("full", false, false, false, false, amqpclient.Table{
+		"x-max-length": int32(1),
+		"x-overflow":   "reject-publish",
+	})
+	var expectConfirm = func(tag uint64, ack bool) {
+		select {
+		case confirm := <-confirms:
+			if confirm.DeliveryTag != tag || confirm.Ack != ack {
+				t.Fatalf("Expected publish %d to get ack %v, got %+v", tag, ack, confirm)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Publish %d wasn't confirmed", tag)
+		}
+	}
+
+	ch.Publish("", "q1", false, false, amqpclient.Publishing{Body: []byte("transient")})
+	expectConfirm(1, true)
+	ch.Publish("", "q1", false, false, amqpclient.Publishing{DeliveryMode: amqpclient.Persistent, Body: []byte("persistent")})
+	expectConfirm(2, true)
+
+	// A full queue nacks instead of closing the channel
+	ch.Publish("", "full", false, false, amqpclient.Publishing{Body: []byte("fits")})
+	expectConfirm(3, true)
+	ch.Publish("", "full", false, false, amqpclient.Publishing{Body: []byte("refused")})
+	expectConfirm(4, false)
+
+	// Persistent messages the store can't write are nacked
+	tc.vhost().msgStore.Close()
+	ch.Publish("", "q1", false, false, amqpclient.Publishing{DeliveryMode: amqpclient.Persistent, Body: []byte("lost")})
+	expectConfirm(5, false)
+	ch.Publish("", "q1", false, false, amqpclient.Publishing{Body: []byte("transient")})
+	expectConfirm(6, true)
+
+	// Transactions and confirms don't mix
+	if err = ch.Tx(); err == nil {
+		t.Errorf("tx.select was allowed on a confirm channel")
+	} else if amqpErr, ok := err.(*amqpclient.Error); !ok || amqpErr.Code != 406 {
+		t.Errorf("Expected 406 for tx.select on a confirm channel, got %v", err)
 	}
 }
@@ -1,7 +1,20 @@
 package server
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/karelbilek/amqp-test-server/amqp"
+	"github.com/karelbilek/amqp-test-server/util"
+	"github.com/rcrowley/go-metrics"
+	amqpclient "github.com/streadway/amqp"
 )
 
 func TestQueueMethods(t *testing.T) {
@@ -13,8 +26,8 @@ func TestQueueMethods(t *testing.T) {
 	// Create Queue
 	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
 
-	if len(tc.s.queues) != 1 {
-		t.Errorf("Wrong number of queues: %d", len(tc.s.queues))
+	if len(tc.vhost().queues) != 1 {
+		t.Errorf("Wrong number of queues: %d", len(tc.vhost().queues))
 	}
 
 	// Passive Check
@@ -22,21 +35,21 @@ func TestQueueMethods(t *testing.T) {
 
 	// Bind
 	ch.QueueBind("q1", "rk.*.#", "amq.topic", false, NO_ARGS)
-	if len(tc.s.exchanges["amq.topic"].BindingsForQueue("q1")) != 1 {
+	if len(tc.vhost().exchanges["amq.topic"].BindingsForQueue("q1")) != 1 {
 		t.Errorf("Failed to bind to q1")
 	}
 
 	// Unbind
 	ch.QueueUnbind("q1", "rk.*.#", "amq.topic", NO_ARGS)
 
-	if len(tc.s.exchanges["amq.topic"].BindingsForQueue("q1")) != 0 {
+	if len(tc.vhost().exchanges["amq.topic"].BindingsForQueue("q1")) != 0 {
 		t.Errorf("Failed to unbind from q1")
 	}
 
 	// Delete
 	ch.QueueDelete("q1", false, false, false)
-	if len(tc.s.queues) != 0 {
-		t.Errorf("Wrong number of queues: %d", len(tc.s.queues))
+	if len(tc.vhost().queues) != 0 {
+		t.Errorf("Wrong number of queues: %d", len(tc.vhost().queues))
 	}
 }
 
@@ -104,7 +117,7 @@ func TestPurge(t *testing.T) {
 	// This unbind is just to block us on the message being processed by the
 	// channel so that the server has it.
 	ch.QueueUnbind("q1", "a.b.c", "amq.topic", NO_ARGS)
-	if tc.s.queues["q1"].Len() == 0 {
+	if tc.vhost().queues["q1"].Len() == 0 {
 		t.Fatalf("Message did not make it into queue")
 	}
 
@@ -113,8 +126,8 @@ func TestPurge(t *testing.T) {
 		t.Fatalf("Failed to call QueuePurge")
 	}
 
-	if tc.s.queues["q1"].Len() != 0 {
-		t.Fatalf("Message did not get purged from queue. Got %d", tc.s.queues["q1"].Len())
+	if tc.vhost().queues["q1"].Len() != 0 {
+		t.Fatalf("Message did not get purged from queue. Got %d", tc.vhost().queues["q1"].Len())
 	}
 
 	if resp != 1 {
@@ -133,7 +146,7 @@ func TestExclusive(t *testing.T) {
 
 	// Check conn id
 	serverConn := tc.connFromServer()
-	q, ok := tc.s.queues["q1"]
+	q, ok := tc.vhost().queues["q1"]
 	if !ok {
 		t.Fatalf("Could not find q1")
 	}
@@ -153,6 +166,77 @@ func TestExclusive(t *testing.T) {
 	}
 }
 
+func TestQueueDeleteConditions(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, errChan := channelHelper(tc, conn)
+
+	ch.QueueDeclare("q1", true, false, false, false, NO_ARGS)
+	ch.QueueBind("q1", "rk", "amq.direct", false, NO_ARGS)
+	ch.Publish("amq.direct", "rk", false, false, TEST_TRANSIENT_MSG)
+	ch.Publish("amq.direct", "rk", false, false, TEST_TRANSIENT_MSG)
+	tc.wait(ch)
+
+	// if-empty with messages left
+	go ch.QueueDelete("q1", false, true, false)
+	if resp := <-errChan; resp.Code != 406 {
+		t.Errorf("Wrong response code for if-empty: %d", resp.Code)
+	}
+	if q, found := tc.vhost().queues["q1"]; !found || q.Len() != 2 {
+		t.Fatalf("Queue was changed by a refused if-empty delete")
+	}
+
+	// if-unused with a consumer
+	ch, _, errChan = channelHelper(tc, conn)
+	ch.Qos(1, 0, false)
+	if _, err := ch.Consume("q1", "c1", false, false, false, false, NO_ARGS); err != nil {
+		t.Fatalf("Failed to consume")
+	}
+	ch2, err := conn.Channel()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := ch2.QueueDelete("q1", true, false, false); err == nil {
+		t.Errorf("if-unused delete of a consumed queue succeeded")
+	} else if err.(*amqpclient.Error).Code != 406 {
+		t.Errorf("Wrong response code for if-unused: %s", err.Error())
+	}
+	if _, found := tc.vhost().queues["q1"]; !found {
+		t.Fatalf("Queue was deleted by a refused if-unused delete")
+	}
+	if len(tc.s.BindingsForQueue("q1")) != 2 {
+		t.Errorf("Bindings were removed by a refused delete")
+	}
+
+	// Closing the channel requeues the unacked delivery, so both messages
+	// are back and the queue is unused
+	ch.Close()
+	ch, _ = conn.Channel()
+	if count, err := ch.QueuePurge("q1", false); err != nil || count != 2 {
+		t.Fatalf("Expected to purge 2 messages, got %d", count)
+	}
+	ch.Publish("amq.direct", "rk", false, false, TEST_TRANSIENT_MSG)
+	tc.wait(ch)
+	count, err := ch.QueueDelete("q1", true, false, false)
+	if err != nil {
+		t.Fatalf("Failed to delete: %s", err.Error())
+	}
+	if count != 1 {
+		t.Errorf("Wrong delete-ok message count: %d", count)
+	}
+	if _, found := tc.vhost().queues["q1"]; found {
+		t.Errorf("Queue still present after delete")
+	}
+	if len(tc.s.BindingsForQueue("q1")) != 0 {
+		t.Errorf("Bindings left after delete")
+	}
+	tc.restart()
+	if _, found := tc.vhost().queues["q1"]; found {
+		t.Errorf("Deleted queue came back after restart")
+	}
+}
+
 func TestNonMatchingQueue(t *testing.T) {
 	tc := newTestClient(t)
 	defer tc.cleanup()
@@ -170,3 +254,899 @@ func TestNonMatchingQueue(t *testing.T) {
 		t.Errorf("Wrong response code")
 	}
 }
+
+func TestDurableMessageOrderAfterRestart(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	ch.QueueDeclare("q1", true, false, false, false, NO_ARGS)
+	ch.QueueBind("q1", "abc", "amq.direct", false, NO_ARGS)
+	for i := 1; i <= 100; i++ {
+		ch.Publish("amq.direct", "abc", false, false, amqpclient.Publishing{
+			DeliveryMode: amqpclient.Persistent,
+			Body:         []byte(strconv.Itoa(i)),
+		})
+	}
+	tc.wait(ch)
+	if tc.vhost().queues["q1"].Len() != 100 {
+		t.Fatalf("Messages did not make it into queue")
+	}
+
+	tc.restart()
+	conn = tc.connect()
+	ch, _, _ = channelHelper(tc, conn)
+	if tc.vhost().queues["q1"].Len() != 100 {
+		t.Fatalf("Wrong number of messages after restart: %d", tc.vhost().queues["q1"].Len())
+	}
+	deliveries, err := ch.Consume("q1", util.RandomId(), true, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume")
+	}
+	for i := 1; i <= 100; i++ {
+		msg := <-deliveries
+		if string(msg.Body) != strconv.Itoa(i) {
+			t.Fatalf("Message out of order. Expected %d, got %s", i, msg.Body)
+		}
+	}
+}
+
+func TestQueueStats(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	ch.QueueDeclare("stats-q", false, false, false, false, NO_ARGS)
+	ch.QueueBind("stats-q", "abc", "amq.direct", false, NO_ARGS)
+	var ready = metrics.Get("Queue.stats-q.MessagesReady").(metrics.Gauge)
+	if ready.Value() != 0 {
+		t.Fatalf("Ready gauge should start at 0")
+	}
+	ch.Publish("amq.direct", "abc", false, false, TEST_TRANSIENT_MSG)
+	ch.Publish("amq.direct", "abc", false, false, TEST_TRANSIENT_MSG)
+	tc.wait(ch)
+	if ready.Value() != 2 {
+		t.Fatalf("Ready gauge did not increment. Got %d", ready.Value())
+	}
+	var publishIn = metrics.Get("Exchange.amq.direct.PublishIn").(metrics.Meter)
+	if publishIn.Count() < 2 {
+		t.Fatalf("Exchange publish meter did not increment")
+	}
+
+	deliveries, err := ch.Consume("stats-q", util.RandomId(), false, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume")
+	}
+	<-deliveries
+	msg := <-deliveries
+	tc.wait(ch)
+	var unacked = metrics.Get("Queue.stats-q.MessagesUnacked").(metrics.Gauge)
+	if ready.Value() != 0 || unacked.Value() != 2 {
+		t.Fatalf("Wrong ready/unacked counts: %d/%d", ready.Value(), unacked.Value())
+	}
+	msg.Ack(true)
+	tc.wait(ch)
+	if unacked.Value() != 0 {
+		t.Fatalf("Unacked gauge did not decrement. Got %d", unacked.Value())
+	}
+	if metrics.Get("Queue.stats-q.Ack").(metrics.Meter).Count() != 2 {
+		t.Fatalf("Ack meter did not count acks")
+	}
+
+	ch.QueueDelete("stats-q", false, false, false)
+	if metrics.Get("Queue.stats-q.MessagesReady") != nil {
+		t.Fatalf("Queue stats were not removed on delete")
+	}
+}
+
+func TestPassiveExists(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	ch.QueueBind("q1", "abc", "amq.direct", false, NO_ARGS)
+	ch.Publish("amq.direct", "abc", false, false, TEST_TRANSIENT_MSG)
+	ch.Consume("q1", util.RandomId(), false, false, false, false, NO_ARGS)
+	tc.wait(ch)
+
+	// The flags are ignored for a passive declare
+	resp, err := ch.QueueDeclarePassive("q1", true, true, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Passive declare of existing queue failed: %s", err.Error())
+	}
+	if resp.Name != "q1" || resp.Consumers != 1 {
+		t.Fatalf("Wrong passive declare-ok: %+v", resp)
+	}
+	if len(tc.vhost().queues) != 2 || tc.vhost().queues["q1"].Durable {
+		t.Fatalf("Passive declare changed the queue")
+	}
+}
+
+func TestDeclareOkCounts(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	ch.QueueBind("q1", "abc", "amq.direct", false, NO_ARGS)
+	ch.Publish("amq.direct", "abc", false, false, TEST_TRANSIENT_MSG)
+	ch.Publish("amq.direct", "abc", false, false, TEST_TRANSIENT_MSG)
+	ch.Publish("amq.direct", "abc", false, false, TEST_TRANSIENT_MSG)
+	tc.wait(ch)
+
+	resp, err := ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to redeclare queue: %s", err.Error())
+	}
+	if resp.Messages != 3 {
+		t.Fatalf("Wrong message count in declare-ok: %d", resp.Messages)
+	}
+	if resp.Consumers != 0 {
+		t.Fatalf("Wrong consumer count in declare-ok: %d", resp.Consumers)
+	}
+
+	ch2, _, _ := channelHelper(tc, conn)
+	ch2.Qos(1, 0, false)
+	deliveries, err := ch2.Consume("q1", util.RandomId(), false, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume")
+	}
+	<-deliveries
+	resp, err = ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to redeclare queue: %s", err.Error())
+	}
+	if resp.Messages != 2 || resp.Consumers != 1 {
+		t.Fatalf("Wrong counts in declare-ok: %d messages, %d consumers", resp.Messages, resp.Consumers)
+	}
+}
+
+func TestQueueJSON(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	ch.QueueDeclare("q1", true, false, false, false, NO_ARGS)
+	ch.QueueBind("q1", "abc", "amq.direct", false, NO_ARGS)
+	ch.Qos(1, 0, false)
+	for i := 0; i < 3; i++ {
+		ch.Publish("amq.direct", "abc", false, false, TEST_TRANSIENT_MSG)
+	}
+	deliveries, err := ch.Consume("q1", "TestQueueJSON-1", false, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume")
+	}
+	<-deliveries
+	tc.wait(ch)
+
+	bytes, err := json.Marshal(tc.vhost().queues["q1"])
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var fields map[string]interface{}
+	if err = json.Unmarshal(bytes, &fields); err != nil {
+		t.Fatalf(err.Error())
+	}
+	var expected = map[string]interface{}{
+		"messagesReady":   float64(2),
+		"messagesUnacked": float64(1),
+		"consumerCount":   float64(1),
+		"durable":         true,
+		"exclusive":       false,
+		"autoDelete":      false,
+	}
+	for key, value := range expected {
+		if fields[key] != value {
+			t.Errorf("Wrong value for %s: %v", key, fields[key])
+		}
+	}
+	if _, found := fields["arguments"]; !found {
+		t.Errorf("Missing arguments")
+	}
+}
+
+func TestLazyQueue(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	var args = amqpclient.Table{"x-queue-mode": "lazy"}
+	ch.QueueDeclare("lazy", false, false, false, false, args)
+	ch.QueueBind("lazy", "lazy", "amq.direct", false, NO_ARGS)
+
+	var count = 100
+	var body = make([]byte, 32*1024)
+	for i := 0; i < count; i++ {
+		body[0] = byte(i)
+		ch.Publish("amq.direct", "lazy", false, false, amqpclient.Publishing{Body: body})
+	}
+	tc.wait(ch)
+
+	// The bodies are on disk, not in memory
+	var store = tc.vhost().msgStore
+	if store.MessageCount() != 0 {
+		t.Errorf("Lazy queue kept %d bodies in memory", store.MessageCount())
+	}
+	if store.PagedCount() != count {
+		t.Fatalf("Wrong number of paged messages: %d", store.PagedCount())
+	}
+
+	// They are loaded back on delivery
+	deliveries, err := ch.Consume("lazy", "", false, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf("Failed to consume: %s", err.Error())
+	}
+	for i := 0; i < count; i++ {
+		var d = <-deliveries
+		if len(d.Body) != len(body) || d.Body[0] != byte(i) {
+			t.Fatalf("Wrong body for message %d", i)
+		}
+		d.Ack(false)
+	}
+	tc.wait(ch)
+	if store.PagedCount() != 0 {
+		t.Errorf("Acked messages are still paged: %d", store.PagedCount())
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	var args = amqpclient.Table{"x-dedup-window": int32(2)}
+	ch.QueueDeclare("dedup", false, false, false, false, args)
+	ch.QueueBind("dedup", "dedup", "amq.direct", false, NO_ARGS)
+	ch.QueueDeclare("plain", false, false, false, false, NO_ARGS)
+	ch.QueueBind("plain", "dedup", "amq.direct", false, NO_ARGS)
+
+	var publish = func(id string) {
+		ch.Publish("amq.direct", "dedup", false, false, amqpclient.Publishing{
+			MessageId: id,
+			Body:      []byte("dispatchd"),
+		})
+	}
+	publish("a")
+	publish("a")
+	tc.wait(ch)
+	if tc.vhost().queues["dedup"].Len() != 1 {
+		t.Fatalf("Duplicate message was enqueued")
+	}
+	// Only queues with a window drop duplicates
+	if tc.vhost().queues["plain"].Len() != 2 {
+		t.Fatalf("Queue without a dedup window dropped a message")
+	}
+
+	// Once enough newer ids have been seen an id is forgotten
+	publish("b")
+	publish("c")
+	publish("a")
+	// Messages without an id are never dropped
+	publish("")
+	publish("")
+	tc.wait(ch)
+	if tc.vhost().queues["dedup"].Len() != 6 {
+		t.Fatalf("Wrong queue length: %d", tc.vhost().queues["dedup"].Len())
+	}
+}
+
+func TestDedupRetry(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, errChan := channelHelper(tc, conn)
+	var clock = util.NewFakeClock(time.Unix(1700000000, 0))
+	tc.s.SetClock(clock)
+
+	ch.QueueDeclare("dedup", false, false, false, false, amqpclient.Table{
+		"x-dedup-window": int32(10),
+		"x-dedup-ttl":    int32(1000),
+		"x-max-length":   int32(1),
+		"x-overflow":     "reject-publish",
+	})
+	var publish = func(ch *amqpclient.Channel, id string) {
+		ch.Publish("", "dedup", false, false, amqpclient.Publishing{
+			MessageId: id,
+			Body:      []byte("dispatchd"),
+		})
+	}
+	var length = func() uint32 {
+		return tc.vhost().queues["dedup"].Len()
+	}
+
+	// A publish the full queue refused can be retried
+	publish(ch, "a")
+	publish(ch, "b")
+	if resp := <-errChan; resp.Code != 406 {
+		t.Fatalf("Wrong response code: %d", resp.Code)
+	}
+	ch, _, _ = channelHelper(tc, conn)
+	ch.QueuePurge("dedup", false)
+	publish(ch, "b")
+	tc.wait(ch)
+	if length() != 1 {
+		t.Fatalf("Retry of a refused publish was dropped")
+	}
+
+	// Ids are forgotten after the ttl
+	ch.QueuePurge("dedup", false)
+	publish(ch, "b")
+	tc.wait(ch)
+	if length() != 0 {
+		t.Fatalf("Duplicate message was enqueued")
+	}
+	clock.Advance(time.Second)
+	publish(ch, "b")
+	tc.wait(ch)
+	if length() != 1 {
+		t.Fatalf("Id was remembered past the ttl")
+	}
+
+	// Rolled back publishes don't count, and a transaction only enqueues
+	// an id once
+	ch.QueuePurge("dedup", false)
+	ch.Tx()
+	publish(ch, "c")
+	ch.TxRollback()
+	publish(ch, "c")
+	publish(ch, "c")
+	ch.TxCommit()
+	tc.wait(ch)
+	if length() != 1 {
+		t.Fatalf("Wrong queue length after the commit: %d", length())
+	}
+}
+
+func TestQueueActivityTimestamps(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	var clock = util.NewFakeClock(time.Unix(1700000000, 0))
+	tc.s.SetClock(clock)
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	tc.wait(ch)
+	var q = tc.vhost().queues["q1"]
+	if !q.LastPublish().IsZero() || !q.LastDeliver().IsZero() || !q.LastAck().IsZero() {
+		t.Fatalf("New queue has activity timestamps")
+	}
+	var firstPublish = clock.Now()
+	ch.Publish("", "q1", false, false, TEST_TRANSIENT_MSG)
+	tc.wait(ch)
+	if !q.LastPublish().Equal(firstPublish) {
+		t.Fatalf("Last publish not set: %v", q.LastPublish())
+	}
+	clock.Advance(time.Second)
+	ch.Publish("", "q1", false, false, TEST_TRANSIENT_MSG)
+	tc.wait(ch)
+	if !q.LastPublish().Equal(firstPublish.Add(time.Second)) {
+		t.Errorf("Last publish didn't advance: %v, then %v", firstPublish, q.LastPublish())
+	}
+
+	clock.Advance(time.Second)
+	var delivered = clock.Now()
+	deliveries, err := ch.Consume("q1", "c1", false, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	msg := <-deliveries
+	<-deliveries
+	tc.wait(ch)
+	clock.Advance(time.Second)
+	msg.Ack(false)
+	tc.wait(ch)
+	if !q.LastDeliver().Equal(delivered) || !q.LastAck().Equal(delivered.Add(time.Second)) {
+		t.Errorf("Bad deliver/ack timestamps: %v, %v", q.LastDeliver(), q.LastAck())
+	}
+
+	var fields map[string]interface{}
+	bytes, _ := json.Marshal(q)
+	json.Unmarshal(bytes, &fields)
+	for _, key := range []string{"lastPublish", "lastDeliver", "lastAck"} {
+		if fields[key] == nil {
+			t.Errorf("Missing '%s' in queue JSON", key)
+		}
+	}
+}
+
+func TestMaxLengthRejectPublish(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, errChan := channelHelper(tc, conn)
+
+	ch.QueueDeclare("q1", false, false, false, false, amqpclient.Table{
+		"x-max-length": int32(2),
+		"x-overflow":   "reject-publish",
+	})
+	ch.QueueDeclare("q2", false, false, false, false, NO_ARGS)
+	ch.QueueBind("q1", "", "amq.fanout", false, NO_ARGS)
+	ch.QueueBind("q2", "", "amq.fanout", false, NO_ARGS)
+	ch.Publish("amq.fanout", "", false, false, TEST_TRANSIENT_MSG)
+	ch.Publish("amq.fanout", "", false, false, TEST_TRANSIENT_MSG)
+	tc.wait(ch)
+	if tc.vhost().queues["q1"].Len() != 2 {
+		t.Fatalf("Publishes below the max length were not routed")
+	}
+
+	ch.Publish("amq.fanout", "", false, false, TEST_TRANSIENT_MSG)
+	resp := <-errChan
+	if resp.Code != 406 {
+		t.Errorf("Wrong response code: %d", resp.Code)
+	}
+	if tc.vhost().queues["q1"].Len() != 2 || tc.vhost().queues["q2"].Len() != 2 {
+		t.Errorf("Publish to a full queue was routed")
+	}
+}
+
+func TestMaxLengthDropHead(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	ch.QueueDeclare("q1", false, false, false, false, amqpclient.Table{"x-max-length": int32(2)})
+	for i := 0; i < 3; i++ {
+		ch.Publish("", "q1", false, false, amqpclient.Publishing{Body: []byte(strconv.Itoa(i))})
+	}
+	tc.wait(ch)
+	if tc.vhost().queues["q1"].Len() != 2 {
+		t.Fatalf("Wrong queue length: %d", tc.vhost().queues["q1"].Len())
+	}
+	for _, expected := range []string{"1", "2"} {
+		msg, _, _ := ch.Get("q1", true)
+		if string(msg.Body) != expected {
+			t.Errorf("Expected message %s, got %s", expected, msg.Body)
+		}
+	}
+	if tc.vhost().msgStore.MessageCount() != 0 {
+		t.Errorf("Dropped message was left in the message store")
+	}
+}
+
+func TestNoWait(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.rawConnect()
+	defer conn.Close()
+	rawOpenChannel(t, conn)
+
+	// Methods are handled in order, so an ok sent for any no-wait method
+	// would arrive before the one for basic.qos
+	var probe = func() {
+		rawSendMethod(conn, 1, &amqp.BasicQos{})
+		var method = rawReadMethod(t, conn)
+		if _, ok := method.(*amqp.BasicQosOk); !ok {
+			t.Fatalf("Got %s for a no-wait method", method.MethodName())
+		}
+	}
+	for _, method := range []amqp.MethodFrame{
+		&amqp.ExchangeDeclare{Exchange: "ex1", Type: "direct", NoWait: true, Arguments: amqp.NewTable()},
+		&amqp.ExchangeDeclare{Exchange: "ex2", Type: "fanout", NoWait: true, Arguments: amqp.NewTable()},
+		&amqp.ExchangeBind{Destination: "ex2", Source: "ex1", RoutingKey: "rk", NoWait: true, Arguments: amqp.NewTable()},
+		&amqp.QueueDeclare{Queue: "q1", NoWait: true, Arguments: amqp.NewTable()},
+		&amqp.QueueBind{Queue: "q1", Exchange: "ex2", NoWait: true, Arguments: amqp.NewTable()},
+		&amqp.BasicConsume{Queue: "q1", ConsumerTag: "c1", NoWait: true, Arguments: amqp.NewTable()},
+	} {
+		rawSendMethod(conn, 1, method)
+	}
+	probe()
+	var vhost = tc.vhost()
+	if _, found := vhost.exchanges["ex2"]; !found {
+		t.Fatalf("No-wait exchange.declare did nothing")
+	}
+	if len(vhost.exchanges["ex1"].Bindings()) != 1 || len(vhost.exchanges["ex2"].BindingsForQueue("q1")) != 1 {
+		t.Fatalf("No-wait bind did nothing")
+	}
+	if vhost.queues["q1"].ActiveConsumerCount() != 1 {
+		t.Fatalf("No-wait basic.consume did nothing")
+	}
+
+	for _, method := range []amqp.MethodFrame{
+		&amqp.BasicCancel{ConsumerTag: "c1", NoWait: true},
+		&amqp.ExchangeUnbind{Destination: "ex2", Source: "ex1", RoutingKey: "rk", NoWait: true, Arguments: amqp.NewTable()},
+		&amqp.QueuePurge{Queue: "q1", NoWait: true},
+		&amqp.QueueDelete{Queue: "q1", NoWait: true},
+		&amqp.ExchangeDelete{Exchange: "ex1", NoWait: true},
+	} {
+		rawSendMethod(conn, 1, method)
+	}
+	probe()
+	if _, found := vhost.queues["q1"]; found {
+		t.Fatalf("No-wait queue.delete did nothing")
+	}
+	if _, found := vhost.exchanges["ex1"]; found {
+		t.Fatalf("No-wait exchange.delete did nothing")
+	}
+
+	// Failures are still reported
+	rawSendMethod(conn, 1, &amqp.QueueBind{Queue: "missing", Exchange: "ex2", NoWait: true, Arguments: amqp.NewTable()})
+	chClose, ok := rawReadMethod(t, conn).(*amqp.ChannelClose)
+	if !ok || chClose.ReplyCode != 404 {
+		t.Fatalf("Expected channel.close with 404 for a failed no-wait bind")
+	}
+}
+
+func TestQueueExpires(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	var exists = func(name string) bool {
+		var vhost = tc.vhost()
+		vhost.lock.Lock()
+		defer vhost.lock.Unlock()
+		var _, found = vhost.queues[name]
+		return found
+	}
+	var waitGone = func(name string) {
+		var start = time.Now()
+		for exists(name) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("Queue %s never expired", name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	var args = amqpclient.Table{"x-expires": int32(300)}
+
+	// Unused, the queue goes after the expiry
+	ch.QueueDeclare("q1", false, false, false, false, args)
+	waitGone("q1")
+
+	// Each use restarts the countdown
+	ch.QueueDeclare("q2", false, false, false, false, args)
+	for i := 0; i < 3; i++ {
+		time.Sleep(200 * time.Millisecond)
+		ch.Get("q2", true)
+	}
+	for i := 0; i < 3; i++ {
+		time.Sleep(200 * time.Millisecond)
+		ch.QueueDeclarePassive("q2", false, false, false, false, NO_ARGS)
+	}
+	if !exists("q2") {
+		t.Fatalf("Queue expired while in use")
+	}
+	waitGone("q2")
+
+	// Consumers keep the queue, and the countdown starts when they go
+	ch.QueueDeclare("q3", false, false, false, false, args)
+	ch.Consume("q3", "c1", true, false, false, false, NO_ARGS)
+	time.Sleep(500 * time.Millisecond)
+	if !exists("q3") {
+		t.Fatalf("Queue with a consumer expired")
+	}
+	ch.Cancel("c1", false)
+	waitGone("q3")
+
+	// Queues without the argument stay
+	ch.QueueDeclare("q4", false, false, false, false, NO_ARGS)
+	time.Sleep(400 * time.Millisecond)
+	if !exists("q4") {
+		t.Errorf("Queue without x-expires was deleted")
+	}
+}
+
+func TestMaxInMemoryLength(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	tc.s.SetMaxInMemoryLength(10)
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	ch.QueueDeclare("default", false, false, false, false, NO_ARGS)
+	ch.QueueBind("default", "default", "amq.direct", false, NO_ARGS)
+	var args = amqpclient.Table{"x-max-in-memory-length": int32(5)}
+	ch.QueueDeclare("override", false, false, false, false, args)
+	ch.QueueBind("override", "override", "amq.direct", false, NO_ARGS)
+
+	var count = 30
+	for _, key := range []string{"default", "override"} {
+		for i := 0; i < count; i++ {
+			ch.Publish("amq.direct", key, false, false, amqpclient.Publishing{Body: []byte{byte(i)}})
+		}
+	}
+	tc.wait(ch)
+
+	// The head of each queue stays in memory and the rest is paged out
+	var store = tc.vhost().msgStore
+	if store.MessageCount() != 10+5 {
+		t.Errorf("Wrong number of bodies in memory: %d", store.MessageCount())
+	}
+	if store.PagedCount() != 2*count-10-5 {
+		t.Fatalf("Wrong number of paged messages: %d", store.PagedCount())
+	}
+
+	for _, key := range []string{"default", "override"} {
+		deliveries, err := ch.Consume(key, "", false, false, false, false, NO_ARGS)
+		if err != nil {
+			t.Fatalf("Failed to consume: %s", err.Error())
+		}
+		for i := 0; i < count; i++ {
+			var d = <-deliveries
+			if len(d.Body) != 1 || d.Body[0] != byte(i) {
+				t.Fatalf("Message %d from %s out of order", i, key)
+			}
+			d.Ack(false)
+		}
+	}
+	tc.wait(ch)
+	if store.PagedCount() != 0 {
+		t.Errorf("Acked messages are still paged: %d", store.PagedCount())
+	}
+}
+
+func TestQueueType(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+
+	var args = amqpclient.Table{"x-queue-type": "classic"}
+	if _, err := ch.QueueDeclare("classic", false, false, false, false, args); err != nil {
+		t.Fatalf("Failed to declare classic queue: %s", err.Error())
+	}
+	ch.QueueDeclare("untyped", false, false, false, false, NO_ARGS)
+	for _, name := range []string{"classic", "untyped"} {
+		var b, err = json.Marshal(tc.vhost().queues[name])
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if !strings.Contains(string(b), `"type":"classic"`) {
+			t.Errorf("Queue JSON doesn't give the type: %s", b)
+		}
+	}
+
+	badCh, err := conn.Channel()
+	if err != nil {
+		t.Fatalf("Failed to open channel")
+	}
+	_, err = badCh.QueueDeclare("unknown", false, false, false, false, amqpclient.Table{"x-queue-type": "foo"})
+	if amqpErr, ok := err.(*amqpclient.Error); !ok || amqpErr.Code != 406 {
+		t.Errorf("Expected 406 for an unknown queue type, got %v", err)
+	}
+
+	// Quorum queues don't silently become classic ones
+	conn2 := tc.connect()
+	ch2, err := conn2.Channel()
+	if err != nil {
+		t.Fatalf("Failed to open channel")
+	}
+	_, err = ch2.QueueDeclare("quorum", true, false, false, false, amqpclient.Table{"x-queue-type": "quorum"})
+	if amqpErr, ok := err.(*amqpclient.Error); !ok || amqpErr.Code != 540 {
+		t.Errorf("Expected 540 for a quorum queue, got %v", err)
+	}
+	if _, found := tc.vhost().queues["quorum"]; found {
+		t.Errorf("Quorum queue was created")
+	}
+}
+
+func TestReadyBytes(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	var q = tc.vhost().queues["q1"]
+	var expectBytes = func(step string, expected uint64) {
+		tc.wait(ch)
+		if q.ReadyBytes() != expected {
+			t.Fatalf("%s: expected %d ready bytes, got %d", step, expected, q.ReadyBytes())
+		}
+	}
+
+	var total uint64 = 0
+	for _, size := range []int{10, 200, 0, 3000, 70000} {
+		var body = bytes.Repeat([]byte("a"), size)
+		ch.Publish("", "q1", false, false, amqpclient.Publishing{Body: body})
+		total += uint64(size)
+		expectBytes(fmt.Sprintf("publish %d", size), total)
+	}
+
+	if _, ok, err := ch.Get("q1", true); err != nil || !ok {
+		t.Fatalf("Failed to get message: %v", err)
+	}
+	total -= 10
+	expectBytes("get", total)
+
+	// Unacked messages don't count, until they are requeued
+	ch.Qos(1, 0, false)
+	deliveries, err := ch.Consume("q1", "c1", false, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var msg = <-deliveries
+	ch.Cancel("c1", false)
+	expectBytes("deliver", total-200)
+	msg.Nack(false, true)
+	expectBytes("requeue", total)
+
+	for _, size := range []uint64{200, 0, 3000, 70000} {
+		if _, ok, err := ch.Get("q1", true); err != nil || !ok {
+			t.Fatalf("Failed to get message: %v", err)
+		}
+		total -= size
+		expectBytes(fmt.Sprintf("get %d", size), total)
+	}
+
+	ch.Publish("", "q1", false, false, amqpclient.Publishing{Body: []byte("gone")})
+	expectBytes("publish after get", 4)
+	ch.QueuePurge("q1", false)
+	expectBytes("purge", 0)
+}
+
+func TestQueueDump(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+	ch.QueueDeclare("q1", false, false, false, false, NO_ARGS)
+	var long = bytes.Repeat([]byte("x"), 1000)
+	ch.Publish("", "q1", false, false, amqpclient.Publishing{
+		ContentType: "text/plain",
+		Headers:     amqpclient.Table{"tenant": "a"},
+		Body:        []byte("first"),
+	})
+	ch.Publish("", "q1", false, false, amqpclient.Publishing{Body: long})
+	ch.Publish("", "q1", false, false, amqpclient.Publishing{Body: []byte("third")})
+	tc.wait(ch)
+	var api = httptest.NewServer(tc.s.QueueHandler())
+	defer api.Close()
+
+	var dump = func(query string) (int, []map[string]interface{}) {
+		resp, err := http.Get(api.URL + "/api/queues/" + query)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return resp.StatusCode, nil
+		}
+		var messages []map[string]interface{}
+		if err = json.NewDecoder(resp.Body).Decode(&messages); err != nil {
+			t.Fatalf(err.Error())
+		}
+		return resp.StatusCode, messages
+	}
+
+	_, messages := dump("q1/dump?limit=2")
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(messages))
+	}
+	var props = messages[0]["properties"].(map[string]interface{})
+	var headers = messages[0]["headers"].(map[string]interface{})
+	if messages[0]["body_preview"] != "first" || props["content_type"] != "text/plain" || headers["tenant"] != "a" {
+		t.Errorf("Wrong first message: %v", messages[0])
+	}
+	if messages[0]["routing_key"] != "q1" || messages[0]["truncated"] != false {
+		t.Errorf("Wrong first message: %v", messages[0])
+	}
+	var preview = messages[1]["body_preview"].(string)
+	if len(preview) != dumpPreviewBytes || messages[1]["truncated"] != true || messages[1]["body_size"] != float64(1000) {
+		t.Errorf("Long body wasn't truncated: %v", messages[1])
+	}
+
+	// Dumping leaves the messages where they are
+	_, messages = dump("q1/dump")
+	if len(messages) != 3 || messages[2]["body_preview"] != "third" {
+		t.Errorf("Wrong default dump: %v", messages)
+	}
+	if tc.vhost().queues["q1"].Len() != 3 {
+		t.Errorf("Dump changed the queue depth to %d", tc.vhost().queues["q1"].Len())
+	}
+	msg, ok, err := ch.Get("q1", true)
+	if err != nil || !ok || string(msg.Body) != "first" {
+		t.Errorf("Dumped message wasn't left at the front of the queue")
+	}
+
+	if code, _ := dump("missing/dump"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing queue, got %d", code)
+	}
+	if code, _ := dump("q1/dump?limit=x"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad limit, got %d", code)
+	}
+}
+
+func TestDeliveryLimit(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+	ch.ExchangeDeclare("dlx", "fanout", false, false, false, false, NO_ARGS)
+	ch.QueueDeclare("dead", false, false, false, false, NO_ARGS)
+	ch.QueueBind("dead", "", "dlx", false, NO_ARGS)
+	ch.QueueDeclare("q1", false, false, false, false, amqpclient.Table{
+		"x-delivery-limit":       int32(2),
+		"x-dead-letter-exchange": "dlx",
+	})
+	// Without a dead letter exchange the message is dropped
+	ch.QueueDeclare("q2", false, false, false, false, amqpclient.Table{
+		"x-delivery-limit": int32(0),
+	})
+	ch.Publish("", "q1", false, false, amqpclient.Publishing{Body: []byte("poison")})
+	ch.Publish("", "q2", false, false, amqpclient.Publishing{Body: []byte("dropped")})
+	ch.Qos(1, 0, false)
+
+	deliveries, err := ch.Consume("q1", "c1", false, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	// Requeued twice, then dead lettered the third time
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-deliveries:
+			if msg.Redelivered != (i > 0) {
+				t.Errorf("Delivery %d has redelivered %v", i, msg.Redelivered)
+			}
+			msg.Nack(false, true)
+		case <-time.After(time.Second):
+			t.Fatalf("Message wasn't redelivered after %d nacks", i)
+		}
+	}
+	select {
+	case <-deliveries:
+		t.Fatalf("Message was delivered past the delivery limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	tc.wait(ch)
+	if tc.vhost().queues["q1"].Len() != 0 {
+		t.Errorf("Message is still in the queue")
+	}
+	msg, ok, err := ch.Get("dead", true)
+	if err != nil || !ok {
+		t.Fatalf("Message wasn't dead lettered: %v", err)
+	}
+	if string(msg.Body) != "poison" || msg.RoutingKey != "q1" {
+		t.Errorf("Wrong dead lettered message: %s with key %s", msg.Body, msg.RoutingKey)
+	}
+	if msg.Headers["x-first-death-reason"] != "delivery_limit" || msg.Headers["x-first-death-queue"] != "q1" {
+		t.Errorf("Wrong dead letter headers: %v", msg.Headers)
+	}
+
+	ch.Cancel("c1", false)
+	deliveries, err = ch.Consume("q2", "c2", false, false, false, false, NO_ARGS)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	(<-deliveries).Nack(false, true)
+	tc.wait(ch)
+	if tc.vhost().queues["q2"].Len() != 0 || tc.vhost().queues["dead"].Len() != 0 {
+		t.Errorf("Message without a dead letter exchange wasn't dropped")
+	}
+}
+
+func TestForceDurable(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.cleanup()
+	conn := tc.connect()
+	ch, _, _ := channelHelper(tc, conn)
+	ch.QueueDeclare("forced", true, false, false, false, amqpclient.Table{"x-force-durable": true})
+	ch.QueueDeclare("plain", true, false, false, false, NO_ARGS)
+	ch.Publish("", "forced", false, false, amqpclient.Publishing{Body: []byte("kept")})
+	ch.Publish("", "plain", false, false, amqpclient.Publishing{Body: []byte("lost")})
+	tc.wait(ch)
+
+	tc.restart()
+	conn = tc.connect()
+	ch, _, _ = channelHelper(tc, conn)
+	if tc.vhost().queues["plain"].Len() != 0 {
+		t.Errorf("Transient message survived the restart of a queue without x-force-durable")
+	}
+	msg, ok, err := ch.Get("forced", true)
+	if err != nil || !ok {
+		t.Fatalf("Transient message didn't survive the restart: %v", err)
+	}
+	if string(msg.Body) != "kept" || msg.DeliveryMode != amqpclient.Persistent {
+		t.Errorf("Wrong message after restart: %s with delivery mode %d", msg.Body, msg.DeliveryMode)
+	}
+}
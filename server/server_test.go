@@ -1,12 +1,15 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"net"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/karelbilek/amqp-test-server/amqp"
 	"github.com/karelbilek/amqp-test-server/util"
 	amqpclient "github.com/streadway/amqp"
 )
@@ -27,7 +30,6 @@ func newTestClient(t *testing.T) *testClient {
 	serverDb := dbPath()
 	msgDb := dbPath()
 	s := NewServer(context.Background(), serverDb, msgDb, nil, false)
-	s.init(context.Background())
 	tc := &testClient{
 		t:        t,
 		s:        s,
@@ -57,12 +59,20 @@ func channelHelper(
 }
 
 func (tc *testClient) connect() *amqpclient.Connection {
+	client, err := tc.dial("/")
+	if err != nil {
+		panic(err.Error())
+	}
+	return client
+}
+
+func (tc *testClient) dial(vhost string) (*amqpclient.Connection, error) {
 	internal, external := net.Pipe()
 	go tc.s.OpenConnection(internal)
 	// Set up connection
 	clientconfig := amqpclient.Config{
 		SASL:            nil,
-		Vhost:           "/",
+		Vhost:           vhost,
 		ChannelMax:      100000,
 		FrameSize:       100000,
 		Heartbeat:       time.Duration(0),
@@ -73,11 +83,20 @@ func (tc *testClient) connect() *amqpclient.Connection {
 		},
 	}
 
-	client, err := amqpclient.DialConfig("amqp://localhost:1234", clientconfig)
-	if err != nil {
+	return amqpclient.DialConfig("amqp://localhost:1234", clientconfig)
+}
+
+// restart closes the server and boots a new one from the same database
+// files
+func (tc *testClient) restart() {
+	if err := tc.s.Close(); err != nil {
 		panic(err.Error())
 	}
-	return client
+	tc.s = NewServer(context.Background(), tc.serverDb, tc.msgDb, nil, false)
+}
+
+func (tc *testClient) vhost() *VirtualHost {
+	return tc.s.vhosts[DefaultVirtualHost]
 }
 
 func (tc *testClient) wait(ch *amqpclient.Channel) {
@@ -87,6 +106,19 @@ func (tc *testClient) wait(ch *amqpclient.Channel) {
 func (tc *testClient) cleanup() {
 	os.Remove(tc.msgDb)
 	os.Remove(tc.serverDb)
+	// Files of any extra virtual hosts
+	extra, _ := filepath.Glob(tc.serverDb + ".*")
+	for _, path := range extra {
+		os.Remove(path)
+	}
+	// Memory servers have no message database
+	if tc.msgDb == "" {
+		return
+	}
+	extra, _ = filepath.Glob(tc.msgDb + ".*")
+	for _, path := range extra {
+		os.Remove(path)
+	}
 	// tc.client.Close()
 }
 
@@ -100,3 +132,112 @@ func (tc *testClient) connFromServer() *AMQPConnection {
 	}
 	panic("no connections!")
 }
+
+// rawConnect opens a connection to the server without going through the
+// client library and sends the protocol header. It is used by tests which
+// need to see or produce frames the client library hides.
+func (tc *testClient) rawConnect() net.Conn {
+	internal, external := net.Pipe()
+	go tc.s.OpenConnection(internal)
+	if err := amqp.WriteProtocolHeader(external); err != nil {
+		panic(err.Error())
+	}
+	return external
+}
+
+func rawSendMethod(conn net.Conn, channel uint16, method amqp.MethodFrame) {
+	var buf = bytes.NewBuffer([]byte{})
+	method.Write(buf)
+	amqp.WriteFrame(conn, &amqp.WireFrame{
+		FrameType: uint8(amqp.FrameMethod),
+		Channel:   channel,
+		Payload:   buf.Bytes(),
+	})
+}
+
+// rawReadMethod reads frames until it finds a method frame, skipping
+// heartbeats
+func rawReadMethod(t *testing.T, conn net.Conn) amqp.MethodFrame {
+	for {
+		frame, err := amqp.ReadFrame(conn)
+		if err != nil {
+			t.Fatalf("Error reading frame: %s", err.Error())
+		}
+		if frame.FrameType == uint8(amqp.FrameHeartbeat) {
+			continue
+		}
+		if frame.FrameType != uint8(amqp.FrameMethod) {
+			t.Fatalf("Expected method frame, got frame type %d", frame.FrameType)
+		}
+		method, err := amqp.ReadMethod(bytes.NewReader(frame.Payload), false)
+		if err != nil {
+			t.Fatalf("Error reading method: %s", err.Error())
+		}
+		return method
+	}
+}
+
+// rawHandshake does connection.start/start-ok and connection.tune/tune-ok
+// with the given tune-ok and returns the server's tune method
+func rawHandshake(t *testing.T, conn net.Conn, tuneOk *amqp.ConnectionTuneOk) *amqp.ConnectionTune {
+	if _, ok := rawReadMethod(t, conn).(*amqp.ConnectionStart); !ok {
+		t.Fatalf("Expected connection.start")
+	}
+	rawSendMethod(conn, 0, &amqp.ConnectionStartOk{
+		ClientProperties: amqp.NewTable(),
+		Mechanism:        "PLAIN",
+		Response:         []byte("\x00guest\x00guest"),
+		Locale:           "en_US",
+	})
+	tune, ok := rawReadMethod(t, conn).(*amqp.ConnectionTune)
+	if !ok {
+		t.Fatalf("Expected connection.tune")
+	}
+	rawSendMethod(conn, 0, tuneOk)
+	return tune
+}
+
+// rawOpenChannel does the full handshake, opens the connection and then
+// opens channel 1
+func rawOpenChannel(t *testing.T, conn net.Conn) {
+	rawHandshake(t, conn, &amqp.ConnectionTuneOk{ChannelMax: 100, FrameMax: 65536})
+	rawSendMethod(conn, 0, &amqp.ConnectionOpen{VirtualHost: "/"})
+	if _, ok := rawReadMethod(t, conn).(*amqp.ConnectionOpenOk); !ok {
+		t.Fatalf("Expected connection.open-ok")
+	}
+	rawSendMethod(conn, 1, &amqp.ChannelOpen{})
+	if _, ok := rawReadMethod(t, conn).(*amqp.ChannelOpenOk); !ok {
+		t.Fatalf("Expected channel.open-ok")
+	}
+}
+
+func rawSendHeader(conn net.Conn, channel uint16, bodySize uint64) {
+	rawSendHeaderProps(conn, channel, bodySize, &amqp.BasicContentHeaderProperties{})
+}
+
+func rawSendHeaderProps(conn net.Conn, channel uint16, bodySize uint64, props *amqp.BasicContentHeaderProperties) {
+	var propBuf = bytes.NewBuffer([]byte{})
+	flags, err := props.WriteProps(propBuf, false)
+	if err != nil {
+		panic(err.Error())
+	}
+	var buf = bytes.NewBuffer([]byte{})
+	amqp.WriteShort(buf, amqp.ClassIdBasic)
+	amqp.WriteShort(buf, 0)
+	amqp.WriteLonglong(buf, bodySize)
+	amqp.WriteShort(buf, flags)
+	buf.Write(propBuf.Bytes())
+	amqp.WriteFrame(conn, &amqp.WireFrame{
+		FrameType: uint8(amqp.FrameHeader),
+		Channel:   channel,
+		Payload:   buf.Bytes(),
+	})
+}
+
+func rawSendBody(conn net.Conn, channel uint16, body []byte) {
+	amqp.WriteFrame(conn, &amqp.WireFrame{
+		FrameType: uint8(amqp.FrameBody),
+		Channel:   channel,
+		Payload:   body,
+	})
+}
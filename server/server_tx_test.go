@@ -21,12 +21,12 @@ func TestTxCommitPublish(t *testing.T) {
 	ch.Publish("amq.direct", "abc", false, false, TEST_TRANSIENT_MSG)
 	ch.Publish("amq.direct", "abc", false, false, TEST_TRANSIENT_MSG)
 	tc.wait(ch)
-	if tc.s.queues["q1"].Len() != 0 {
+	if tc.vhost().queues["q1"].Len() != 0 {
 		t.Fatalf("Tx failed to buffer messages")
 	}
 	ch.TxCommit()
 	tc.wait(ch)
-	if tc.s.queues["q1"].Len() != 3 {
+	if tc.vhost().queues["q1"].Len() != 3 {
 		t.Fatalf("All messages were not added to queue")
 	}
 }
@@ -49,7 +49,7 @@ func TestTxRollbackPublish(t *testing.T) {
 	ch.TxRollback()
 	ch.TxCommit()
 	tc.wait(ch)
-	if tc.s.queues["q1"].Len() != 0 {
+	if tc.vhost().queues["q1"].Len() != 0 {
 		t.Fatalf("Tx Rollback still put messages in queue")
 	}
 }
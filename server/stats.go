@@ -0,0 +1,121 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/karelbilek/amqp-test-server/msgstore"
+	"github.com/karelbilek/amqp-test-server/stats"
+	"github.com/karelbilek/amqp-test-server/util"
+)
+
+// Totals across every virtual host and connection, for tests and tools
+// which want numbers without going through the metrics registry
+type ServerStats struct {
+	Connections     int
+	Channels        int
+	VirtualHosts    int
+	Exchanges       int
+	Queues          int
+	Bindings        int
+	MessagesReady   uint64
+	MessagesUnacked uint64
+	// Body size of the ready messages
+	ReadyBytes uint64
+}
+
+// Stats takes a snapshot of the server's totals. The server lock and each
+// virtual host's lock are held while counting, so no connection, queue or
+// exchange comes or goes in the meantime. Message counts can still move
+// while they are summed.
+func (server *Server) Stats() ServerStats {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	var ret = ServerStats{
+		Connections:  len(server.conns),
+		VirtualHosts: len(server.vhosts),
+	}
+	for _, conn := range server.conns {
+		conn.lock.Lock()
+		for id := range conn.channels {
+			// Channel 0 is the connection's own
+			if id != 0 {
+				ret.Channels += 1
+			}
+		}
+		conn.lock.Unlock()
+	}
+	for _, vhost := range server.vhosts {
+		vhost.lock.Lock()
+		ret.Exchanges += len(vhost.exchanges)
+		ret.Queues += len(vhost.queues)
+		for _, exchange := range vhost.exchanges {
+			ret.Bindings += exchange.BindingCount()
+		}
+		for _, queue := range vhost.queues {
+			ret.MessagesReady += uint64(queue.Len())
+			ret.MessagesUnacked += uint64(queue.UnackedCount())
+			ret.ReadyBytes += queue.ReadyBytes()
+		}
+		vhost.lock.Unlock()
+	}
+	return ret
+}
+
+// StoreStats adds up the message store counts of every virtual host
+func (server *Server) StoreStats() msgstore.StoreStats {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	var ret = msgstore.StoreStats{}
+	for _, vhost := range server.vhosts {
+		var s = vhost.msgStore.Stats()
+		ret.LiveEntries += s.LiveEntries
+		ret.DeadEntries += s.DeadEntries
+		ret.LiveBytes += s.LiveBytes
+		ret.DeadBytes += s.DeadBytes
+	}
+	return ret
+}
+
+// CompactStores reclaims the dead messages of every virtual host's store
+func (server *Server) CompactStores() {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	for _, vhost := range server.vhosts {
+		vhost.msgStore.Compact()
+	}
+}
+
+// How long the store gauges share one StoreStats. Counting scans every
+// store's index and holds off its flushes, so a scrape reading all four
+// gauges should only do it once.
+const storeGaugeMaxAge = time.Second
+
+// The StoreStats the store gauges read from, taken again once it is older
+// than storeGaugeMaxAge
+type storeStatsSnapshot struct {
+	server *Server
+	clock  util.Clock
+	lock   sync.Mutex
+	taken  time.Time
+	stats  msgstore.StoreStats
+}
+
+func (snapshot *storeStatsSnapshot) get() msgstore.StoreStats {
+	snapshot.lock.Lock()
+	defer snapshot.lock.Unlock()
+	var now = snapshot.clock.Now()
+	if snapshot.taken.IsZero() || now.Sub(snapshot.taken) >= storeGaugeMaxAge {
+		snapshot.stats = snapshot.server.StoreStats()
+		snapshot.taken = now
+	}
+	return snapshot.stats
+}
+
+func (server *Server) registerStoreGauges() {
+	var snapshot = &storeStatsSnapshot{server: server, clock: util.RealClock}
+	stats.MakeGauge("msgstore.live-entries", func() int64 { return int64(snapshot.get().LiveEntries) })
+	stats.MakeGauge("msgstore.dead-entries", func() int64 { return int64(snapshot.get().DeadEntries) })
+	stats.MakeGauge("msgstore.live-bytes", func() int64 { return int64(snapshot.get().LiveBytes) })
+	stats.MakeGauge("msgstore.dead-bytes", func() int64 { return int64(snapshot.get().DeadBytes) })
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/karelbilek/amqp-test-server/amqp"
+	"github.com/karelbilek/amqp-test-server/exchange"
+)
+
+// The exchange the firehose publishes trace copies to. Copies of published
+// messages use the routing key publish.<exchange> and copies of delivered
+// messages deliver.<queue>.
+const TRACE_EXCHANGE = "amq.rabbitmq.trace"
+
+// Turn the firehose for a virtual host on or off. The trace exchange is
+// declared the first time tracing is enabled. Tracing is off by default.
+func (server *Server) SetTracing(vhostName string, enabled bool) error {
+	vhost, found := server.virtualHost(vhostName)
+	if !found {
+		return fmt.Errorf("Virtual host not found: '%s'", vhostName)
+	}
+	if enabled {
+		vhost.lock.Lock()
+		_, hasExchange := vhost.exchanges[TRACE_EXCHANGE]
+		vhost.lock.Unlock()
+		if !hasExchange {
+			var ex = exchange.NewExchange(
+				TRACE_EXCHANGE,
+				exchange.EX_TYPE_TOPIC,
+				false,
+				false,
+				true,
+				amqp.NewTable(),
+				true,
+				vhost.exchangeDeleter,
+			)
+			if err := vhost.addExchange(ex); err != nil {
+				return err
+			}
+		}
+	}
+	vhost.tracing.Store(enabled)
+	return nil
+}
+
+// Publish a copy of msg to the trace exchange if tracing is on. Messages
+// that went through the trace exchange are never traced themselves.
+func (vhost *VirtualHost) trace(key string, msg *amqp.Message) {
+	if !vhost.tracing.Load() || msg.Exchange == TRACE_EXCHANGE {
+		return
+	}
+	vhost.lock.Lock()
+	var traceExchange, found = vhost.exchanges[TRACE_EXCHANGE]
+	vhost.lock.Unlock()
+	if !found {
+		return
+	}
+	var traced = amqp.NewMessage(&amqp.BasicPublish{
+		Exchange:   TRACE_EXCHANGE,
+		RoutingKey: key,
+	}, -1)
+	traced.Header = traceHeader(msg)
+	traced.Payload = msg.Payload
+	vhost.publish(traceExchange, traced)
+}
+
+// Copy the content header of a traced message, adding where it was
+// originally published to alongside its own headers
+func traceHeader(msg *amqp.Message) *amqp.ContentHeaderFrame {
+	var header = *msg.Header
+	var props = amqp.BasicContentHeaderProperties{}
+	if header.Properties != nil {
+		props = *header.Properties
+	}
+	var headers = amqp.NewTable()
+	if props.Headers != nil {
+		headers.Table = append(headers.Table, props.Headers.Table...)
+	}
+	// Long strings, since most clients can't read short strings in tables
+	var routingKeys = amqp.NewFieldArray()
+	routingKeys.AppendFA([]byte(msg.Key))
+	headers.SetKey("exchange_name", []byte(msg.Exchange))
+	headers.SetKey("routing_keys", routingKeys)
+	props.Headers = headers
+	header.Properties = &props
+	header.PropertyFlags |= amqp.MaskHeaders
+	return &header
+}
+
+func (vhost *VirtualHost) tracePublish(ex *exchange.Exchange, msg *amqp.Message) {
+	vhost.trace("publish."+ex.Name, msg)
+}
+
+func (vhost *VirtualHost) traceDeliver(queueName string, msg *amqp.Message) {
+	vhost.trace("deliver."+queueName, msg)
+}
+
+// Publish a copy of a message delivered from queueName to the firehose
+func (channel *Channel) TraceDelivery(queueName string, msg *amqp.Message) {
+	channel.vhost.traceDeliver(queueName, msg)
+}
@@ -14,10 +14,14 @@ func (channel *Channel) txRoute(methodFrame amqp.MethodFrame) *amqp.AMQPError {
 		return channel.txRollback(method)
 	}
 	var classId, methodId = methodFrame.MethodIdentifier()
-	return amqp.NewHardError(540, "Unable to route method frame", classId, methodId)
+	return channel.notImplemented(classId, methodId)
 }
 
 func (channel *Channel) txSelect(method *amqp.TxSelect) *amqp.AMQPError {
+	if channel.confirmMode {
+		var classId, methodId = method.MethodIdentifier()
+		return amqp.NewSoftError(406, "Channel is in confirm mode", classId, methodId)
+	}
 	channel.startTxMode()
 	channel.SendMethod(&amqp.TxSelectOk{})
 	return nil
@@ -0,0 +1,701 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/karelbilek/amqp-test-server/amqp"
+	"github.com/karelbilek/amqp-test-server/binding"
+	"github.com/karelbilek/amqp-test-server/exchange"
+	"github.com/karelbilek/amqp-test-server/msgstore"
+	"github.com/karelbilek/amqp-test-server/persist"
+	"github.com/karelbilek/amqp-test-server/queue"
+	"github.com/karelbilek/amqp-test-server/util"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The virtual host every server has. Clients select it with "/" or, for
+// lenient clients, an empty name in connection.open.
+const DefaultVirtualHost = "/"
+
+// A system exchange declared in every virtual host
+type SystemExchange struct {
+	Name string
+	Type uint8
+}
+
+// The system exchanges each virtual host declares when it is created, besides
+// the default exchange "" which always exists. Tools which don't want them can
+// leave some out before the server is created.
+var SystemExchanges = []SystemExchange{
+	{"amq.direct", exchange.EX_TYPE_DIRECT},
+	{"amq.fanout", exchange.EX_TYPE_FANOUT},
+	{"amq.topic", exchange.EX_TYPE_TOPIC},
+	{"amq.match", exchange.EX_TYPE_HEADERS},
+}
+
+// A VirtualHost is an isolated set of exchanges, queues and bindings. Each
+// one keeps its own server database and message store.
+type VirtualHost struct {
+	name            string
+	exchanges       map[string]*exchange.Exchange
+	queues          map[string]*queue.Queue
+	db              *bolt.DB
+	lock            sync.Mutex
+	msgStore        *msgstore.MessageStore
+	exchangeDeleter chan *exchange.Exchange
+	queueDeleter    chan *queue.Queue
+	ctx             context.Context
+	// Whether published and delivered messages are copied to TRACE_EXCHANGE
+	tracing atomic.Bool
+	events  *eventBus
+	clock   util.Clock
+	// Default x-max-in-memory-length for the queues
+	maxInMemoryLength int64
+	// See vhostlimits.go
+	limits VirtualHostLimits
+	// Channels consuming direct replies by reply address, see directreply.go
+	directReplies map[string]directReplyConsumer
+}
+
+func (vhost *VirtualHost) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"exchanges":     vhost.exchanges,
+		"queues":        vhost.queues,
+		"msgCount":      vhost.msgStore.MessageCount(),
+		"msgIndexCount": vhost.msgStore.IndexCount(),
+		"msgPagedCount": vhost.msgStore.PagedCount(),
+	})
+}
+
+func newVirtualHost(ctx context.Context, name string, dbPath string, msgStore *msgstore.MessageStore, events *eventBus, clock util.Clock) *VirtualHost {
+	db, err := bolt.Open(dbPath, 0600, nil)
+	if err != nil {
+		panic(err.Error())
+
+	}
+	msgStore.Start()
+
+	var vhost = &VirtualHost{
+		name:            name,
+		exchanges:       make(map[string]*exchange.Exchange),
+		queues:          make(map[string]*queue.Queue),
+		db:              db,
+		msgStore:        msgStore,
+		exchangeDeleter: make(chan *exchange.Exchange),
+		queueDeleter:    make(chan *queue.Queue),
+		directReplies:   make(map[string]directReplyConsumer),
+		ctx:             ctx,
+		events:          events,
+		clock:           clock,
+	}
+	vhost.init(ctx)
+	return vhost
+}
+
+// Stats for the default virtual host keep their unprefixed names
+func (vhost *VirtualHost) statPrefix() string {
+	if vhost.name == DefaultVirtualHost {
+		return ""
+	}
+	return "VirtualHost." + vhost.name + "."
+}
+
+// Flush the message store and close the database files
+func (vhost *VirtualHost) close() error {
+	vhost.lock.Lock()
+	defer vhost.lock.Unlock()
+	if err := vhost.msgStore.Close(); err != nil {
+		return err
+	}
+	return vhost.db.Close()
+}
+
+func (vhost *VirtualHost) init(ctx context.Context) {
+	vhost.msgStore.LoadMessages() //this must be before initQueues
+	vhost.initExchanges()
+	vhost.initQueues(ctx)
+	vhost.initBindings() // this must be after init{Exchanges,Queues}
+	go vhost.exchangeDeleteMonitor()
+	go vhost.queueDeleteMonitor()
+}
+
+func (vhost *VirtualHost) exchangeDeleteMonitor() {
+	for {
+		select {
+		case e := <-vhost.exchangeDeleter:
+			var dele = &amqp.ExchangeDelete{
+				Exchange: e.Name,
+				// In case a binding was added since the timeout started
+				IfUnused: true,
+				NoWait:   true,
+			}
+			vhost.deleteExchange(dele)
+		case <-vhost.ctx.Done():
+			return
+		}
+	}
+}
+
+func (vhost *VirtualHost) queueDeleteMonitor() {
+	for {
+		select {
+		case q := <-vhost.queueDeleter:
+			var delq = &amqp.QueueDelete{
+				Queue: q.Name,
+				// In case a consumer came along since the timeout started
+				IfUnused: true,
+				NoWait:   true,
+			}
+			// Exclusive queues can expire or auto-delete too
+			vhost.deleteQueue(delq, q.ConnId)
+		case <-vhost.ctx.Done():
+			return
+		}
+	}
+}
+
+func (vhost *VirtualHost) initBindings() {
+	// Load bindings
+	bindings, err := binding.LoadAllBindings(vhost.db)
+	if err != nil {
+		panic("Couldn't load bindings!")
+	}
+	for key, b := range bindings {
+		// Get Exchange
+		var exchange, foundExchange = vhost.exchanges[b.ExchangeName]
+		if !foundExchange {
+			panic("Couldn't bind non-existant exchange " + b.ExchangeName)
+		}
+		if exchange.IsHeaders() {
+			b.SetHeaders()
+		}
+		// Binding IDs used to include the arguments, which only headers
+		// bindings still do. Move the others saved with arguments to their
+		// current ID, merging any which only differed in their arguments.
+		if key != string(b.Id) {
+			vhost.rekeyBinding(key, b)
+		}
+		// Add Binding
+		err = exchange.AddBinding(b, -1)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+	// Load exchange-to-exchange bindings
+	exBindings, err := binding.LoadAllExchangeBindings(vhost.db)
+	if err != nil {
+		panic("Couldn't load exchange bindings!")
+	}
+	for key, b := range exBindings {
+		var source, foundSource = vhost.exchanges[b.ExchangeName]
+		var _, foundDest = vhost.exchanges[b.QueueName]
+		if !foundSource || !foundDest {
+			// One end was transient and didn't survive the restart
+			persist.DepersistOne(vhost.db, binding.EXCHANGE_BINDINGS_BUCKET_NAME, key)
+			continue
+		}
+		if source.IsHeaders() {
+			b.SetHeaders()
+		}
+		if key != string(b.Id) {
+			vhost.rekeyBinding(key, b)
+		}
+		err = source.AddBinding(b, -1)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+}
+
+func (vhost *VirtualHost) rekeyBinding(oldKey string, b *binding.Binding) {
+	var err = vhost.db.Update(func(tx *bolt.Tx) error {
+		var bucketName = binding.BINDINGS_BUCKET_NAME
+		if b.ToExchange {
+			bucketName = binding.EXCHANGE_BINDINGS_BUCKET_NAME
+		}
+		bucket, err := tx.CreateBucketIfNotExists(bucketName)
+		if err != nil {
+			return err
+		}
+		if err = persist.DepersistOneBoltTx(bucket, oldKey); err != nil {
+			return err
+		}
+		return persist.PersistOneBoltTx(bucket, string(b.Id), b)
+	})
+	if err != nil {
+		panic("Couldn't update binding: " + err.Error())
+	}
+}
+
+func (vhost *VirtualHost) initQueues(ctx context.Context) {
+	// Load queues
+	queues, err := queue.LoadAllQueues(ctx, vhost.db, vhost.msgStore, vhost.queueDeleter)
+	if err != nil {
+		panic("Couldn't load queues!")
+	}
+	for _, queue := range queues {
+		err = vhost.addQueue(queue)
+		if err != nil {
+			panic("Couldn't load queues!")
+		}
+	}
+	// Load queue data
+	for _, queue := range vhost.queues {
+		queue.LoadFromMsgStore(vhost.msgStore)
+	}
+}
+
+func (vhost *VirtualHost) initExchanges() {
+	// LOAD FROM PERSISTENT STORAGE
+	exchanges, err := exchange.LoadAllExchanges(vhost.db, vhost.exchangeDeleter)
+	if err != nil {
+		panic("Couldn't load exchanges!")
+	}
+	for _, ex := range exchanges {
+		// Only durable exchanges survive a restart. Older versions persisted
+		// transient ones as well, so clean those up.
+		if !ex.Durable {
+			ex.Depersist(vhost.db)
+			continue
+		}
+		err = vhost.addExchange(ex)
+		if err != nil {
+			panic("FAILED TO LOAD EXCHANGES: " + err.Error())
+		}
+	}
+
+	// DECLARE MISSING SYSEM EXCHANGES
+	vhost.genDefaultExchange("", exchange.EX_TYPE_DIRECT)
+	for _, ex := range SystemExchanges {
+		vhost.genDefaultExchange(ex.Name, ex.Type)
+	}
+}
+
+func (vhost *VirtualHost) genDefaultExchange(name string, typ uint8) {
+	existing, hasKey := vhost.exchanges[name]
+	if hasKey && existing.ExType != typ {
+		// Older versions declared every system exchange as a topic exchange
+		existing.ExType = typ
+		existing.Persist(vhost.db)
+	}
+	if !hasKey {
+		var ex = exchange.NewExchange(
+			name,
+			typ,
+			true,
+			false,
+			false,
+			amqp.NewTable(),
+			true,
+			vhost.exchangeDeleter,
+		)
+		// Persist
+		ex.Persist(vhost.db)
+		err := vhost.addExchange(ex)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+}
+
+func (vhost *VirtualHost) setClock(clock util.Clock) {
+	vhost.lock.Lock()
+	defer vhost.lock.Unlock()
+	vhost.clock = clock
+	for _, ex := range vhost.exchanges {
+		ex.SetClock(clock)
+	}
+	for _, q := range vhost.queues {
+		q.SetClock(clock)
+	}
+}
+
+func (vhost *VirtualHost) setMaxInMemoryLength(max int64) {
+	vhost.lock.Lock()
+	defer vhost.lock.Unlock()
+	vhost.maxInMemoryLength = max
+	for _, q := range vhost.queues {
+		q.SetDefaultMaxInMemoryLength(max)
+	}
+}
+
+func (vhost *VirtualHost) addExchange(ex *exchange.Exchange) error {
+	var prefix = vhost.statPrefix()
+	vhost.lock.Lock()
+	defer vhost.lock.Unlock()
+	if !ex.System && vhost.exchangeLimitReachedNotThreadSafe() {
+		return errExchangeLimit
+	}
+	ex.RegisterStats(prefix)
+	ex.SetClock(vhost.clock)
+	vhost.exchanges[ex.Name] = ex
+	return nil
+}
+
+func (vhost *VirtualHost) addQueue(q *queue.Queue) error {
+	var prefix = vhost.statPrefix()
+	vhost.lock.Lock()
+	defer vhost.lock.Unlock()
+	if vhost.queueLimitReachedNotThreadSafe() {
+		return errQueueLimit
+	}
+	q.RegisterStats(prefix)
+	q.SetClock(vhost.clock)
+	q.SetDefaultMaxInMemoryLength(vhost.maxInMemoryLength)
+	q.SetDeadLetter(vhost.deadLetter)
+	vhost.queues[q.Name] = q
+	var defaultExchange = vhost.exchanges[""]
+	var defaultBinding, err = binding.NewBinding(q.Name, "", q.Name, amqp.NewTable(), false)
+	if err != nil {
+		return err
+	}
+	defaultExchange.AddBinding(defaultBinding, q.ConnId)
+	q.Start()
+	return nil
+}
+
+func (vhost *VirtualHost) deleteQueuesForConn(connId int64) {
+	vhost.lock.Lock()
+	var queues = make([]*queue.Queue, 0)
+	for _, queue := range vhost.queues {
+		if queue.ConnId == connId {
+			queues = append(queues, queue)
+		}
+	}
+	vhost.lock.Unlock()
+	for _, queue := range queues {
+		var method = &amqp.QueueDelete{
+			Queue: queue.Name,
+		}
+		vhost.deleteQueue(method, connId)
+	}
+}
+
+func (vhost *VirtualHost) deleteQueue(method *amqp.QueueDelete, connId int64) (uint32, uint16, error) {
+	vhost.lock.Lock()
+	defer vhost.lock.Unlock()
+	// Validate
+	var queue, foundQueue = vhost.queues[method.Queue]
+	if !foundQueue {
+		return 0, 404, errors.New("Queue not found")
+	}
+
+	if queue.ConnId != -1 && queue.ConnId != connId {
+		return 0, 405, fmt.Errorf("Queue is locked to another connection")
+	}
+
+	// Check before anything is changed
+	if err := queue.CanDelete(method.IfUnused, method.IfEmpty); err != nil {
+		return 0, 406, err
+	}
+
+	// Close to stop anything from changing
+	queue.Close()
+	// Delete for storage
+	bindings := vhost.bindingsForQueue(queue.Name)
+	vhost.removeBindingsForQueue(method.Queue)
+	vhost.depersistQueue(queue, bindings)
+
+	// Cleanup
+	numPurged := queue.Delete()
+	delete(vhost.queues, method.Queue)
+	queue.UnregisterStats()
+	vhost.emit("queue.delete", map[string]interface{}{"name": method.Queue})
+	return numPurged, 0, nil
+
+}
+
+func (vhost *VirtualHost) depersistQueue(queue *queue.Queue, bindings []*binding.Binding) error {
+	return vhost.db.Update(func(tx *bolt.Tx) error {
+		for _, binding := range bindings {
+			if err := binding.DepersistBoltTx(tx); err != nil {
+				return err
+			}
+		}
+		return queue.DepersistBoltTx(tx)
+	})
+}
+
+func (vhost *VirtualHost) bindingsForQueue(queueName string) []*binding.Binding {
+	ret := make([]*binding.Binding, 0)
+	for _, exchange := range vhost.exchanges {
+		ret = append(ret, exchange.BindingsForQueue(queueName)...)
+	}
+	return ret
+}
+
+// The virtual host's exchanges ordered by name
+func (vhost *VirtualHost) sortedExchanges() []*exchange.Exchange {
+	vhost.lock.Lock()
+	defer vhost.lock.Unlock()
+	var names = make([]string, 0, len(vhost.exchanges))
+	for name := range vhost.exchanges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var exchanges = make([]*exchange.Exchange, 0, len(names))
+	for _, name := range names {
+		exchanges = append(exchanges, vhost.exchanges[name])
+	}
+	return exchanges
+}
+
+// Copies of every binding in the virtual host, ordered by source exchange
+func (vhost *VirtualHost) allBindings() []*binding.Binding {
+	var ret = make([]*binding.Binding, 0)
+	for _, exchange := range vhost.sortedExchanges() {
+		ret = append(ret, exchange.Bindings()...)
+	}
+	return ret
+}
+
+func (vhost *VirtualHost) removeBindingsForQueue(queueName string) {
+	for _, exchange := range vhost.exchanges {
+		exchange.RemoveBindingsForQueue(queueName)
+	}
+}
+
+func (vhost *VirtualHost) deleteExchange(method *amqp.ExchangeDelete) (uint16, error) {
+	vhost.lock.Lock()
+	defer vhost.lock.Unlock()
+	exchange, found := vhost.exchanges[method.Exchange]
+	if !found {
+		return 404, fmt.Errorf("Exchange not found: '%s'", method.Exchange)
+	}
+	if exchange.System {
+		return 403, fmt.Errorf("Cannot delete system exchange: '%s'", method.Exchange)
+	}
+	// Like RabbitMQ, only bindings from the exchange count as using it
+	if method.IfUnused && len(exchange.Bindings()) != 0 {
+		return 406, fmt.Errorf("Exchange in use: '%s'", method.Exchange)
+	}
+	exchange.Close()
+	exchange.UnregisterStats()
+	exchange.Depersist(vhost.db)
+	// Note: we don't need to delete the bindings from the queues they are
+	// associated with because they are stored on the exchange. Bindings from
+	// other exchanges to this one are stored on the source, though.
+	for _, source := range vhost.exchanges {
+		for _, b := range source.BindingsForExchange(method.Exchange) {
+			b.Depersist(vhost.db)
+		}
+		source.RemoveBindingsForExchange(method.Exchange)
+	}
+	delete(vhost.exchanges, method.Exchange)
+	vhost.emit("exchange.delete", map[string]interface{}{"name": method.Exchange})
+	return 0, nil
+}
+
+// Collect the queues a message published to ex ends up in, following
+// exchange-to-exchange bindings. Each exchange is visited at most once so
+// binding cycles terminate.
+func (vhost *VirtualHost) queuesForPublish(ex *exchange.Exchange, msg *amqp.Message) map[string]bool {
+	var queues = make(map[string]bool)
+	if msg.Method.Exchange != ex.Name {
+		return queues
+	}
+	vhost.tracePublish(ex, msg)
+	var visited = map[string]bool{ex.Name: true}
+	var pending = []*exchange.Exchange{ex}
+	for len(pending) > 0 {
+		var current = pending[0]
+		pending = pending[1:]
+		var routedQueues, routedExchanges = current.Route(msg)
+		for name := range routedQueues {
+			queues[name] = true
+		}
+		for name := range routedExchanges {
+			if visited[name] {
+				continue
+			}
+			visited[name] = true
+			var dest, found = vhost.exchanges[name]
+			if !found || dest.Closed {
+				continue
+			}
+			pending = append(pending, dest)
+		}
+	}
+	return queues
+}
+
+// Remove the queues which have already seen this message's id within their
+// dedup window. Dropped duplicates don't count as unroutable.
+func (vhost *VirtualHost) dropDuplicates(queues map[string]bool, msg *amqp.Message) {
+	for name := range queues {
+		var queue, found = vhost.queues[name]
+		if found && queue.IsDuplicate(msg) {
+			delete(queues, name)
+		}
+	}
+}
+
+// Have the queue remember the message's id once it is enqueued there
+func (vhost *VirtualHost) recordMessageId(queueName string, msg *amqp.Message) {
+	if queue, found := vhost.queues[queueName]; found {
+		queue.RecordMessageId(msg)
+	}
+}
+
+// Drop the messages of a transaction being committed whose id a queue saw
+// since they were published, including earlier in the same transaction
+func (vhost *VirtualHost) dropTxDuplicates(txMessages []*amqp.TxMessage) []*amqp.TxMessage {
+	var kept = make([]*amqp.TxMessage, 0, len(txMessages))
+	var pending = make(map[string]map[string]bool)
+	for _, txmsg := range txMessages {
+		var queue, found = vhost.queues[txmsg.QueueName]
+		if found {
+			var id, ok = queue.DedupId(txmsg.Msg)
+			if ok && (pending[txmsg.QueueName][id] || queue.IsDuplicate(txmsg.Msg)) {
+				continue
+			}
+			if ok {
+				if pending[txmsg.QueueName] == nil {
+					pending[txmsg.QueueName] = make(map[string]bool)
+				}
+				pending[txmsg.QueueName][id] = true
+			}
+		}
+		kept = append(kept, txmsg)
+	}
+	return kept
+}
+
+// Make a message persistent if it is routed to a queue which forces
+// durability. The message as a whole is made persistent, so it is kept on
+// disk for the other queues it is routed to as well.
+func (vhost *VirtualHost) forceDurable(queues map[string]bool, msg *amqp.Message) {
+	for name := range queues {
+		var queue, found = vhost.queues[name]
+		if !found || !queue.ForcesDurable() {
+			continue
+		}
+		if msg.Header.Properties == nil {
+			msg.Header.Properties = &amqp.BasicContentHeaderProperties{}
+		}
+		var persistent = byte(2)
+		msg.Header.Properties.DeliveryMode = &persistent
+		msg.Header.PropertyFlags |= amqp.MaskDeliveryMode
+		return
+	}
+}
+
+// Refuse a publish routed to a queue which is at its max length and rejects
+// publishes. Publishers using confirms get a nack, otherwise the only way to
+// tell the publisher is to close the channel. The whole publish is refused,
+// not just the copy for the full queue.
+func (vhost *VirtualHost) checkFull(queues map[string]bool) *amqp.AMQPError {
+	for name := range queues {
+		var queue, found = vhost.queues[name]
+		if found && queue.Full() {
+			var msg = fmt.Sprintf("Queue '%s' is full and rejects publishes", name)
+			return amqp.NewSoftError(406, msg, amqp.ClassIdBasic, amqp.MethodIdBasicPublish)
+		}
+	}
+	return nil
+}
+
+func (vhost *VirtualHost) returnMessage(msg *amqp.Message, code uint16, text string) *amqp.BasicReturn {
+	return &amqp.BasicReturn{
+		Exchange:   msg.Method.Exchange,
+		RoutingKey: msg.Method.RoutingKey,
+		ReplyCode:  code,
+		ReplyText:  text,
+	}
+}
+
+func (vhost *VirtualHost) publish(exchange *exchange.Exchange, msg *amqp.Message) (*amqp.BasicReturn, *amqp.AMQPError) {
+	// Concurrency note: Since there is no lock we can, technically, have messages
+	// published after the exchange has been closed. These couldn't be on the same
+	// channel as the close is happening on, so that seems justifiable.
+	if exchange.Closed {
+		if msg.Method.Mandatory || msg.Method.Immediate {
+			var rm = vhost.returnMessage(msg, 313, "Exchange closed, cannot route to queues or consumers")
+			return rm, nil
+		}
+		return nil, nil
+	}
+	queues := vhost.queuesForPublish(exchange, msg)
+
+	if len(queues) == 0 {
+		// If we got here the message was unroutable.
+		if msg.Method.Mandatory || msg.Method.Immediate {
+			var rm = vhost.returnMessage(msg, 313, "No queues available")
+			return rm, nil
+		}
+	}
+	vhost.dropDuplicates(queues, msg)
+	if amqpErr := vhost.checkFull(queues); amqpErr != nil {
+		return nil, amqpErr
+	}
+	vhost.forceDurable(queues, msg)
+
+	var queueNames = make([]string, 0, len(queues))
+	for k, _ := range queues {
+		queueNames = append(queueNames, k)
+	}
+
+	// Immediate messages
+	if msg.Method.Immediate {
+		var consumed = false
+		// Add message to message store
+		queueMessagesByQueue, err := vhost.msgStore.AddMessage(msg, queueNames)
+		if err != nil {
+			return nil, amqp.NewSoftError(500, err.Error(), 60, 40)
+		}
+		// Try to immediately consumed it
+		for queueName, _ := range queues {
+			qms := queueMessagesByQueue[queueName]
+			for _, qm := range qms {
+				queue, found := vhost.queues[queueName]
+				if !found {
+					// The queue must have been deleted since the queuesForPublish call
+					continue
+				}
+				var oneConsumed = queue.ConsumeImmediate(qm)
+				var rhs = make([]amqp.MessageResourceHolder, 0)
+				if !oneConsumed {
+					vhost.msgStore.RemoveRef(qm, queueName, rhs)
+				} else {
+					queue.RecordMessageId(msg)
+				}
+				consumed = oneConsumed || consumed
+			}
+		}
+		if !consumed {
+			var rm = vhost.returnMessage(msg, 313, "No consumers available for immediate message")
+			return rm, nil
+		}
+		return nil, nil
+	}
+
+	// Add the message to the message store along with the queues we're about to add it to
+	queueMessagesByQueue, err := vhost.msgStore.AddMessage(msg, queueNames)
+	if err != nil {
+		return nil, amqp.NewSoftError(500, err.Error(), 60, 40)
+	}
+
+	for queueName, _ := range queues {
+		qms := queueMessagesByQueue[queueName]
+		for _, qm := range qms {
+			queue, found := vhost.queues[queueName]
+			if !found || !queue.Add(qm) {
+				// If we couldn't add it means the queue is closed and we should
+				// remove the ref from the message store. The queue being closed means
+				// it is going away, so worst case if the server dies we have to process
+				// and discard the message on boot.
+				var rhs = make([]amqp.MessageResourceHolder, 0)
+				vhost.msgStore.RemoveRef(qm, queueName, rhs)
+				continue
+			}
+			queue.RecordMessageId(msg)
+		}
+	}
+	return nil, nil
+}
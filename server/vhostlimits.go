@@ -0,0 +1,107 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Returned by addQueue and addExchange, which check the limits under the
+// lock they add with, so declares running at the same time can't both pass
+var errQueueLimit = errors.New("Queue limit reached for virtual host")
+var errExchangeLimit = errors.New("Exchange limit reached for virtual host")
+
+// Caps on what one virtual host may hold, so one tenant can't starve the
+// others. 0 means no limit.
+type VirtualHostLimits struct {
+	MaxQueues int
+	// System exchanges, like amq.direct, don't count
+	MaxExchanges   int
+	MaxConnections int
+	// Bodies of the ready messages in all of the virtual host's queues
+	MaxBytes uint64
+}
+
+// Set the limits of a virtual host. They are checked when queues and
+// exchanges are declared, connections open the virtual host and messages are
+// published, and don't affect what it already holds.
+func (server *Server) SetVirtualHostLimits(vhostName string, limits VirtualHostLimits) error {
+	vhost, found := server.virtualHost(vhostName)
+	if !found {
+		return fmt.Errorf("Virtual host not found: '%s'", vhostName)
+	}
+	vhost.lock.Lock()
+	defer vhost.lock.Unlock()
+	vhost.limits = limits
+	return nil
+}
+
+func (vhost *VirtualHost) getLimits() VirtualHostLimits {
+	vhost.lock.Lock()
+	defer vhost.lock.Unlock()
+	return vhost.limits
+}
+
+// Whether another queue may be declared. addQueue checks again, since
+// another declare may get in between.
+func (vhost *VirtualHost) queueLimitReached() bool {
+	vhost.lock.Lock()
+	defer vhost.lock.Unlock()
+	return vhost.queueLimitReachedNotThreadSafe()
+}
+
+// The caller must hold vhost.lock
+func (vhost *VirtualHost) queueLimitReachedNotThreadSafe() bool {
+	return vhost.limits.MaxQueues != 0 && len(vhost.queues) >= vhost.limits.MaxQueues
+}
+
+// Whether another exchange may be declared. The caller must hold vhost.lock.
+func (vhost *VirtualHost) exchangeLimitReachedNotThreadSafe() bool {
+	if vhost.limits.MaxExchanges == 0 {
+		return false
+	}
+	var count = 0
+	for _, ex := range vhost.exchanges {
+		if !ex.System {
+			count += 1
+		}
+	}
+	return count >= vhost.limits.MaxExchanges
+}
+
+// Whether a message body of the given size would take the ready messages
+// over the byte limit
+func (vhost *VirtualHost) byteLimitReached(size uint64) bool {
+	vhost.lock.Lock()
+	defer vhost.lock.Unlock()
+	if vhost.limits.MaxBytes == 0 {
+		return false
+	}
+	var total = size
+	for _, q := range vhost.queues {
+		total += q.ReadyBytes()
+	}
+	return total > vhost.limits.MaxBytes
+}
+
+// Whether another connection may open the virtual host
+func (server *Server) connectionLimitReached(vhost *VirtualHost) bool {
+	var max = vhost.getLimits().MaxConnections
+	if max == 0 {
+		return false
+	}
+	server.serverLock.Lock()
+	var conns = make([]*AMQPConnection, 0, len(server.conns))
+	for _, conn := range server.conns {
+		conns = append(conns, conn)
+	}
+	server.serverLock.Unlock()
+	var count = 0
+	for _, conn := range conns {
+		conn.lock.Lock()
+		if conn.vhost == vhost {
+			count += 1
+		}
+		conn.lock.Unlock()
+	}
+	return count >= max
+}
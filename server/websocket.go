@@ -0,0 +1,129 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The WebSocket sub-protocol clients must ask for
+const WebSocketSubprotocol = "amqp"
+
+// wsConn adapts a WebSocket to net.Conn so it can be handed to
+// OpenConnection. Incoming binary messages are read as one continuous
+// stream, and every Write goes out as its own binary message, which with
+// WriteFrame means one AMQP frame per message.
+type wsConn struct {
+	ws        *websocket.Conn
+	reader    io.Reader
+	readLock  sync.Mutex
+	writeLock sync.Mutex
+}
+
+func newWSConn(ws *websocket.Conn) *wsConn {
+	return &wsConn{ws: ws}
+}
+
+func (conn *wsConn) Read(b []byte) (int, error) {
+	conn.readLock.Lock()
+	defer conn.readLock.Unlock()
+	for {
+		if conn.reader == nil {
+			msgType, reader, err := conn.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if msgType != websocket.BinaryMessage {
+				return 0, fmt.Errorf("Unexpected WebSocket message type %d", msgType)
+			}
+			conn.reader = reader
+		}
+		n, err := conn.reader.Read(b)
+		if err == io.EOF {
+			conn.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (conn *wsConn) Write(b []byte) (int, error) {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	if err := conn.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (conn *wsConn) Close() error {
+	return conn.ws.Close()
+}
+
+func (conn *wsConn) LocalAddr() net.Addr {
+	return conn.ws.LocalAddr()
+}
+
+func (conn *wsConn) RemoteAddr() net.Addr {
+	return conn.ws.RemoteAddr()
+}
+
+func (conn *wsConn) SetDeadline(t time.Time) error {
+	if err := conn.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return conn.ws.SetWriteDeadline(t)
+}
+
+func (conn *wsConn) SetReadDeadline(t time.Time) error {
+	return conn.ws.SetReadDeadline(t)
+}
+
+func (conn *wsConn) SetWriteDeadline(t time.Time) error {
+	return conn.ws.SetWriteDeadline(t)
+}
+
+// WebSocketHandler upgrades HTTP requests to WebSockets carrying AMQP frames
+// as binary messages and serves each one as a regular connection
+func (server *Server) WebSocketHandler() http.Handler {
+	var upgrader = websocket.Upgrader{
+		Subprotocols: []string{WebSocketSubprotocol},
+		// Browser clients are usually served from another origin
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasSubprotocol(r, WebSocketSubprotocol) {
+			http.Error(w, "The amqp WebSocket sub-protocol is required", http.StatusBadRequest)
+			return
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// Upgrade already replied with an error
+			fmt.Println("Error upgrading to WebSocket:", err.Error())
+			return
+		}
+		server.OpenConnection(newWSConn(ws))
+	})
+}
+
+func hasSubprotocol(r *http.Request, protocol string) bool {
+	for _, p := range websocket.Subprotocols(r) {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+func isWebSocket(network net.Conn) bool {
+	var _, ok = network.(*wsConn)
+	return ok
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/karelbilek/amqp-test-server/amqp"
+)
+
+// Frames a channel handles on a pool worker before it goes to the back of
+// the queue, so a busy channel doesn't keep a worker from the others
+const poolBatch = 64
+
+// A fixed number of goroutines handling the frames of many channels, instead
+// of one goroutine for each channel. A channel is queued when frames arrive
+// for it and only one worker handles it at a time, so its frames are still
+// handled in order.
+type workerPool struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	queue   []*Channel
+	size    int
+	running int
+}
+
+func newWorkerPool() *workerPool {
+	var pool = &workerPool{}
+	pool.cond = sync.NewCond(&pool.lock)
+	return pool
+}
+
+// Start or stop workers until there are size of them. Workers over the size
+// only stop once no channel is waiting.
+func (pool *workerPool) resize(size int) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	pool.size = size
+	for pool.running < size {
+		pool.running += 1
+		go pool.work()
+	}
+	pool.cond.Broadcast()
+}
+
+func (pool *workerPool) submit(channel *Channel) {
+	pool.lock.Lock()
+	pool.queue = append(pool.queue, channel)
+	pool.lock.Unlock()
+	pool.cond.Signal()
+}
+
+func (pool *workerPool) work() {
+	pool.lock.Lock()
+	for {
+		for len(pool.queue) == 0 && pool.running <= pool.size {
+			pool.cond.Wait()
+		}
+		if len(pool.queue) == 0 {
+			pool.running -= 1
+			pool.lock.Unlock()
+			return
+		}
+		var channel = pool.queue[0]
+		pool.queue[0] = nil
+		pool.queue = pool.queue[1:]
+		pool.lock.Unlock()
+		channel.handlePooled()
+		pool.lock.Lock()
+	}
+}
+
+// Handle the frames of channels other than 0 on a pool of this many
+// goroutines, for connections opened afterwards. Connections still have
+// their own goroutines. Since a worker waits while a channel's frames are
+// sent out, a client which stops reading holds on to the workers handling
+// its channels. 0 goes back to a goroutine per channel for new connections,
+// leaving the workers to the channels already using them.
+func (server *Server) SetChannelWorkers(workers int) {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	if workers > 0 {
+		if server.channelPool == nil {
+			server.channelPool = newWorkerPool()
+		}
+		server.channelPool.resize(workers)
+	}
+	server.channelWorkers = workers
+}
+
+// The pool for a new connection. The caller holds serverLock.
+func (server *Server) currentChannelPool() *workerPool {
+	if server.channelWorkers == 0 {
+		return nil
+	}
+	return server.channelPool
+}
+
+// The pool for a new channel. Channel 0 always has its own goroutine.
+func (conn *AMQPConnection) channelPool(id uint16) *workerPool {
+	if id == 0 {
+		return nil
+	}
+	return conn.pool
+}
+
+// Queue the channel on its pool unless it already is
+func (channel *Channel) schedule() {
+	if channel.scheduled.CompareAndSwap(false, true) {
+		channel.pool.submit(channel)
+	}
+}
+
+// Hand a frame from the connection to the channel
+func (channel *Channel) dispatch(frame *amqp.WireFrame) {
+	channel.incoming <- frame
+	if channel.pool != nil {
+		channel.schedule()
+	}
+}
+
+// Tell the channel no more frames are coming, once the connection is gone
+func (channel *Channel) closeIncoming() {
+	channel.incomingClosed.Store(true)
+	close(channel.incoming)
+	if channel.pool != nil {
+		channel.schedule()
+	}
+}
+
+// Handle the frames waiting for the channel on a pool worker
+func (channel *Channel) handlePooled() {
+	for i := 0; i < poolBatch; i++ {
+		if channel.getState() == CH_STATE_CLOSED || channel.ctx.Err() != nil {
+			return
+		}
+		select {
+		case frame, open := <-channel.incoming:
+			if !open {
+				channel.shutdown()
+				return
+			}
+			channel.handleFrame(frame)
+		default:
+			channel.scheduled.Store(false)
+			// Frames sent after the select found none only queue the
+			// channel if they came after the line above
+			if len(channel.incoming) > 0 || channel.incomingClosed.Load() {
+				channel.schedule()
+			}
+			return
+		}
+	}
+	channel.pool.submit(channel)
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/karelbilek/amqp-test-server/util"
+)
+
+// Defaults for retrying network writes which failed with a temporary error
+const (
+	DefaultWriteRetries = 3
+	DefaultWriteBackoff = 10 * time.Millisecond
+)
+
+// Set how often a write which failed with a temporary network error is
+// retried before the connection is closed. The wait before each retry starts
+// at backoff and doubles every time. Other write errors close the connection
+// straight away. 0 or less disables retrying. This applies to connections opened
+// afterwards.
+func (server *Server) SetWriteRetry(retries int, backoff time.Duration) {
+	server.serverLock.Lock()
+	defer server.serverLock.Unlock()
+	if retries < 0 {
+		retries = 0
+	}
+	server.writeRetries = retries
+	server.writeBackoff = backoff
+}
+
+// Write all of data, retrying temporary errors up to retries times. Only the
+// part which wasn't written yet is retried, so the frame isn't duplicated on
+// the wire.
+func writeWithRetry(w io.Writer, data []byte, retries int, backoff time.Duration, clock util.Clock) error {
+	var attempt = 0
+	for {
+		n, err := w.Write(data)
+		data = data[n:]
+		if err == nil {
+			return nil
+		}
+		if !isTemporary(err) || attempt >= retries {
+			return err
+		}
+		clock.Sleep(backoff << uint(attempt))
+		attempt += 1
+	}
+}
+
+func isTemporary(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Temporary()
+}
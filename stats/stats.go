@@ -1,6 +1,7 @@
 package stats
 
 import (
+	"github.com/karelbilek/amqp-test-server/util"
 	"github.com/rcrowley/go-metrics"
 	"time"
 )
@@ -13,6 +14,46 @@ func MakeHistogram(name string) metrics.Histogram {
 	)
 }
 
+// A histogram of one object's samples, which also go to a shared histogram
+// holding everyone's
+type linkedHistogram struct {
+	metrics.Histogram
+	shared metrics.Histogram
+}
+
+func (histo *linkedHistogram) Update(value int64) {
+	histo.Histogram.Update(value)
+	histo.shared.Update(value)
+}
+
+// MakeLinkedHistogram makes an unregistered histogram for a single object,
+// like one connection, whose samples are also recorded in the registered
+// histogram of the given name. Its sample is smaller than MakeHistogram's
+// since there can be many of them.
+func MakeLinkedHistogram(name string) metrics.Histogram {
+	return &linkedHistogram{
+		Histogram: metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015)),
+		shared:    MakeHistogram(name),
+	}
+}
+
+// The size of a histogram and where its samples lie, for reports which don't
+// want every sample
+type HistogramSummary struct {
+	Count int64   `json:"count"`
+	Mean  float64 `json:"mean"`
+	P95   float64 `json:"p95"`
+}
+
+func Summarize(histo metrics.Histogram) HistogramSummary {
+	var snap = histo.Snapshot()
+	return HistogramSummary{
+		Count: snap.Count(),
+		Mean:  snap.Mean(),
+		P95:   snap.Percentile(0.95),
+	}
+}
+
 func RecordHisto(histo metrics.Histogram, start int64) {
 	histo.Update(time.Now().UnixNano() - start)
 }
@@ -21,4 +62,38 @@ func Start() int64 {
 	return time.Now().UnixNano()
 }
 
+// MakeMeter registers a new meter, replacing anything already registered
+// under the name. Meters belong to a single queue or exchange, so a stale
+// one left by an object with the same name must not be reused. Its recent
+// rate is given by WindowRate.
+func MakeMeter(name string) metrics.Meter {
+	var meter = NewWindowedMeter(DefaultRateWindow, util.RealClock)
+	metrics.Unregister(name)
+	metrics.Register(name, meter)
+	return meter
+}
+
+// MakeGauge registers a gauge whose value is read from f whenever the
+// registry is queried, replacing anything already registered under the name
+func MakeGauge(name string, f func() int64) metrics.Gauge {
+	var gauge = metrics.NewFunctionalGauge(f)
+	metrics.Unregister(name)
+	metrics.Register(name, gauge)
+	return gauge
+}
+
+// NilMeter is a meter that discards everything. It is used before the
+// owner's meters are registered.
+func NilMeter() metrics.Meter {
+	return metrics.NilMeter{}
+}
+
+func Unregister(names ...string) {
+	for _, name := range names {
+		metrics.Unregister(name)
+	}
+}
+
 type Histogram metrics.Histogram
+type Meter metrics.Meter
+type Gauge metrics.Gauge
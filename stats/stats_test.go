@@ -1,8 +1,10 @@
 package stats
 
 import (
+	"github.com/karelbilek/amqp-test-server/util"
 	"github.com/rcrowley/go-metrics"
 	"testing"
+	"time"
 )
 
 func TestStats(t *testing.T) {
@@ -19,3 +21,102 @@ func TestStats(t *testing.T) {
 		t.Errorf("Bad value in histo %d", m.Max())
 	}
 }
+
+func TestMeterAndGauge(t *testing.T) {
+	var meter = MakeMeter("meter")
+	meter.Mark(3)
+	if metrics.Get("meter").(metrics.Meter).Count() != 3 {
+		t.Errorf("Wrong meter count")
+	}
+	// Re-registering replaces the old meter
+	MakeMeter("meter")
+	if metrics.Get("meter").(metrics.Meter).Count() != 0 {
+		t.Errorf("Meter was not replaced")
+	}
+
+	var value int64 = 5
+	MakeGauge("gauge", func() int64 { return value })
+	value = 6
+	if metrics.Get("gauge").(metrics.Gauge).Value() != 6 {
+		t.Errorf("Gauge did not read current value")
+	}
+
+	Unregister("meter", "gauge")
+	if metrics.Get("meter") != nil || metrics.Get("gauge") != nil {
+		t.Errorf("Metrics were not unregistered")
+	}
+}
+
+func TestLinkedHistogram(t *testing.T) {
+	var own = MakeLinkedHistogram("linked")
+	var other = MakeLinkedHistogram("linked")
+	for i := int64(1); i <= 100; i++ {
+		own.Update(i)
+	}
+	other.Update(1000)
+	var summary = Summarize(own)
+	if summary.Count != 100 || summary.Mean != 50.5 {
+		t.Errorf("Wrong summary: %+v", summary)
+	}
+	if summary.P95 < 94 || summary.P95 > 96 {
+		t.Errorf("Wrong 95th percentile: %f", summary.P95)
+	}
+	// The shared histogram has both
+	if metrics.Get("linked").(metrics.Histogram).Count() != 101 {
+		t.Errorf("Samples were not recorded in the shared histogram")
+	}
+	Unregister("linked")
+}
+
+func TestWindowRate(t *testing.T) {
+	var clock = util.NewFakeClock(time.Unix(1000, 0))
+	var meter = NewWindowedMeter(10*time.Second, clock)
+	defer meter.Stop()
+	// A burst of 100 in one second, then nothing
+	meter.Mark(100)
+	if rate := WindowRate(meter); rate != 10 {
+		t.Errorf("Expected a rate of 10 after the burst, got %f", rate)
+	}
+	var last = WindowRate(meter)
+	for i := 0; i < 9; i++ {
+		clock.Advance(time.Second)
+		if rate := WindowRate(meter); rate > last {
+			t.Errorf("Rate went up from %f to %f while idle", last, rate)
+		}
+	}
+	clock.Advance(time.Second)
+	if rate := WindowRate(meter); rate != 0 {
+		t.Errorf("Expected the rate to drop to 0 once the burst left the window, got %f", rate)
+	}
+	if meter.Count() != 100 {
+		t.Errorf("Count should still have the burst, got %d", meter.Count())
+	}
+
+	// Activity spread over the window
+	for i := 0; i < 10; i++ {
+		meter.Mark(5)
+		clock.Advance(time.Second)
+	}
+	if rate := WindowRate(meter); rate != 4.5 {
+		t.Errorf("Expected a rate of 4.5, got %f", rate)
+	}
+	clock.Advance(time.Hour)
+	if rate := WindowRate(meter); rate != 0 {
+		t.Errorf("Expected 0 after a long idle, got %f", rate)
+	}
+}
+
+func TestReset(t *testing.T) {
+	var histo = MakeHistogram("reset")
+	histo.Update(10)
+	Reset("reset")
+	if histo.Count() != 0 {
+		t.Errorf("Histogram was not reset")
+	}
+	histo.Update(10)
+	ResetAll()
+	if histo.Count() != 0 {
+		t.Errorf("Histogram was not reset by ResetAll")
+	}
+	Unregister("reset")
+}
@@ -0,0 +1,109 @@
+package stats
+
+import (
+	"sync"
+	"time"
+
+	"github.com/karelbilek/amqp-test-server/util"
+	"github.com/rcrowley/go-metrics"
+)
+
+// How far back the rates of meters made by MakeMeter look
+const DefaultRateWindow = time.Minute
+
+// A meter which also keeps what was marked in each of the last few seconds,
+// so that its rate only reflects recent activity. Rate1 and the others are
+// decaying averages, which take minutes to fall back to zero once activity
+// stops, and RateMean is the average since the meter was made.
+type windowedMeter struct {
+	metrics.Meter
+	lock  sync.Mutex
+	clock util.Clock
+	// A ring of one second buckets. current is the bucket for the second
+	// starting at currentStart.
+	buckets      []int64
+	current      int
+	currentStart time.Time
+}
+
+// NewWindowedMeter makes an unregistered meter whose WindowRate is over the
+// given window, rounded to whole seconds
+func NewWindowedMeter(window time.Duration, clock util.Clock) metrics.Meter {
+	var seconds = int(window / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return &windowedMeter{
+		Meter:        metrics.NewMeter(),
+		clock:        clock,
+		buckets:      make([]int64, seconds),
+		currentStart: clock.Now().Truncate(time.Second),
+	}
+}
+
+func (meter *windowedMeter) Mark(n int64) {
+	meter.Meter.Mark(n)
+	meter.lock.Lock()
+	defer meter.lock.Unlock()
+	meter.advance()
+	meter.buckets[meter.current] += n
+}
+
+// Events per second over the window
+func (meter *windowedMeter) WindowRate() float64 {
+	meter.lock.Lock()
+	defer meter.lock.Unlock()
+	meter.advance()
+	var total int64
+	for _, n := range meter.buckets {
+		total += n
+	}
+	return float64(total) / float64(len(meter.buckets))
+}
+
+// Empty the buckets of the seconds which passed since the last call. The
+// caller holds the lock.
+func (meter *windowedMeter) advance() {
+	var now = meter.clock.Now()
+	var elapsed = int(now.Sub(meter.currentStart) / time.Second)
+	if elapsed <= 0 {
+		return
+	}
+	if elapsed > len(meter.buckets) {
+		elapsed = len(meter.buckets)
+	}
+	for i := 0; i < elapsed; i++ {
+		meter.current = (meter.current + 1) % len(meter.buckets)
+		meter.buckets[meter.current] = 0
+	}
+	meter.currentStart = now.Truncate(time.Second)
+}
+
+// The rate of meter over its window for meters made by MakeMeter. Other
+// meters don't keep a window, so their one minute rate is used instead.
+func WindowRate(meter Meter) float64 {
+	if windowed, ok := meter.(*windowedMeter); ok {
+		return windowed.WindowRate()
+	}
+	return meter.Rate1()
+}
+
+// Reset drops the samples of the registered histograms with the given
+// names, so they only describe what happens from now on. Other metrics
+// under those names are left alone.
+func Reset(names ...string) {
+	for _, name := range names {
+		if histo, ok := metrics.Get(name).(metrics.Histogram); ok {
+			histo.Clear()
+		}
+	}
+}
+
+// ResetAll drops the samples of every registered histogram
+func ResetAll() {
+	metrics.DefaultRegistry.Each(func(name string, i interface{}) {
+		if histo, ok := i.(metrics.Histogram); ok {
+			histo.Clear()
+		}
+	})
+}
@@ -0,0 +1,154 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// The source of time for timeouts, so tests can control it instead of
+// waiting on the real clock
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+	// Call f in its own goroutine once d has passed, like time.AfterFunc
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// A timer from Clock.AfterFunc. Stop and Reset work like they do on
+// time.Timer.
+type Timer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                            { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time    { return time.After(d) }
+func (realClock) Sleep(d time.Duration)                     { time.Sleep(d) }
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// The clock everything uses unless told otherwise
+var RealClock Clock = realClock{}
+
+// Waiters have either a channel for After and Sleep or a function for
+// AfterFunc
+type fakeWaiter struct {
+	until time.Time
+	ch    chan time.Time
+	fn    func()
+}
+
+// A clock which only moves when Advance is called. After and Sleep wait
+// until the clock has been advanced past their deadline.
+type FakeClock struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	var clock = &FakeClock{now: now}
+	clock.cond = sync.NewCond(&clock.lock)
+	return clock
+}
+
+func (clock *FakeClock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return clock.now
+}
+
+func (clock *FakeClock) After(d time.Duration) <-chan time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	var ch = make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- clock.now
+		return ch
+	}
+	clock.waiters = append(clock.waiters, &fakeWaiter{until: clock.now.Add(d), ch: ch})
+	clock.cond.Broadcast()
+	return ch
+}
+
+func (clock *FakeClock) Sleep(d time.Duration) {
+	<-clock.After(d)
+}
+
+type fakeTimer struct {
+	clock  *FakeClock
+	fn     func()
+	waiter *fakeWaiter
+}
+
+func (clock *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	var timer = &fakeTimer{clock: clock, fn: f}
+	timer.Reset(d)
+	return timer
+}
+
+func (timer *fakeTimer) Stop() bool {
+	timer.clock.lock.Lock()
+	defer timer.clock.lock.Unlock()
+	return timer.stopNotThreadSafe()
+}
+
+func (timer *fakeTimer) stopNotThreadSafe() bool {
+	var clock = timer.clock
+	for i, w := range clock.waiters {
+		if w == timer.waiter {
+			clock.waiters = append(clock.waiters[:i], clock.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (timer *fakeTimer) Reset(d time.Duration) bool {
+	var clock = timer.clock
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	var active = timer.stopNotThreadSafe()
+	timer.waiter = &fakeWaiter{until: clock.now.Add(d), fn: timer.fn}
+	if d <= 0 {
+		go timer.fn()
+		return active
+	}
+	clock.waiters = append(clock.waiters, timer.waiter)
+	clock.cond.Broadcast()
+	return active
+}
+
+// Move the clock forward, waking everything whose deadline has passed
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	clock.now = clock.now.Add(d)
+	var waiting = clock.waiters[:0]
+	for _, w := range clock.waiters {
+		if w.until.After(clock.now) {
+			waiting = append(waiting, w)
+			continue
+		}
+		if w.fn != nil {
+			go w.fn()
+			continue
+		}
+		w.ch <- clock.now
+	}
+	clock.waiters = waiting
+}
+
+// Wait until n callers are blocked in After or Sleep or have a timer running
+// from AfterFunc, so a test can be sure
+// a timeout has started before advancing past it
+func (clock *FakeClock) BlockUntil(n int) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	for len(clock.waiters) < n {
+		clock.cond.Wait()
+	}
+}
@@ -0,0 +1,68 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	var start = time.Unix(1000, 0)
+	var clock = NewFakeClock(start)
+	var woke = make(chan bool)
+	go func() {
+		clock.Sleep(5 * time.Second)
+		woke <- true
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(4 * time.Second)
+	select {
+	case <-woke:
+		t.Fatalf("Sleep returned before its deadline")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	select {
+	case <-woke:
+	case <-time.After(time.Second):
+		t.Fatalf("Sleep did not return after advancing past its deadline")
+	}
+	if !clock.Now().Equal(start.Add(5 * time.Second)) {
+		t.Errorf("Wrong time after advancing: %s", clock.Now())
+	}
+}
+
+func TestFakeClockAfterFunc(t *testing.T) {
+	var clock = NewFakeClock(time.Unix(1000, 0))
+	var fired = make(chan bool, 1)
+	var timer = clock.AfterFunc(5*time.Second, func() { fired <- true })
+	clock.Advance(3 * time.Second)
+	// Resetting replaces the pending deadline rather than adding another
+	for i := 0; i < 10; i++ {
+		timer.Reset(5 * time.Second)
+	}
+	if len(clock.waiters) != 1 {
+		t.Fatalf("Expected one waiter after resetting, got %d", len(clock.waiters))
+	}
+	clock.Advance(4 * time.Second)
+	select {
+	case <-fired:
+		t.Fatalf("Timer fired before its reset deadline")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatalf("Timer did not fire after advancing past its deadline")
+	}
+	timer.Reset(time.Second)
+	if !timer.Stop() || timer.Stop() {
+		t.Errorf("Stop should only report a pending timer once")
+	}
+	clock.Advance(time.Second)
+	select {
+	case <-fired:
+		t.Fatalf("Stopped timer fired")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
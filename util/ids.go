@@ -0,0 +1,35 @@
+package util
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Where names the server makes up come from: generated queue names,
+// consumer tags and direct reply-to addresses. Internal message ids always
+// come from NextId, since the message store relies on them increasing.
+type IdGenerator interface {
+	NewId() string
+}
+
+type randomIds struct{}
+
+func (randomIds) NewId() string { return RandomId() }
+
+// The generator everything uses unless told otherwise
+var RandomIds IdGenerator = randomIds{}
+
+// Ids made of a prefix and a counter, prefix1, prefix2 and so on, for tests
+// which need to know the ids in advance
+type SequentialIds struct {
+	prefix  string
+	counter int64
+}
+
+func NewSequentialIds(prefix string) *SequentialIds {
+	return &SequentialIds{prefix: prefix}
+}
+
+func (ids *SequentialIds) NewId() string {
+	return fmt.Sprintf("%s%d", ids.prefix, atomic.AddInt64(&ids.counter, 1))
+}
@@ -34,3 +34,12 @@ func TestNextId(t *testing.T) {
 		)
 	}
 }
+
+func TestSequentialIds(t *testing.T) {
+	var ids = NewSequentialIds("id-")
+	for _, expected := range []string{"id-1", "id-2", "id-3"} {
+		if id := ids.NewId(); id != expected {
+			t.Errorf("Expected %s, got %s", expected, id)
+		}
+	}
+}